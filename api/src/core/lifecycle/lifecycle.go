@@ -0,0 +1,192 @@
+package lifecycle
+
+import (
+	"context"
+	"dse/src/core/log"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Service is one part of the server. Services are started in the order they
+// are registered and stopped in reverse, so a service can rely on everything
+// registered before it for as long as it runs.
+type Service struct {
+	Name string
+
+	// Start returns once the service is ready. ctx is cancelled when the
+	// server starts shutting down; background work should stop with it.
+	Start func(ctx context.Context) error
+
+	// Stop drains the service. It must return when ctx expires. Services
+	// without anything to drain leave it nil.
+	Stop func(ctx context.Context) error
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	services = []*Service{}
+
+	ready    atomic.Bool
+	stopping = make(chan struct{})
+	once     sync.Once
+
+	// Time every service together gets to drain
+	timeout = 30 * time.Second
+
+	// Errors
+	ErrStopTimeout = errors.New("shutdown timed out")
+)
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Register adds services to start, in order.
+func Register(list ...*Service) {
+	services = append(services, list...)
+}
+
+// Ready reports whether every service has started and shutdown has not begun.
+func Ready() bool {
+	return ready.Load()
+}
+
+// Stopping is closed when shutdown begins. Long-lived connections (SSE,
+// WebSockets) select on it to end themselves.
+func Stopping() <-chan struct{} {
+	return stopping
+}
+
+// Shutdown begins a graceful shutdown, as SIGTERM would.
+func Shutdown() {
+	once.Do(func() {
+		ready.Store(false)
+		close(stopping)
+	})
+}
+
+// Run starts every service, waits for SIGINT, SIGTERM or Shutdown, and stops
+// the started services in reverse order. It returns the exit code.
+func Run() int {
+	if value, ok := os.LookupEnv("SHUTDOWN_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			timeout = d
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	code    := 0
+	started := []*Service{}
+
+	for _, service := range services {
+		// A signal during startup skips the remaining services
+		if interrupted(signals) {
+			break
+		}
+
+		begin := time.Now()
+		if err := start(ctx, service); err != nil {
+			log.Error().Err(err).Str("service", service.Name).Msg("Failed to start")
+			code = 1
+			break
+		}
+		log.Info().Str("service", service.Name).Dur("took", time.Since(begin)).Msg("Started")
+		started = append(started, service)
+	}
+
+	if code == 0 && len(started) == len(services) {
+		ready.Store(true)
+		log.Info().Int("services", len(started)).Msg("Ready")
+
+		select {
+			case sig := <-signals: log.Info().Str("signal", sig.String()).Msg("Shutting down")
+			case <-stopping      : log.Info().Msg("Shutting down")
+		}
+	}
+
+	Shutdown()
+	cancel()
+
+	// A second signal stops waiting for the drain
+	drain, abort := context.WithTimeout(context.Background(), timeout)
+	defer abort()
+	go func() {
+		select {
+			case <-signals    : log.Warn().Msg("Second signal, not waiting for services to drain"); abort()
+			case <-drain.Done():
+		}
+	}()
+
+	for i := len(started) - 1; i >= 0; i-- {
+		service := started[i]
+		if service.Stop == nil {
+			continue
+		}
+
+		begin := time.Now()
+		if err := stop(drain, service); err != nil {
+			log.Error().Err(err).Str("service", service.Name).Msg("Failed to stop")
+			code = 1
+			continue
+		}
+		log.Info().Str("service", service.Name).Dur("took", time.Since(begin)).Msg("Stopped")
+	}
+
+	return code
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func start(ctx context.Context, service *Service) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return service.Start(ctx)
+}
+
+func stop(ctx context.Context, service *Service) error {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- service.Stop(ctx)
+	}()
+
+	select {
+		case err := <-done: return err
+		case <-ctx.Done() : return ErrStopTimeout
+	}
+}
+
+// interrupted reports whether shutdown was requested.
+func interrupted(signals chan os.Signal) bool {
+	select {
+		case <-signals : Shutdown(); return true
+		case <-stopping: return true
+		default        : return false
+	}
+}
@@ -0,0 +1,157 @@
+// Package loadtest measures the server from the outside, with virtual
+// extensions speaking the real protocol. Run it against a test database:
+// every virtual participant is created as a user.
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Level is the outcome of one concurrency level.
+type Level struct {
+	Participants int           `json:"participants"`
+	Requests     int           `json:"requests"`
+	Errors       int           `json:"errors"`
+	Throughput   float64       `json:"throughput"` // Successful requests per second
+	P50          time.Duration `json:"p50"`
+	P95          time.Duration `json:"p95"`
+	P99          time.Duration `json:"p99"`
+	Max          time.Duration `json:"max"`
+}
+
+// ------------------------------------------------------------
+// : Bench
+// ------------------------------------------------------------
+
+// Bench runs each level for a duration: that many participants post updates
+// back to back. Throughput that keeps growing with participants means
+// their events are handled concurrently; throughput that stays flat means
+// they are serialised somewhere.
+func Bench(ctx context.Context, base string, levels []int, duration time.Duration) ([]*Level, error) {
+	largest := 0
+	for _, n := range levels {
+		largest = max(largest, n)
+	}
+
+	client := &http.Client{
+		Timeout  : 30 * time.Second,
+		Transport: &http.Transport{MaxIdleConns: largest, MaxIdleConnsPerHost: largest},
+	}
+
+	results := []*Level{}
+	for _, n := range levels {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		results = append(results, level(ctx, base, client, n, duration))
+	}
+	return results, nil
+}
+
+func level(ctx context.Context, base string, client *http.Client, n int, duration time.Duration) *Level {
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = NewClient(base, client)
+	}
+
+	// Participants are created outside the measurement
+	for _, c := range clients {
+		c.Update(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var wg    sync.WaitGroup
+
+	latencies := []time.Duration{}
+	errors    := 0
+	start     := time.Now()
+
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			local  := []time.Duration{}
+			failed := 0
+			for ctx.Err() == nil {
+				took, err := c.Update(ctx)
+				if ctx.Err() != nil {
+					break // Cut off by the end of the level
+				}
+				if err != nil {
+					failed += 1
+					continue
+				}
+				local = append(local, took)
+			}
+
+			mutex.Lock()
+			latencies = append(latencies, local...)
+			errors   += failed
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	result := &Level{
+		Participants: n,
+		Requests    : len(latencies) + errors,
+		Errors      : errors,
+		Throughput  : float64(len(latencies)) / elapsed.Seconds(),
+		P50         : percentile(latencies, 0.50),
+		P95         : percentile(latencies, 0.95),
+		P99         : percentile(latencies, 0.99),
+	}
+	if len(latencies) > 0 {
+		result.Max = latencies[len(latencies)-1]
+	}
+	return result
+}
+
+// Report writes the levels as a table, with how throughput scaled relative
+// to the first level.
+func Report(w io.Writer, levels []*Level) {
+	fmt.Fprintf(w, "%12s %10s %8s %10s %8s %10s %10s %10s %10s\n", "participants", "requests", "errors", "req/s", "scaling", "p50", "p95", "p99", "max")
+
+	for _, l := range levels {
+		scaling := 0.0
+		if len(levels) > 0 && levels[0].Throughput > 0 {
+			scaling = l.Throughput / levels[0].Throughput
+		}
+		fmt.Fprintf(w, "%12d %10d %8d %10.1f %7.2fx %10s %10s %10s %10s\n",
+			l.Participants, l.Requests, l.Errors, l.Throughput, scaling,
+			round(l.P50), round(l.P95), round(l.P99), round(l.Max),
+		)
+	}
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
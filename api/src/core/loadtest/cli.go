@@ -0,0 +1,202 @@
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : CLI
+// ------------------------------------------------------------
+const usage = `usage:
+  dse loadtest bench [--url URL] [--levels 1,2,4,...] [--duration 10s] [--json]
+      post updates from a growing number of participants and report how
+      throughput and latency scale
+  dse loadtest soak [--url URL] [--participants 100] [--ramp 1m] [--duration 10m]
+                    [--interval 30s] [--delay 2s] [--json]
+      connect virtual extensions that consent, stay on the event stream and
+      answer crawls with fixture pages, and report latency and errors
+  dse loadtest engine [--addr :5100] [--dir DIR]
+      serve fake Google, Bing and DuckDuckGo result pages, recorded ones from
+      DIR/<engine>/<query>.html and generated ones otherwise; point a server
+      at it with SEARCHES_FILE=config/searches.fixture.json
+  dse loadtest e2e [--url URL] [--addr 127.0.0.1:5100] [--dir DIR] [--timeout 5m] [--json]
+      crawl one new participant against the fake engine and check that every
+      uploaded search is extracted and downloadable`
+
+// Command runs "dse loadtest ..." and returns the exit code.
+func Command(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+		case "bench" : return bench(args[1:])
+		case "soak"  : return soak(args[1:])
+		case "engine": return engine(args[1:])
+		case "e2e"   : return e2e(args[1:])
+		default      : {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+	}
+}
+
+func bench(args []string) int {
+	flags    := flag.NewFlagSet("bench", flag.ContinueOnError)
+	base     := flags.String("url", "http://localhost:5000", "server to load")
+	list     := flags.String("levels", "1,2,4,8,16,32,64", "participants per level")
+	duration := flags.Duration("duration", 10*time.Second, "time per level")
+	asJSON   := flags.Bool("json", false, "print the levels as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	levels := []int{}
+	for _, value := range strings.Split(*list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid level %q\n", value)
+			return 2
+		}
+		levels = append(levels, n)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	results, err := Bench(ctx, strings.TrimSuffix(*base, "/"), levels, *duration)
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(results, "", "    ")
+		fmt.Println(string(b))
+	} else {
+		Report(os.Stdout, results)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func soak(args []string) int {
+	flags        := flag.NewFlagSet("soak", flag.ContinueOnError)
+	base         := flags.String("url", "http://localhost:5000", "server to load")
+	participants := flags.Int("participants", 100, "virtual extensions")
+	ramp         := flags.Duration("ramp", time.Minute, "time over which participants join")
+	duration     := flags.Duration("duration", 10*time.Minute, "time after the ramp")
+	interval     := flags.Duration("interval", 30*time.Second, "time between state updates")
+	delay        := flags.Duration("delay", 2*time.Second, "time a search takes")
+	asJSON       := flags.Bool("json", false, "print the operations as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *participants <= 0 || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "participants and interval must be positive")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ops := Soak(ctx, strings.TrimSuffix(*base, "/"), SoakOptions{
+		Participants: *participants,
+		Ramp        : *ramp,
+		Duration    : *duration,
+		Interval    : *interval,
+		Delay       : *delay,
+	})
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(ops, "", "    ")
+		fmt.Println(string(b))
+	} else {
+		Summary(os.Stdout, ops)
+	}
+	return 0
+}
+
+func engine(args []string) int {
+	flags := flag.NewFlagSet("engine", flag.ContinueOnError)
+	addr  := flags.String("addr", ":5100", "address to listen on")
+	dir   := flags.String("dir", "", "directory of recorded pages")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: *addr, Handler: NewEngine(*dir)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving fake engines on %s\n", *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func e2e(args []string) int {
+	flags   := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	base    := flags.String("url", "http://localhost:5000", "server to test")
+	addr    := flags.String("addr", "127.0.0.1:5100", "address of the fake engine")
+	dir     := flags.String("dir", "", "directory of recorded pages")
+	timeout := flags.Duration("timeout", 5*time.Minute, "time for the crawl and extraction")
+	asJSON  := flags.Bool("json", false, "print the checks as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	server := &http.Server{Handler: NewEngine(*dir)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	checks, err := E2E(ctx, strings.TrimSuffix(*base, "/"), "http://"+listener.Addr().String(), *timeout)
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(checks, "", "    ")
+		fmt.Println(string(b))
+	} else {
+		for _, check := range checks {
+			status := "ok"
+			switch {
+				case !check.Found      : status = "missing"
+				case check.Results == 0: status = "empty"
+			}
+			fmt.Printf("%-12s %-32s %8d  %s\n", check.Website, check.Keyword, check.Results, status)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
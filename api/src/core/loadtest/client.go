@@ -0,0 +1,114 @@
+package loadtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"dse/src/core/global"
+	"dse/src/core/models"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ------------------------------------------------------------
+// : Client
+// ------------------------------------------------------------
+
+// Client is one virtual extension. It speaks the extension's protocol:
+// packets are msgpack encoded and gzipped, and posted to /api/event.
+type Client struct {
+	Token string
+
+	base string
+	http *http.Client
+}
+
+// NewClient creates a client with a random token.
+func NewClient(base string, client *http.Client) *Client {
+	return &Client{Token: Token(), base: base, http: client}
+}
+
+// Token returns a random participant token.
+func Token() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+// Post sends one packet and returns how long the server took to answer.
+func (c *Client) Post(ctx context.Context, action string, data any) (time.Duration, error) {
+	body, err := Encode(c.Token, action, data)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.base+"/api/event", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	res, err := c.http.Do(req)
+	if err != nil {
+		return time.Since(start), err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	took := time.Since(start)
+
+	if res.StatusCode != http.StatusOK {
+		return took, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return took, nil
+}
+
+// Update posts the state an idle extension reports.
+func (c *Client) Update(ctx context.Context) (time.Duration, error) {
+	return c.Post(ctx, "update", State(c.Token, "idle"))
+}
+
+// Encode builds the body of a POST to /api/event.
+func Encode(token string, action string, data any) ([]byte, error) {
+	packet, err := models.NewPacket(global.VERSION, token, "api", action, data)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := msgpack.Marshal(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(packed); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// State is the client state an extension sends with "update", with the
+// crawler in the given state.
+func State(token string, crawler string) map[string]any {
+	return map[string]any{
+		"background": map[string]any{"state": "ready"},
+		"browser"   : map[string]any{"name": "chrome", "os": "linux", "os_version": "6", "version": "126"},
+		"crawler"   : map[string]any{"state": crawler, "window": "", "started_at": "", "completed_at": ""},
+		"extension" : map[string]any{"state": "ready", "version": global.VERSION, "language": "nl"},
+		"user"      : map[string]any{"type": "loadtest", "token": token, "popup": false},
+	}
+}
@@ -0,0 +1,149 @@
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Check is whether one uploaded search made it to the download.
+type Check struct {
+	Website string `json:"website"`
+	Keyword string `json:"keyword"`
+	Found   bool   `json:"found"`
+	Results int    `json:"results"` // Organic results extracted
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Errors
+	ErrNoCrawl   = errors.New("server did not complete a crawl")
+	ErrNoUploads = errors.New("crawl completed without uploads")
+	ErrMissing   = errors.New("uploaded searches missing from the download")
+)
+
+// ------------------------------------------------------------
+// : E2E
+// ------------------------------------------------------------
+
+// E2E takes one new participant through the whole pipeline of a server:
+// the participant consents and is crawled (User.Start), searches on the fake
+// engine at engines and uploads the pages, which the server extracts
+// (extractor.OnFile) and offers for download. It returns, for every upload,
+// whether the search came back from /api/download/searches.
+func E2E(ctx context.Context, base string, engines string, timeout time.Duration) ([]*Check, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	events := &http.Client{}
+
+	recorder  := NewRecorder()
+	extension := NewExtension(base, client, events, recorder, 30*time.Second, 100*time.Millisecond).Engines(engines)
+
+	running, stop := context.WithCancel(ctx)
+	defer stop()
+	go extension.Run(running)
+
+	select {
+		case <-ctx.Done()            : return nil, ErrNoCrawl
+		case <-extension.Completed():
+	}
+
+	uploads := extension.Uploads()
+	if len(uploads) == 0 {
+		return nil, ErrNoUploads
+	}
+
+	// Extraction runs in the background; poll until every search is stored
+	for {
+		checks, err := download(ctx, client, base, extension.Token, uploads)
+		if err == nil && found(checks) {
+			return checks, nil
+		}
+
+		select {
+			case <-ctx.Done(): {
+				if err != nil {
+					return checks, err
+				}
+				return checks, ErrMissing
+			}
+			case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// download matches the searches of a participant in the download to its
+// uploads.
+func download(ctx context.Context, client *http.Client, base string, token string, uploads []Upload) ([]*Check, error) {
+	checks := []*Check{}
+	byKey  := map[string]*Check{}
+	for _, u := range uploads {
+		key := u.Website + "\xff" + u.Keyword
+		if byKey[key] == nil {
+			byKey[key] = &Check{Website: u.Website, Keyword: u.Keyword}
+			checks = append(checks, byKey[key])
+		}
+	}
+
+	query := url.Values{"token": {"dse2024"}, "tokens": {token}, "format": {"ndjson"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/api/download/searches?"+query.Encode(), nil)
+	if err != nil {
+		return checks, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return checks, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return checks, fmt.Errorf("status %d", res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		search := gjson.ParseBytes(scanner.Bytes())
+		if search.Get("token").String() != token {
+			continue
+		}
+
+		check := byKey[search.Get("website").String()+"\xff"+search.Get("keyword").String()]
+		if check == nil {
+			continue
+		}
+		check.Found   = true
+		check.Results = max(check.Results, int(search.Get("results.search_result.#").Int()))
+	}
+	return checks, scanner.Err()
+}
+
+func found(checks []*Check) bool {
+	for _, check := range checks {
+		if !check.Found || check.Results == 0 {
+			return false
+		}
+	}
+	return true
+}
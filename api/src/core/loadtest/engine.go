@@ -0,0 +1,106 @@
+package loadtest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Engine is a fake search engine. It serves result pages of Google, Bing
+// and DuckDuckGo under /google, /bing and /duckduckgo, for the query in the
+// q parameter, so a crawl can run without reaching the real engines.
+//
+// Pages recorded from a browser are served for the query they were saved
+// for, from <dir>/<engine>/<slug>.html (e.g. recorded/google/asielcrisis.html).
+// Queries without a recording get a generated page, see Page.
+type Engine struct {
+	dir string
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	engines = map[string]string{
+		"google"    : "Google",
+		"bing"      : "Bing",
+		"duckduckgo": "DuckDuckGo",
+	}
+
+	rslug = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// ------------------------------------------------------------
+// : Engine
+// ------------------------------------------------------------
+
+// NewEngine creates an engine serving the recordings in dir. An empty dir
+// serves generated pages only.
+func NewEngine(dir string) *Engine {
+	return &Engine{dir: dir}
+}
+
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	engine, ok := engines[strings.ToLower(prefix)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "missing q", http.StatusBadRequest)
+		return
+	}
+
+	html, err := e.Page(engine, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(html))
+}
+
+// Page returns the recorded page of an engine for a query, or a generated
+// one when there is no recording.
+func (e *Engine) Page(engine string, query string) (string, error) {
+	if e.dir != "" {
+		b, err := os.ReadFile(e.Path(engine, query))
+		if err == nil {
+			return string(b), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("read recording: %w", err)
+		}
+	}
+	return Page(engine, query)
+}
+
+// Path returns where the recording of an engine for a query is kept.
+func (e *Engine) Path(engine string, query string) string {
+	return filepath.Join(e.dir, strings.ToLower(engine), Slug(query)+".html")
+}
+
+// Url returns the address of an engine's result pages on a server running
+// the engine at base, as configured in config/searches.json.
+func Url(base string, engine string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.ToLower(engine) + "/search"
+}
+
+// Slug returns the file name a query is recorded under.
+func Slug(query string) string {
+	return strings.Trim(rslug.ReplaceAllString(strings.ToLower(query), "-"), "-")
+}
@@ -0,0 +1,343 @@
+package loadtest
+
+import (
+	"bufio"
+	"context"
+	"dse/src/core/global"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Extension is a virtual browser extension. It connects over SSE, reports
+// its state on an interval and answers the crawler like the real one:
+// crawler.start makes it ready, crawler.scrape makes it scrape and upload
+// a fixture page per task, and crawler.complete makes it idle.
+type Extension struct {
+	*Client
+
+	recorder *Recorder
+	events   *http.Client  // Without a timeout, for the event stream
+	interval time.Duration // Between state updates
+	delay    time.Duration // Time a search takes in the browser
+	engines  string        // Fake engine to search on, see Engine
+
+	mutex    sync.Mutex
+	crawler  string // Crawler state reported to the server
+	last     time.Time
+	uploads  []Upload
+	complete chan struct{}
+	once     sync.Once
+}
+
+// Upload is a search the extension uploaded.
+type Upload struct {
+	Website string `json:"website"`
+	Keyword string `json:"keyword"`
+	Attempt string `json:"attempt"`
+}
+
+// task is what the server sends with crawler.scrape.
+type task struct {
+	ID      int    `json:"id"`
+	Keyword string `json:"keyword"`
+	Attempt string `json:"attempt"`
+	Website struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+		Url   string `json:"url"`
+	} `json:"website"`
+}
+
+// ------------------------------------------------------------
+// : Extension
+// ------------------------------------------------------------
+func NewExtension(base string, client *http.Client, events *http.Client, recorder *Recorder, interval time.Duration, delay time.Duration) *Extension {
+	return &Extension{
+		Client  : NewClient(base, client),
+		recorder: recorder,
+		events  : events,
+		interval: interval,
+		delay   : delay,
+		crawler : "idle",
+		complete: make(chan struct{}),
+	}
+}
+
+// Engines makes the extension search on a fake engine at base, as a
+// browser would, instead of rendering result pages itself.
+func (e *Extension) Engines(base string) *Extension {
+	e.engines = strings.TrimSuffix(base, "/")
+	return e
+}
+
+// Uploads returns every search uploaded so far.
+func (e *Extension) Uploads() []Upload {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]Upload{}, e.uploads...)
+}
+
+// Completed is closed when the server first completes a crawl.
+func (e *Extension) Completed() <-chan struct{} {
+	return e.complete
+}
+
+// Run registers the participant, consents to the current text and stays
+// connected until ctx ends, reconnecting when the stream drops.
+func (e *Extension) Run(ctx context.Context) {
+	e.update(ctx)
+	e.consent(ctx)
+
+	go e.report(ctx)
+
+	for ctx.Err() == nil {
+		err := e.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		e.recorder.Observe("sse.disconnect", 0, err)
+
+		select {
+			case <-ctx.Done()             : return
+			case <-time.After(time.Second):
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// : Protocol
+// ------------------------------------------------------------
+
+// stream reads the event stream and answers every packet.
+func (e *Extension) stream(ctx context.Context) error {
+	query := url.Values{"token": {e.Token}, "version": {global.VERSION}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.base+"/api/event?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	res, err := e.events.Do(req)
+	if err != nil {
+		e.recorder.Observe("sse.connect", time.Since(start), err)
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("status %d", res.StatusCode)
+		e.recorder.Observe("sse.connect", time.Since(start), err)
+		return err
+	}
+	e.recorder.Observe("sse.connect", time.Since(start), nil)
+
+	heartbeat := time.Time{}
+	scanner   := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var packet struct {
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(line), &packet); err != nil {
+			e.recorder.Observe("sse.packet", 0, err)
+			continue
+		}
+
+		switch packet.Action {
+			case "heartbeat": {
+				// Heartbeats are due every 5 seconds; the gap shows how far
+				// the server falls behind
+				if !heartbeat.IsZero() {
+					e.recorder.Observe("sse.heartbeat", time.Since(heartbeat), nil)
+				}
+				heartbeat = time.Now()
+			}
+			case "crawler.start"   : go e.set(ctx, "ready")
+			case "crawler.scrape"  : go e.scrape(ctx, packet.Data)
+			case "crawler.complete": {
+				e.recorder.Count("crawl.complete")
+				e.once.Do(func() { close(e.complete) })
+				go e.set(ctx, "idle")
+			}
+			default: e.recorder.Count("sse." + packet.Action)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// scrape answers crawler.scrape: it reports scraping, uploads a page per
+// task and reports ready again.
+func (e *Extension) scrape(ctx context.Context, data json.RawMessage) {
+	var tasks []task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		e.recorder.Observe("crawl.scrape", 0, err)
+		return
+	}
+
+	e.set(ctx, "scraping")
+
+	for _, t := range tasks {
+		select {
+			case <-ctx.Done()         : return
+			case <-time.After(e.delay):
+		}
+
+		link, html, err := e.search(ctx, t)
+		if err != nil {
+			e.recorder.Observe("upload", 0, err)
+			continue
+		}
+
+		took, err := e.Post(ctx, "upload", map[string]any{
+			"token"       : e.Token,
+			"url"         : link,
+			"website"     : t.Website.Name,
+			"keyword"     : t.Keyword,
+			"attempt"     : t.Attempt,
+			"html"        : html,
+			"timestamp"   : time.Now().UTC().Format(time.RFC3339),
+			"localization": "nl",
+			"version"     : global.VERSION,
+			"browser"     : map[string]any{"name": "chrome", "os": "linux"},
+		})
+		e.recorder.Observe("upload", took, err)
+
+		if err == nil {
+			e.mutex.Lock()
+			e.uploads = append(e.uploads, Upload{Website: t.Website.Name, Keyword: t.Keyword, Attempt: t.Attempt})
+			e.mutex.Unlock()
+		}
+	}
+
+	e.set(ctx, "ready")
+}
+
+// search returns the address searched for a task and the page it gave,
+// from the fake engine when there is one.
+func (e *Extension) search(ctx context.Context, t task) (string, string, error) {
+	base := t.Website.Url
+	if e.engines != "" {
+		base = Url(e.engines, t.Website.Name)
+	}
+	query := url.Values{t.Website.Query: {t.Keyword}, "dse_id": {t.Attempt}}
+	link  := base + "?" + query.Encode()
+
+	if e.engines == "" {
+		html, err := Page(t.Website.Name, t.Keyword)
+		return link, html, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return link, "", err
+	}
+
+	start := time.Now()
+	res, err := e.http.Do(req)
+	if err != nil {
+		e.recorder.Observe("search", time.Since(start), err)
+		return link, "", err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err == nil && res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status %d", res.StatusCode)
+	}
+	e.recorder.Observe("search", time.Since(start), err)
+	return link, string(b), err
+}
+
+// set changes the crawler state and reports it right away.
+func (e *Extension) set(ctx context.Context, state string) {
+	e.mutex.Lock()
+	e.crawler = state
+	e.mutex.Unlock()
+
+	e.update(ctx)
+}
+
+func (e *Extension) update(ctx context.Context) {
+	e.mutex.Lock()
+	state  := e.crawler
+	e.last  = time.Now()
+	e.mutex.Unlock()
+
+	took, err := e.Post(ctx, "update", State(e.Token, state))
+	if ctx.Err() == nil {
+		e.recorder.Observe("update", took, err)
+	}
+}
+
+// report sends the state on an interval, as the extension's background
+// page does.
+func (e *Extension) report(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
+		}
+
+		e.mutex.Lock()
+		due := time.Since(e.last) >= e.interval
+		e.mutex.Unlock()
+
+		if due {
+			e.update(ctx)
+		}
+	}
+}
+
+// consent accepts the current consent text, without which the server does
+// not crawl.
+func (e *Extension) consent(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.base+"/api/consent", nil)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	res, err := e.http.Do(req)
+	if err != nil {
+		e.recorder.Observe("consent", time.Since(start), err)
+		return
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Text struct {
+			Version string `json:"version"`
+		} `json:"text"`
+	}
+	if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&body) != nil {
+		e.recorder.Observe("consent", time.Since(start), fmt.Errorf("status %d", res.StatusCode))
+		return
+	}
+
+	_, err = e.Post(ctx, "consent.grant", map[string]any{"version": body.Text.Version})
+	e.recorder.Observe("consent", time.Since(start), err)
+}
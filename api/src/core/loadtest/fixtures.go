@@ -0,0 +1,84 @@
+package loadtest
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Result is one organic result on a fixture page.
+type Result struct {
+	Title       string
+	Link        string
+	Publisher   string
+	Description string
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	//go:embed fixtures/*.html
+	files embed.FS
+
+	pages = template.Must(template.ParseFS(files, "fixtures/*.html"))
+
+	// Sites results are drawn from; every engine ranks them differently
+	domains = []string{
+		"nos.nl", "nu.nl", "telegraaf.nl", "volkskrant.nl", "nl.wikipedia.org",
+		"rijksoverheid.nl", "ad.nl", "trouw.nl", "nrc.nl", "rtl.nl",
+	}
+
+	// Errors
+	ErrUnknownEngine = errors.New("no fixture for engine")
+)
+
+// ------------------------------------------------------------
+// : Fixtures
+// ------------------------------------------------------------
+
+// Page renders a result page of an engine (Google, Bing, DuckDuckGo) for a
+// keyword, in the markup the extractor parses. The same engine and keyword
+// always give the same page.
+func Page(engine string, keyword string) (string, error) {
+	name := strings.ToLower(engine) + ".html"
+	if pages.Lookup(name) == nil {
+		return "", fmt.Errorf("%w: %s", ErrUnknownEngine, engine)
+	}
+
+	var buffer bytes.Buffer
+	err := pages.ExecuteTemplate(&buffer, name, map[string]any{
+		"Keyword": keyword,
+		"Results": Results(engine, keyword),
+	})
+	return buffer.String(), err
+}
+
+// Results returns the results a fixture page lists, in rank order.
+func Results(engine string, keyword string) []Result {
+	h := fnv.New32a()
+	h.Write([]byte(engine + "\xff" + keyword))
+	offset := int(h.Sum32() % uint32(len(domains)))
+
+	slug    := url.PathEscape(strings.ToLower(keyword))
+	results := make([]Result, 0, len(domains))
+	for i := range domains {
+		domain := domains[(offset+i)%len(domains)]
+		results = append(results, Result{
+			Title      : fmt.Sprintf("%s - %s", keyword, domain),
+			Link       : fmt.Sprintf("https://%s/%s", domain, slug),
+			Publisher  : domain,
+			Description: fmt.Sprintf("Alles over %s op %s.", keyword, domain),
+		})
+	}
+	return results
+}
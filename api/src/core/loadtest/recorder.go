@@ -0,0 +1,198 @@
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Operation summarises one kind of request or event over a run.
+type Operation struct {
+	Name   string         `json:"name"`
+	Count  int            `json:"count"`
+	Errors map[string]int `json:"errors"` // By class, such as "status 503" or "timeout"
+
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+
+	// Share of samples per latency bucket, by upper bound
+	Histogram map[string]float64 `json:"histogram"`
+}
+
+// Recorder collects latencies and errors from every virtual extension.
+type Recorder struct {
+	mutex   sync.Mutex
+	samples map[string][]time.Duration
+	errors  map[string]map[string]int
+	counts  map[string]int
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	buckets = []time.Duration{
+		5 * time.Millisecond, 25 * time.Millisecond, 100 * time.Millisecond,
+		500 * time.Millisecond, 1 * time.Second, 5 * time.Second, 30 * time.Second,
+	}
+)
+
+// ------------------------------------------------------------
+// : Recorder
+// ------------------------------------------------------------
+func NewRecorder() *Recorder {
+	return &Recorder{
+		samples: map[string][]time.Duration{},
+		errors : map[string]map[string]int{},
+		counts : map[string]int{},
+	}
+}
+
+// Observe records one sample of an operation, or its error.
+func (r *Recorder) Observe(name string, took time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.counts[name] += 1
+	if err != nil {
+		if r.errors[name] == nil {
+			r.errors[name] = map[string]int{}
+		}
+		r.errors[name][classify(err)] += 1
+		return
+	}
+	r.samples[name] = append(r.samples[name], took)
+}
+
+// Count records an event without a latency, such as a completed crawl.
+func (r *Recorder) Count(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts[name] += 1
+}
+
+// Operations summarises every operation, by name.
+func (r *Recorder) Operations() []*Operation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := []*Operation{}
+	for name, count := range r.counts {
+		samples := append([]time.Duration{}, r.samples[name]...)
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		op := &Operation{
+			Name     : name,
+			Count    : count,
+			Errors   : map[string]int{},
+			P50      : percentile(samples, 0.50),
+			P90      : percentile(samples, 0.90),
+			P99      : percentile(samples, 0.99),
+			Histogram: histogram(samples),
+		}
+		for class, n := range r.errors[name] {
+			op.Errors[class] = n
+		}
+		if len(samples) > 0 {
+			op.Max = samples[len(samples)-1]
+		}
+		list = append(list, op)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Summary writes every operation as a table, followed by the error classes
+// and the latency distribution of each.
+func Summary(w io.Writer, ops []*Operation) {
+	fmt.Fprintf(w, "%-18s %8s %8s %10s %10s %10s %10s\n", "operation", "count", "errors", "p50", "p90", "p99", "max")
+	for _, op := range ops {
+		errors := 0
+		for _, n := range op.Errors {
+			errors += n
+		}
+		fmt.Fprintf(w, "%-18s %8d %8d %10s %10s %10s %10s\n",
+			op.Name, op.Count, errors, round(op.P50), round(op.P90), round(op.P99), round(op.Max),
+		)
+	}
+
+	for _, op := range ops {
+		if len(op.Errors) == 0 {
+			continue
+		}
+		classes := []string{}
+		for class := range op.Errors {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		fmt.Fprintf(w, "\nerrors %s:\n", op.Name)
+		for _, class := range classes {
+			fmt.Fprintf(w, "  %-24s %8d\n", class, op.Errors[class])
+		}
+	}
+
+	for _, op := range ops {
+		if len(op.Histogram) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nlatency %s:\n", op.Name)
+		for _, label := range labels() {
+			share := op.Histogram[label]
+			fmt.Fprintf(w, "  %-8s %6.1f%% %s\n", label, share*100, strings.Repeat("#", int(share*40)))
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// classify groups errors so the report stays short.
+func classify(err error) string {
+	var netErr net.Error
+	switch {
+		case errors.Is(err, context.DeadlineExceeded)  : return "timeout"
+		case errors.As(err, &netErr) && netErr.Timeout(): return "timeout"
+		case strings.HasPrefix(err.Error(), "status ")  : return err.Error()
+		case strings.Contains(err.Error(), "refused")   : return "connection refused"
+		case strings.Contains(err.Error(), "reset")     : return "connection reset"
+		case strings.Contains(err.Error(), "EOF")       : return "eof"
+		default                                         : return "other"
+	}
+}
+
+func labels() []string {
+	list := []string{}
+	for _, bucket := range buckets {
+		list = append(list, "<"+bucket.String())
+	}
+	return append(list, ">="+buckets[len(buckets)-1].String())
+}
+
+func histogram(samples []time.Duration) map[string]float64 {
+	shares := map[string]float64{}
+	if len(samples) == 0 {
+		return shares
+	}
+
+	names := labels()
+	for _, sample := range samples {
+		i := sort.Search(len(buckets), func(i int) bool { return sample < buckets[i] })
+		shares[names[i]] += 1 / float64(len(samples))
+	}
+	return shares
+}
@@ -0,0 +1,74 @@
+package loadtest
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// SoakOptions describes a soak run.
+type SoakOptions struct {
+	Participants int
+	Ramp         time.Duration // Time over which participants join
+	Duration     time.Duration // Time everyone stays connected after the ramp
+	Interval     time.Duration // Between state updates of one participant
+	Delay        time.Duration // Time a search takes in the browser
+}
+
+// ------------------------------------------------------------
+// : Soak
+// ------------------------------------------------------------
+
+// Soak connects virtual extensions that behave like real ones for a while
+// and returns what every operation cost. Participants join evenly over the
+// ramp, so a run also shows how the server holds up as connections grow.
+// Crawls only happen for tasks the server has due; with a fresh database
+// every participant is crawled as soon as it has consented.
+func Soak(ctx context.Context, base string, options SoakOptions) []*Operation {
+	n := options.Participants
+
+	client := &http.Client{
+		Timeout  : 30 * time.Second,
+		Transport: &http.Transport{MaxIdleConns: n, MaxIdleConnsPerHost: n},
+	}
+	events := &http.Client{
+		Transport: &http.Transport{MaxIdleConns: n, MaxIdleConnsPerHost: n},
+	}
+
+	recorder := NewRecorder()
+
+	ctx, cancel := context.WithTimeout(ctx, options.Ramp+options.Duration)
+	defer cancel()
+
+	step := time.Duration(0)
+	if n > 1 {
+		step = options.Ramp / time.Duration(n-1)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+				case <-ctx.Done()      :
+				case <-time.After(step):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewExtension(base, client, events, recorder, options.Interval, options.Delay).Run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	return recorder.Operations()
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"dse/src/utils/event"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Command is a packet for a participant whose connection is held by
+// another instance.
+type Command struct {
+	Token  string      `json:"token"`
+	Action string      `json:"action"`
+	Data   interface{} `json:"data"`
+}
+
+// ------------------------------------------------------------
+// : Events
+// ------------------------------------------------------------
+var (
+	UserCreated      = event.NewTopic[*User]("user.created", 0)
+	UserDeleted      = event.NewTopic[*User]("user.deleted", 0)
+	UserConnected    = event.NewTopic[*User]("user.connected", 0)
+	UserDisconnected = event.NewTopic[*User]("user.disconnected", 0)
+	UserUpdated      = event.NewTopic[*User]("user.updated", 0) // State changed; published before it is persisted
+	UserReset        = event.NewTopic[*User]("user.reset", 0)
+
+	// Queues a user to be persisted; handled by the database
+	SaveUser = event.NewCall[*User, struct{}]("user.save")
+
+	// Delivers a packet through the instance holding the connection; handled
+	// by the cluster
+	SendRemote = event.NewCall[*Command, struct{}]("user.send")
+)
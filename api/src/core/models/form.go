@@ -1,128 +1,131 @@
 package models
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 // ------------------------------------------------------------
 // : Form
 // ------------------------------------------------------------
+
+// Form holds the answers to the questionnaire described by config/form.json
+// (see core/schema), keyed by question name:
+//
+//   - single choice and text answers are strings
+//   - multiple choice answers map every option to whether it was selected
+//   - postcodes are {"value": "..."}
+//
+// Answers are stored flat next to the version of the schema they were given
+// under, so forms from before the schema existed decode unchanged with an
+// empty version.
 type Form struct {
-	Age          string        `json:"age"`
-	Browser      *Browser      `json:"browser"`
-	Education    string        `json:"education"`
-	Employment   string        `json:"employment"`
-	Income       string        `json:"income"`
-	Language     *Language     `json:"language"`
-	Political    string        `json:"political"`
-	Postcode     *Postcode     `json:"postcode"`
-	Resident     string        `json:"resident"`
-	SearchEngine *SearchEngine `json:"search_engine"`
-	Sex          string        `json:"sex"`
-	Social       *Social       `json:"social"`
+	Version string
+	Answers map[string]any
 }
 
 func NewForm() *Form {
 	return &Form{
-		Age          : "",
-		Browser      : &Browser{
-			Brave         : false,
-			Chrome        : false,
-			Firefox       : false,
-			MicrosoftEdge : false,
-			Opera         : false,
-			Safari        : false,
-			Unselected    : false,
-		},
-		Education    : "",
-		Employment   : "",
-		Income       : "",
-		Language     : &Language{
-			Duits      : false,
-			Engels     : false,
-			Frans      : false,
-			Italiaans  : false,
-			Nederlands : false,
-			Spaans     : false,
-			Unselected : false,
-		},
-		Political    : "",
-		Postcode     : &Postcode{
-			Value: "",
-		},
-		Resident     : "",
-		SearchEngine : &SearchEngine{
-			Anders     : false,
-			Bing       : false,
-			Duckduckgo : false,
-			Ecosia     : false,
-			Google     : false,
-			Startpage  : false,
-			Yahoo      : false,
-			Unselected : false,
-		},
+		Answers: map[string]any{},
 	}
 }
 
 // ------------------------------------------------------------
-// : Browser
+// : Getters
 // ------------------------------------------------------------
-type Browser struct {
-	Brave         bool `json:"brave"`
-	Chrome        bool `json:"chrome"`
-	Firefox       bool `json:"firefox"`
-	MicrosoftEdge bool `json:"microsoft-edge"`
-	Opera         bool `json:"opera"`
-	Safari        bool `json:"safari"`
-	Unselected    bool `json:"unselected"`
+
+// Text returns a single choice, text or postcode answer.
+func (f *Form) Text(name string) string {
+	if f == nil {
+		return ""
+	}
+
+	switch value := f.Answers[name].(type) {
+		case string        : return value
+		case map[string]any: text, _ := value["value"].(string); return text
+	}
+	return ""
 }
 
-// ------------------------------------------------------------
-// : Language
-// ------------------------------------------------------------
-type Language struct {
-	Duits      bool `json:"duits"`
-	Engels     bool `json:"engels"`
-	Frans      bool `json:"frans"`
-	Italiaans  bool `json:"italiaans"`
-	Nederlands bool `json:"nederlands"`
-	Spaans     bool `json:"spaans"`
-	Unselected bool `json:"unselected"`
+// Selected returns the selected options of a multiple choice answer.
+func (f *Form) Selected(name string) map[string]bool {
+	selected := map[string]bool{}
+	if f == nil {
+		return selected
+	}
+
+	options, _ := f.Answers[name].(map[string]any)
+	for option, value := range options {
+		if b, _ := value.(bool); b {
+			selected[option] = true
+		}
+	}
+	return selected
 }
 
 // ------------------------------------------------------------
-// : SearchEngine
+// : Setters
 // ------------------------------------------------------------
-type SearchEngine struct {
-	Anders     bool `json:"anders"`
-	Bing       bool `json:"bing"`
-	Duckduckgo bool `json:"duckduckgo"`
-	Ecosia     bool `json:"ecosia"`
-	Google     bool `json:"google"`
-	Startpage  bool `json:"startpage"`
-	Yahoo      bool `json:"yahoo"`
-	Unselected bool `json:"unselected"`
+func (f *Form) SetText(name string, value string) {
+	f.Answers[name] = value
 }
 
-// ------------------------------------------------------------
-// : Social
-// ------------------------------------------------------------
-type Social struct {
-	Anders         bool `json:"anders"`
-	DeKrant        bool `json:"de-krant"`
-	Facebook       bool `json:"facebook"`
-	WhatsApp	   bool `json:"whatsapp"`
-	Instagram      bool `json:"instagram"`
-	Linkedin       bool `json:"linkedin"`
-	Nieuwswebsites bool `json:"nieuwswebsites"`
-	YouTube	       bool `json:"youtube"`
-	Radio          bool `json:"radio"`
-	Reddit         bool `json:"reddit"`
-	Telegram       bool `json:"telegram"`
-	TV             bool `json:"tv"`
-	Twitter        bool `json:"twitter"`
-	Unselected     bool `json:"unselected"`
+func (f *Form) SetPostcode(name string, value string) {
+	f.Answers[name] = map[string]any{"value": value}
+}
+
+func (f *Form) SetSelected(name string, selected map[string]bool) {
+	options := map[string]any{}
+	for option, value := range selected {
+		options[option] = value
+	}
+	f.Answers[name] = options
+}
+
+// Clone returns a copy that can be changed without touching the original.
+func (f *Form) Clone() *Form {
+	if f == nil {
+		return nil
+	}
+
+	clone := &Form{Version: f.Version, Answers: make(map[string]any, len(f.Answers))}
+	for name, value := range f.Answers {
+		if options, ok := value.(map[string]any); ok {
+			copied := make(map[string]any, len(options))
+			for option, selected := range options {
+				copied[option] = selected
+			}
+			value = copied
+		}
+		clone.Answers[name] = value
+	}
+	return clone
 }
 
 // ------------------------------------------------------------
-// : Postcode
+// : Serialize
 // ------------------------------------------------------------
-type Postcode struct {
-	Value string `json:"value"`
+func (f Form) MarshalJSON() ([]byte, error) {
+	flat := make(map[string]any, len(f.Answers) + 1)
+	for name, value := range f.Answers {
+		flat[name] = value
+	}
+	if f.Version != "" {
+		flat["version"] = f.Version
+	}
+	return json.Marshal(flat)
+}
+
+func (f *Form) UnmarshalJSON(b []byte) error {
+	flat := map[string]any{}
+	if err := json.Unmarshal(b, &flat); err != nil {
+		return err
+	}
+
+	version, _ := flat["version"].(string)
+	delete(flat, "version")
+
+	f.Version = strings.TrimSpace(version)
+	f.Answers = flat
+	return nil
 }
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"dse/src/utils/datetime"
+	"errors"
+	"fmt"
+)
+
+// ------------------------------------------------------------
+// : Server > Patch
+// ------------------------------------------------------------
+
+// ServerPatch changes server-side fields of a participant, as an operator
+// would. Fields left out are kept; an empty timestamp clears it.
+type ServerPatch struct {
+	State       *string      `json:"state,omitempty"`
+	StartedAt   *string      `json:"started_at,omitempty"`
+	CompletedAt *string      `json:"completed_at,omitempty"`
+	TaskHash    *string      `json:"task_hash,omitempty"`
+	Tasks       []*TaskPatch `json:"tasks,omitempty"`
+}
+
+// TaskPatch changes one task, by ID. Clearing completed_at makes the task
+// due again.
+type TaskPatch struct {
+	ID          int     `json:"id"`
+	StartedAt   *string `json:"started_at,omitempty"`
+	CompletedAt *string `json:"completed_at,omitempty"`
+}
+
+var (
+	// Errors
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	ErrUnknownTask      = errors.New("unknown task")
+)
+
+// Validate checks the patch against a server state: timestamps must parse
+// and tasks must exist.
+func (p *ServerPatch) Validate(s *ServerState) error {
+	timestamps := map[string]*string{"started_at": p.StartedAt, "completed_at": p.CompletedAt}
+	for _, t := range p.Tasks {
+		if s.GetTask(t.ID) == nil {
+			return fmt.Errorf("%w: %d", ErrUnknownTask, t.ID)
+		}
+		timestamps[fmt.Sprintf("tasks.%d.started_at"  , t.ID)] = t.StartedAt
+		timestamps[fmt.Sprintf("tasks.%d.completed_at", t.ID)] = t.CompletedAt
+	}
+
+	for name, value := range timestamps {
+		if value == nil || *value == "" {
+			continue
+		}
+		if datetime.Parse(*value).IsZero() {
+			return fmt.Errorf("%w: %s", ErrInvalidTimestamp, name)
+		}
+	}
+	return nil
+}
+
+// Patch applies a validated patch. Tasks that no longer exist are skipped.
+func (s *ServerState) Patch(p *ServerPatch) {
+	if p.State       != nil { s.State       = *p.State }
+	if p.StartedAt   != nil { s.StartedAt   = iso(*p.StartedAt) }
+	if p.CompletedAt != nil { s.CompletedAt = iso(*p.CompletedAt) }
+	if p.TaskHash    != nil { s.TaskHash    = *p.TaskHash }
+
+	for _, t := range p.Tasks {
+		task := s.GetTask(t.ID)
+		if task == nil {
+			continue
+		}
+		if t.StartedAt   != nil { task.StartedAt   = iso(*t.StartedAt) }
+		if t.CompletedAt != nil { task.CompletedAt = iso(*t.CompletedAt) }
+	}
+	s.UpdatedAt = datetime.ToISO(datetime.Now())
+}
+
+// iso normalises a timestamp to the format the state is stored in.
+func iso(value string) string {
+	if value == "" {
+		return ""
+	}
+	return datetime.ToISO(datetime.Parse(value))
+}
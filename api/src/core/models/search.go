@@ -8,6 +8,9 @@ type Search struct {
 	Token     string    `json:"token"`
 	Timestamp string    `json:"timestamp"`
 	Metadata  JSONBMap  `json:"metadata"`
+
+	Attempt     string `json:"attempt,omitempty"`     // Attempt ID of the task that produced the capture
+	Correlation string `json:"correlation,omitempty"` // How the upload matched that task
 }
 
 
@@ -1,8 +1,13 @@
 package models
 
 import (
+	"crypto/rand"
 	"dse/src/utils/datetime"
 	"dse/src/utils/gatekeeper"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -149,6 +154,19 @@ func (s *ServerState) GetTasks() []*Task {
 func (s *ServerState) AddTask(task *Task) {
 	*s.Tasks = append(*s.Tasks, task)
 }
+
+// GetTask returns the task with an ID, or nil.
+func (s *ServerState) GetTask(id int) *Task {
+	if s.Tasks == nil {
+		return nil
+	}
+	for _, task := range *s.Tasks {
+		if task.ID == id {
+			return task
+		}
+	}
+	return nil
+}
 // ------------------------------------------------------------
 // : Server > State > Crawler > Tasks
 // ------------------------------------------------------------
@@ -164,11 +182,27 @@ type Task struct {
 	CreatedAt   string `json:"created_at"`
 	StartedAt   string `json:"started_at"`
 	CompletedAt string `json:"completed_at"`
+
+	// Every dispatch gets a new attempt ID, which the extension echoes back
+	// with the upload so it can be matched to this task
+	Attempt    string `json:"attempt"`
+	UploadedAt string `json:"uploaded_at"` // First upload for the attempt
 }
 
 func (t *Task) Reset() {
 	t.StartedAt   = ""
 	t.CompletedAt = ""
+	t.UploadedAt  = ""
+}
+
+// Dispatch starts a new attempt of the task.
+func (t *Task) Dispatch() {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	t.Attempt    = fmt.Sprintf("%d.%s", t.ID, hex.EncodeToString(b))
+	t.StartedAt  = datetime.ToISO(datetime.Now())
+	t.UploadedAt = ""
 }
 
 func (t *Task) GetCompletedAt() time.Time {
@@ -183,6 +217,49 @@ func (t *Task) IsStale() bool {
 	return updated.IsZero() || updated.Before(monday)
 }
 
+// ------------------------------------------------------------
+// : Server > State > Crawler > Tasks > Correlation
+// ------------------------------------------------------------
+
+// Correlation is how an upload relates to the task that produced it.
+type Correlation string
+
+const (
+	CorrelationMatched   Correlation = "matched"   // First upload for the current attempt of a task
+	CorrelationCompleted Correlation = "completed" // The attempt already had an upload
+	CorrelationStale     Correlation = "stale"     // An earlier attempt of a task that has been dispatched again
+	CorrelationUnknown   Correlation = "unknown"   // No task of the participant has the attempt
+	CorrelationMissing   Correlation = "missing"   // The upload has no attempt ID (older extensions)
+)
+
+// Correlate finds the task an attempt ID belongs to. A matched task is
+// marked as uploaded, so a second upload for the same attempt is flagged.
+// The caller holds the participant's lock.
+func (s *ServerState) Correlate(attempt string) (*Task, Correlation) {
+	if attempt == "" {
+		return nil, CorrelationMissing
+	}
+
+	prefix, _, ok := strings.Cut(attempt, ".")
+	if !ok {
+		return nil, CorrelationUnknown
+	}
+	id, err := strconv.Atoi(prefix)
+	if err != nil {
+		return nil, CorrelationUnknown
+	}
+
+	task := s.GetTask(id)
+	switch {
+		case task == nil             : return nil, CorrelationUnknown
+		case task.Attempt != attempt : return task, CorrelationStale
+		case task.UploadedAt != ""   : return task, CorrelationCompleted
+	}
+
+	task.UploadedAt = datetime.ToISO(datetime.Now())
+	return task, CorrelationMatched
+}
+
 func (t *Task) IsCompleted() bool {
 	monday  := datetime.ToTime(datetime.StartOfWeek())
 	return  !t.GetCompletedAt().After(monday)
@@ -1,8 +1,9 @@
 package models
 
 import (
+	"context"
+	"dse/src/core/telemetry"
 	"dse/src/utils/datetime"
-	"dse/src/utils/event"
 	"dse/src/utils/gatekeeper"
 	"fmt"
 	"net/http"
@@ -13,7 +14,6 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/natefinch/lumberjack"
-	"github.com/olebedev/emitter"
 	"github.com/rs/zerolog"
 )
 
@@ -22,6 +22,9 @@ import (
 // ------------------------------------------------------------
 var (
 	version string = "3.0.5"
+
+	// SSE connections that have not been marked offline yet
+	connections sync.WaitGroup
 )
 
 // ------------------------------------------------------------
@@ -41,7 +44,6 @@ type User struct {
 	conn *websocket.Conn   `json:"-"` // WS Connection
 
 	mutex          sync.Mutex  `json:"-"` // Mutex for user
-	flag_saving    atomic.Bool `json:"-"` // Saving flag
 	flag_crawling  atomic.Bool `json:"-"` // Crawling flag
 	flag_resetting atomic.Bool `json:"-"` // Resetting flag
 }
@@ -67,9 +69,6 @@ func (u *User) Init() {
 	u.State.Client.Crawler.cond  = *sync.NewCond(&u.State.Client.Crawler.mutex)
 
 	u.mutex        = sync.Mutex{}
-	u.flag_saving  = atomic.Bool{}
-
-	event.On(fmt.Sprintf("user.%s.reload", u.Token), func(e *emitter.Event) { })
 }
 
 // ------------------------------------------------------------
@@ -79,27 +78,36 @@ func (u *User) SetSSE(w http.ResponseWriter, r *http.Request) {
 	u.w = w
 	u.r = r
 
+	connections.Add(1)
 	go func() {
+		defer connections.Done()
+
 		version := r.URL.Query().Get("version")
 		u.version = version
 		u.logger  = newLogger(u)
 		u.logger.Info().Msg("Connected SSE")
+		telemetry.Participants.With("sse").Inc()
 
 		var server = u.State.Server
 		
+		u.Lock()
 		server.Online   = true
 		server.LastPing = datetime.ToISO(datetime.Now())
 		u.Save()
+		u.Unlock()
 	
 		 <- r.Context().Done()
 	
 		u.logger.Info().Msg("Disconnected SSE")
+		telemetry.Participants.With("sse").Dec()
 	
 		u.w = nil
 		u.r = nil
 	
+		u.Lock()
 		server.Online = false
 		u.Save()
+		u.Unlock()
 		
 	}()
 }
@@ -115,14 +123,20 @@ func (u *User) SetWS(conn *websocket.Conn) {
 
 		var server = u.State.Server
 
+		u.Lock()
 		server.Online   = true
 		server.LastPing = datetime.ToISO(datetime.Now())
 		u.Save()
+		u.Unlock()
 	}()
 }
 
 func (u *User) Send(action string, data interface{}) {
-    if u.w == nil || u.r == nil { return }
+    // Participants connected elsewhere are reached through their instance
+    if u.w == nil || u.r == nil {
+        SendRemote.Request(context.Background(), &Command{Token: u.Token, Action: action, Data: data})
+        return
+    }
 
     flusher, ok := u.w.(http.Flusher)
     if !ok {
@@ -159,6 +173,8 @@ func (u *User) Reload() {
 	u.Send("reload", nil)
 }
 
+// Start crawls the tasks that are due. The state is only locked while it is
+// changed, since the crawler's progress arrives as events that need the lock.
 func (u *User) Start() {
 
 	if u.flag_crawling.Load() {
@@ -173,11 +189,13 @@ func (u *User) Start() {
 
     // Collect tasks that need processing (stale tasks)
     var todo = []*Task{}
+    u.Lock()
     for _, task := range *server.Tasks {
         if task.IsStale() {
             todo = append(todo, task)
         }
     }
+    u.Unlock()
 
     // If there are no tasks, return early
     if len(todo) == 0 {
@@ -187,8 +205,10 @@ func (u *User) Start() {
     u.Send("crawler.start", nil)
     u.logger.Info().Str("token", u.Token).Msg("Starting")
 
+    u.Lock()
     server.StartedAt = datetime.ToISO(datetime.Now())
     u.Save()
+    u.Unlock()
 
     // Wait for the crawler to be ready
     if !u.WaitForState("ready", 5*time.Second) {
@@ -206,36 +226,53 @@ func (u *User) Start() {
         u.logger.Info().Str("token", u.Token).Int("batch_size", len(batch)).Msg("Processing batch of tasks")
 
         // Mark tasks as started
+        u.Lock()
         for _, task := range batch {
-            u.logger.Info().Str("token", u.Token).Str("task", task.Keyword).Str("status", "starting").Msg("Task")
-            task.StartedAt = datetime.ToISO(datetime.Now())
+            task.Dispatch()
+            u.logger.Info().Str("token", u.Token).Str("task", task.Keyword).Str("attempt", task.Attempt).Str("status", "starting").Msg("Task")
         }
+        u.Save()
 
-        // Send batch of tasks to crawler
-        u.Send("crawler.scrape", batch)
+        // Send batch of tasks to crawler; every task carries its attempt ID.
+        // Copies are sent, as the tasks change while the batch is encoded
+        tasks := make([]Task, len(batch))
+        for i, task := range batch {
+            tasks[i] = *task
+        }
+        u.Unlock()
+
+        u.Send("crawler.scrape", tasks)
+        telemetry.Tasks.With("dispatched").Add(float64(len(batch)))
 
         // Wait for the scraper to transition to "scraping"
         if !u.WaitForState("scraping", 5*time.Second) {
+            telemetry.Tasks.With("timed_out").Add(float64(len(batch)))
             continue // Skip to next batch if timeout occurs
         }
 
         // Wait for the scraper to complete and transition back to "ready"
         if !u.WaitForState("ready", 20*time.Second) {
+            telemetry.Tasks.With("timed_out").Add(float64(len(batch)))
             continue // Skip to next batch if timeout occurs
         }
 
+        telemetry.Tasks.With("completed").Add(float64(len(batch)))
+
         // Mark tasks as completed
+        u.Lock()
         for _, task := range batch {
             task.CompletedAt = datetime.ToISO(datetime.Now())
             u.logger.Info().Str("token", u.Token).Str("task", task.Keyword).Str("status", "completed").Msg("Task")
         }
-
         u.Save()
+        u.Unlock()
     }
 
     // Mark the entire process as completed
+    u.Lock()
     server.CompletedAt = datetime.ToISO(datetime.Now())
     u.Save()
+    u.Unlock()
 
     u.Send("crawler.complete", nil)
     u.logger.Info().Str("token", u.Token).Msg("All tasks completed")
@@ -256,6 +293,9 @@ func (u *User) Reset() {
 	u.flag_resetting.Store(true)
 	defer u.flag_resetting.Store(false)
 
+	u.Lock()
+	defer u.Unlock()
+
 	server := u.State.Server
 	server.CompletedAt = ""
 
@@ -266,6 +306,20 @@ func (u *User) Reset() {
 	u.Save()
 }
 
+// ------------------------------------------------------------
+// : Locking
+// ------------------------------------------------------------
+
+// Lock serialises changes to one participant, such as their events being
+// applied; other participants are not held up.
+func (u *User) Lock() {
+	u.mutex.Lock()
+}
+
+func (u *User) Unlock() {
+	u.mutex.Unlock()
+}
+
 // ------------------------------------------------------------
 // : Setters
 // ------------------------------------------------------------
@@ -280,6 +334,12 @@ func (u *User) IsOnline() bool {
 	return u.State.Server.Online
 }
 
+// Connected reports whether this instance holds the participant's SSE
+// connection, and so can send to them and run their crawl.
+func (u *User) Connected() bool {
+	return u.w != nil
+}
+
 func (u *User) ValidVersion() bool {
 	if u.State.Client.Extension.Version == "" { return false }
 	return u.State.Client.Extension.Version >= version
@@ -326,29 +386,69 @@ func (u *User) WaitForState(target string, timeout time.Duration) bool {
 	return true
 }
 
-func (u *User) Save() {
-	u.State.Client.Crawler.cond.Broadcast()
+// Replace takes over a state loaded from the database. The crawler keeps its
+// lock and condition, which goroutines waiting for a state hold on to.
+func (u *User) Replace(state State) {
+	if state.Client == nil || state.Server == nil {
+		return
+	}
 
-	if u.flag_saving.Load() { 
-		return 
+	u.Lock()
+	defer u.Unlock()
+
+	c := u.State.Client.Crawler
+	c.mutex.Lock()
+	if state.Client.Crawler != nil {
+		c.State       = state.Client.Crawler.State
+		c.Window      = state.Client.Crawler.Window
+		c.StartedAt   = state.Client.Crawler.StartedAt
+		c.CompletedAt = state.Client.Crawler.CompletedAt
 	}
+	state.Client.Crawler = c
 
-	u.flag_saving.Store(true)
-	defer u.flag_saving.Store(false)
+	state.Server.GK     = u.State.Server.GK
+	state.Server.Online = u.State.Server.Online
+	if state.Server.Tasks == nil {
+		state.Server.Tasks = &[]*Task{}
+	}
 
-	ch := make(chan error)
-	event.Emit("user.updated", u, ch)
-	
-	err := <- ch
+	u.State = state
+	c.mutex.Unlock()
 
-	if err != nil {
-		u.logger.Error().Err(err).Msg("")
+	c.cond.Broadcast()
+}
+
+// Save announces the change and queues the user to be persisted; it does
+// not wait for the write.
+func (u *User) Save() {
+	u.State.Client.Crawler.cond.Broadcast()
+
+	UserUpdated.Publish(u)
+
+	_, err := SaveUser.Request(context.Background(), u)
+	if err != nil && u.logger != nil {
+		u.logger.Error().Err(err).Msg("Failed to save user")
 	}
 }
 
 // ------------------------------------------------------------
 // : Statics
 // ------------------------------------------------------------
+
+// Drain waits until every closed SSE connection has been saved as offline.
+func Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+
+	select {
+		case <-done      : return nil
+		case <-ctx.Done(): return ctx.Err()
+	}
+}
+
 func newLogger(u *User) *zerolog.Logger {
 	var logger  zerolog.Logger
 	var multi   zerolog.LevelWriter
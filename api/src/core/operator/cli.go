@@ -0,0 +1,123 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ------------------------------------------------------------
+// : CLI
+// ------------------------------------------------------------
+const usage = `usage:
+  dse users list [--version 3.0.5,...] [--online true|false]
+                 [--completion complete,partial,none] [--json]
+      list participants with their version, connection and tasks
+  dse users show [--searches 20] <token>
+      print the summary, task status, recent searches and full state of a
+      participant
+  dse users patch <token> <patch>
+      change server-side fields, such as '{"tasks": [{"id": 3, "completed_at": ""}]}'
+      to make a task due again
+  dse users reset <token>
+      mark every task of a participant as due again
+  dse users repopulate <token>
+      replace the tasks of a participant with the configured ones
+  dse users crawl [--force] <token>
+      start the crawl of a connected participant; with --force every task is
+      searched again
+  dse users send <token> <action> [data]
+      send a packet to the extension of a connected participant, such as
+      "reload"; data is JSON or a string
+  dse users erase [--anonymise] <token>
+      erase a participant everywhere (GDPR) and print the receipt; with
+      --anonymise their searches are kept under a random ID
+  dse export [--days 7 | --start DATE [--end DATE]] [--format ndjson|csv|parquet]
+             [--recipient NAME] [--out FILE]
+      run an export job on the server and download the file
+  dse health [--json]
+      check the pipeline; exits 1 when it is degraded
+
+Every command takes --url (default $DSE_URL or http://localhost:5000) and
+--token (default $ADMIN_TOKEN).`
+
+var (
+	commands = map[string]func(ctx context.Context, args []string) int{
+		"users" : users,
+		"export": exports,
+		"health": health,
+	}
+)
+
+// Has reports whether name is an operator command.
+func Has(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// Command runs "dse <command> ..." and returns the exit code.
+func Command(args []string) int {
+	if len(args) == 0 || !Has(args[0]) {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return commands[args[0]](ctx, args[1:])
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// connection is a flag set with the flags every command takes.
+type connection struct {
+	*flag.FlagSet
+
+	url   *string
+	token *string
+}
+
+func flags(name string) *connection {
+	base := os.Getenv("DSE_URL")
+	if base == "" {
+		base = "http://localhost:5000"
+	}
+
+	set := flag.NewFlagSet(name, flag.ContinueOnError)
+	set.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+
+	return &connection{
+		FlagSet: set,
+		url    : set.String("url", base, "server"),
+		token  : set.String("token", os.Getenv("ADMIN_TOKEN"), "admin token"),
+	}
+}
+
+func (c *connection) Client() *Client {
+	return NewClient(*c.url, *c.token)
+}
+
+// operator names who runs the command in the server's logs and receipts.
+func operator() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "cli"
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+func printJSON(v any) {
+	b, _ := json.MarshalIndent(v, "", "    ")
+	fmt.Println(string(b))
+}
@@ -0,0 +1,141 @@
+// Package operator is the command line for operators. It talks to a running
+// server through the admin API, authenticated with ADMIN_TOKEN, so it works
+// the same against a local server and production.
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Client calls the admin API of a server.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// APIError is an error answered by the server.
+type APIError struct {
+	Code    int
+	Message string
+	Body    []byte
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Errors
+	ErrNoToken = errors.New("no admin token, set ADMIN_TOKEN or pass --token")
+)
+
+// ------------------------------------------------------------
+// : Client
+// ------------------------------------------------------------
+func NewClient(base string, token string) *Client {
+	return &Client{
+		base : strings.TrimSuffix(base, "/"),
+		token: token,
+		http : &http.Client{},
+	}
+}
+
+// Do sends a request with an optional JSON body and decodes the JSON answer
+// into out, when given.
+func (c *Client) Do(ctx context.Context, method string, path string, body any, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	res, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return failure(res.StatusCode, b)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Download writes the body of a GET to w. It has no timeout, as exports
+// can be large.
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) (int64, error) {
+	res, err := c.send(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(res.Body)
+		return 0, failure(res.StatusCode, b)
+	}
+	return io.Copy(w, res.Body)
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body any) (*http.Response, error) {
+	if c.token == "" {
+		return nil, ErrNoToken
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("X-Operator"   , operator())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return c.http.Do(req)
+}
+
+// failure turns an error response into an APIError. The error is a message,
+// or an object of messages by field for invalid requests.
+func failure(code int, body []byte) error {
+	message := strings.TrimSpace(string(body))
+
+	parsed := gjson.GetBytes(body, "error")
+	switch {
+		case parsed.Type == gjson.String: message = parsed.String()
+		case parsed.IsObject()          : message = parsed.Raw
+	}
+	return &APIError{Code: code, Message: message, Body: body}
+}
@@ -0,0 +1,87 @@
+package operator
+
+import (
+	"context"
+	"dse/src/core/services/export"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Export
+// ------------------------------------------------------------
+
+// exports submits an export job, waits for it and downloads the artifact.
+func exports(ctx context.Context, args []string) int {
+	flags     := flags("export")
+	days      := flags.Int("days", 0, "searches of the last days")
+	start     := flags.String("start", "", "first day, such as 2025-01-28")
+	end       := flags.String("end", "", "day after the last")
+	format    := flags.String("format", "ndjson", "ndjson, csv or parquet")
+	recipient := flags.String("recipient", "", "pseudonymise for a recipient")
+	out       := flags.String("out", "", "file to write, named after the job by default")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	body := map[string]any{"format": *format}
+	if *days > 0         { body["days"]      = *days }
+	if *start != ""      { body["start"]     = *start }
+	if *end != ""        { body["end"]       = *end }
+	if *recipient != ""  { body["recipient"] = *recipient }
+
+	client := flags.Client()
+
+	var response struct {
+		Job *export.Job `json:"job"`
+	}
+	if err := client.Do(ctx, http.MethodPost, "/api/download/jobs", body, &response); err != nil {
+		return fail(err)
+	}
+	id := response.Job.ID
+	fmt.Fprintf(os.Stderr, "job %s submitted\n", id)
+
+	// Jobs run in the background on the server
+	for response.Job.Status != export.StatusDone {
+		if response.Job.Status == export.StatusFailed {
+			return fail(errors.New("job failed: " + response.Job.Error))
+		}
+
+		select {
+			case <-ctx.Done()                  : return fail(ctx.Err())
+			case <-time.After(2 * time.Second):
+		}
+
+		if err := client.Do(ctx, http.MethodGet, "/api/download/jobs/"+id, nil, &response); err != nil {
+			return fail(err)
+		}
+		fmt.Fprintf(os.Stderr, "job %s %s, %d rows\n", id, response.Job.Status, response.Job.Rows)
+	}
+
+	manifest := response.Job.Manifest
+	if manifest == nil {
+		return fail(export.ErrJobNotDone)
+	}
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("%s-%s", id, manifest.File)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+
+	size, err := client.Download(ctx, "/api/download/jobs/"+id+"/file", f)
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%s: %d rows, %d bytes, %s\n", path, manifest.Rows, size, manifest.Checksum)
+	return 0
+}
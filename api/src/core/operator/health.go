@@ -0,0 +1,95 @@
+package operator
+
+import (
+	"context"
+	"dse/src/core/services/api/admin"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Health
+// ------------------------------------------------------------
+func health(ctx context.Context, args []string) int {
+	flags  := flags("health")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var response struct {
+		Health *admin.Health `json:"health"`
+	}
+
+	// A degraded pipeline is answered with 503 and the same report
+	err := flags.Client().Do(ctx, http.MethodGet, "/api/admin/health", nil, &response)
+	var failed *APIError
+	if errors.As(err, &failed) && failed.Code == http.StatusServiceUnavailable {
+		err = json.Unmarshal(failed.Body, &response)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	health := response.Health
+	if *asJSON {
+		printJSON(health)
+	} else {
+		report(health)
+	}
+
+	if health.Status != "ok" {
+		return 1
+	}
+	return 0
+}
+
+func report(health *admin.Health) {
+	fmt.Printf("status     %s\n", health.Status)
+	for _, problem := range health.Problems {
+		fmt.Printf("  problem  %s\n", problem)
+	}
+	fmt.Printf("ready      %t\n", health.Ready)
+	fmt.Printf("database   %s\n", health.Database.Round(time.Microsecond))
+	fmt.Printf("unwritten  %d users\n", health.Dirty)
+
+	if summary := health.Cluster; summary != nil {
+		fmt.Printf("instances  %d\n", len(summary.Instances))
+		for _, instance := range summary.Instances {
+			fmt.Printf("  %-24s heartbeat %s ago\n", instance.ID, time.Since(instance.HeartbeatAt).Round(time.Second))
+		}
+		fmt.Printf("connected  %s\n", pairs(summary.Presence))
+		fmt.Printf("totals     %s\n", pairs(summary.Totals))
+	}
+
+	if searches := health.Searches; searches != nil {
+		last := "never"
+		if searches.Last != nil {
+			last = searches.Last.Format(time.RFC3339)
+		}
+		fmt.Printf("searches   %d last hour, %d last day, last at %s\n", searches.Hour, searches.Day, last)
+	}
+}
+
+// pairs formats a map as "key=value" pairs, sorted by key.
+func pairs[V int | float64](m map[string]V) string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := []string{}
+	for _, key := range keys {
+		list = append(list, fmt.Sprintf("%s=%v", key, m[key]))
+	}
+	if len(list) == 0 {
+		return "-"
+	}
+	return strings.Join(list, " ")
+}
@@ -0,0 +1,228 @@
+package operator
+
+import (
+	"context"
+	"dse/src/core/services/api/admin"
+	"dse/src/core/services/gdpr"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// ------------------------------------------------------------
+// : Users
+// ------------------------------------------------------------
+func users(ctx context.Context, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+		case "list"      : return list(ctx, args[1:])
+		case "show"      : return show(ctx, args[1:])
+		case "reset"     : return action(ctx, "reset", args[1:])
+		case "repopulate": return action(ctx, "repopulate", args[1:])
+		case "crawl"     : return crawl(ctx, args[1:])
+		case "patch"     : return patch(ctx, args[1:])
+		case "send"      : return send(ctx, args[1:])
+		case "erase"     : return erase(ctx, args[1:])
+		default          : {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+	}
+}
+
+func list(ctx context.Context, args []string) int {
+	flags      := flags("list")
+	version    := flags.String("version", "", "extension versions")
+	online     := flags.String("online", "", "true for connected participants, false for the others")
+	completion := flags.String("completion", "", "complete, partial or none")
+	asJSON     := flags.Bool("json", false, "print as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	query := url.Values{}
+	if *version != ""    { query.Set("version"   , *version) }
+	if *online != ""     { query.Set("online"    , *online) }
+	if *completion != "" { query.Set("completion", *completion) }
+
+	var response struct {
+		Users []*admin.UserSummary `json:"users"`
+	}
+	if err := flags.Client().Do(ctx, http.MethodGet, "/api/admin/users?"+query.Encode(), nil, &response); err != nil {
+		return fail(err)
+	}
+
+	if *asJSON {
+		printJSON(response.Users)
+		return 0
+	}
+
+	fmt.Printf("%-12s %-8s %-10s %-7s %5s %5s %-10s  %s\n", "token", "version", "connected", "consent", "tasks", "due", "completion", "last ping")
+	for _, user := range response.Users {
+		fmt.Printf("%-12s %-8s %-10t %-7t %5d %5d %-10s  %s\n",
+			user.Token, user.Version, user.Connected, user.Consent, user.Tasks, user.Due, user.Completion, user.LastPing,
+		)
+	}
+	fmt.Printf("\n%d participants\n", len(response.Users))
+	return 0
+}
+
+func show(ctx context.Context, args []string) int {
+	flags    := flags("show")
+	searches := flags.Int("searches", 20, "recent searches to include")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var response json.RawMessage
+	path := fmt.Sprintf("/api/admin/users/%s?searches=%d", url.PathEscape(flags.Arg(0)), *searches)
+	if err := flags.Client().Do(ctx, http.MethodGet, path, nil, &response); err != nil {
+		return fail(err)
+	}
+
+	printJSON(response)
+	return 0
+}
+
+// action runs an operation without a body on a participant, such as a reset.
+func action(ctx context.Context, name string, args []string) int {
+	flags := flags(name)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var response struct {
+		Status string `json:"status"`
+	}
+	path := fmt.Sprintf("/api/admin/users/%s/%s", url.PathEscape(flags.Arg(0)), name)
+	if err := flags.Client().Do(ctx, http.MethodPost, path, nil, &response); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%s: %s\n", flags.Arg(0), response.Status)
+	return 0
+}
+
+func crawl(ctx context.Context, args []string) int {
+	flags := flags("crawl")
+	force := flags.Bool("force", false, "search every task again")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var response struct {
+		Status string `json:"status"`
+	}
+	path := fmt.Sprintf("/api/admin/users/%s/crawl?force=%t", url.PathEscape(flags.Arg(0)), *force)
+	if err := flags.Client().Do(ctx, http.MethodPost, path, nil, &response); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%s: crawl %s\n", flags.Arg(0), response.Status)
+	return 0
+}
+
+func patch(ctx context.Context, args []string) int {
+	flags := flags("patch")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	var body json.RawMessage
+	if err := json.Unmarshal([]byte(flags.Arg(1)), &body); err != nil {
+		return fail(fmt.Errorf("patch is not JSON: %w", err))
+	}
+
+	var response struct {
+		Status string `json:"status"`
+	}
+	if err := flags.Client().Do(ctx, http.MethodPatch, "/api/admin/users/"+url.PathEscape(flags.Arg(0)), body, &response); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%s: %s\n", flags.Arg(0), response.Status)
+	return 0
+}
+
+func send(ctx context.Context, args []string) int {
+	flags := flags("send")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	body := map[string]any{"action": flags.Arg(1)}
+	if flags.NArg() == 3 {
+		var data any
+		if err := json.Unmarshal([]byte(flags.Arg(2)), &data); err != nil {
+			data = flags.Arg(2)
+		}
+		body["data"] = data
+	}
+
+	var response struct {
+		Instance string `json:"instance"`
+	}
+	path := fmt.Sprintf("/api/admin/users/%s/command", url.PathEscape(flags.Arg(0)))
+	if err := flags.Client().Do(ctx, http.MethodPost, path, body, &response); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("%s: sent %s through %s\n", flags.Arg(0), flags.Arg(1), response.Instance)
+	return 0
+}
+
+// erase goes through the server, which drops the participant from every
+// instance before it answers with the receipt.
+func erase(ctx context.Context, args []string) int {
+	flags     := flags("erase")
+	anonymise := flags.Bool("anonymise", false, "keep searches under a random ID")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	mode := gdpr.ModeErase
+	if *anonymise {
+		mode = gdpr.ModeAnonymise
+	}
+
+	var response struct {
+		Receipt *gdpr.Receipt `json:"receipt"`
+	}
+	path := fmt.Sprintf("/api/admin/participants/%s?mode=%s", url.PathEscape(flags.Arg(0)), mode)
+	if err := flags.Client().Do(ctx, http.MethodDelete, path, nil, &response); err != nil {
+		return fail(err)
+	}
+
+	printJSON(response.Receipt)
+	return 0
+}
@@ -0,0 +1,300 @@
+package schema
+
+import (
+	"dse/src/core/models"
+	"dse/src/utils/parquet"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cohesivestack/valgo"
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Type string
+
+const (
+	TypeDropdown      Type = "dropdown"       // One option
+	TypeDropdownMulti Type = "dropdown-multi" // Any number of options
+	TypePostcode      Type = "postcode"       // {"value": "..."}
+	TypeText          Type = "text"           // Free text
+)
+
+// Schema describes the demographic questionnaire. It is loaded from
+// config/form.json, which is the only place questions, options and required
+// flags are defined; parsing, validation and export columns follow from it.
+type Schema struct {
+	Version   string      `json:"version"`
+	Submitted string      `json:"submitted"` // Question whose answer marks the form as submitted
+	Questions []*Question `json:"questions"`
+}
+
+type Question struct {
+	Name     string            `json:"name"`
+	Type     Type              `json:"type"`
+	Required bool              `json:"required"` // Required once the form is submitted
+	Question map[string]string `json:"question"` // Text per language
+	Options  []*Option         `json:"options,omitempty"`
+	Pattern  string            `json:"pattern,omitempty"` // Postcode and text answers
+
+	pattern *regexp.Regexp
+	values  []string
+}
+
+type Option struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+// Column is one export column generated from the schema. Multiple choice
+// questions get one boolean column per option, named <question>_<option>.
+type Column struct {
+	Name     string
+	Kind     parquet.Kind
+	Question string
+	Option   string
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	path = "config/form.json"
+
+	mutex    sync.Mutex
+	current  *Schema
+	modified time.Time
+
+	// Errors
+	ErrInvalidSchema = errors.New("invalid form schema")
+)
+
+// ------------------------------------------------------------
+// : Load
+// ------------------------------------------------------------
+
+// Current returns the schema in config/form.json. The file is read again
+// when it changes, so the questionnaire can be updated without a restart.
+func Current() (*Schema, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && info.ModTime().Equal(modified) {
+		return current, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	current  = schema
+	modified = info.ModTime()
+	return current, nil
+}
+
+// Parse decodes and checks a schema.
+func Parse(b []byte) (*Schema, error) {
+	schema := &Schema{}
+	if err := json.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	if schema.Version == "" {
+		return nil, fmt.Errorf("%w: missing version", ErrInvalidSchema)
+	}
+
+	names := map[string]bool{"version": true, "token": true}
+	for _, question := range schema.Questions {
+		if names[question.Name] {
+			return nil, fmt.Errorf("%w: duplicate or reserved question %q", ErrInvalidSchema, question.Name)
+		}
+		names[question.Name] = true
+
+		switch question.Type {
+			case TypeDropdown, TypeDropdownMulti:
+				if len(question.Options) == 0 {
+					return nil, fmt.Errorf("%w: question %q has no options", ErrInvalidSchema, question.Name)
+				}
+			case TypePostcode, TypeText:
+			default:
+				return nil, fmt.Errorf("%w: question %q has unknown type %q", ErrInvalidSchema, question.Name, question.Type)
+		}
+
+		for _, option := range question.Options {
+			question.values = append(question.values, option.Value)
+		}
+
+		if question.Pattern != "" {
+			pattern, err := regexp.Compile(question.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%w: question %q: %v", ErrInvalidSchema, question.Name, err)
+			}
+			question.pattern = pattern
+		}
+	}
+
+	if schema.Submitted != "" && !names[schema.Submitted] {
+		return nil, fmt.Errorf("%w: unknown submitted question %q", ErrInvalidSchema, schema.Submitted)
+	}
+
+	return schema, nil
+}
+
+// ------------------------------------------------------------
+// : Answers
+// ------------------------------------------------------------
+
+// Read builds a form from the answers sent by a client. Only questions in
+// the schema are read; anything else is ignored.
+func (s *Schema) Read(answers gjson.Result) *models.Form {
+	form := models.NewForm()
+	form.Version = s.Version
+
+	for _, question := range s.Questions {
+		value := answers.Get(question.Name)
+
+		switch question.Type {
+			case TypeDropdown, TypeText: form.SetText(question.Name, value.String())
+			case TypePostcode          : form.SetPostcode(question.Name, value.Get("value").String())
+			case TypeDropdownMulti     : {
+				selected := map[string]bool{}
+				value.ForEach(func(option, checked gjson.Result) bool {
+					selected[option.String()] = checked.Bool()
+					return true
+				})
+				form.SetSelected(question.Name, selected)
+			}
+		}
+	}
+
+	return form
+}
+
+// IsSubmitted reports whether the participant submitted the form.
+func (s *Schema) IsSubmitted(form *models.Form) bool {
+	return s.Submitted != "" && form.Text(s.Submitted) != ""
+}
+
+// Submitted reports whether a user submitted the current form.
+func Submitted(user *models.User) bool {
+	current, err := Current()
+	if err != nil || user.State.Client.User.Form == nil {
+		return false
+	}
+	return current.IsSubmitted(user.State.Client.User.Form)
+}
+
+// Validate checks every answer against its question. Empty answers are
+// allowed until the form is submitted, after which required questions must
+// be answered.
+func (s *Schema) Validate(form *models.Form) *valgo.Validation {
+	v         := valgo.New()
+	submitted := s.IsSubmitted(form)
+
+	for _, question := range s.Questions {
+		required := submitted && question.Required
+
+		switch question.Type {
+			case TypeDropdown: {
+				value := form.Text(question.Name)
+				if value != "" {
+					v.Is(valgo.String(value, question.Name).InSlice(question.values))
+				} else if required {
+					v.Is(valgo.String(value, question.Name).Not().Blank())
+				}
+			}
+			case TypePostcode, TypeText: {
+				value := form.Text(question.Name)
+				if value != "" && question.pattern != nil {
+					v.Is(valgo.String(value, question.Name).MatchingTo(question.pattern))
+				} else if required {
+					v.Is(valgo.String(value, question.Name).Not().Blank())
+				}
+			}
+			case TypeDropdownMulti: {
+				selected := form.Selected(question.Name)
+				for option := range selected {
+					v.Is(valgo.String(option, question.Name).InSlice(question.values))
+				}
+				if required {
+					v.Is(valgo.Bool(len(selected) > 0, question.Name).True())
+				}
+			}
+		}
+	}
+
+	return v
+}
+
+// ------------------------------------------------------------
+// : Export
+// ------------------------------------------------------------
+
+// Columns lists the export columns in question order.
+func (s *Schema) Columns() []*Column {
+	columns := []*Column{}
+	for _, question := range s.Questions {
+		if question.Type != TypeDropdownMulti {
+			columns = append(columns, &Column{Name: question.Name, Kind: parquet.String, Question: question.Name})
+			continue
+		}
+
+		for _, option := range question.Options {
+			columns = append(columns, &Column{
+				Name    : question.Name + "_" + option.Value,
+				Kind    : parquet.Boolean,
+				Question: question.Name,
+				Option  : option.Value,
+			})
+		}
+	}
+	return columns
+}
+
+// Value returns the value of a column for a form.
+func (c *Column) Value(form *models.Form) any {
+	if c.Option != "" {
+		return form.Selected(c.Question)[c.Option]
+	}
+	return form.Text(c.Question)
+}
+
+// ------------------------------------------------------------
+// : Update
+// ------------------------------------------------------------
+
+// Update reads the answers sent by a client and stores them on the user's
+// form, tagged with the schema version. Invalid answers leave the stored
+// form unchanged; the failed validation is returned.
+func Update(user *models.User, answers gjson.Result) (*valgo.Validation, error) {
+	current, err := Current()
+	if err != nil {
+		return nil, err
+	}
+
+	form := current.Read(answers)
+	v    := current.Validate(form)
+	if v.Valid() {
+		user.State.Client.User.Form = form
+	}
+
+	return v, nil
+}
@@ -0,0 +1,64 @@
+package analysis
+
+import (
+	"context"
+	"dse/src/core/log"
+	"dse/src/core/services/progress"
+	"errors"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Kinds
+// ------------------------------------------------------------
+const (
+	KindOverlap = "overlap"
+)
+
+// ------------------------------------------------------------
+// : Overlap
+// ------------------------------------------------------------
+
+// GetOverlap returns the stored overlap report of a week, computing and storing
+// it first when there is none or refresh is set.
+func GetOverlap(ctx context.Context, period progress.Period, refresh bool) (*OverlapReport, error) {
+	report := &OverlapReport{}
+	if !refresh {
+		err := Load(ctx, KindOverlap, period.ISOWeek(), report)
+		if err == nil {
+			return report, nil
+		}
+		if !errors.Is(err, ErrReportNotFound) {
+			return nil, err
+		}
+	}
+
+	report, err := ComputeOverlap(ctx, period)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Save(ctx, KindOverlap, report.Week, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ------------------------------------------------------------
+// : Schedule
+// ------------------------------------------------------------
+
+// Weekly computes the reports of the week that just ended. The scheduler
+// runs it early on Monday, after the last uploads of Sunday are stored.
+func Weekly() {
+	ctx    := context.Background()
+	period := progress.Week(time.Now().AddDate(0, 0, -7))
+
+	report, err := GetOverlap(ctx, period, true)
+	if err != nil {
+		log.Error().Err(err).Str("week", period.ISOWeek()).Msg("Failed to compute overlap report")
+		return
+	}
+
+	log.Info().Str("week", report.Week).Int("cells", len(report.Overlaps)).Msg("Computed overlap report")
+}
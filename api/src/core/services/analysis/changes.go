@@ -0,0 +1,538 @@
+package analysis
+
+import (
+	"context"
+	"dse/src/core/log"
+	"dse/src/core/services/db"
+	"dse/src/core/services/progress"
+	"dse/src/core/sources"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Change string
+
+const (
+	ChangeAdded   Change = "added"
+	ChangeRemoved Change = "removed"
+	ChangeMoved   Change = "moved"
+)
+
+// Diff compares one capture with the previous capture of the same keyword
+// on the same engine by the same participant. The first capture has no
+// previous one and lists every result as added.
+type Diff struct {
+	ID         int64      `json:"id"`       // Search id of the capture
+	Previous   *int64     `json:"previous"` // Search id of the capture before it
+	Token      string     `json:"token"`
+	Keyword    string     `json:"keyword"`
+	Engine     string     `json:"engine"`
+	CapturedAt time.Time  `json:"captured_at"`
+	PreviousAt *time.Time `json:"previous_at"`
+
+	Jaccard   float64 `json:"jaccard"`
+	RBO       float64 `json:"rbo"`
+	Added     int     `json:"added"`
+	Removed   int     `json:"removed"`
+	Moved     int     `json:"moved"`
+	Unchanged int     `json:"unchanged"`
+	Shift     float64 `json:"shift"` // Mean absolute rank change of moved results
+
+	DomainsAdded   []string `json:"domains_added"`
+	DomainsRemoved []string `json:"domains_removed"`
+
+	Changes []*ResultChange `json:"changes,omitempty"`
+}
+
+// ResultChange is one result that appeared, disappeared or changed rank.
+// Ranks start at 1.
+type ResultChange struct {
+	Link     string `json:"link"`
+	Domain   string `json:"domain"`
+	Change   Change `json:"change"`
+	Previous *int   `json:"previous_rank"`
+	Current  *int   `json:"current_rank"`
+}
+
+// Volatility summarises how much results for one keyword on one engine
+// changed between consecutive captures.
+type Volatility struct {
+	Keyword     string   `json:"keyword"`
+	Engine      string   `json:"engine"`
+	Comparisons int      `json:"comparisons"`
+	Changed     float64  `json:"changed"` // Share of comparisons with any change
+	Jaccard     float64  `json:"jaccard"` // Mean
+	RBO         float64  `json:"rbo"`     // Mean
+	Added       float64  `json:"added"`   // Mean per comparison
+	Removed     float64  `json:"removed"` // Mean per comparison
+	Shift       float64  `json:"shift"`   // Mean over comparisons with moved results
+	Entering    []*Count `json:"entering"` // Domains that entered most often
+	Leaving     []*Count `json:"leaving"`  // Domains that left most often
+}
+
+type Count struct {
+	Domain string `json:"domain"`
+	Count  int64  `json:"count"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Captures compared per statement
+	diffBatch = 200
+
+	// Domains listed per keyword in volatility reports
+	topDomains = 10
+)
+
+// ------------------------------------------------------------
+// : Compare
+// ------------------------------------------------------------
+
+// Compare diffs two ranked, de-duplicated lists of links. previous is nil
+// for a first capture.
+func Compare(previous []string, current []string) *Diff {
+	diff := &Diff{
+		RBO           : 1,
+		Jaccard       : 1,
+		DomainsAdded  : []string{},
+		DomainsRemoved: []string{},
+		Changes       : []*ResultChange{},
+	}
+
+	if previous != nil {
+		diff.Jaccard = Jaccard(previous, current)
+		diff.RBO     = RBO(previous, current)
+	}
+
+	ranks := make(map[string]int, len(previous))
+	for i, link := range previous {
+		ranks[link] = i + 1
+	}
+
+	shift := 0
+	for i, link := range current {
+		rank := i + 1
+
+		before, ok := ranks[link]
+		switch {
+			case !ok: {
+				diff.Added += 1
+				diff.Changes = append(diff.Changes, &ResultChange{Link: link, Change: ChangeAdded, Current: &rank})
+			}
+			case before != rank: {
+				diff.Moved += 1
+				shift      += int(math.Abs(float64(before - rank)))
+				diff.Changes = append(diff.Changes, &ResultChange{Link: link, Change: ChangeMoved, Previous: &before, Current: &rank})
+			}
+			default: diff.Unchanged += 1
+		}
+		delete(ranks, link)
+	}
+
+	for i, link := range previous {
+		if _, ok := ranks[link]; ok {
+			rank := i + 1
+			diff.Removed += 1
+			diff.Changes = append(diff.Changes, &ResultChange{Link: link, Change: ChangeRemoved, Previous: &rank})
+		}
+	}
+
+	if diff.Moved > 0 {
+		diff.Shift = float64(shift) / float64(diff.Moved)
+	}
+
+	before, after := domains(previous), domains(current)
+	for domain := range after {
+		if !before[domain] {
+			diff.DomainsAdded = append(diff.DomainsAdded, domain)
+		}
+	}
+	for domain := range before {
+		if !after[domain] {
+			diff.DomainsRemoved = append(diff.DomainsRemoved, domain)
+		}
+	}
+	sort.Strings(diff.DomainsAdded)
+	sort.Strings(diff.DomainsRemoved)
+
+	for _, change := range diff.Changes {
+		change.Domain = sources.Domain("https://" + change.Link)
+	}
+
+	return diff
+}
+
+func domains(links []string) map[string]bool {
+	set := map[string]bool{}
+	for _, link := range links {
+		if domain := sources.Domain("https://" + link); domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+// ------------------------------------------------------------
+// : Job
+// ------------------------------------------------------------
+
+// DiffCaptures compares every capture that has not been compared yet with
+// the capture before it, in id order, and stores the result. It returns the
+// number of captures compared.
+//
+// Captures are walked up to db.SettledSearch, so one that commits late is
+// not skipped. A capture can still be older than captures compared before it
+// arrived (an upload that was retried, for example); the capture after it is
+// then compared again with the new one.
+func DiffCaptures(ctx context.Context) (int, error) {
+	pool  := db.GetConnection()
+	total := 0
+
+	settled, err := db.SettledSearch(ctx)
+	if err != nil {
+		return total, err
+	}
+
+	for {
+		var last int64
+		if err := pool.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM result_diffs`).Scan(&last); err != nil {
+			return total, err
+		}
+
+		diffs, err := compare(ctx, `
+		s.id > $1 AND s.id <= $2 AND s.timestamp IS NOT NULL AND s.metadata->>'keyword' IS NOT NULL AND s.metadata->>'website' IS NOT NULL
+		ORDER BY s.id
+		LIMIT $3`, last, settled, diffBatch)
+		if err != nil {
+			return total, err
+		}
+
+		if len(diffs) == 0 {
+			return total, nil
+		}
+
+		successors, err := successors(ctx, diffs, last)
+		if err != nil {
+			return total, err
+		}
+
+		if len(successors) > 0 {
+			again, err := compare(ctx, `s.id = ANY($1)`, successors)
+			if err != nil {
+				return total, err
+			}
+			diffs = append(diffs, again...)
+		}
+
+		if err := store(ctx, diffs); err != nil {
+			return total, err
+		}
+		total += len(diffs)
+	}
+}
+
+// compare diffs the captures matched by where (on searches s) with the
+// capture before each of them.
+func compare(ctx context.Context, where string, args ...any) ([]*Diff, error) {
+	rows, err := db.GetConnection().Query(ctx, `
+	SELECT
+		s.id, s.token, s.metadata->>'keyword', s.metadata->>'website', s.timestamp, s.metadata->'results'->'search_result',
+		p.id, p.timestamp, p.metadata->'results'->'search_result'
+	FROM searches s
+	LEFT JOIN LATERAL (
+		SELECT id, timestamp, metadata FROM searches
+		WHERE
+			token                 = s.token                 AND
+			metadata->>'keyword'  = s.metadata->>'keyword'  AND
+			metadata->>'website'  = s.metadata->>'website'  AND
+			(timestamp, id)       < (s.timestamp, s.id)
+		ORDER BY timestamp DESC, id DESC
+		LIMIT 1
+	) p ON TRUE
+	WHERE ` + where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	diffs := []*Diff{}
+	for rows.Next() {
+		var id         int64
+		var token      string
+		var keyword    string
+		var engine     string
+		var capturedAt time.Time
+		var results    []byte
+		var previous   *int64
+		var previousAt *time.Time
+		var before     []byte
+
+		if err := rows.Scan(&id, &token, &keyword, &engine, &capturedAt, &results, &previous, &previousAt, &before); err != nil {
+			return nil, err
+		}
+
+		var links []string
+		if previous != nil {
+			links = Links(gjson.ParseBytes(before))
+		}
+
+		diff := Compare(links, Links(gjson.ParseBytes(results)))
+		diff.ID         = id
+		diff.Previous   = previous
+		diff.Token      = token
+		diff.Keyword    = keyword
+		diff.Engine     = engine
+		diff.CapturedAt = capturedAt
+		diff.PreviousAt = previousAt
+		diffs = append(diffs, diff)
+	}
+
+	return diffs, rows.Err()
+}
+
+// successors returns the captures that directly follow one of the diffs but
+// were compared in an earlier run, before the diffed capture existed.
+func successors(ctx context.Context, diffs []*Diff, last int64) ([]int64, error) {
+	ids := make([]int64, len(diffs))
+	for i, d := range diffs {
+		ids[i] = d.ID
+	}
+
+	rows, err := db.GetConnection().Query(ctx, `
+	SELECT DISTINCT n.id
+	FROM searches s
+	JOIN LATERAL (
+		SELECT id FROM searches
+		WHERE
+			token                 = s.token                 AND
+			metadata->>'keyword'  = s.metadata->>'keyword'  AND
+			metadata->>'website'  = s.metadata->>'website'  AND
+			(timestamp, id)       > (s.timestamp, s.id)
+		ORDER BY timestamp, id
+		LIMIT 1
+	) n ON TRUE
+	WHERE s.id = ANY($1) AND n.id <= $2`, ids, last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		list = append(list, id)
+	}
+
+	return list, rows.Err()
+}
+
+func store(ctx context.Context, diffs []*Diff) error {
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	for _, d := range diffs {
+		batch.Queue(`
+			INSERT INTO result_diffs (id, previous, token, keyword, engine, captured_at, previous_at,
+				jaccard, rbo, added, removed, moved, unchanged, shift, domains_added, domains_removed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+			ON CONFLICT (id) DO UPDATE SET
+				previous        = EXCLUDED.previous,
+				token           = EXCLUDED.token,
+				previous_at     = EXCLUDED.previous_at,
+				jaccard         = EXCLUDED.jaccard,
+				rbo             = EXCLUDED.rbo,
+				added           = EXCLUDED.added,
+				removed         = EXCLUDED.removed,
+				moved           = EXCLUDED.moved,
+				unchanged       = EXCLUDED.unchanged,
+				shift           = EXCLUDED.shift,
+				domains_added   = EXCLUDED.domains_added,
+				domains_removed = EXCLUDED.domains_removed`,
+			d.ID, d.Previous, d.Token, d.Keyword, d.Engine, d.CapturedAt, d.PreviousAt,
+			d.Jaccard, d.RBO, d.Added, d.Removed, d.Moved, d.Unchanged, d.Shift, d.DomainsAdded, d.DomainsRemoved,
+		)
+
+		// The watermark goes back when the newest diffs are erased, so a
+		// capture can be compared again
+		batch.Queue(`DELETE FROM result_changes WHERE diff = $1`, d.ID)
+
+		// First captures are all additions; only real changes are stored
+		if d.Previous == nil {
+			continue
+		}
+		for _, c := range d.Changes {
+			batch.Queue(`
+				INSERT INTO result_changes (diff, link, domain, change, previous_rank, current_rank)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				d.ID, c.Link, c.Domain, c.Change, c.Previous, c.Current,
+			)
+		}
+	}
+
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RunDiffs is the scheduled job.
+func RunDiffs() {
+	compared, err := DiffCaptures(context.Background())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to diff captures")
+		return
+	}
+	if compared > 0 {
+		log.Info().Int("captures", compared).Msg("Diffed captures")
+	}
+}
+
+// ------------------------------------------------------------
+// : Queries
+// ------------------------------------------------------------
+
+// History returns the diffs of one participant for a keyword and engine,
+// oldest first, with the individual result changes.
+func History(ctx context.Context, token string, keyword string, engine string) ([]*Diff, error) {
+	pool := db.GetConnection()
+
+	rows, err := pool.Query(ctx, `
+		SELECT id, previous, token, keyword, engine, captured_at, previous_at,
+			jaccard, rbo, added, removed, moved, unchanged, shift, domains_added, domains_removed
+		FROM result_diffs
+		WHERE token = $1 AND keyword = $2 AND engine = $3
+		ORDER BY captured_at, id`, token, keyword, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []*Diff{}
+	index := map[int64]*Diff{}
+	for rows.Next() {
+		d := &Diff{Changes: []*ResultChange{}}
+		if err := rows.Scan(&d.ID, &d.Previous, &d.Token, &d.Keyword, &d.Engine, &d.CapturedAt, &d.PreviousAt,
+			&d.Jaccard, &d.RBO, &d.Added, &d.Removed, &d.Moved, &d.Unchanged, &d.Shift, &d.DomainsAdded, &d.DomainsRemoved); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		diffs       = append(diffs, d)
+		index[d.ID] = d
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = pool.Query(ctx, `
+		SELECT c.diff, c.link, c.domain, c.change, c.previous_rank, c.current_rank
+		FROM result_changes c JOIN result_diffs d ON d.id = c.diff
+		WHERE d.token = $1 AND d.keyword = $2 AND d.engine = $3
+		ORDER BY c.diff, COALESCE(c.current_rank, c.previous_rank)`, token, keyword, engine)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		c := &ResultChange{}
+		if err := rows.Scan(&id, &c.Link, &c.Domain, &c.Change, &c.Previous, &c.Current); err != nil {
+			return nil, err
+		}
+		if d, ok := index[id]; ok {
+			d.Changes = append(d.Changes, c)
+		}
+	}
+
+	return diffs, rows.Err()
+}
+
+// Volatilities summarises the diffs of captures taken in a period per
+// keyword and engine. First captures are not comparisons and are left out.
+func Volatilities(ctx context.Context, period progress.Period) ([]*Volatility, error) {
+	pool := db.GetConnection()
+
+	rows, err := pool.Query(ctx, `
+		SELECT keyword, engine, COUNT(*),
+			AVG(CASE WHEN added + removed + moved > 0 THEN 1 ELSE 0 END),
+			AVG(jaccard), AVG(rbo), AVG(added), AVG(removed),
+			COALESCE(AVG(shift) FILTER (WHERE moved > 0), 0)
+		FROM result_diffs
+		WHERE previous IS NOT NULL AND captured_at >= $1 AND captured_at < $2
+		GROUP BY keyword, engine
+		ORDER BY keyword, engine`, period.Start, period.End)
+	if err != nil {
+		return nil, err
+	}
+
+	list  := []*Volatility{}
+	index := map[[2]string]*Volatility{}
+	for rows.Next() {
+		v := &Volatility{Entering: []*Count{}, Leaving: []*Count{}}
+		if err := rows.Scan(&v.Keyword, &v.Engine, &v.Comparisons, &v.Changed, &v.Jaccard, &v.RBO, &v.Added, &v.Removed, &v.Shift); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, v)
+		index[[2]string{v.Keyword, v.Engine}] = v
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = pool.Query(ctx, `
+		SELECT keyword, engine, direction, domain, count FROM (
+			SELECT keyword, engine, direction, domain, COUNT(*) AS count,
+				ROW_NUMBER() OVER (PARTITION BY keyword, engine, direction ORDER BY COUNT(*) DESC, domain) AS position
+			FROM (
+				SELECT keyword, engine, 'entering' AS direction, unnest(domains_added) AS domain
+				FROM result_diffs WHERE previous IS NOT NULL AND captured_at >= $1 AND captured_at < $2
+				UNION ALL
+				SELECT keyword, engine, 'leaving' AS direction, unnest(domains_removed) AS domain
+				FROM result_diffs WHERE previous IS NOT NULL AND captured_at >= $1 AND captured_at < $2
+			) moves
+			GROUP BY keyword, engine, direction, domain
+		) ranked
+		WHERE position <= $3
+		ORDER BY keyword, engine, direction, position`, period.Start, period.End, topDomains)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var keyword, engine, direction string
+		count := &Count{}
+		if err := rows.Scan(&keyword, &engine, &direction, &count.Domain, &count.Count); err != nil {
+			return nil, err
+		}
+
+		v, ok := index[[2]string{keyword, engine}]
+		if !ok {
+			continue
+		}
+		switch direction {
+			case "entering": v.Entering = append(v.Entering, count)
+			case "leaving" : v.Leaving  = append(v.Leaving, count)
+		}
+	}
+
+	return list, rows.Err()
+}
@@ -0,0 +1,79 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ------------------------------------------------------------
+// : Tests
+// ------------------------------------------------------------
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name      string
+		previous  []string
+		current   []string
+		added     int
+		removed   int
+		moved     int
+		unchanged int
+		shift     float64
+	}{
+		{"first capture", nil                              , []string{"a.nl/1", "b.nl/2"}              , 2, 0, 0, 0, 0},
+		{"identical"    , []string{"a.nl/1", "b.nl/2"}     , []string{"a.nl/1", "b.nl/2"}              , 0, 0, 0, 2, 0},
+		{"disjoint"     , []string{"a.nl/1", "b.nl/2"}     , []string{"c.nl/3", "d.nl/4"}              , 2, 2, 0, 0, 0},
+		{"swapped"      , []string{"a.nl/1", "b.nl/2"}     , []string{"b.nl/2", "a.nl/1"}              , 0, 0, 2, 0, 1},
+
+		// a 1 -> 2, b 2 -> 1, c 3 -> 4: three moves of one rank; e is new
+		// and d is gone
+		{"mixed"        , []string{"a.nl/1", "b.nl/2", "c.nl/3", "d.nl/4"}, []string{"b.nl/2", "a.nl/1", "e.nl/5", "c.nl/3"}, 1, 1, 3, 0, 1},
+
+		// a drops from 1 to 3 and c rises from 3 to 1; b stays
+		{"jump"         , []string{"a.nl/1", "b.nl/2", "c.nl/3"}, []string{"c.nl/3", "b.nl/2", "a.nl/1"}, 0, 0, 2, 1, 2},
+	}
+
+	for _, test := range tests {
+		diff := Compare(test.previous, test.current)
+
+		got  := []any{diff.Added, diff.Removed, diff.Moved, diff.Unchanged, diff.Shift}
+		want := []any{test.added, test.removed, test.moved, test.unchanged, test.shift}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: added, removed, moved, unchanged, shift = %v, want %v", test.name, got, want)
+		}
+
+		if len(diff.Changes) != test.added + test.removed + test.moved {
+			t.Errorf("%s: %d changes, want %d", test.name, len(diff.Changes), test.added + test.removed + test.moved)
+		}
+	}
+}
+
+func TestCompareChanges(t *testing.T) {
+	previous := []string{"www.nu.nl/a", "nos.nl/b", "nos.nl/c"}
+	current  := []string{"nos.nl/c", "nos.nl/b", "www.ad.nl/d"}
+
+	diff := Compare(previous, current)
+
+	rank := func(r int) *int { return &r }
+	want := []*ResultChange{
+		{Link: "nos.nl/c"   , Domain: "nos.nl", Change: ChangeMoved  , Previous: rank(3), Current: rank(1)},
+		{Link: "www.ad.nl/d", Domain: "ad.nl" , Change: ChangeAdded  , Current : rank(3)},
+		{Link: "www.nu.nl/a", Domain: "nu.nl" , Change: ChangeRemoved, Previous: rank(1)},
+	}
+	if !reflect.DeepEqual(diff.Changes, want) {
+		for _, c := range diff.Changes {
+			t.Logf("%+v", *c)
+		}
+		t.Fatal("changes differ")
+	}
+
+	if !reflect.DeepEqual(diff.DomainsAdded, []string{"ad.nl"}) || !reflect.DeepEqual(diff.DomainsRemoved, []string{"nu.nl"}) {
+		t.Errorf("domains added %v, removed %v", diff.DomainsAdded, diff.DomainsRemoved)
+	}
+
+	if !near(diff.Jaccard, 2.0 / 4) {
+		t.Errorf("Jaccard = %v, want 0.5", diff.Jaccard)
+	}
+	if !near(diff.RBO, RBO(previous, current)) {
+		t.Errorf("RBO = %v, want %v", diff.RBO, RBO(previous, current))
+	}
+}
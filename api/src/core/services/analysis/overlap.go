@@ -0,0 +1,415 @@
+package analysis
+
+import (
+	"context"
+	"dse/src/core/models"
+	"dse/src/core/services/consent"
+	"dse/src/core/services/db"
+	"dse/src/core/services/progress"
+	"dse/src/core/sources"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Summary aggregates the similarity of a set of participant pairs.
+type Summary struct {
+	Pairs   int     `json:"pairs"`
+	Jaccard float64 `json:"jaccard"` // Mean
+	RBO     float64 `json:"rbo"`     // Mean
+}
+
+// Group compares pairs of participants that share a demographic value with
+// pairs where only one of them has it. Lower similarity within than between
+// would mean the group sees results of its own.
+type Group struct {
+	Dimension    string   `json:"dimension"`
+	Value        string   `json:"value"`
+	Participants int      `json:"participants"`
+	Within       *Summary `json:"within,omitempty"`  // Omitted for groups below the minimum size
+	Between      *Summary `json:"between,omitempty"`
+}
+
+// Overlap is the similarity of result lists for one keyword on one engine.
+type Overlap struct {
+	Keyword      string   `json:"keyword"`
+	Engine       string   `json:"engine"`
+	Participants int      `json:"participants"`
+	Results      float64  `json:"results"` // Mean list length
+	All          *Summary `json:"all"`
+	Groups       []*Group `json:"groups"`
+
+	// Mean share of results per source tag and value, such as
+	// sources["type"]["newspaper"]; results from unlisted domains count as
+	// "unknown"
+	Sources map[string]map[string]float64 `json:"sources"`
+}
+
+// OverlapReport covers every keyword and engine in one week.
+type OverlapReport struct {
+	Week       string          `json:"week"`
+	Period     progress.Period `json:"period"`
+	Computed   time.Time       `json:"computed"`
+	Dimensions []string        `json:"dimensions"`
+	SourceList string          `json:"source_list"` // Version of config/sources.json
+	MinGroup   int             `json:"min_group"`
+	Overlaps   []*Overlap      `json:"overlaps"`
+}
+
+// list is the result list one participant got for one keyword and engine.
+type list struct {
+	token  string
+	links  []string
+	groups map[string]string             // Dimension -> value
+	shares map[string]map[string]float64 // Source tag -> value -> share of links
+}
+
+type accumulator struct {
+	pairs   int
+	jaccard float64
+	rbo     float64
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Demographics that overlap is broken down by, read from the form
+	dimensions = map[string]func(form *models.Form) string{
+		"political": func(form *models.Form) string { return form.Text("political") },
+		"age"      : func(form *models.Form) string { return form.Text("age") },
+		"region"   : func(form *models.Form) string {
+			// The first digit of a Dutch postcode is the region
+			postcode := form.Text("postcode")
+			if postcode == "" {
+				return ""
+			}
+			return postcode[:1]
+		},
+	}
+
+	// Query parameters that identify a click rather than a page
+	tracking = map[string]bool{"gclid": true, "fbclid": true, "msclkid": true, "ved": true, "sa": true, "usg": true}
+
+	// Groups smaller than this are reported without similarities, so no
+	// statistic describes only a handful of identifiable participants
+	minGroup = 5
+)
+
+// ------------------------------------------------------------
+// : Overlap
+// ------------------------------------------------------------
+
+// ComputeOverlap compares the result lists of every pair of consenting
+// participants per keyword and engine in one week. Each participant
+// contributes their latest search of the week.
+func ComputeOverlap(ctx context.Context, period progress.Period) (*OverlapReport, error) {
+	catalogue, err := sources.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	lists, err := load(ctx, period, catalogue)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OverlapReport{
+		Week      : period.ISOWeek(),
+		Period    : period,
+		Computed  : time.Now().UTC(),
+		Dimensions: names(),
+		SourceList: catalogue.Version,
+		MinGroup  : minGroup,
+		Overlaps  : []*Overlap{},
+	}
+
+	for cell, entries := range lists {
+		report.Overlaps = append(report.Overlaps, overlap(cell[0], cell[1], entries))
+	}
+
+	sort.Slice(report.Overlaps, func(i, j int) bool {
+		a, b := report.Overlaps[i], report.Overlaps[j]
+		if a.Keyword != b.Keyword {
+			return a.Keyword < b.Keyword
+		}
+		return a.Engine < b.Engine
+	})
+
+	return report, nil
+}
+
+func overlap(keyword string, engine string, lists []*list) *Overlap {
+	o := &Overlap{
+		Keyword     : keyword,
+		Engine      : engine,
+		Participants: len(lists),
+		Groups      : []*Group{},
+		Sources     : map[string]map[string]float64{},
+	}
+
+	total := 0
+	for _, l := range lists {
+		total += len(l.links)
+	}
+	if len(lists) > 0 {
+		o.Results = float64(total) / float64(len(lists))
+	}
+
+	for _, l := range lists {
+		for tag, values := range l.shares {
+			if o.Sources[tag] == nil {
+				o.Sources[tag] = map[string]float64{}
+			}
+			for value, share := range values {
+				o.Sources[tag][value] += share / float64(len(lists))
+			}
+		}
+	}
+
+	all     := &accumulator{}
+	within  := map[[2]string]*accumulator{}
+	between := map[[2]string]*accumulator{}
+	sizes   := map[[2]string]int{}
+
+	for _, l := range lists {
+		for dimension, value := range l.groups {
+			sizes[[2]string{dimension, value}] += 1
+		}
+	}
+
+	for i := 0; i < len(lists); i++ {
+		for j := i + 1; j < len(lists); j++ {
+			a, b := lists[i], lists[j]
+
+			jaccard := Jaccard(a.links, b.links)
+			rbo     := RBO(a.links, b.links)
+			all.add(jaccard, rbo)
+
+			for dimension := range dimensions {
+				va, vb := a.groups[dimension], b.groups[dimension]
+				switch {
+					case va == "" || vb == "": continue
+					case va == vb            : get(within, dimension, va).add(jaccard, rbo)
+					default: {
+						get(between, dimension, va).add(jaccard, rbo)
+						get(between, dimension, vb).add(jaccard, rbo)
+					}
+				}
+			}
+		}
+	}
+
+	o.All = all.summary()
+
+	for group, size := range sizes {
+		g := &Group{Dimension: group[0], Value: group[1], Participants: size}
+		if size >= minGroup {
+			if acc, ok := within[group];  ok { g.Within  = acc.summary() }
+			if acc, ok := between[group]; ok { g.Between = acc.summary() }
+		}
+		o.Groups = append(o.Groups, g)
+	}
+
+	sort.Slice(o.Groups, func(i, j int) bool {
+		a, b := o.Groups[i], o.Groups[j]
+		if a.Dimension != b.Dimension {
+			return a.Dimension < b.Dimension
+		}
+		return a.Value < b.Value
+	})
+
+	return o
+}
+
+// ------------------------------------------------------------
+// : Load
+// ------------------------------------------------------------
+
+// load returns the latest result list of every consenting participant per
+// keyword and engine in the period.
+func load(ctx context.Context, period progress.Period, catalogue *sources.List) (map[[2]string][]*list, error) {
+	rows, err := db.GetConnection().Query(ctx, `
+	SELECT DISTINCT ON (token, metadata->>'keyword', metadata->>'website')
+		token, metadata->>'keyword', metadata->>'website', metadata->'results'->'search_result'
+	FROM searches
+	WHERE timestamp >= $1 AND timestamp < $2
+	ORDER BY token, metadata->>'keyword', metadata->>'website', timestamp DESC`,
+		period.Start, period.End,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := map[string]map[string]string{}
+	lists  := map[[2]string][]*list{}
+
+	for rows.Next() {
+		var token   string
+		var keyword *string
+		var engine  *string
+		var results []byte
+
+		if err := rows.Scan(&token, &keyword, &engine, &results); err != nil {
+			return nil, err
+		}
+		if keyword == nil || engine == nil || !consent.Has(token) {
+			continue
+		}
+
+		if _, ok := groups[token]; !ok {
+			groups[token] = demographics(token)
+		}
+
+		parsed := gjson.ParseBytes(results)
+		cell   := [2]string{*keyword, *engine}
+		lists[cell] = append(lists[cell], &list{
+			token : token,
+			links : Links(parsed),
+			groups: groups[token],
+			shares: shares(parsed, catalogue),
+		})
+	}
+
+	return lists, rows.Err()
+}
+
+// Links returns the normalised, de-duplicated links of a result list in
+// rank order.
+func Links(results gjson.Result) []string {
+	links := []string{}
+	seen  := map[string]bool{}
+
+	results.ForEach(func(_, result gjson.Result) bool {
+		link := Normalise(sources.Unwrap(result.Get("link").String()))
+		if link != "" && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+		return true
+	})
+
+	return links
+}
+
+// Normalise reduces a link to host, path and query without tracking
+// parameters, so the same page reached with a different scheme, fragment or
+// campaign tag compares equal.
+func Normalise(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	query := u.Query()
+	for name := range query {
+		if strings.HasPrefix(name, "utm_") || tracking[name] {
+			query.Del(name)
+		}
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	if len(query) > 0 {
+		return host + path + "?" + query.Encode()
+	}
+	return host + path
+}
+
+// shares returns the share of results per source tag and value.
+func shares(results gjson.Result, catalogue *sources.List) map[string]map[string]float64 {
+	counts := map[string]map[string]int{}
+	total  := 0
+
+	results.ForEach(func(_, result gjson.Result) bool {
+		link := result.Get("link").String()
+		if link == "" {
+			return true
+		}
+		total += 1
+
+		source := catalogue.Match(link)
+		for _, tag := range sources.Tags {
+			value := "unknown"
+			if source != nil && source.Tag(tag) != "" {
+				value = source.Tag(tag)
+			}
+			if counts[tag] == nil {
+				counts[tag] = map[string]int{}
+			}
+			counts[tag][value] += 1
+		}
+		return true
+	})
+
+	shares := map[string]map[string]float64{}
+	for tag, values := range counts {
+		shares[tag] = map[string]float64{}
+		for value, count := range values {
+			shares[tag][value] = float64(count) / float64(total)
+		}
+	}
+	return shares
+}
+
+func demographics(token string) map[string]string {
+	result := map[string]string{}
+
+	user, err := db.GetUser(token)
+	if err != nil || user.State.Client == nil || user.State.Client.User == nil {
+		return result
+	}
+
+	form := user.State.Client.User.Form
+	for dimension, read := range dimensions {
+		if value := read(form); value != "" && value != "unselected" {
+			result[dimension] = value
+		}
+	}
+	return result
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func names() []string {
+	list := []string{}
+	for dimension := range dimensions {
+		list = append(list, dimension)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func get(m map[[2]string]*accumulator, dimension string, value string) *accumulator {
+	key := [2]string{dimension, value}
+	if _, ok := m[key]; !ok {
+		m[key] = &accumulator{}
+	}
+	return m[key]
+}
+
+func (a *accumulator) add(jaccard float64, rbo float64) {
+	a.pairs   += 1
+	a.jaccard += jaccard
+	a.rbo     += rbo
+}
+
+func (a *accumulator) summary() *Summary {
+	if a.pairs == 0 {
+		return &Summary{}
+	}
+	return &Summary{
+		Pairs  : a.pairs,
+		Jaccard: a.jaccard / float64(a.pairs),
+		RBO    : a.rbo / float64(a.pairs),
+	}
+}
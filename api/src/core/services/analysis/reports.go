@@ -0,0 +1,72 @@
+package analysis
+
+import (
+	"context"
+	"dse/src/core/services/db"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Reports
+// ------------------------------------------------------------
+
+// Reports are computed on a schedule and stored per kind and period (an ISO
+// week), so the API serves them without recomputing pairwise comparisons.
+
+var (
+	// Errors
+	ErrReportNotFound = errors.New("report not found")
+)
+
+// Save stores a report, replacing an earlier one for the same period.
+func Save(ctx context.Context, kind string, period string, report any) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.GetConnection().Exec(ctx, `
+		INSERT INTO reports (kind, period, computed, report) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, period) DO UPDATE SET computed = EXCLUDED.computed, report = EXCLUDED.report`,
+		kind, period, time.Now().UTC(), b,
+	)
+	return err
+}
+
+// Load decodes a stored report into report.
+func Load(ctx context.Context, kind string, period string, report any) error {
+	var b []byte
+
+	err := db.GetConnection().QueryRow(ctx, `SELECT report FROM reports WHERE kind = $1 AND period = $2`, kind, period).Scan(&b)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrReportNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, report)
+}
+
+// Periods lists the periods with a stored report of a kind, newest first.
+func Periods(ctx context.Context, kind string) ([]string, error) {
+	rows, err := db.GetConnection().Query(ctx, `SELECT period FROM reports WHERE kind = $1 ORDER BY period DESC`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := []string{}
+	for rows.Next() {
+		var period string
+		if err := rows.Scan(&period); err != nil {
+			return nil, err
+		}
+		periods = append(periods, period)
+	}
+	return periods, rows.Err()
+}
@@ -0,0 +1,99 @@
+package analysis
+
+// ------------------------------------------------------------
+// : Similarity
+// ------------------------------------------------------------
+
+// Persistence of rank-biased overlap: the weight of the first d ranks is
+// 1 - p^d, so with 0.9 the top 10 results carry about 65% of the weight.
+const persistence = 0.9
+
+// Jaccard returns |a ∩ b| / |a ∪ b| of two result lists, ignoring rank.
+func Jaccard(a []string, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	set := make(map[string]bool, len(a))
+	for _, item := range a {
+		set[item] = true
+	}
+
+	union        := len(set)
+	intersection := 0
+	seen         := make(map[string]bool, len(b))
+	for _, item := range b {
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+
+		if set[item] {
+			intersection += 1
+		} else {
+			union += 1
+		}
+	}
+
+	return float64(intersection) / float64(union)
+}
+
+// RBO returns the extrapolated rank-biased overlap of two ranked lists
+// (Webber, Moffat & Zobel, 2010, eq. 32), which handles lists of different
+// lengths. 1 means identical rankings, 0 disjoint ones. Lists must not
+// contain duplicates.
+func RBO(a []string, b []string) float64 {
+	return rbo(a, b, persistence)
+}
+
+func rbo(a []string, b []string, p float64) float64 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+
+	s, l := len(a), len(b)
+	if s == 0 {
+		if l == 0 {
+			return 1
+		}
+		return 0
+	}
+
+	seenA := make(map[string]bool, s)
+	seenB := make(map[string]bool, l)
+
+	var overlap int     // Overlap at the current depth
+	var overlapS int    // Overlap at depth s
+	var sum float64
+	weight := 1.0       // p^d
+
+	for d := 1; d <= l; d++ {
+		weight *= p
+
+		item := b[d-1]
+		if seenA[item] {
+			overlap += 1
+		}
+		seenB[item] = true
+
+		if d <= s {
+			item = a[d-1]
+			if seenB[item] {
+				overlap += 1
+			}
+			seenA[item] = true
+		}
+
+		if d == s {
+			overlapS = overlap
+		}
+
+		sum += float64(overlap) / float64(d) * weight
+		if d > s {
+			sum += float64(overlapS) * float64(d-s) / float64(s*d) * weight
+		}
+	}
+
+	// weight is p^l here
+	return (1-p)/p*sum + (float64(overlap-overlapS)/float64(l)+float64(overlapS)/float64(s))*weight
+}
@@ -0,0 +1,79 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+)
+
+// Expected values follow Webber, Moffat & Zobel (2010), eq. 32, worked by
+// hand with p = 0.9.
+
+// ------------------------------------------------------------
+// : Tests
+// ------------------------------------------------------------
+func TestJaccard(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want float64
+	}{
+		{"empty"     , nil                      , nil                      , 1},
+		{"identical" , []string{"a", "b", "c"}  , []string{"a", "b", "c"}  , 1},
+		{"reordered" , []string{"a", "b", "c"}  , []string{"c", "a", "b"}  , 1},
+		{"disjoint"  , []string{"a", "b"}       , []string{"c", "d"}       , 0},
+		{"one empty" , []string{"a"}            , nil                      , 0},
+		{"half"      , []string{"a", "b", "c"}  , []string{"b", "c", "d"}  , 2.0 / 4},
+		{"duplicates", []string{"a", "b"}       , []string{"a", "a", "b"}  , 1},
+	}
+
+	for _, test := range tests {
+		if got := Jaccard(test.a, test.b); !near(got, test.want) {
+			t.Errorf("%s: Jaccard = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRBO(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want float64
+	}{
+		{"empty"    , nil                          , nil                          , 1},
+		{"one empty", []string{"a"}                , nil                          , 0},
+		{"identical", []string{"a", "b", "c", "d"} , []string{"a", "b", "c", "d"} , 1},
+		{"disjoint" , []string{"a", "b", "c"}      , []string{"d", "e", "f"}      , 0},
+
+		// A list that is a prefix of the other agrees on everything seen
+		{"prefix"   , []string{"a", "b"}           , []string{"a", "b", "c", "d"} , 1},
+
+		// 1/9 * (2/3 * 0.9^3 + 4/4 * 0.9^4) + 0.9^4
+		{"reversed" , []string{"a", "b", "c", "d"} , []string{"d", "c", "b", "a"} , 0.783},
+
+		// 1/9 * 2/2 * 0.9^2 + 0.9^2
+		{"swapped"  , []string{"a", "b"}           , []string{"b", "a"}           , 0.9},
+
+		// 1/9 * (0.9 + 0.9^2 + 0.9^3 + 3/4 * 0.9^4) + 3/4 * 0.9^4
+		{"last"     , []string{"a", "b", "c", "d"} , []string{"a", "b", "c", "e"} , 0.81775},
+	}
+
+	for _, test := range tests {
+		if got := RBO(test.a, test.b); !near(got, test.want) {
+			t.Errorf("%s: RBO = %v, want %v", test.name, got, test.want)
+		}
+
+		// Symmetric, including for lists of different lengths
+		if got := RBO(test.b, test.a); !near(got, test.want) {
+			t.Errorf("%s: RBO reversed arguments = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// : Helpers
+// ------------------------------------------------------------
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/services/analysis"
+	"dse/src/core/services/progress"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"net/http"
+	"time"
+
+	"github.com/cohesivestack/valgo"
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Analysis
+// ------------------------------------------------------------
+
+// week reads ?week=2025-W10, defaulting to the current week.
+func week(r *http.Request) (progress.Period, error) {
+	if value := r.URL.Query().Get("week"); value != "" {
+		return progress.ParseWeek(value)
+	}
+	return progress.Week(time.Now()), nil
+}
+
+// GetOverlap returns the pairwise overlap of participants' result lists per
+// keyword and engine for a week, broken down by demographics. Stored reports
+// are served as is; ?refresh=true recomputes.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/analysis/overlap?week=2025-W10'
+func GetOverlap(w http.ResponseWriter, r *http.Request) {
+	period, err := week(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := analysis.GetOverlap(r.Context(), period, r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compute overlap report")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to compute overlap report")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"overlap": report})
+}
+
+// GetOverlapWeeks lists the weeks with a stored overlap report.
+func GetOverlapWeeks(w http.ResponseWriter, r *http.Request) {
+	weeks, err := analysis.Periods(r.Context(), analysis.KindOverlap)
+	if err != nil {
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"weeks": weeks})
+}
+
+// GetVolatility returns how much results changed between consecutive
+// captures per keyword and engine, for captures taken in a week.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/analysis/volatility?week=2025-W10'
+func GetVolatility(w http.ResponseWriter, r *http.Request) {
+	period, err := week(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	volatility, err := analysis.Volatilities(r.Context(), period)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compute volatility")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to compute volatility")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"week": period.ISOWeek(), "period": period, "volatility": volatility})
+}
+
+// GetChanges returns every diff of one participant's captures of a keyword
+// on an engine, with the results that were added, removed or moved.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/analysis/changes/{token}?keyword=Asielcrisis&engine=Google'
+func GetChanges(w http.ResponseWriter, r *http.Request) {
+	keyword := r.URL.Query().Get("keyword")
+	engine  := r.URL.Query().Get("engine")
+
+	v := valgo.New()
+	v.Is(valgo.String(keyword, "keyword").Not().Blank())
+	v.Is(valgo.String(engine, "engine").Not().Blank())
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	diffs, err := analysis.History(r.Context(), chi.URLParam(r, "token"), keyword, engine)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load result changes")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to load result changes")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"diffs": diffs})
+}
@@ -0,0 +1,29 @@
+package admin
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/services/cluster"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"net/http"
+)
+
+// ------------------------------------------------------------
+// : Cluster
+// ------------------------------------------------------------
+
+// GetCluster returns every running instance with its latest metrics, the
+// metrics summed over instances and the participants connected to any of
+// them.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/cluster
+func GetCluster(w http.ResponseWriter, r *http.Request) {
+	summary, err := cluster.Aggregate(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to aggregate cluster")
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"cluster": summary})
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/services/consent"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"errors"
+	"net/http"
+
+	"github.com/cohesivestack/valgo"
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Consent
+// ------------------------------------------------------------
+
+// GetConsentTexts returns every published version of the consent text.
+func GetConsentTexts(w http.ResponseWriter, r *http.Request) {
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"texts": consent.Texts()})
+}
+
+// PostConsentText publishes a new version of the consent text. With
+// "reconsent" set, grants of earlier versions stop counting.
+//
+// curl -X POST -H 'Authorization: Bearer $ADMIN_TOKEN' -d '{"version": "2025-03", "text": "...", "reconsent": true}' http://localhost:5000/api/admin/consent/texts
+func PostConsentText(w http.ResponseWriter, r *http.Request) {
+	body, err := httpio.ReadJSON(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	version := body.Get("version").String()
+	text    := body.Get("text").String()
+
+	v := valgo.New()
+	v.Is(valgo.String(version, "version").Not().Blank().MaxLength(32))
+	v.Is(valgo.String(text, "text").Not().Blank())
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	published, err := consent.Publish(r.Context(), version, text, body.Get("reconsent").Bool())
+	switch {
+		case errors.Is(err, consent.ErrVersionExists) : httpio.WriteError(w, http.StatusConflict  , err.Error()); return
+		case errors.Is(err, consent.ErrInvalidVersion): httpio.WriteError(w, http.StatusBadRequest, err.Error()); return
+		case err != nil: {
+			log.Error().Err(err).Msg("Failed to publish consent text")
+			httpio.WriteError(w, http.StatusInternalServerError, "Failed to publish consent text")
+			return
+		}
+	}
+
+	httpio.WriteJSON(w, http.StatusCreated, json.JSON{"text": published})
+}
+
+// GetConsentHistory returns every grant and withdrawal of a participant.
+func GetConsentHistory(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	records, err := consent.History(r.Context(), token)
+	if err != nil {
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"consent": consent.Get(token), "records": records})
+}
@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"context"
+	"dse/src/core/lifecycle"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/db"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"net/http"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Health is the state of the pipeline, from connections to stored searches.
+type Health struct {
+	Status   string   `json:"status"`   // "ok" or "degraded"
+	Problems []string `json:"problems"`
+
+	Ready    bool          `json:"ready"`    // This instance accepts requests
+	Database time.Duration `json:"database"` // Round trip of a query
+	Dirty    int           `json:"dirty"`    // Users of this instance not written yet
+
+	Cluster  *cluster.Summary `json:"cluster"`
+	Searches *SearchHealth    `json:"searches"`
+}
+
+// SearchHealth is how recently searches were stored.
+type SearchHealth struct {
+	Last *time.Time `json:"last"`
+	Hour int64      `json:"hour"` // Stored in the last hour
+	Day  int64      `json:"day"`  // Stored in the last day
+}
+
+// ------------------------------------------------------------
+// : Health
+// ------------------------------------------------------------
+
+// GetHealth checks every stage of the pipeline and answers 503 when one of
+// them is failing.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/health
+//
+//	@Summary	Check the pipeline
+//	@Tags		health
+//	@Produce	json
+//	@Security	AdminToken
+//	@Success	200	{object}	object{health=Health}
+//	@Failure	401	{object}	ErrorResponse
+//	@Failure	503	{object}	object{health=Health}	"The pipeline is degraded"
+//	@Router		/api/admin/health [get]
+func GetHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	health := &Health{
+		Problems: []string{},
+		Ready   : lifecycle.Ready(),
+		Dirty   : db.Dirty(),
+	}
+	if !health.Ready {
+		health.Problems = append(health.Problems, "instance is not ready")
+	}
+
+	start := time.Now()
+	if err := db.GetConnection().Ping(ctx); err != nil {
+		health.Problems = append(health.Problems, "database: "+err.Error())
+	}
+	health.Database = time.Since(start)
+
+	summary, err := cluster.Aggregate(ctx)
+	if err != nil {
+		health.Problems = append(health.Problems, "cluster: "+err.Error())
+	}
+	health.Cluster = summary
+
+	searches := &SearchHealth{}
+	// Search timestamps are stored in UTC without a time zone
+	err = db.GetConnection().QueryRow(ctx, `
+		SELECT MAX(timestamp),
+		       COUNT(*) FILTER (WHERE timestamp >= (now() AT TIME ZONE 'UTC') - interval '1 hour'),
+		       COUNT(*)
+		FROM   searches
+		WHERE  timestamp >= (now() AT TIME ZONE 'UTC') - interval '1 day'`,
+	).Scan(&searches.Last, &searches.Hour, &searches.Day)
+	if err != nil {
+		health.Problems = append(health.Problems, "searches: "+err.Error())
+	}
+	health.Searches = searches
+
+	health.Status = "ok"
+	code         := http.StatusOK
+	if len(health.Problems) > 0 {
+		health.Status = "degraded"
+		code          = http.StatusServiceUnavailable
+	}
+
+	httpio.WriteJSON(w, code, json.JSON{"health": health})
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/services/gdpr"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Participants
+// ------------------------------------------------------------
+
+// GetParticipantExport returns a zip archive with everything held for a
+// token (GDPR access request).
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' -o data.zip http://localhost:5000/api/admin/participants/<token>/export
+func GetParticipantExport(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if err := gdpr.ValidateToken(token); err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type"       , "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", token))
+	w.Header().Set("Cache-Control"      , "no-store")
+
+	// Headers are already sent, so a failure can only be logged
+	if err := gdpr.Export(r.Context(), token, w); err != nil {
+		log.Error().Err(err).Msg("Failed to export participant")
+	}
+}
+
+// DeleteParticipant erases a token everywhere (GDPR erasure request) and
+// returns the receipt. With ?mode=anonymise searches are kept under a random
+// ID instead of being deleted.
+//
+// curl -X DELETE -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/participants/<token>?mode=erase
+func DeleteParticipant(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if err := gdpr.ValidateToken(token); err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mode, err := gdpr.ParseMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	operator := r.Header.Get("X-Operator")
+	if operator == "" {
+		operator = "admin"
+	}
+
+	receipt, err := gdpr.Erase(r.Context(), token, mode, "api:"+operator)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to erase participant")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to erase participant")
+		return
+	}
+
+	log.Info().Int64("seq", receipt.Seq).Str("action", string(receipt.Action)).Msg("Erased participant")
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"receipt": receipt})
+}
+
+// GetReceipts returns the erasure receipts and whether the chain verifies.
+func GetReceipts(w http.ResponseWriter, r *http.Request) {
+	receipts, err := gdpr.Receipts()
+	if err != nil {
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	verified, err := gdpr.Verify()
+	if err != nil && !errors.Is(err, gdpr.ErrBrokenChain) {
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := json.JSON{"receipts": receipts, "verified": verified, "valid": err == nil}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, result)
+}
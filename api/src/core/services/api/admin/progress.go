@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/services/db"
+	"dse/src/core/services/progress"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Progress
+// ------------------------------------------------------------
+
+// period reads ?week=2025-W10 or ?start=...&end=... (RFC 3339 or
+// 2006-01-02), defaulting to the current week.
+func period(r *http.Request) (progress.Period, error) {
+	params := r.URL.Query()
+
+	if week := params.Get("week"); week != "" {
+		return progress.ParseWeek(week)
+	}
+
+	p := progress.Week(time.Now())
+	for name, target := range map[string]*time.Time{"start": &p.Start, "end": &p.End} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t, err = time.Parse(time.DateOnly, value)
+		}
+		if err != nil {
+			return p, errors.New("invalid " + name)
+		}
+		*target = t.UTC()
+	}
+
+	if !p.Start.Before(p.End) {
+		return p, progress.ErrInvalidRange
+	}
+	return p, nil
+}
+
+// GetProgress returns cohort completion for a period and the participants
+// with partial or no uploads. With ?matrix=true every participant's
+// keyword x engine matrix is included.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/progress?week=2025-W10'
+func GetProgress(w http.ResponseWriter, r *http.Request) {
+	p, err := period(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, err := progress.Build(r.Context(), p, r.URL.Query().Get("matrix") == "true")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build progress report")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to build progress report")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"progress": report})
+}
+
+// GetParticipantProgress returns the completion matrix of one participant.
+func GetParticipantProgress(w http.ResponseWriter, r *http.Request) {
+	p, err := period(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	participant, err := progress.Get(r.Context(), chi.URLParam(r, "token"), p)
+	switch {
+		case errors.Is(err, db.ErrUserNotFound)  : httpio.WriteError(w, http.StatusNotFound  , err.Error()); return
+		case errors.Is(err, db.ErrTokenEmpty)    : httpio.WriteError(w, http.StatusBadRequest, err.Error()); return
+		case errors.Is(err, db.ErrTokenIncorrect): httpio.WriteError(w, http.StatusBadRequest, err.Error()); return
+		case err != nil: {
+			log.Error().Err(err).Msg("Failed to build participant progress")
+			httpio.WriteError(w, http.StatusInternalServerError, "Failed to build participant progress")
+			return
+		}
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"period": p, "participant": participant})
+}
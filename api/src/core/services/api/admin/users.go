@@ -0,0 +1,568 @@
+package admin
+
+import (
+	"context"
+	"dse/src/core/log"
+	"dse/src/core/models"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
+	"dse/src/core/services/crawler"
+	"dse/src/core/services/db"
+	"dse/src/utils/cast"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	stdjson "encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cohesivestack/valgo"
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// UserSummary is one participant in the user list.
+type UserSummary struct {
+	Token       string `json:"token"`
+	Version     string `json:"version"`   // Extension version
+	Connected   bool   `json:"connected"` // Connected to any instance
+	Instance    string `json:"instance,omitempty"`
+	Consent     bool   `json:"consent"`
+	Tasks       int    `json:"tasks"`
+	Due         int    `json:"due"`        // Tasks not completed this week
+	Completion  string `json:"completion"` // "complete", "partial" or "none"
+	LastPing    string `json:"last_ping"`
+	CompletedAt string `json:"completed_at"`
+}
+
+// TaskStatus is one task of a participant and where it stands this week.
+type TaskStatus struct {
+	ID          int    `json:"id"`
+	Keyword     string `json:"keyword"`
+	Website     string `json:"website"`
+	Status      string `json:"status"` // "done", "dispatched" or "due"
+	Attempt     string `json:"attempt"`
+	StartedAt   string `json:"started_at"`
+	CompletedAt string `json:"completed_at"`
+	UploadedAt  string `json:"uploaded_at"`
+}
+
+// RecentSearch is a stored search of a participant, without its results.
+type RecentSearch struct {
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Website     string    `json:"website"`
+	Keyword     string    `json:"keyword"`
+	Results     int       `json:"results"` // Organic results extracted
+	Attempt     string    `json:"attempt"`
+	Correlation string    `json:"correlation"`
+}
+
+// ErrorResponse is the body of every error answer.
+type ErrorResponse struct {
+	Timestamp string `json:"timestamp"`
+	Error     string `json:"error"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	completions = []string{"complete", "partial", "none"}
+)
+
+// ------------------------------------------------------------
+// : Users
+// ------------------------------------------------------------
+
+// GetUsers returns a summary of every participant, optionally filtered.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/users?online=true&completion=partial,none'
+//
+//	@Summary		List participants
+//	@Description	Every participant with their version, connection and task completion. Filters are combined; list filters take comma separated values.
+//	@Tags			users
+//	@Produce		json
+//	@Security		AdminToken
+//	@Param			version		query		string	false	"Extension versions, such as 3.0.5,3.0.6"
+//	@Param			online		query		bool	false	"Connected to any instance"
+//	@Param			completion	query		string	false	"complete, partial or none"
+//	@Success		200			{object}	object{users=[]UserSummary}
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		401			{object}	ErrorResponse
+//	@Router			/api/admin/users [get]
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	query      := r.URL.Query()
+	versions   := list(query.Get("version"))
+	completion := list(query.Get("completion"))
+	online     := query.Get("online")
+
+	v := valgo.New()
+	if online != "" {
+		_, err := strconv.ParseBool(online)
+		v.Is(valgo.Bool(err == nil, "online").True())
+	}
+	for _, value := range completion {
+		v.Is(valgo.String(value, "completion").InSlice(completions))
+	}
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		httpio.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	owners, err := cluster.Owners(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get owners")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to get owners")
+		return
+	}
+
+	summaries := []*UserSummary{}
+	users.Each(func(index int, user *models.User) bool {
+		summary := summarise(user, owners[user.Token])
+
+		if len(versions)   > 0 && !slices.Contains(versions, summary.Version)      { return true }
+		if len(completion) > 0 && !slices.Contains(completion, summary.Completion) { return true }
+		if online != "" && strconv.FormatBool(summary.Connected) != strings.ToLower(online) {
+			return true
+		}
+
+		summaries = append(summaries, summary)
+		return true
+	})
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Token < summaries[j].Token })
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"users": summaries})
+}
+
+// GetUser returns the summary of a participant, the status of every task,
+// their most recent searches and their full state.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/users/<token>?searches=50'
+//
+//	@Summary		Get a participant
+//	@Description	The summary, task status, most recent searches and full state of a participant.
+//	@Tags			users
+//	@Produce		json
+//	@Security		AdminToken
+//	@Param			token		path		string	true	"Participant token"
+//	@Param			searches	query		int		false	"Number of recent searches, at most 200"	default(20)
+//	@Success		200			{object}	object{summary=UserSummary,tasks=[]TaskStatus,searches=[]RecentSearch,user=object}
+//	@Failure		400			{object}	ErrorResponse
+//	@Failure		401			{object}	ErrorResponse
+//	@Failure		404			{object}	ErrorResponse
+//	@Router			/api/admin/users/{token} [get]
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	valid := true
+	if value := r.URL.Query().Get("searches"); value != "" {
+		n, err := strconv.Atoi(value)
+		limit, valid = n, err == nil
+	}
+
+	v := valgo.New()
+	v.Is(valgo.Bool(valid, "searches").True())
+	v.Is(valgo.Int(limit, "searches").Between(0, 200))
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	user, err := db.GetUser(chi.URLParam(r, "token"))
+	if writeUserError(w, err, "Failed to get user") {
+		return
+	}
+
+	owner, err := owner(r.Context(), user.Token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get owner")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to get owner")
+		return
+	}
+
+	searches, err := recent(r.Context(), user.Token, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get searches")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to get searches")
+		return
+	}
+
+	// A crawl on this instance changes the state meanwhile; it is encoded
+	// under the lock, as the flush does
+	user.Lock()
+	state, err := stdjson.Marshal(user)
+	user.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode user")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to encode user")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{
+		"summary" : summarise(user, owner),
+		"tasks"   : tasks(user),
+		"searches": searches,
+		"user"    : stdjson.RawMessage(state),
+	})
+}
+
+// PatchUser changes server-side fields of a participant: the server state,
+// its timestamps, the task hash and the timestamps of single tasks.
+// Clearing the completed_at of a task makes it due again.
+//
+// curl -X PATCH -H 'Authorization: Bearer $ADMIN_TOKEN' -d '{"tasks": [{"id": 3, "completed_at": ""}]}' http://localhost:5000/api/admin/users/<token>
+//
+//	@Summary		Change a participant
+//	@Description	Changes server-side fields. Fields left out are kept; an empty timestamp clears it. Unknown fields are rejected.
+//	@Tags			users
+//	@Accept			json
+//	@Produce		json
+//	@Security		AdminToken
+//	@Param			token	path		string				true	"Participant token"
+//	@Param			patch	body		models.ServerPatch	true	"Fields to change"
+//	@Success		200		{object}	object{status=string}
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Router			/api/admin/users/{token} [patch]
+func PatchUser(w http.ResponseWriter, r *http.Request) {
+	var patch models.ServerPatch
+
+	decoder := stdjson.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if patch.State != nil {
+		v := valgo.New()
+		v.Is(valgo.String(*patch.State, "state").MaxLength(32))
+		if !v.Valid() {
+			httpio.WriteValidationError(w, v)
+			return
+		}
+	}
+
+	user, err := db.GetUser(chi.URLParam(r, "token"))
+	if writeUserError(w, err, "Failed to get user") {
+		return
+	}
+
+	user.Lock()
+	err = patch.Validate(user.State.Server)
+	user.Unlock()
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = crawler.Patch(r.Context(), user.Token, &patch)
+	if writeUserError(w, err, "Failed to patch user") {
+		return
+	}
+
+	log.Info().Str("token", user.Token).Str("operator", r.Header.Get("X-Operator")).Msg("Patched user")
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"status": "patched"})
+}
+
+// PostUserReset marks every task of a participant as due again.
+//
+// curl -X POST -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/users/<token>/reset
+//
+//	@Summary	Reset the tasks of a participant
+//	@Tags		users
+//	@Produce	json
+//	@Security	AdminToken
+//	@Param		token	path		string	true	"Participant token"
+//	@Success	200		{object}	object{status=string}
+//	@Failure	400		{object}	ErrorResponse
+//	@Failure	401		{object}	ErrorResponse
+//	@Failure	404		{object}	ErrorResponse
+//	@Router		/api/admin/users/{token}/reset [post]
+func PostUserReset(w http.ResponseWriter, r *http.Request) {
+	err := crawler.Reset(r.Context(), chi.URLParam(r, "token"))
+	if writeUserError(w, err, "Failed to reset user") {
+		return
+	}
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"status": "reset"})
+}
+
+// PostUserRepopulate replaces the tasks of a participant with the ones
+// configured in config/searches.json.
+//
+// curl -X POST -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/users/<token>/repopulate
+//
+//	@Summary	Repopulate the tasks of a participant
+//	@Tags		users
+//	@Produce	json
+//	@Security	AdminToken
+//	@Param		token	path		string	true	"Participant token"
+//	@Success	200		{object}	object{status=string}
+//	@Failure	400		{object}	ErrorResponse
+//	@Failure	401		{object}	ErrorResponse
+//	@Failure	404		{object}	ErrorResponse
+//	@Failure	409		{object}	ErrorResponse	"Participant is being crawled"
+//	@Router		/api/admin/users/{token}/repopulate [post]
+func PostUserRepopulate(w http.ResponseWriter, r *http.Request) {
+	err := crawler.Repopulate(r.Context(), chi.URLParam(r, "token"))
+	if writeUserError(w, err, "Failed to repopulate user") {
+		return
+	}
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"status": "repopulated"})
+}
+
+// PostUserCrawl starts the crawl of a connected participant. Only tasks
+// that are due are searched, unless ?force=true resets every task first.
+// It answers 409 when there is nothing to start.
+//
+// curl -X POST -H 'Authorization: Bearer $ADMIN_TOKEN' 'http://localhost:5000/api/admin/users/<token>/crawl?force=true'
+//
+//	@Summary	Crawl a participant
+//	@Tags		users
+//	@Produce	json
+//	@Security	AdminToken
+//	@Param		token	path		string	true	"Participant token"
+//	@Param		force	query		bool	false	"Search every task, not only the due ones"
+//	@Success	202		{object}	object{status=string}
+//	@Failure	400		{object}	ErrorResponse
+//	@Failure	401		{object}	ErrorResponse
+//	@Failure	404		{object}	ErrorResponse
+//	@Failure	409		{object}	ErrorResponse	"Participant is not connected, has not given consent, has no tasks due or is being crawled"
+//	@Router		/api/admin/users/{token}/crawl [post]
+func PostUserCrawl(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	force := r.URL.Query().Get("force") == "true"
+
+	_, err := db.GetUser(token)
+	if writeUserError(w, err, "Failed to get user") {
+		return
+	}
+
+	err = crawler.Crawl(r.Context(), token, force)
+	if writeUserError(w, err, "Failed to start crawl") {
+		return
+	}
+	httpio.WriteJSON(w, http.StatusAccepted, json.JSON{"status": "started"})
+}
+
+// PostUserCommand sends a packet to the extension of a connected
+// participant, such as "reload".
+//
+// curl -X POST -H 'Authorization: Bearer $ADMIN_TOKEN' -d '{"action": "reload"}' http://localhost:5000/api/admin/users/<token>/command
+//
+//	@Summary	Send a command to a participant
+//	@Tags		users
+//	@Accept		json
+//	@Produce	json
+//	@Security	AdminToken
+//	@Param		token	path		string								true	"Participant token"
+//	@Param		command	body		object{action=string,data=object}	true	"Packet to send"
+//	@Success	202		{object}	object{status=string,instance=string}
+//	@Failure	400		{object}	ErrorResponse
+//	@Failure	401		{object}	ErrorResponse
+//	@Failure	404		{object}	ErrorResponse
+//	@Failure	409		{object}	ErrorResponse	"Participant is not connected"
+//	@Router		/api/admin/users/{token}/command [post]
+func PostUserCommand(w http.ResponseWriter, r *http.Request) {
+	body, err := httpio.ReadJSON(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	action := body.Get("action").String()
+
+	v := valgo.New()
+	v.Is(valgo.String(action, "action").Not().Blank().MaxLength(64))
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	user, err := db.GetUser(chi.URLParam(r, "token"))
+	if writeUserError(w, err, "Failed to get user") {
+		return
+	}
+
+	owner, err := owner(r.Context(), user.Token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get owner")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to get owner")
+		return
+	}
+	if owner == "" {
+		httpio.WriteError(w, http.StatusConflict, crawler.ErrOffline.Error())
+		return
+	}
+
+	user.Send(action, body.Get("data").Value())
+	log.Info().Str("token", user.Token).Str("action", action).Msg("Sent command")
+
+	httpio.WriteJSON(w, http.StatusAccepted, json.JSON{"status": "sent", "instance": owner})
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+// summarise and tasks copy what they need under the lock of the
+// participant, which a crawl on this instance holds while it changes them.
+func summarise(user *models.User, owner string) *UserSummary {
+	summary := &UserSummary{
+		Token    : user.Token,
+		Connected: owner != "",
+		Instance : owner,
+		Consent  : consent.Has(user.Token),
+	}
+
+	user.Lock()
+	defer user.Unlock()
+
+	server := user.State.Server
+	summary.LastPing    = server.LastPing
+	summary.CompletedAt = server.CompletedAt
+	if user.State.Client != nil && user.State.Client.Extension != nil {
+		summary.Version = user.State.Client.Extension.Version
+	}
+
+	if server.Tasks != nil {
+		for _, task := range *server.Tasks {
+			summary.Tasks += 1
+			if task.IsStale() {
+				summary.Due += 1
+			}
+		}
+	}
+
+	switch {
+		case summary.Tasks > 0 && summary.Due == 0: summary.Completion = "complete"
+		case summary.Due < summary.Tasks          : summary.Completion = "partial"
+		default                                   : summary.Completion = "none"
+	}
+	return summary
+}
+
+func tasks(user *models.User) []*TaskStatus {
+	user.Lock()
+	defer user.Unlock()
+
+	list := []*TaskStatus{}
+	if user.State.Server.Tasks == nil {
+		return list
+	}
+
+	for _, task := range *user.State.Server.Tasks {
+		status := &TaskStatus{
+			ID         : task.ID,
+			Keyword    : task.Keyword,
+			Website    : website(task.Website),
+			Status     : "due",
+			Attempt    : task.Attempt,
+			StartedAt  : task.StartedAt,
+			CompletedAt: task.CompletedAt,
+			UploadedAt : task.UploadedAt,
+		}
+		switch {
+			case !task.IsStale()   : status.Status = "done"
+			case task.Attempt != "": status.Status = "dispatched"
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// website names the engine of a task; tasks loaded from the database hold
+// it as a map.
+func website(value any) string {
+	switch w := value.(type) {
+		case models.Website : return w.Name
+		case *models.Website: return w.Name
+		case map[string]any : return cast.ToString(w["name"])
+		default             : return ""
+	}
+}
+
+// recent returns the latest searches of a participant, newest first.
+func recent(ctx context.Context, token string, limit int) ([]*RecentSearch, error) {
+	rows, err := db.GetConnection().Query(ctx, `
+		SELECT id, timestamp,
+		       COALESCE(metadata->>'website', ''),
+		       COALESCE(metadata->>'keyword', ''),
+		       CASE WHEN jsonb_typeof(metadata->'results'->'search_result') = 'array'
+		            THEN jsonb_array_length(metadata->'results'->'search_result') ELSE 0 END,
+		       COALESCE(attempt, ''),
+		       COALESCE(correlation, '')
+		FROM   searches
+		WHERE  token = $1
+		ORDER  BY timestamp DESC, id DESC
+		LIMIT  $2`,
+		token, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*RecentSearch{}
+	for rows.Next() {
+		s := &RecentSearch{}
+		if err := rows.Scan(&s.ID, &s.Timestamp, &s.Website, &s.Keyword, &s.Results, &s.Attempt, &s.Correlation); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// list splits a comma separated query parameter.
+func list(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// owner returns the instance a participant is connected to, or "".
+func owner(ctx context.Context, token string) (string, error) {
+	instance, _, err := cluster.Owner(ctx, token)
+	if errors.Is(err, cluster.ErrNoOwner) {
+		return "", nil
+	}
+	return instance, err
+}
+
+// writeUserError writes the response for an error of a user operation,
+// and reports whether there was one.
+func writeUserError(w http.ResponseWriter, err error, message string) bool {
+	switch {
+		case err == nil                           : return false
+		case errors.Is(err, db.ErrUserNotFound)   : httpio.WriteError(w, http.StatusNotFound  , err.Error())
+		case errors.Is(err, db.ErrTokenEmpty)     : httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, db.ErrTokenIncorrect) : httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, crawler.ErrOffline)   : httpio.WriteError(w, http.StatusConflict  , err.Error())
+		case errors.Is(err, crawler.ErrNoConsent) : httpio.WriteError(w, http.StatusConflict  , err.Error())
+		case errors.Is(err, crawler.ErrNothingDue): httpio.WriteError(w, http.StatusConflict  , err.Error())
+		case errors.Is(err, crawler.ErrCrawling)  : httpio.WriteError(w, http.StatusConflict  , err.Error())
+		default: {
+			log.Error().Err(err).Msg(message)
+			httpio.WriteError(w, http.StatusInternalServerError, message)
+		}
+	}
+	return true
+}
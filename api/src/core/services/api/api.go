@@ -2,25 +2,33 @@ package api
 
 import (
 	"compress/gzip"
+	"context"
 	"dse/src/core/global"
+	"dse/src/core/lifecycle"
 	"dse/src/core/log"
 	"dse/src/core/models"
+	"dse/src/core/schema"
+	"dse/src/core/services/api/admin"
 	"dse/src/core/services/api/controller"
+	"dse/src/core/services/api/auth"
 	"dse/src/core/services/api/download"
 	"dse/src/core/services/api/metrics"
 	"dse/src/core/services/api/ws"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
 	"dse/src/core/services/db"
 	"dse/src/core/services/extractor"
+	"dse/src/core/telemetry"
 	"dse/src/utils/datetime"
-	"dse/src/utils/event"
 	"dse/src/utils/gatekeeper"
 	"dse/src/utils/hashmap"
 	"dse/src/utils/json"
 	"fmt"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/dromara/carbon/v2"
@@ -48,6 +56,7 @@ type ServerState = models.ServerState
 // ------------------------------------------------------------
 var (
 	router  = chi.NewRouter()
+	server  *http.Server
 	
 	addr string = fmt.Sprintf("%s:%s", "localhost", "5000")
 	host string = "localhost"
@@ -55,7 +64,6 @@ var (
 
 	started carbon.Carbon = carbon.Now(carbon.UTC)
 	version string        = global.VERSION
-	mutex   sync.Mutex    = sync.Mutex{}
 
 	gk = gatekeeper.NewGateKeeper(true)
 
@@ -227,19 +235,29 @@ func GetEvent(w http.ResponseWriter, r *http.Request) {
 	}
 	flusher.Flush()
 
+	// Subscribe before checking, so a user created in between is not missed
+	ctx, cancel := context.WithCancel(r.Context())
+	created     := models.UserCreated.Subscribe(ctx)
+
 	// Check if user exists
 	exists, err := db.HasUser(qtoken)
 	if err != nil {
+		cancel()
 		log.Error().Err(err).Msg("")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Create user if not exists
-	if !exists {	
-		event := event.On(fmt.Sprintf("user.%s.created", qtoken))
-		<- event // Wait for user creation (in the event handler)
+	// Wait for the user to be created by their first event
+	for !exists {
+		user, ok := <-created
+		if !ok {
+			cancel()
+			return // Disconnected
+		}
+		exists = user.Token == qtoken
 	}
+	cancel()
 
 	// Get user
 	user, err := db.GetUser(qtoken)
@@ -249,18 +267,26 @@ func GetEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Packets for the participant are routed to this instance from now on
+	if err := cluster.Connect(r.Context(), user.Token, "sse"); err != nil {
+		log.Error().Err(err).Str("token", user.Token).Msg("Failed to record presence")
+	}
+	defer cluster.Disconnect(context.Background(), user.Token)
+
 	user.SetSSE(w, r)
 
-	event.Emit(event.UserConnected, user)
+	models.UserConnected.Publish(user)
 
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
-	defer event.Emit(event.UserDisconnected, user)
+	defer models.UserDisconnected.Publish(user)
 
 	for {
 		select {
 			case <-r.Context().Done(): // Wait for disconnect
 				return
+			case <-lifecycle.Stopping(): // The extension reconnects to the next instance
+				return
 			case <-time.After(5 * time.Second): // Heartbeat
 				if !user.IsOnline() {
 					return
@@ -308,12 +334,11 @@ func PostEvent(w http.ResponseWriter, r *http.Request) {
 
 	if !exists {
 		user, err = db.CreateUser(packet.From)
-		if err != nil {
+		if err != nil && !errors.Is(err, db.ErrUserExists) {
 			log.Error().Err(err).Msg("")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		event.Emit(fmt.Sprintf("user.%s.created", user.Token))
 	}
 
 	user, err = db.GetUser(packet.From)
@@ -323,20 +348,57 @@ func PostEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := json.ToBytes(packet.Data)
-	if err != nil {
+	telemetry.Seen(user.Token)
+
+	// Events of a participant connected to another instance are handled
+	// there, so only that instance changes their state
+	owner, remote, err := cluster.Owner(r.Context(), user.Token)
+	if err != nil && !errors.Is(err, cluster.ErrNoOwner) {
 		log.Error().Err(err).Msg("")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if remote {
+		err := cluster.SendTo(r.Context(), owner, "event", user.Token, inflated)
+		if err != nil {
+			log.Error().Err(err).Str("token", user.Token).Str("instance", owner).Msg("Failed to forward event")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	if code, err := handle(r.Context(), user, &packet); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handle applies an event to the participant's state. It returns the status
+// code to answer with when it fails.
+func handle(ctx context.Context, user *User, packet *Packet) (int, error) {
+	b, err := json.ToBytes(packet.Data)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		return http.StatusInternalServerError, err
+	}
+
+	// Events of one participant are applied in turn; different participants
+	// are handled concurrently
+	user.Lock()
+	defer user.Unlock()
 
 	user.State.Server.Online   = true
 	user.State.Server.LastPing = carbon.Now(carbon.UTC).ToIso8601String()
 	user.Save()
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	switch packet.Action {
 		case "update": {
 			func() {
@@ -373,77 +435,93 @@ func PostEvent(w http.ResponseWriter, r *http.Request) {
 				user.State.Client.User.Token = parsed.Get("user.token").String()
 				user.State.Client.User.Popup = parsed.Get("user.popup").Bool()
 	
-				user.State.Client.User.Form.Age = parsed.Get("user.form.age").String()
-				user.State.Client.User.Form.Sex = parsed.Get("user.form.sex").String()
-	
-				user.State.Client.User.Form.Browser.Brave         = parsed.Get("user.form.browser.brave").Bool()
-				user.State.Client.User.Form.Browser.Chrome        = parsed.Get("user.form.browser.chrome").Bool()
-				user.State.Client.User.Form.Browser.Firefox       = parsed.Get("user.form.browser.edge").Bool()
-				user.State.Client.User.Form.Browser.MicrosoftEdge = parsed.Get("user.form.browser.firefox").Bool()
-				user.State.Client.User.Form.Browser.Opera         = parsed.Get("user.form.browser.opera").Bool()
-				user.State.Client.User.Form.Browser.Safari        = parsed.Get("user.form.browser.safari").Bool()
-				user.State.Client.User.Form.Browser.Unselected	  = parsed.Get("user.form.browser.unselected").Bool()
-	
-				user.State.Client.User.Form.Social.TV	          = parsed.Get("user.form.social.tv").Bool()
-				user.State.Client.User.Form.Social.DeKrant        = parsed.Get("user.form.social.de-krant").Bool()
-				user.State.Client.User.Form.Social.Nieuwswebsites = parsed.Get("user.form.social.nieuwswebsites").Bool()
-				user.State.Client.User.Form.Social.YouTube        = parsed.Get("user.form.social.youtube").Bool()
-				user.State.Client.User.Form.Social.Facebook       = parsed.Get("user.form.social.facebook").Bool()
-				user.State.Client.User.Form.Social.Instagram      = parsed.Get("user.form.social.instagram").Bool()
-				user.State.Client.User.Form.Social.WhatsApp       = parsed.Get("user.form.social.whatsapp").Bool()
-				user.State.Client.User.Form.Social.Linkedin       = parsed.Get("user.form.social.linkedin").Bool()
-				user.State.Client.User.Form.Social.Twitter        = parsed.Get("user.form.social.twitter").Bool()
-				user.State.Client.User.Form.Social.Telegram       = parsed.Get("user.form.social.telegram").Bool()
-				user.State.Client.User.Form.Social.Reddit         = parsed.Get("user.form.social.reddit").Bool()
-				user.State.Client.User.Form.Social.Radio          = parsed.Get("user.form.social.radio").Bool()
-				user.State.Client.User.Form.Social.Anders         = parsed.Get("user.form.social.anders").Bool()
-				user.State.Client.User.Form.Social.Unselected     = parsed.Get("user.form.social.unselected").Bool()
-	
-				user.State.Client.User.Form.Education  = parsed.Get("user.form.education").String()
-				user.State.Client.User.Form.Employment = parsed.Get("user.form.employment").String()
-				user.State.Client.User.Form.Income     = parsed.Get("user.form.income").String()
-	
-				user.State.Client.User.Form.Language.Duits      = parsed.Get("user.form.language.duits").Bool()
-				user.State.Client.User.Form.Language.Engels     = parsed.Get("user.form.language.engels").Bool()
-				user.State.Client.User.Form.Language.Frans      = parsed.Get("user.form.language.frans").Bool()
-				user.State.Client.User.Form.Language.Italiaans  = parsed.Get("user.form.language.italiaans").Bool()
-				user.State.Client.User.Form.Language.Nederlands = parsed.Get("user.form.language.nederlands").Bool()
-				user.State.Client.User.Form.Language.Spaans     = parsed.Get("user.form.language.spaans").Bool()
-				user.State.Client.User.Form.Language.Unselected = parsed.Get("user.form.language.unselected").Bool()
-	
-				user.State.Client.User.Form.Political      = parsed.Get("user.form.political").String()
-				user.State.Client.User.Form.Postcode.Value = parsed.Get("user.form.postcode.value").String()
-				user.State.Client.User.Form.Resident       = parsed.Get("user.form.resident").String()
-	
-				user.State.Client.User.Form.SearchEngine.Anders     = parsed.Get("user.form.search_engine.anders").Bool()
-				user.State.Client.User.Form.SearchEngine.Bing       = parsed.Get("user.form.search_engine.bing").Bool()
-				user.State.Client.User.Form.SearchEngine.Duckduckgo = parsed.Get("user.form.search_engine.duckduckgo").Bool()
-				user.State.Client.User.Form.SearchEngine.Ecosia     = parsed.Get("user.form.search_engine.ecosia").Bool()
-				user.State.Client.User.Form.SearchEngine.Google     = parsed.Get("user.form.search_engine.google").Bool()
-				user.State.Client.User.Form.SearchEngine.Startpage  = parsed.Get("user.form.search_engine.startpage").Bool()
-				user.State.Client.User.Form.SearchEngine.Yahoo      = parsed.Get("user.form.search_engine.yahoo").Bool()
-				user.State.Client.User.Form.SearchEngine.Unselected = parsed.Get("user.form.search_engine.unselected").Bool()
+				// Answers are validated against config/form.json
+				v, err := schema.Update(user, parsed.Get("user.form"))
+				if err != nil {
+					log.Error().Err(err).Msg("Failed to load form schema")
+				} else if !v.Valid() {
+					log.Warn().Str("token", user.Token).Interface("errors", v.Error()).Msg("Rejected invalid form")
+				} else if schema.Submitted(user) {
+					if _, err := consent.Registered(ctx, user.Token); err != nil {
+						log.Error().Err(err).Str("token", user.Token).Msg("Failed to record consent")
+					}
+				}
 				user.Save()
 			}()
 		}
 
 		case "upload": { 
-			go extractor.OnUpload(user, b)
+			// Uploads of participants without a current consent are dropped
+			if !consent.Has(user.Token) {
+				log.Warn().Str("token", user.Token).Msg("Dropped upload without consent")
+				return http.StatusForbidden, consent.ErrNoConsent
+			}
+			extractor.OnUpload(user, b)
+		}
+		case "consent.grant": {
+			_, err := consent.Grant(ctx, user.Token, gjson.GetBytes(b, "version").String(), "extension")
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			user.Save()
+		}
+		case "consent.withdraw": {
+			_, err := consent.Withdraw(ctx, user.Token, "extension")
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
 		}
 		case "reset" : {
-			event.Emit("user.reset", user)
+			models.UserReset.Publish(user)
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// onForward handles an event another instance received for a participant
+// connected here.
+func onForward(ctx context.Context, msg *cluster.Message) {
+	var inflated []byte
+	if err := json.FromBytes(msg.Data, &inflated); err != nil {
+		log.Error().Err(err).Str("from", msg.From).Msg("Failed to decode forwarded event")
+		return
+	}
+
+	packet, err := unpack(inflated)
+	if err != nil {
+		log.Error().Err(err).Str("from", msg.From).Msg("Failed unpack")
+		return
+	}
+
+	user, err := db.GetUser(packet.From)
+	if err != nil {
+		log.Error().Err(err).Str("token", packet.From).Msg("")
+		return
+	}
+
+	if _, err := handle(ctx, user, &packet); err != nil {
+		log.Warn().Err(err).Str("token", user.Token).Str("action", packet.Action).Msg("Forwarded event failed")
+	}
+}
+
+// GetReady answers 200 once every service has started and 503 while starting
+// or shutting down, for load balancers.
+func GetReady(w http.ResponseWriter, r *http.Request) {
+	if !lifecycle.Ready() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
 	w.Write([]byte("OK"))
 }
 
 // ------------------------------------------------------------
-// : Init
+// : Lifecycle
 // ------------------------------------------------------------
-func Init() {
+
+// Start listens on API_HOST:API_PORT. It is started after every other
+// service, so requests are only accepted once they are ready.
+func Start(ctx context.Context) error {
 	if value, ok := os.LookupEnv("API_HOST"); ok { host = value }
 	if value, ok := os.LookupEnv("API_PORT"); ok { port = value }
 	addr = fmt.Sprintf("%s:%s", host, port)
@@ -451,14 +529,17 @@ func Init() {
 	// Middlewares
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
+	router.Use(telemetry.Middleware)
 	router.Use(cors.Handler(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders: []string{"Link"},
 		MaxAge:         300,
 	}))
 	
+	cluster.OnMessage("event", onForward)
+
 	// Routes
 	router.Get("/ws", ws.HandleWS)
 	
@@ -472,13 +553,60 @@ func Init() {
 	router.Get("/api/download/searches", 	   download.GetSearches)
 	router.Get("/api/download/searches/full",  download.GetSearches)
 
+	router.Get("/api/download/snapshot",            download.GetSnapshot)
+	router.Get("/api/download/snapshot/since",      download.GetSnapshotSince)
+	router.Get("/api/download/snapshot/{seq}",      download.GetSnapshotPartition)
+
+	router.Get("/api/download/jobs",                download.GetJobs)
+	router.Post("/api/download/jobs",               download.PostJob)
+	router.Get("/api/download/jobs/{id}",           download.GetJob)
+	router.Get("/api/download/jobs/{id}/manifest",  download.GetJobManifest)
+	router.Get("/api/download/jobs/{id}/file",      download.GetJobFile)
+
+	router.With(auth.Admin).Get("/api/admin/pseudonyms/{recipient}/{pseudonym}", download.GetPseudonym)
+	router.With(auth.Admin).Get("/api/admin/participants/{token}/export",         admin.GetParticipantExport)
+	router.With(auth.Admin).Delete("/api/admin/participants/{token}",             admin.DeleteParticipant)
+	router.With(auth.Admin).Get("/api/admin/receipts",                            admin.GetReceipts)
+
+	router.With(auth.Admin).Get("/api/admin/consent/texts",                       admin.GetConsentTexts)
+	router.With(auth.Admin).Post("/api/admin/consent/texts",                      admin.PostConsentText)
+	router.With(auth.Admin).Get("/api/admin/consent/{token}",                     admin.GetConsentHistory)
+
+	router.With(auth.Admin).Get("/api/admin/progress",                            admin.GetProgress)
+	router.With(auth.Admin).Get("/api/admin/progress/{token}",                    admin.GetParticipantProgress)
+
+	router.With(auth.Admin).Get("/api/admin/analysis/overlap",                    admin.GetOverlap)
+	router.With(auth.Admin).Get("/api/admin/analysis/overlap/weeks",              admin.GetOverlapWeeks)
+	router.With(auth.Admin).Get("/api/admin/analysis/volatility",                 admin.GetVolatility)
+	router.With(auth.Admin).Get("/api/admin/analysis/changes/{token}",            admin.GetChanges)
+
+	router.With(auth.Admin).Get("/api/admin/cluster",                             admin.GetCluster)
+	router.With(auth.Admin).Get("/api/admin/health",                              admin.GetHealth)
+
+	router.With(auth.Admin).Get("/api/admin/users",                               admin.GetUsers)
+	router.With(auth.Admin).Get("/api/admin/users/{token}",                       admin.GetUser)
+	router.With(auth.Admin).Patch("/api/admin/users/{token}",                     admin.PatchUser)
+	router.With(auth.Admin).Post("/api/admin/users/{token}/reset",                admin.PostUserReset)
+	router.With(auth.Admin).Post("/api/admin/users/{token}/repopulate",           admin.PostUserRepopulate)
+	router.With(auth.Admin).Post("/api/admin/users/{token}/crawl",                admin.PostUserCrawl)
+	router.With(auth.Admin).Post("/api/admin/users/{token}/command",              admin.PostUserCommand)
+
 	router.Get("/api/users/reset", controller.HandleReset)
 
+	router.Get("/api/form",             controller.GetForm)
+	router.Get("/api/consent",          controller.GetConsentText)
+	router.Get("/api/consent/{token}",  controller.GetConsent)
+	router.Post("/api/consent/{token}", controller.PostConsent)
+
+	router.Get("/metrics", telemetry.Handler)
+	router.Get("/ready",   GetReady)
+
 	router.Get("/api/metrics",                metrics.HandleHealthCheck)
 	router.Get("/api/metrics/users",          metrics.GetMetricUsers)
 	router.Get("/api/metrics/searches",       metrics.GetMetricSearch)
 	router.Get("/api/metrics/searches/size",  metrics.GetMetricsSearchSize)
 	router.Get("/api/metrics/searches/total", metrics.GetMetricsSearchTotal)
+	router.Get("/api/metrics/query",          metrics.GetMetricQuery)
 
 	// Serve assets at /assets
 	router.Handle("/assets/*", http.StripPrefix("/assets/", http.FileServer(http.Dir("./public/assets"))))
@@ -494,19 +622,23 @@ func Init() {
 		}
 	}))
 	
-	db.Wait()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", addr, err)
+	}
 
 	// Start server
+	server = &http.Server{Handler: router}
 	go func() {
-		err := http.ListenAndServe(addr, router)
-		if err != nil {
-			log.Fatal().Err(err).Str("addr", addr).Msg("Failed to start server")
-			return
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("addr", addr).Msg("Server stopped")
+			lifecycle.Shutdown()
 		}
 	}()
 	log.Info().Str("addr", addr).Msg("Ready")
 	gk.Unlock()
-	
+
 	// TODO: Remove
 	// go func() {
 	// 	http.Get("http://localhost:5000/api/download/searches/merge?token=dse2024&start=2024-11-01&end=2024-11-10")
@@ -514,4 +646,22 @@ func Init() {
 
 	// TODO: Remove
 	// tool.Prepare()
+	return nil
+}
+
+// Stop stops accepting connections and waits for requests in progress. SSE
+// streams and WebSockets end themselves on lifecycle.Stopping; WebSockets are
+// hijacked, so the server does not wait for them and they are drained here.
+func Stop(ctx context.Context) error {
+	if server == nil {
+		return nil
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := ws.Drain(ctx); err != nil {
+		return err
+	}
+	return models.Drain(ctx)
 }
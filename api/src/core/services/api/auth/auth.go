@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"dse/src/utils/httpio"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ------------------------------------------------------------
+// : Admin
+// ------------------------------------------------------------
+
+// IsAdmin reports whether the request carries the admin token as
+// "Authorization: Bearer <ADMIN_TOKEN>". Without ADMIN_TOKEN nobody is admin.
+func IsAdmin(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Admin only lets admin requests through to the next handler.
+func Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdmin(r) {
+			httpio.WriteError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"dse/src/core/services/consent"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"errors"
+	"net/http"
+
+	"github.com/cohesivestack/valgo"
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Consent
+// ------------------------------------------------------------
+
+// GetConsentText returns the consent text participants are asked to accept.
+func GetConsentText(w http.ResponseWriter, r *http.Request) {
+	text, err := consent.Current()
+	if err != nil {
+		httpio.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"text": text})
+}
+
+// GetConsent returns the consent status of a participant.
+func GetConsent(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if len(token) != 12 {
+		httpio.WriteError(w, http.StatusBadRequest, consent.ErrInvalidToken.Error())
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"consent": consent.Get(token)})
+}
+
+// PostConsent records a grant or withdrawal.
+//
+//	{"action": "grant", "version": "2025-03"}
+//	{"action": "withdraw"}
+func PostConsent(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+
+	body, err := httpio.ReadJSON(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	action  := body.Get("action").String()
+	version := body.Get("version").String()
+
+	v := valgo.New()
+	v.Is(valgo.String(token, "token").OfLength(12))
+	v.Is(valgo.String(action, "action").InSlice([]string{string(consent.ActionGrant), string(consent.ActionWithdraw)}))
+	if action == string(consent.ActionGrant) {
+		v.Is(valgo.String(version, "version").Not().Blank())
+	}
+	if !v.Valid() {
+		httpio.WriteValidationError(w, v)
+		return
+	}
+
+	var record *consent.Record
+	if action == string(consent.ActionGrant) {
+		record, err = consent.Grant(r.Context(), token, version, "web")
+	} else {
+		record, err = consent.Withdraw(r.Context(), token, "web")
+	}
+
+	switch {
+		case errors.Is(err, consent.ErrUnknownVersion) : httpio.WriteError(w, http.StatusBadRequest, err.Error()); return
+		case errors.Is(err, consent.ErrOutdatedVersion): httpio.WriteError(w, http.StatusConflict  , err.Error()); return
+		case err != nil                                : httpio.WriteError(w, http.StatusInternalServerError, "Failed to record consent"); return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"record": record, "consent": consent.Get(token)})
+}
@@ -0,0 +1,25 @@
+package controller
+
+import (
+	"dse/src/core/schema"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"net/http"
+)
+
+// ------------------------------------------------------------
+// : Form
+// ------------------------------------------------------------
+
+// GetForm returns the questionnaire from config/form.json, so clients can
+// render it instead of hard-coding the questions.
+func GetForm(w http.ResponseWriter, r *http.Request) {
+	current, err := schema.Current()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load form schema")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to load form schema")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"form": current})
+}
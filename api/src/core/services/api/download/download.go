@@ -1,115 +1,43 @@
 package download
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"dse/src/core/log"
-	"dse/src/core/models"
-	"dse/src/core/services/db"
+	"dse/src/core/services/api/auth"
+	"dse/src/core/services/export"
 	"dse/src/utils/cast"
 	"dse/src/utils/datetime"
-	"dse/src/utils/file"
-	"dse/src/utils/gatekeeper"
 	"dse/src/utils/httpio"
 	"dse/src/utils/json"
-	"dse/src/utils/object"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/cohesivestack/valgo"
-	"github.com/dromara/carbon/v2"
-	"github.com/sourcegraph/conc"
+	"github.com/go-chi/chi/v5"
 	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
 )
 
 // ------------------------------------------------------------
 // : Types
 // ------------------------------------------------------------
-type OutputUser struct {
-	Token                string `json:"token"`
-
-	Age                  string `json:"age"`
-	Sex                  string `json:"sex"`
-	Income               string `json:"income"`
-	Resident             string `json:"resident"`
-	Education            string `json:"education"`
-	Political            string `json:"political"`
-	Employment           string `json:"employment"`
-	Postcode             string `json:"postcode"`
-
-	SocialTv             bool `json:"social_tv"`
-	SocialRadio          bool `json:"social_radio"`
-	SocialAnders         bool `json:"social_anders"`
-	SocialReddit         bool `json:"social_reddit"`
-	SocialTwitter        bool `json:"social_twitter"`
-	SocialYoutube        bool `json:"social_youtube"`
-	SocialDeKrant        bool `json:"social_de-krant"`
-	SocialFacebook       bool `json:"social_facebook"`
-	SocialLinkedin       bool `json:"social_linkedin"`
-	SocialTelegram       bool `json:"social_telegram"`
-	SocialWhatsapp       bool `json:"social_whatsapp"`
-	SocialInstagram      bool `json:"social_instagram"`
-	SocialUnselected     bool `json:"social_unselected"`
-	SocialNieuwswebsites bool `json:"social_nieuwswebsites"`
-
-	BrowserBrave         bool `json:"browser_brave"`
-	BrowserOpera         bool `json:"browser_opera"`
-	BrowserChrome        bool `json:"browser_chrome"`
-	BrowserSafari        bool `json:"browser_safari"`
-	BrowserFirefox       bool `json:"browser_firefox"`
-	BrowserUnselected    bool `json:"browser_unselected"`
-	BrowserMicrosoftEdge bool `json:"browser_microsoft-edge"`
-
-	LanguageDuits        bool `json:"language_duits"`
-	LanguageFrans        bool `json:"language_frans"`
-	LanguageEngels       bool `json:"language_engels"`
-	LanguageSpaans       bool `json:"language_spaans"`
-	LanguageItaliaans    bool `json:"language_italiaans"`
-	LanguageNederlands   bool `json:"language_nederlands"`
-	LanguageUnselected   bool `json:"language_unselected"`
-
-	SearchEngineBing       bool `json:"search_engine_bing"`
-	SearchEngineYahoo      bool `json:"search_engine_yahoo"`
-	SearchEngineAnders     bool `json:"search_engine_anders"`
-	SearchEngineEcosia     bool `json:"search_engine_ecosia"`
-	SearchEngineGoogle     bool `json:"search_engine_google"`
-	SearchEngineStartpage  bool `json:"search_engine_startpage"`
-	SearchEngineDuckduckgo bool `json:"search_engine_duckduckgo"`
-	SearchEngineUnselected bool `json:"search_engine_unselected"`
-}
-
-type OutputSearch struct {
-	ID          int    `json:"id"`
-	Token       string `json:"token"`
-	Timestamp   string `json:"timestamp"`
-
-	Url         string `json:"url"`
-	Website     string `json:"website"`
-	Keyword     string `json:"keyword"`
-
-	Browser       map[string]any `json:"browser"`
-	Localization  string          `json:"localization"`
-
-	Form     *models.Form `json:"form"`
-	Results  map[string]any `json:"results"`
-}
+type OutputUser   = export.OutputUser
+type OutputSearch = export.OutputSearch
 
 // ------------------------------------------------------------
 // : Locals
 // ------------------------------------------------------------
 var (
-	gk = gatekeeper.NewGateKeeper(true)
-
 	// Errors
 	ErrInvalidToken         = fmt.Errorf("invalid token")
+	ErrRecipientForbidden   = fmt.Errorf("recipient does not match the token")
 	ErrInvalidDays          = fmt.Errorf("invalid days parameter")
 	ErrInternal             = fmt.Errorf("internal server error")
 )
@@ -117,824 +45,593 @@ var (
 // ------------------------------------------------------------
 // : Helpers
 // ------------------------------------------------------------
-func parseTokenParameter(r *http.Request) (string, error) {
-	token := r.URL.Query().Get("token")
-
-	if token == "dse2024" {
-		return token, nil
-	}
-
-	return token, ErrInvalidToken
-}
+// parseTokenParameter checks the download token and returns the
+// pseudonymiser every download of the caller goes through:
+//
+//   - admins get internal exports, or those of the recipient they name
+//   - the internal token gets internal exports and cannot name a recipient
+//   - a recipient's own key gets that recipient's profile, and nothing else
+func parseTokenParameter(r *http.Request) (*export.Pseudonymiser, error) {
+	token     := r.URL.Query().Get("token")
+	recipient := r.URL.Query().Get("recipient")
 
-func parseDaysParameter(r *http.Request) (int, error) {
-	days := r.URL.Query().Get("days")
+	switch {
+		case auth.IsAdmin(r):
+			if recipient == "" {
+				return nil, nil
+			}
+			return export.NewPseudonymiser(recipient)
 
-	if days == "" {
-		return 1000, nil
+		case token == "dse2024":
+			if recipient != "" {
+				return nil, ErrRecipientForbidden
+			}
+			return nil, nil
 	}
 
-	value, err := strconv.Atoi(days)
+	p, err := export.Authenticate(token)
 	if err != nil {
-		return 0, ErrInvalidDays
+		return nil, ErrInvalidToken
 	}
-
-	if value < 0 {
-		return 0, ErrInvalidDays
+	if recipient != "" && recipient != p.Recipient {
+		return nil, ErrRecipientForbidden
 	}
-
-	return value, nil
+	return p, nil
 }
 
-func parseStartEndParameters(r *http.Request) (time.Time, time.Time, error) {
-    const layout0 = time.RFC3339
-    const layout1 = "2006-01-02"
-
-    start := r.URL.Query().Get("start")
-    end   := r.URL.Query().Get("end")
-
-    var timestart, timeend time.Time
-    var err error
-
-	if start == "" || end == "" {
-		return time.Time{}, time.Time{}, nil
-	}
-
-    // Parse start time
-    timestart, err = time.Parse(layout0, start)
-    if err != nil {
-        timestart, err = time.Parse(layout1, start)
-        if err != nil {
-            return time.Time{}, time.Time{}, fmt.Errorf("invalid start time format")
-        }
-        // Set to start of the day
-        timestart = timestart.Truncate(24 * time.Hour)
-    }
-
-    // Parse end time
-    timeend, err = time.Parse(layout0, end)
-    if err != nil {
-        timeend, err = time.Parse(layout1, end)
-        if err != nil {
-            return time.Time{}, time.Time{}, fmt.Errorf("invalid end time format")
-        }
-        // Set to end of the day
-        timeend = timeend.Add(24*time.Hour - time.Second)
-    }
-
-    return timestart, timeend, nil
-}
-
-func parseTimestampFromLogLine(line string) (time.Time, error) {
-	timestr := gjson.Get(line, "time").String()
-	if timestr == "" {
-		return time.Time{}, fmt.Errorf("missing time field")
+// writeTokenError answers a request parseTokenParameter rejected.
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch {
+		case errors.Is(err, ErrInvalidToken)      : httpio.WriteError(w, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, ErrRecipientForbidden): httpio.WriteError(w, http.StatusForbidden, err.Error())
+		default                                   : httpio.WriteError(w, http.StatusBadRequest, err.Error())
 	}
+}
 
-	timestamp, err := time.Parse(time.RFC3339, timestr)
-	if err != nil {
-		return time.Time{}, err
+// recipient is the recipient a caller downloads for, empty for internal
+// exports.
+func recipient(p *export.Pseudonymiser) string {
+	if p == nil {
+		return ""
 	}
-
-	return timestamp, nil
+	return p.Recipient
 }
 
-func reverseBytes(b []byte) []byte {
-	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
-		b[i], b[j] = b[j], b[i]
+// parseListParameter collects a repeatable, comma separated query parameter.
+func parseListParameter(r *http.Request, name string) []string {
+	values := []string{}
+	for _, param := range r.URL.Query()[name] {
+		for _, value := range strings.Split(param, ",") {
+			value = strings.TrimSpace(value)
+			if value != "" {
+				values = append(values, value)
+			}
+		}
 	}
-	return b
+	return values
 }
 
+// parseFilter reads the export filter shared by the search downloads:
+// keyword, website, tokens, version and study lists plus a date range given
+// either as start/end or as a number of days.
+func parseFilter(r *http.Request) (export.Filter, *valgo.Validation) {
+	var filter = export.Filter{}
+	var query  = r.URL.Query()
+	var v      = valgo.New()
 
-func loadUsers() ([]*models.User, error) {
-	users := make([]*models.User, 0)
-	stream, err := db.StreamUsers()
-	if err != nil { return nil, err }
-
-	for user := range stream {
-		if user == nil { break }
-		users = append(users, user)
-	}
-
-	return users, nil
-}
+	filter.Keywords = parseListParameter(r, "keyword")
+	filter.Websites = parseListParameter(r, "website")
+	filter.Tokens   = parseListParameter(r, "tokens")
+	filter.Versions = parseListParameter(r, "version")
+	filter.Study    = query.Get("study")
 
-func loadUserMap() (map[string]*models.User, error) {
-	users := make(map[string]*models.User, 0)
-	stream, err := db.StreamUsers()
-	if err != nil { return nil, err }
+	parseRange(v, &filter, query.Get("days"), query.Get("start"), query.Get("end"))
 
-	for user := range stream {
-		if user == nil { break }
-		users[user.Token] = user
+	if v.Valid() {
+		if err := filter.Validate(); err != nil {
+			v.AddErrorMessage("filter", err.Error())
+		}
 	}
 
-	return users, nil
+	return filter, v
 }
 
-func transformSearch(search *models.Search, user *models.User) (*OutputSearch, error) {
-	var output = &OutputSearch{}
-	var skip = false
+// parseRange reads the date range of a filter, given either as a number of
+// days or as start/end. A date-only end includes that whole day, so
+// start=2024-11-01&end=2024-11-02 covers two days.
+func parseRange(v *valgo.Validation, filter *export.Filter, days string, start string, end string) {
+	fn := func(value string) bool { return datetime.Parse(value).IsZero() == false }
 
-	func() {
-		b, err := search.Metadata.Value()
-		if err != nil {
-			skip = true
-		}
+	switch {
+		case days != "" && (start != "" || end != ""):
+			v.AddErrorMessage("parameters", "Cannot specify both days and start/end")
 
-		var parsed = gjson.ParseBytes(b)
+		case days != "":
+			d := cast.ToInt(days)
+			v.Is(valgo.Int(d, "days").GreaterThan(0).LessThan(10000))
+			filter.Start = datetime.Now().SubDays(d).StdTime()
 
-		output.ID        = int(search.ID)
-		output.Token     = search.Token
-		output.Timestamp = search.Timestamp
+		case start != "":
+			v.Is(valgo.String(start, "start").Passing(fn))
+			filter.Start = datetime.Parse(start).StdTime()
 
-		output.Url     = parsed.Get("url").String()
-		output.Website = parsed.Get("website").String()
-		output.Keyword = parsed.Get("keyword").String()
+			if end != "" {
+				v.Is(valgo.String(end, "end").Passing(fn))
+				filter.End = datetime.Parse(end).StdTime()
 
-		output.Browser, _ = parsed.Get("browser").Value().(map[string]any)
+				if _, err := time.Parse(time.DateOnly, end); err == nil {
+					filter.End = datetime.Parse(end).EndOfDay().StdTime()
+				}
+			}
 
-		output.Localization = parsed.Get("localization").String()
-		output.Results, _   = parsed.Get("results").Value().(map[string]any)
+		case end != "":
+			v.AddErrorMessage("parameters", "Start must be specified if end is provided")
+	}
 
-		output.Form = user.State.Client.User.Form
+	if v.IsValid("days")  == false { v.AddErrorMessage("days" , "Days is invalid")  }
+	if v.IsValid("start") == false { v.AddErrorMessage("start", "Start is invalid") }
+	if v.IsValid("end")   == false { v.AddErrorMessage("end"  , "End is invalid")   }
+}
 
-		if output.Results == nil || len(output.Results) == 0 {
-			skip = true
-		}
-	}()
+func parseFormatParameter(r *http.Request) (export.Format, *valgo.Validation) {
+	v := valgo.New()
 
-	if skip {
-		return nil, ErrInternal
+	format, err := export.ParseFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		v.AddErrorMessage("format", err.Error())
 	}
 
-	return output, nil
+	return format, v
 }
 
-func LoadData() {
-	defer gk.Unlock()
-
-	if file.Exists("searches.json") {
-		t, err := file.GetModified("searches.json")
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get modified time")
-			return
-		}
+// writeHeaders sets the headers of a download in the given format, named
+// after the resource and the current date (e.g. searches-2025-01-28.csv).
+func writeHeaders(w http.ResponseWriter, format export.Format, name string) {
+	filename := fmt.Sprintf("%s-%s.%s", name, datetime.Now().ToDateString(), format.Extension())
 
-		if time.Since(t) < 10 * time.Minute {
-			return
-		}
-	}
+	w.Header().Set("Content-Type"       , format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control"      , "no-cache")
+	w.WriteHeader(http.StatusOK)
+}
 
-	meta := struct {
-		users map[string]*models.User // From current table
-		forms map[string]*models.Form // From backup table
-	}{}
-	meta.users = make(map[string]*models.User)
-	meta.forms = make(map[string]*models.Form)
+// writeSearches streams the searches matching the filter in the requested
+// format. Every search download goes through here, see export.Export.
+func writeSearches(w http.ResponseWriter, r *http.Request, format export.Format, filter export.Filter, pseudonymiser *export.Pseudonymiser) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
 
-	{ // Users
-		var err error
-		query     := `SELECT * FROM public.users`
-		rows, err := db.Query(query)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to query users")
-		}
+	users, err := export.LoadUsers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load users")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-		for rows.Next() {
-			var user models.User
-			err := rows.Scan(&user.Token, &user.State)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to scan user")
-			}
+	writeHeaders(w, format, "searches")
 
-			meta.users[user.Token] = &user
-		}
+	writer := export.NewSearchWriter(flushWriter{w}, format).Pseudonymise(pseudonymiser)
+	if _, err := export.Export(ctx, filter, users, writer); err != nil {
+		log.Error().Err(err).Msg("Failed to export searches")
 	}
 
-	{ // Forms
-		query := `SELECT * FROM public.users_2 as users`
-		rows, err := db.Query(query)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to query users")
-		}
+	if err := writer.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close writer")
+	}
+}
 
-		for rows.Next() {
-			var err error
-			var token string
-			var data map[string]any
-			var form models.Form
+// flushWriter flushes every write, so large downloads reach the client as
+// they are produced instead of when the handler returns.
+type flushWriter struct {
+	w http.ResponseWriter
+}
 
-			err = rows.Scan(&token, &data)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to scan user")
-			}
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
 
-			o, has := object.Get(data, "client.user.form")
-			if has == false {
-				continue
-			}
+func parseTimestampFromLogLine(line string) (time.Time, error) {
+	timestr := gjson.Get(line, "time").String()
+	if timestr == "" {
+		return time.Time{}, fmt.Errorf("missing time field")
+	}
 
-			err = object.ToStruct(o, &form)
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to convert form")
-			}
+	timestamp, err := time.Parse(time.RFC3339, timestr)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-			if form.Sex == "" {
-				continue
-			}
+	return timestamp, nil
+}
 
-			meta.forms[token] = &form
-		}
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
 	}
+	return b
+}
 
-	{ // Merge
-		for token, form := range meta.forms {
-			user, has := meta.users[token]
-			if has == false {
-				continue
-			}
-
-			user.State.Client.User.Form.Sex = form.Sex
-		}
 
-		cusers := 0
+// ------------------------------------------------------------
+// : Download Users
+// ------------------------------------------------------------
+func GetUsers(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := parseTokenParameter(r)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid token")
+		writeTokenError(w, err)
+		return
+	}
 
-		for _, user := range meta.users {
-			if user.State.Client.User.Form.Sex != "" {
-				cusers += 1
-			}
-		}
+	format, v := parseFormatParameter(r)
+	if v.Valid() == false {
+		httpio.WriteValidationError(w, v)
+		return
 	}
 
-	{ // Output
-		var err error
-		counter := 0
+	users, err := export.LoadUsers(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load users")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		f, err := os.Create("searches.json")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to create output file")
-		}
-		defer f.Close()
+	tokens := make([]string, 0, len(users))
+	for token := range users {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
 
-		ctx := context.Background()
-		query := `SELECT * FROM public.searches`
-		ch, err := db.QueryWithLimit(ctx, query, 10000)
+	writeHeaders(w, format, "users")
 
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to query searches")
+	writer := export.NewUserWriter(w, format).Pseudonymise(pseudonymiser)
+	for _, token := range tokens {
+		if err := writer.WriteUser(users[token]); err != nil {
+			log.Error().Err(err).Msg("Failed to write user")
+			return
 		}
+	}
 
-		for row := range ch {
-			var ok bool
-			var user *models.User
-			search := &models.Search{}
-
-			id, ok := row[0].(int64)
-			if !ok {
-				log.Fatal().Msg("Failed to convert row[0] to int64")
-			}
-
-			token, ok := row[1].(string)
-			if !ok {
-				log.Fatal().Msg("Failed to convert row[1] to string")
-			}
+	if err := writer.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close writer")
+	}
+}
 
-			timestamp, ok := row[2].(time.Time)
-			if !ok {
-				log.Fatal().Msg("Failed to convert row[2] to time.Time")
-			}
+// ------------------------------------------------------------
+// : Export Jobs
+// ------------------------------------------------------------
 
-			metadata, ok := row[3].(map[string]any)
-			if !ok {
-				log.Fatal().Msg("Failed to convert row[3] to map[string]any")
+// parseJobRequest reads the filter spec of an export job from the request
+// body. It accepts the same fields as the search downloads:
+//
+//	{"keyword": [...], "website": [...], "tokens": [...], "version": [...],
+//	 "study": "...", "days": 7 | "start": "...", "end": "...", "format": "csv",
+//	 "recipient": "..."}
+func parseJobRequest(r *http.Request) (export.Filter, export.Format, string, *valgo.Validation) {
+	var filter = export.Filter{}
+	var v      = valgo.New()
+
+	body, err := httpio.ReadJSON(r)
+	if err != nil || (body.Raw != "" && !body.IsObject()) {
+		v.AddErrorMessage("body", "Body must be a JSON object")
+		return filter, "", "", v
+	}
+
+	list := func(key string) []string {
+		values := []string{}
+		body.Get(key).ForEach(func(_, value gjson.Result) bool {
+			if value := strings.TrimSpace(value.String()); value != "" {
+				values = append(values, value)
 			}
+			return true
+		})
+		return values
+	}
 
-			search.ID        = uint64(id)
-			search.Token     = token
-			search.Timestamp = datetime.FromTime(timestamp).ToIso8601String()
-			search.Metadata  = metadata
-
-			user = meta.users[token]
-
-			output, _ := sjson.Set("", "id", int(search.ID))
-			output, _ = sjson.Set(output, "token", search.Token)
-			output, _ = sjson.Set(output, "timestamp", search.Timestamp)
-
-			b, err := search.Metadata.Value()
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to convert metadata to bytes")
-			}
+	filter.Keywords = list("keyword")
+	filter.Websites = list("website")
+	filter.Tokens   = list("tokens")
+	filter.Versions = list("version")
+	filter.Study    = body.Get("study").String()
 
-			parsed := gjson.ParseBytes(b)
+	parseRange(v, &filter, body.Get("days").String(), body.Get("start").String(), body.Get("end").String())
 
-			output, _ = sjson.Set(output, "url", parsed.Get("url").String())
-			output, _ = sjson.Set(output, "website", parsed.Get("website").String())
-			output, _ = sjson.Set(output, "keyword", parsed.Get("keyword").String())
+	format, err := export.ParseFormat(body.Get("format").String())
+	if err != nil {
+		v.AddErrorMessage("format", err.Error())
+	}
 
-			browser, _ := parsed.Get("browser").Value().(map[string]any)
-			output, _ = sjson.Set(output, "browser", browser)
+	if v.Valid() {
+		if err := filter.Validate(); err != nil {
+			v.AddErrorMessage("filter", err.Error())
+		}
+	}
 
-			output, _ = sjson.Set(output, "localization", parsed.Get("localization").String())
+	return filter, format, body.Get("recipient").String(), v
+}
 
-			mapping, ok := parsed.Get("results").Value().(map[string]interface{})
-			var results []interface{}
-			if ok {
-				results, _ = mapping["search_result"].([]interface{})
-			}
+// parseJob resolves the {id} route parameter, writing the error response
+// when the job does not exist or belongs to another recipient.
+func parseJob(w http.ResponseWriter, r *http.Request) (*export.Job, bool) {
+	pseudonymiser, err := parseTokenParameter(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return nil, false
+	}
 
-			output, _ = sjson.Set(output, "results", results)
-			output, _ = sjson.Set(output, "form", user.State.Client.User.Form)
+	job, err := export.GetJob(chi.URLParam(r, "id"))
+	if err != nil || !visible(r, pseudonymiser, job.Snapshot()) {
+		httpio.WriteError(w, http.StatusNotFound, export.ErrJobNotFound.Error())
+		return nil, false
+	}
 
-			if results == nil || len(results) == 0 {
-				continue
-			}
+	return job, true
+}
 
-			f.WriteString(fmt.Sprintf("%s\n", output))
-			counter += 1
-		}
-	}
+// visible reports whether a caller may see a job: admins see every job,
+// everyone else only the jobs made for them.
+func visible(r *http.Request, p *export.Pseudonymiser, job *export.Job) bool {
+	return auth.IsAdmin(r) || job.Recipient == recipient(p)
 }
 
-// ------------------------------------------------------------
-// : Download Users
-// ------------------------------------------------------------
-func GetUsers(w http.ResponseWriter, r *http.Request) {
-	_, err := parseTokenParameter(r)
+// curl -X POST 'http://localhost:5000/api/download/jobs?token=dse2024' -d '{"days": 7, "format": "csv"}'
+func PostJob(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := parseTokenParameter(r)
 	if err != nil {
-		log.Error().Err(err).Msg("Invalid token")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeTokenError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	users, err := loadUsers()
-	if err != nil {
-		log.Error().Err(err).Msg("")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	filter, format, named, v := parseJobRequest(r)
+	if v.Valid() == false {
+		httpio.WriteValidationError(w, v)
 		return
 	}
 
-	first := true
-
-	for _, user := range users {
-		b, err := json.ToBytes(user)
-		if err != nil {
-			log.Error().Err(err).Msg("")
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+	// Only admins export for a recipient other than the token's
+	target := recipient(pseudonymiser)
+	if named != "" && named != target {
+		if !auth.IsAdmin(r) {
+			writeTokenError(w, ErrRecipientForbidden)
 			return
 		}
+		target = named
+	}
 
-		if first {
-			first = false
-			w.Write([]byte(fmt.Sprintf("%s", b)))
-		} else {
-			w.Write([]byte(fmt.Sprintf(",\n%s", b)))
-		}
+	job, err := export.Submit(filter, format, target)
+	if errors.Is(err, export.ErrInvalidRecipient) || errors.Is(err, export.ErrMissingSecret) {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to submit export job")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to submit export job")
+		return
 	}
-}
 
-// ------------------------------------------------------------
-// : Download Searches
-// ------------------------------------------------------------
-// http://localhost:5000/api/download/searches?token=dse2024&start=2024-11-01&end=2024-11-02
-// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches?token=dse2024&days=1
-// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches?token=dse2024&start=2024-11-01&end=2024-11-02
-// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches?token=dse2024&start=2024-11-01T00:00:00Z&end=2024-11-02T00:00:00Z
-func HandleDownloadSearches(w http.ResponseWriter, r *http.Request) {
-    // Parse parameters
-    _, err := parseTokenParameter(r)
-    if err != nil {
-        log.Error().Err(err).Msg("Invalid token")
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    days, err := parseDaysParameter(r)
-    if err != nil {
-        log.Error().Err(err).Msg("Invalid days parameter")
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    timestart, timeend, err := parseStartEndParameters(r)
-    if err != nil {
-        log.Error().Err(err).Msg("Invalid start or end parameter")
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    // Set response headers
-    w.Header().Set("Content-Type", "application/json")
-    w.Header().Set("Cache-Control", "no-cache")
-    w.WriteHeader(http.StatusOK)
-
-    // Load user data
-    users, err := loadUserMap()
-    if err != nil {
-        log.Error().Err(err).Msg("Failed to load users")
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
-    defer cancel()
-
-    mutex   := &sync.Mutex{}
-    offset  := 0
-    limit   := 5_000
-    channel := make(chan *models.Search, 50_000)
-
-    go func() {
-        defer close(channel)
-        for {
-            count := 0 // Reset count at the start of each loop iteration
-
-            var params []interface{}
-            param_index := 1
-
-            var builder strings.Builder
-            builder.WriteString("SELECT searches.*, users.* FROM searches LEFT JOIN users ON searches.token = users.token")
-
-            // Build WHERE clause based on parameters
-            if !timestart.IsZero() && !timeend.IsZero() {
-                builder.WriteString(fmt.Sprintf(" WHERE timestamp BETWEEN $%d AND $%d", param_index, param_index+1))
-                params = append(params, timestart, timeend)
-                param_index += 2
-            } else if days > 0 {
-                builder.WriteString(fmt.Sprintf(" WHERE timestamp >= NOW() - INTERVAL '%d days'", days))
-                // No additional parameters needed
-            }
-
-            // Add ORDER BY, OFFSET, and LIMIT clauses
-            builder.WriteString(" ORDER BY timestamp DESC")
-            builder.WriteString(fmt.Sprintf(" OFFSET $%d LIMIT $%d", param_index, param_index+1))
-            params = append(params, offset, limit)
-
-            query := builder.String()
-
-            mutex.Lock()
-            rows, err := db.QueryWithContext(ctx, query, params...)
-            mutex.Unlock()
-            if err != nil {
-                log.Error().Err(err).Msg("Failed to query searches")
-                http.Error(w, err.Error(), http.StatusInternalServerError)
-                return
-            }
-
-            for rows.Next() {
-                count++
-
-                var user      models.User
-                var search    models.Search
-                var timestamp time.Time
-
-                err = rows.Scan(
-                    &search.ID,
-                    &search.Token,
-                    &timestamp,
-                    &search.Metadata,
-                    &user.Token,
-                    &user.State,
-                )
-                if err != nil {
-                    log.Error().Err(err).Msg("Failed to scan search")
-                    return
-                }
-
-                search.Timestamp = datetime.FromTime(timestamp).ToIso8601String()
-
-                select {
-                case <-ctx.Done():
-                    return
-                case channel <- &search:
-                }
-            }
-
-            rows.Close()
-
-            if count < limit {
-                break
-            }
-            offset += limit
-        }
-    }()
-
-    for search := range channel {
-        select {
-        case <-ctx.Done():
-            return
-        default:
-            user := users[search.Token]
-            if user == nil {
-                continue
-            }
-
-            output, err := transformSearch(search, user)
-            if err != nil {
-                continue
-            }
-
-            encoded, err := json.ToBytes(output)
-            if err != nil {
-                continue
-            }
-
-            w.Write(encoded)
-            w.Write([]byte("\n"))
-        }
-    }
+	w.Header().Set("Location", fmt.Sprintf("%s/%s", r.URL.Path, job.ID))
+	httpio.WriteJSON(w, http.StatusAccepted, json.JSON{"job": job.Snapshot()})
 }
 
-// http://localhost:5000/api/download/searches/merge?token=dse2024&start=2024-11-01&end=2024-11-02
-func HandleDownloadSearches2(w http.ResponseWriter, r *http.Request) {
-	request := struct {
-		token   string
-		start   string
-		end     string
-		days	string
-	}{}
-
-	request.token = r.URL.Query().Get("token")
-	request.start = r.URL.Query().Get("start")
-	request.end   = r.URL.Query().Get("end")
-	request.days  = r.URL.Query().Get("days")
-	
-	validation := valgo.New()
-	validation.Is(valgo.String(request.token, "token").EqualTo("dse2024"))
+func GetJobs(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := parseTokenParameter(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
 
-	switch {
-		case request.days != "": {
-			validation.Is(valgo.String(request.days, "days").GreaterThan("0").LessThan("10000"))
+	list := []*export.Job{}
+	for _, job := range export.Jobs() {
+		if visible(r, pseudonymiser, job) {
+			list = append(list, job)
 		}
+	}
 
-		case request.start != "" && request.end != "": {
-			fn := func(value string) bool { return datetime.Parse(value).IsZero() == false }
-			validation.Is(valgo.String(request.start, "start").Passing(fn))
-			validation.Is(valgo.String(request.end  , "end")  .Passing(fn))
-		}
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"jobs": list})
+}
 
-		default: {
-			request.days = "9999"
-		}
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := parseJob(w, r)
+	if !ok {
+		return
 	}
 
-	if validation.IsValid("token") == false { validation.AddErrorMessage("token", "Token is invalid") }
-	if validation.IsValid("start") == false { validation.AddErrorMessage("start", "Start is invalid") }
-	if validation.IsValid("end")   == false { validation.AddErrorMessage("end"  , "End is invalid")   }
-	if validation.IsValid("days")  == false { validation.AddErrorMessage("days" , "Days is invalid")  }
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"job": job.Snapshot()})
+}
 
-	if validation.Valid() == false {
-		httpio.WriteValidationError(w, validation)
+func GetJobManifest(w http.ResponseWriter, r *http.Request) {
+	job, ok := parseJob(w, r)
+	if !ok {
 		return
 	}
 
-	// Set response headers
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.WriteHeader(http.StatusOK)
-
-	state := struct {
-		Type  int
+	snapshot := job.Snapshot()
+	if snapshot.Manifest == nil {
+		httpio.WriteError(w, http.StatusConflict, export.ErrJobNotDone.Error())
+		return
+	}
 
-		Start carbon.Carbon
-		End   carbon.Carbon
-		Days  int
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"manifest": snapshot.Manifest})
+}
 
-		Offset int
-		Limit  int
-		Rows   int
-		
-		Query string
-		
-		Users map[string]*models.User // From current table
-		Forms map[string]*models.Form // From backup table
+// GetJobFile serves the artifact of a finished job. Range and If-Range
+// requests are handled by http.ServeContent, so interrupted downloads can be
+// resumed; the ETag is the artifact checksum.
+func GetJobFile(w http.ResponseWriter, r *http.Request) {
+	job, ok := parseJob(w, r)
+	if !ok {
+		return
+	}
 
-		Mutex *sync.Mutex
-		Channel chan *models.Search
-	}{}
+	f, manifest, err := job.Open()
+	if err != nil {
+		httpio.WriteError(w, http.StatusConflict, err.Error())
+		return
+	}
+	defer f.Close()
 
-	state.Mutex   = &sync.Mutex{}
-	state.Channel = make(chan *models.Search, 50_000)
+	filename := fmt.Sprintf("%s-%s", job.ID, manifest.File)
 
-	state.Users = make(map[string]*models.User, 0)
-	state.Forms = make(map[string]*models.Form, 0)
+	w.Header().Set("Content-Type"       , manifest.Format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("ETag"               , fmt.Sprintf(`"%s"`, manifest.Checksum))
+	w.Header().Set("X-Checksum"         , manifest.Checksum)
 
-	state.Offset  = 0     // Current page
-	state.Limit   = 5_000 // Items per page
-	state.Rows    = 0
+	http.ServeContent(w, r, filename, manifest.Finished, f)
+}
 
-	switch {
-		case request.start != "" && request.end != "": {
-			state.Type  = 1
-			state.Start = datetime.Parse(request.start)
-			state.End   = datetime.Parse(request.end)
-		}
+// ------------------------------------------------------------
+// : Snapshot
+// ------------------------------------------------------------
 
-		case request.days != "": {
-			state.Type    = 2
-			state.Days, _ = strconv.Atoi(request.days)
-		}
+// LoadData appends the searches since the last run to the snapshot.
+func LoadData() {
+	partition, err := export.UpdateSnapshot(context.Background())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update snapshot")
+		return
 	}
 
-	wg := conc.NewWaitGroup()
-
-	// Load users from current table
-	wg.Go(func() {
-		query := `
-			SELECT 
-				users.token, 
-				users.state 
-			FROM 
-				public.users as users
-		`
-
-		rows, err := db.Query(query)
-		if err != nil {
-			panic(err)
-		}
+	if partition != nil {
+		log.Info().Int("seq", partition.Seq).Int64("watermark", partition.To).Int64("searches", partition.Searches).Msg("Updated snapshot")
+	}
+}
 
-		for rows.Next() {
-			user := &models.User{}
-			err  := rows.Scan(&user.Token, &user.State)
-			if err != nil {
-				panic(err)
-			}
+func GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	if _, err := parseTokenParameter(r); err != nil {
+		writeTokenError(w, err)
+		return
+	}
 
-			state.Users[user.Token] = user
-		}
-	})
-
-	// Load users from backup table
-	wg.Go(func() {
-		query := `
-			SELECT
-				users.token,
-				users.state
-			FROM
-				public.users_2 as users
-		`
-
-		rows, err := db.Query(query)
-		if err != nil {
-			panic(err)
-		}
+	snapshot, err := export.ReadSnapshot()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read snapshot")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to read snapshot")
+		return
+	}
 
-		for rows.Next() {
-			usertoken := ""
-			userstate := map[string]any{}
-			err  := rows.Scan(&usertoken, &userstate)
-			if err != nil {
-				panic(err)
-			}
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"snapshot": snapshot})
+}
 
-			o, has := object.Get(userstate, "client.user.form")
-			if has == false {
-				continue
-			}
+// GetSnapshotSince streams every search above the watermark. The response
+// carries the new watermark in X-Watermark, to be passed on the next call.
+//
+// http://localhost:5000/api/download/snapshot/since?token=dse2024&watermark=120000
+func GetSnapshotSince(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := parseTokenParameter(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
 
-			form := &models.Form{}
-			
-			b, err := json.ToBytes(o)
-			json.FromBytes(b, form)
+	watermark, err := strconv.ParseInt(r.URL.Query().Get("watermark"), 10, 64)
 
-			if form.Age == "" {
-				continue
-			}
+	v := valgo.New()
+	if err != nil || watermark < 0 {
+		v.AddErrorMessage("watermark", "Watermark must be a search ID")
+	}
 
-			state.Forms[usertoken] = form
-		}
-	})
+	if v.Valid() == false {
+		httpio.WriteValidationError(w, v)
+		return
+	}
 
-	err := wg.WaitAndRecover().AsError()
+	snapshot, err := export.ReadSnapshot()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to load users")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Error().Err(err).Msg("Failed to read snapshot")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to read snapshot")
 		return
 	}
 
-	// Merge users
-	wg.Go(func() {
-		for token, form := range state.Forms {
-			if form.Age == "" {
-				continue
-			}
+	w.Header().Set("X-Watermark", strconv.FormatInt(snapshot.Watermark, 10))
+	writeHeaders(w, export.FormatNDJSON, fmt.Sprintf("searches-since-%d", watermark))
 
-			if user, exists := state.Users[token]; exists {
-				user.State.Client.User.Form = form
-			}
-		}
-	})
+	if err := snapshot.Since(flushWriter{w}, watermark, pseudonymiser); err != nil {
+		log.Error().Err(err).Msg("Failed to stream snapshot")
+	}
+}
 
-	err = wg.WaitAndRecover().AsError()
+// GetSnapshotPartition serves a single partition with Range support.
+// Recipients get the partition rewritten for their profile, without ranges.
+func GetSnapshotPartition(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := parseTokenParameter(r)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to merge users")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeTokenError(w, err)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
-    defer cancel()
-
-	go func() {
-		defer close(state.Channel)
-		for {
-			state.Rows = 0 // Reset row counter
-			
-			builder := strings.Builder{}
-            builder.WriteString(`SELECT * FROM public.searches`)
-
-			switch {
-				// Start and End specified
-				case state.Type == 1: { 
-					start := state.Start.SetTimezone("UTC").ToIso8601ZuluString()
-					end   := state.End.SetTimezone("UTC").ToIso8601ZuluString()
-					builder.WriteString(fmt.Sprintf(" WHERE timestamp BETWEEN '%s' AND '%s'\n", start, end))
-				}
-
-				// Days specified
-				case state.Type == 2: { 
-					days := state.Days
-					builder.WriteString(fmt.Sprintf(" WHERE timestamp >= NOW() - INTERVAL '%d days'\n", days))
-				}
-			}
-
-			builder.WriteString(" ORDER BY timestamp DESC\n")
-			builder.WriteString(fmt.Sprintf(" OFFSET %d LIMIT %d", state.Offset, state.Limit))
-
-			state.Query = builder.String()
+	snapshot, err := export.ReadSnapshot()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read snapshot")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to read snapshot")
+		return
+	}
 
-			println(state.Query)
+	seq := cast.ToInt(chi.URLParam(r, "seq"))
 
-			state.Mutex.Lock()
-			rows, err := db.QueryWithContext(ctx, state.Query)
-			state.Mutex.Unlock()
+	if pseudonymiser != nil {
+		f, _, err := snapshot.OpenPartition(seq)
+		if err != nil {
+			httpio.WriteError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		f.Close()
 
-			for rows.Next() {
-				state.Rows += 1
+		writeHeaders(w, export.FormatNDJSON, fmt.Sprintf("partition-%06d", seq))
+		if err := snapshot.WritePartition(flushWriter{w}, seq, pseudonymiser); err != nil {
+			log.Error().Err(err).Msg("Failed to stream partition")
+		}
+		return
+	}
 
-				var search models.Search
-				var timestamp time.Time
+	f, partition, err := snapshot.OpenPartition(seq)
+	if err != nil {
+		httpio.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer f.Close()
 
-				err = rows.Scan(
-					&search.ID,
-					&search.Token,
-					&timestamp,
-					&search.Metadata,
-				)
+	w.Header().Set("Content-Type", export.FormatNDJSON.ContentType())
+	w.Header().Set("ETag"        , fmt.Sprintf(`"%s"`, partition.Checksum))
+	w.Header().Set("X-Checksum"  , partition.Checksum)
 
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to scan search")
-					return
-				}
+	http.ServeContent(w, r, partition.File, partition.Created, f)
+}
 
-				search.Timestamp = datetime.FromTime(timestamp).ToIso8601String()
+// ------------------------------------------------------------
+// : Pseudonyms
+// ------------------------------------------------------------
 
-				select {
-					case <-ctx.Done(): return
-					case state.Channel <- &search:
-				}
-			}
-			rows.Close()
+// GetPseudonym reverses a pseudonym of a recipient. Admin only.
+//
+// curl -H 'Authorization: Bearer $ADMIN_TOKEN' http://localhost:5000/api/admin/pseudonyms/uva/3f2a...
+func GetPseudonym(w http.ResponseWriter, r *http.Request) {
+	pseudonymiser, err := export.NewPseudonymiser(chi.URLParam(r, "recipient"))
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-			if state.Rows < state.Limit {
-				break
-			}
+	pseudonym := chi.URLParam(r, "pseudonym")
+	token, err := pseudonymiser.Reverse(r.Context(), pseudonym)
+	if errors.Is(err, export.ErrUnknownPseudonym) {
+		httpio.WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reverse pseudonym")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to reverse pseudonym")
+		return
+	}
 
-			state.Offset += state.Limit
-		}
-	}()
-
-	for search := range state.Channel {
-        select {
-        case <-ctx.Done():
-            return
-        default:
-			user := state.Users[search.Token]
-            if user == nil {
-                continue
-            }
-
-            output, err := transformSearch(search, user)
-            if err != nil {
-                continue
-            }
-
-            encoded, err := json.ToBytes(output)
-            if err != nil {
-                continue
-            }
-
-            w.Write(encoded)
-            w.Write([]byte("\n"))
-        }
-    }
+	log.Info().Str("recipient", pseudonymiser.Recipient).Str("pseudonym", pseudonym).Msg("Reversed pseudonym")
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{"token": token, "recipient": pseudonymiser.Recipient})
 }
 
-
 // ------------------------------------------------------------
 // : Download Log File
 // ------------------------------------------------------------
@@ -1078,122 +775,26 @@ func GetLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// http://localhost/api/download/searches?days=2
-// http://localhost/api/download/searches?start=2025-01-28
-// http://localhost/api/download/searches?start=2025-01-28&end=2025-01-29
-// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches?days=2
-// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches/full?days=2
+// http://localhost/api/download/searches?token=dse2024&days=2
+// http://localhost/api/download/searches?token=dse2024&start=2025-01-28
+// http://localhost/api/download/searches?token=dse2024&start=2025-01-28&end=2025-01-29
+// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches?token=dse2024&days=2
+// https://static.33.56.161.5.clients.your-server.de/dse/api/download/searches/full?token=dse2024&days=2
 func GetSearches(w http.ResponseWriter, r *http.Request) {
-	gk.Wait()
-
-	request := struct {
-		start string
-		end   string
-		days  string
-
-		kind string
-	}{}
-
-	request.kind  = ""
-	request.days  = r.URL.Query().Get("days")
-	request.start = r.URL.Query().Get("start")
-	request.end   = r.URL.Query().Get("end")
-
-	v := valgo.New()
-
-	switch {
-		case request.days != "" && (request.start != "" || request.end != ""):
-			v.AddErrorMessage("parameters", "Cannot specify both days and start/end")
-
-		case request.days != "":
-			d := cast.ToInt(request.days)
-			v.Is(valgo.Int(d, "days").GreaterThan(0).LessThan(10000))
-			request.kind = "days"
-
-		case request.start != "" && request.end != "":
-			fn := func(value string) bool { return datetime.Parse(value).IsZero() == false }
-			v.Is(valgo.String(request.start, "start").Passing(fn))
-			v.Is(valgo.String(request.end, "end").Passing(fn))
-			request.kind = "start_end"
-
-		case request.start != "":
-			fn := func(value string) bool { return datetime.Parse(value).IsZero() == false }
-			v.Is(valgo.String(request.start, "start").Passing(fn))
-			request.end = datetime.Now().ToIso8601String()
-			request.kind = "start"
-
-		case request.end != "":
-			v.AddErrorMessage("parameters", "Start must be specified if end is provided")
-
-		default:
-			request.days = "9999"
-			request.kind = "days"
+	pseudonymiser, err := parseTokenParameter(r)
+	if err != nil {
+		writeTokenError(w, err)
+		return
 	}
 
-	if v.IsValid("days")  == false { v.AddErrorMessage("days" , `days is invalid`)  }
+	filter, v := parseFilter(r)
+	format, f := parseFormatParameter(r)
+	v.Merge(f)
 
 	if v.Valid() == false {
 		httpio.WriteValidationError(w, v)
 		return
 	}
 
-	f, err := file.Open("searches.json")
-	if err != nil {
-		httpio.WriteError(w, http.StatusInternalServerError, "File not found")
-		return 
-	}
-	defer f.Close()
-
-	ctx  := r.Context()
-	buf  := bytes.Buffer{}
-	size := 0
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			line      := scanner.Text()
-			timestamp := json.Get(line, "timestamp").String()
-			var skip bool
-
-			switch request.kind {
-			case "days":
-				cutoff := datetime.Now().SubDays(cast.ToInt(request.days))
-				skip    = cutoff.Gte(datetime.Parse(timestamp))
-			case "start":
-				start := datetime.Parse(request.start)
-				skip   = start.Gte(datetime.Parse(timestamp))
-			case "start_end":
-				start := datetime.Parse(request.start)
-				end   := datetime.Parse(request.end)
-				skip   = start.Gte(datetime.Parse(timestamp)) || end.Lte(datetime.Parse(timestamp))
-			}
-
-			if skip {
-				break
-			}
-
-			line = fmt.Sprintf("%s\n", line)
-			buf.WriteString(line)
-			size++
-
-			if size >= 10000 {
-				w.Write(buf.Bytes())
-				if flusher, ok := w.(http.Flusher); ok {
-					flusher.Flush()
-				}
-				buf.Reset()
-				size = 0
-			}
-		}
-	}
-
-	if buf.Len() > 0 {
-		w.Write(buf.Bytes())
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
-		}
-	}
+	writeSearches(w, r, format, filter, pseudonymiser)
 }
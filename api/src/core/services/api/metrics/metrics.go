@@ -277,12 +277,16 @@ func GetMetricsSearchTotal(w http.ResponseWriter, r *http.Request) {
 // ------------------------------------------------------------
 // : Init
 // ------------------------------------------------------------
-func Init() {
+func Init(ctx context.Context) {
+	go runRollup(ctx)
+
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
 			time_begin = datetime.ToTime(datetime.Now().SubHours(24))
 			time_end   = datetime.ToTime(datetime.Now())
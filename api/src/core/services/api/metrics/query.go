@@ -0,0 +1,326 @@
+package metrics
+
+import (
+	"context"
+	"dse/src/core/services/db"
+	"dse/src/utils/httpio"
+	"dse/src/utils/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Aggregation string
+
+const (
+	AggregationAvg  Aggregation = "avg"
+	AggregationMax  Aggregation = "max"
+	AggregationLast Aggregation = "last"
+)
+
+// Query selects one metric type over an arbitrary range, aggregated into
+// buckets of a fixed size.
+type Query struct {
+	Type        string        `json:"type"`
+	Fields      []string      `json:"fields"`
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Bucket      time.Duration `json:"-"`
+	Aggregation Aggregation   `json:"agg"`
+}
+
+// Point is one bucket, keyed by field name plus "timestamp".
+type Point = Map
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Numeric fields written by the monitor, per metric type
+	fields = map[string][]string{
+		"users"         : {"all", "connected", "disconnected", "consented"},
+		"searches"      : {"count"},
+		"searches_size" : {"size"},
+		"searches_total": {"count"},
+	}
+
+	// Buckets picked when none is given, smallest first
+	buckets = []time.Duration{
+		10 * time.Second,
+		1  * time.Minute,
+		5  * time.Minute,
+		15 * time.Minute,
+		1  * time.Hour,
+		6  * time.Hour,
+		24 * time.Hour,
+	}
+
+	// The monitor samples at most every 5 seconds per type and the old
+	// endpoints used 10 second buckets; smaller buckets would be mostly empty
+	minBucket = 10 * time.Second
+	maxPoints = 5000
+
+	// Errors
+	ErrUnknownType        = errors.New("unknown metric type")
+	ErrUnknownField       = errors.New("unknown metric field")
+	ErrInvalidRange       = errors.New("start must be before end")
+	ErrInvalidBucket      = errors.New("invalid bucket")
+	ErrInvalidAggregation = errors.New("agg must be avg, max or last")
+	ErrTooManyPoints      = errors.New("range and bucket produce too many points")
+)
+
+// ------------------------------------------------------------
+// : Parse
+// ------------------------------------------------------------
+
+// ParseQuery reads a query from URL parameters:
+//
+//	type   metric type (users, searches, searches_size, searches_total)
+//	field  comma separated fields; all fields of the type by default
+//	start  RFC 3339 time; 24 hours before end by default
+//	end    RFC 3339 time; now by default
+//	bucket duration such as 10s, 5m, 1h or 7d; sized to the range by default
+//	agg    avg (default), max or last
+func ParseQuery(r *http.Request) (*Query, error) {
+	params := r.URL.Query()
+
+	q := &Query{
+		Type       : params.Get("type"),
+		End        : time.Now().UTC(),
+		Aggregation: AggregationAvg,
+	}
+
+	known, ok := fields[q.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownType, q.Type)
+	}
+
+	q.Fields = known
+	if value := params.Get("field"); value != "" {
+		q.Fields = strings.Split(value, ",")
+		for _, field := range q.Fields {
+			if !slices.Contains(known, field) {
+				return nil, fmt.Errorf("%w: %q", ErrUnknownField, field)
+			}
+		}
+	}
+
+	if value := params.Get("end"); value != "" {
+		end, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end: %w", err)
+		}
+		q.End = end.UTC()
+	}
+
+	q.Start = q.End.Add(-24 * time.Hour)
+	if value := params.Get("start"); value != "" {
+		start, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start: %w", err)
+		}
+		q.Start = start.UTC()
+	}
+
+	if !q.Start.Before(q.End) {
+		return nil, ErrInvalidRange
+	}
+
+	if value := params.Get("agg"); value != "" {
+		q.Aggregation = Aggregation(value)
+	}
+
+	switch q.Aggregation {
+		case AggregationAvg, AggregationMax, AggregationLast:
+		default: return nil, ErrInvalidAggregation
+	}
+
+	if value := params.Get("bucket"); value != "" {
+		bucket, err := parseBucket(value)
+		if err != nil {
+			return nil, err
+		}
+		q.Bucket = bucket
+	} else {
+		q.Bucket = buckets[len(buckets)-1]
+		for _, bucket := range buckets {
+			if q.points(bucket) <= 500 {
+				q.Bucket = bucket
+				break
+			}
+		}
+	}
+
+	if q.points(q.Bucket) > maxPoints {
+		return nil, ErrTooManyPoints
+	}
+
+	return q, nil
+}
+
+// parseBucket accepts Go durations plus a "d" suffix for days.
+func parseBucket(value string) (time.Duration, error) {
+	var bucket time.Duration
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidBucket, value)
+		}
+		bucket = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidBucket, value)
+		}
+		bucket = d
+	}
+
+	if bucket < minBucket || bucket%time.Second != 0 {
+		return 0, fmt.Errorf("%w: must be whole seconds and at least %s", ErrInvalidBucket, minBucket)
+	}
+
+	return bucket, nil
+}
+
+func (q *Query) points(bucket time.Duration) int {
+	return int(q.End.Sub(q.Start) / bucket) + 1
+}
+
+// Source is the table the query reads: the rollup when buckets are whole
+// minutes, the raw samples otherwise.
+func (q *Query) Source() string {
+	if q.Bucket%resolution == 0 {
+		return "metrics_rollup"
+	}
+	return "metrics"
+}
+
+// ------------------------------------------------------------
+// : Run
+// ------------------------------------------------------------
+
+// Run returns one point per non-empty bucket, oldest first. Buckets are
+// aligned to the Unix epoch so the same bucket size always yields the same
+// boundaries. Both sources cover start through end inclusive; the rollup
+// can only do so in whole minutes, so it includes the minutes that contain
+// start and end.
+func (q *Query) Run(ctx context.Context) ([]Point, error) {
+	var sql string
+
+	bucket := `to_timestamp(FLOOR(EXTRACT(EPOCH FROM %s) / $4) * $4)`
+
+	if q.Source() == "metrics_rollup" {
+		var value string
+		switch q.Aggregation {
+			case AggregationAvg : value = `SUM(sum) / SUM(count)`
+			case AggregationMax : value = `MAX(max)`
+			case AggregationLast: value = `(array_agg(last ORDER BY last_at DESC))[1]`
+		}
+
+		sql = `
+		SELECT ` + fmt.Sprintf(bucket, "bucket") + ` AS time_bucket, field, ` + value + `
+		FROM metrics_rollup
+		WHERE
+		type   = $1         AND
+		field  = ANY($2)    AND
+		bucket >= date_trunc('minute', $3::timestamptz) AND
+		bucket <= date_trunc('minute', $5::timestamptz)
+		GROUP BY time_bucket, field
+		ORDER BY time_bucket`
+	} else {
+		var value string
+		switch q.Aggregation {
+			case AggregationAvg : value = `AVG((f.value)::text::double precision)`
+			case AggregationMax : value = `MAX((f.value)::text::double precision)`
+			case AggregationLast: value = `(array_agg((f.value)::text::double precision ORDER BY m.timestamp DESC))[1]`
+		}
+
+		sql = `
+		SELECT ` + fmt.Sprintf(bucket, "m.timestamp") + ` AS time_bucket, f.key, ` + value + `
+		FROM public.metrics m, jsonb_each(m.metric) f
+		WHERE
+		m.metric->>'type' = $1      AND
+		f.key             = ANY($2) AND
+		m.timestamp      >= $3      AND
+		m.timestamp      <= $5      AND
+		jsonb_typeof(f.value) = 'number'
+		GROUP BY time_bucket, f.key
+		ORDER BY time_bucket`
+	}
+
+	rows, err := db.GetConnection().Query(ctx, sql, q.Type, q.Fields, q.Start, int64(q.Bucket.Seconds()), q.End)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := map[time.Time]Point{}
+	for rows.Next() {
+		var timestamp time.Time
+		var field     string
+		var value     *float64
+
+		if err := rows.Scan(&timestamp, &field, &value); err != nil {
+			return nil, err
+		}
+
+		timestamp = timestamp.UTC()
+		point, ok := points[timestamp]
+		if !ok {
+			point = Point{"timestamp": timestamp}
+			points[timestamp] = point
+		}
+		point[field] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]Point, 0, len(points))
+	for _, point := range points {
+		list = append(list, point)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["timestamp"].(time.Time).Before(list[j]["timestamp"].(time.Time))
+	})
+
+	return list, nil
+}
+
+// ------------------------------------------------------------
+// : Handler
+// ------------------------------------------------------------
+
+// GetMetricQuery serves any metric type over any range.
+//
+// curl 'http://localhost:5000/api/metrics/query?type=users&field=connected&start=2025-03-01T00:00:00Z&end=2025-04-01T00:00:00Z&bucket=1h&agg=max'
+func GetMetricQuery(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseQuery(r)
+	if err != nil {
+		httpio.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	points, err := q.Run(r.Context())
+	if err != nil {
+		logger.Error().Err(err).Str("type", q.Type).Msg("Failed to query metrics")
+		httpio.WriteError(w, http.StatusInternalServerError, "Failed to query metrics")
+		return
+	}
+
+	httpio.WriteJSON(w, http.StatusOK, json.JSON{
+		"query" : q,
+		"bucket": q.Bucket.String(),
+		"source": q.Source(),
+		"points": points,
+	})
+}
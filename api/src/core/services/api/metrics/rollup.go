@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/db"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Rollup
+// ------------------------------------------------------------
+
+// The monitor writes a sample up to every 5 seconds, so month-long ranges touch
+// hundreds of thousands of rows. metrics_rollup keeps one row per metric
+// type, field and minute with enough to answer every aggregation (count and
+// sum for avg, min/max, and the last value with its time), and queries with
+// buckets of a minute or more read from it instead.
+
+var (
+	// Resolution of the rollup table
+	resolution = 1 * time.Minute
+
+	// Range rolled up per statement while catching up
+	chunk = 24 * time.Hour
+)
+
+// rollup aggregates the raw samples in [from, to) into minute buckets.
+// Buckets are recomputed from scratch, so running it twice over the same
+// range is harmless.
+func rollup(ctx context.Context, from time.Time, to time.Time) error {
+	_, err := db.GetConnection().Exec(ctx, `
+	INSERT INTO metrics_rollup (type, field, bucket, count, sum, min, max, last, last_at)
+	SELECT
+		m.metric->>'type'                                                    AS type,
+		f.key                                                                AS field,
+		date_trunc('minute', m.timestamp)                                    AS bucket,
+		COUNT(*)                                                             AS count,
+		SUM((f.value)::text::double precision)                               AS sum,
+		MIN((f.value)::text::double precision)                               AS min,
+		MAX((f.value)::text::double precision)                               AS max,
+		(array_agg((f.value)::text::double precision ORDER BY m.timestamp DESC))[1] AS last,
+		MAX(m.timestamp)                                                     AS last_at
+	FROM public.metrics m, jsonb_each(m.metric) f
+	WHERE
+		m.timestamp >= $1 AND
+		m.timestamp <  $2 AND
+		m.metric->>'type' IS NOT NULL AND
+		jsonb_typeof(f.value) = 'number'
+	GROUP BY 1, 2, 3
+	ON CONFLICT (type, field, bucket) DO UPDATE SET
+		count   = EXCLUDED.count,
+		sum     = EXCLUDED.sum,
+		min     = EXCLUDED.min,
+		max     = EXCLUDED.max,
+		last    = EXCLUDED.last,
+		last_at = EXCLUDED.last_at
+	`, from, to)
+
+	return err
+}
+
+// watermark returns where rolling up should resume: the start of the last
+// rolled bucket (it may have been partial), or the first raw sample.
+func watermark(ctx context.Context) (time.Time, bool, error) {
+	var last *time.Time
+
+	pool := db.GetConnection()
+	if err := pool.QueryRow(ctx, `SELECT MAX(bucket) FROM metrics_rollup`).Scan(&last); err != nil {
+		return time.Time{}, false, err
+	}
+	if last != nil {
+		return last.UTC(), true, nil
+	}
+
+	if err := pool.QueryRow(ctx, `SELECT MIN(timestamp) FROM public.metrics`).Scan(&last); err != nil {
+		return time.Time{}, false, err
+	}
+	if last != nil {
+		return last.UTC().Truncate(resolution), true, nil
+	}
+
+	return time.Time{}, false, nil
+}
+
+// catchup rolls up everything from the watermark to the current minute,
+// one chunk at a time. The current minute is included and redone on the
+// next run.
+func catchup(ctx context.Context) error {
+	from, ok, err := watermark(ctx)
+	if err != nil || !ok {
+		return err
+	}
+
+	end := time.Now().UTC().Truncate(resolution).Add(resolution)
+	for from.Before(end) {
+		to := from.Add(chunk)
+		if to.After(end) {
+			to = end
+		}
+
+		if err := rollup(ctx, from, to); err != nil {
+			return err
+		}
+		from = to
+	}
+
+	return nil
+}
+
+// runRollup catches up once a minute until ctx is done. Every instance
+// ticks, but only the one that claims the minute writes the table.
+func runRollup(ctx context.Context) {
+	ticker := time.NewTicker(resolution)
+	defer ticker.Stop()
+
+	run := cluster.Once("metrics.rollup", func() {
+		if err := catchup(ctx); err != nil && ctx.Err() == nil {
+			logger.Error().Err(err).Msg("Failed to roll up metrics")
+		}
+	})
+
+	for {
+		run()
+
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package ws
 
 import (
+	"context"
+	"dse/src/core/lifecycle"
 	"dse/src/core/models"
+	"dse/src/core/schema"
+	"dse/src/core/services/cluster"
 	"dse/src/core/services/db"
+	"dse/src/core/telemetry"
 	"dse/src/utils"
 	"dse/src/utils/hashmap"
 	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/tidwall/gjson"
@@ -39,8 +47,17 @@ var (
 	}
 
 	version string = "3.0.5"
+
+	// Connection handlers that have not returned yet
+	handlers sync.WaitGroup
 )
 
+func init() {
+	telemetry.OnScrape(func() {
+		telemetry.Participants.With("ws").Set(float64(clients.Len()))
+	})
+}
+
 // ------------------------------------------------------------
 // : Methods
 // ------------------------------------------------------------
@@ -48,6 +65,20 @@ func SendToUser(token string) {
 
 }
 
+// Drain waits for every connection handler to return.
+func Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+
+	select {
+		case <-done      : return nil
+		case <-ctx.Done(): return ctx.Err()
+	}
+}
+
 // ------------------------------------------------------------
 // : Handlers
 // ------------------------------------------------------------
@@ -60,6 +91,9 @@ func OnUserUpdate(user *User, packet *Packet) {
 
 	parsed := gjson.ParseBytes(b)
 
+	user.Lock()
+	defer user.Unlock()
+
 	user.SetVersion(packet.Version)
 	
 	user.State.Client.Background.State = parsed.Get("background.state").String()
@@ -83,40 +117,13 @@ func OnUserUpdate(user *User, packet *Packet) {
 	user.State.Client.User.Token = parsed.Get("user.token").String()
 	user.State.Client.User.Popup = parsed.Get("user.popup").Bool()
 
-	user.State.Client.User.Form.Age = parsed.Get("user.form.age").String()
-
-	user.State.Client.User.Form.Browser.Brave         = parsed.Get("user.form.browser.brave").Bool()
-	user.State.Client.User.Form.Browser.Chrome        = parsed.Get("user.form.browser.chrome").Bool()
-	user.State.Client.User.Form.Browser.Firefox       = parsed.Get("user.form.browser.edge").Bool()
-	user.State.Client.User.Form.Browser.MicrosoftEdge = parsed.Get("user.form.browser.firefox").Bool()
-	user.State.Client.User.Form.Browser.Opera         = parsed.Get("user.form.browser.opera").Bool()
-	user.State.Client.User.Form.Browser.Safari        = parsed.Get("user.form.browser.safari").Bool()
-	user.State.Client.User.Form.Browser.Unselected	  = parsed.Get("user.form.browser.unselected").Bool()
-
-	user.State.Client.User.Form.Education  = parsed.Get("user.form.education").String()
-	user.State.Client.User.Form.Employment = parsed.Get("user.form.employment").String()
-	user.State.Client.User.Form.Income     = parsed.Get("user.form.income").String()
-
-	user.State.Client.User.Form.Language.Duits      = parsed.Get("user.form.language.duits").Bool()
-	user.State.Client.User.Form.Language.Engels     = parsed.Get("user.form.language.engels").Bool()
-	user.State.Client.User.Form.Language.Frans      = parsed.Get("user.form.language.frans").Bool()
-	user.State.Client.User.Form.Language.Italiaans  = parsed.Get("user.form.language.italiaans").Bool()
-	user.State.Client.User.Form.Language.Nederlands = parsed.Get("user.form.language.nederlands").Bool()
-	user.State.Client.User.Form.Language.Spaans     = parsed.Get("user.form.language.spaans").Bool()
-	user.State.Client.User.Form.Language.Unselected = parsed.Get("user.form.language.unselected").Bool()
-
-	user.State.Client.User.Form.Political      = parsed.Get("user.form.political").String()
-	user.State.Client.User.Form.Postcode.Value = parsed.Get("user.form.postcode.value").String()
-	user.State.Client.User.Form.Resident       = parsed.Get("user.form.resident").String()
-
-	user.State.Client.User.Form.SearchEngine.Anders     = parsed.Get("user.form.search_engine.anders").Bool()
-	user.State.Client.User.Form.SearchEngine.Bing       = parsed.Get("user.form.search_engine.bing").Bool()
-	user.State.Client.User.Form.SearchEngine.Duckduckgo = parsed.Get("user.form.search_engine.duckduckgo").Bool()
-	user.State.Client.User.Form.SearchEngine.Ecosia     = parsed.Get("user.form.search_engine.ecosia").Bool()
-	user.State.Client.User.Form.SearchEngine.Google     = parsed.Get("user.form.search_engine.google").Bool()
-	user.State.Client.User.Form.SearchEngine.Startpage  = parsed.Get("user.form.search_engine.startpage").Bool()
-	user.State.Client.User.Form.SearchEngine.Yahoo      = parsed.Get("user.form.search_engine.yahoo").Bool()
-	user.State.Client.User.Form.SearchEngine.Unselected = parsed.Get("user.form.search_engine.unselected").Bool()
+	// Answers are validated against config/form.json
+	v, err := schema.Update(user, parsed.Get("user.form"))
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load form schema")
+	} else if !v.Valid() {
+		logger.Warn().Str("token", user.Token).Interface("errors", v.Error()).Msg("Rejected invalid form")
+	}
 	user.Save()
 }
 
@@ -127,7 +134,7 @@ func OnReceive(conn *Connection, packet *Packet) {
 	exists, _ := db.HasUser(packet.From)
 	if !exists {
 		user, err = db.CreateUser(packet.From)
-		if err != nil {
+		if err != nil && !errors.Is(err, db.ErrUserExists) {
 			logger.Error().Err(err).Msg("Error creating user")
 			return
 		}
@@ -139,6 +146,12 @@ func OnReceive(conn *Connection, packet *Packet) {
 		return
 	}
 
+	if !clients.Has(conn) {
+		if err := cluster.Connect(context.Background(), user.Token, "ws"); err != nil {
+			logger.Error().Err(err).Str("token", user.Token).Msg("Failed to record presence")
+		}
+	}
+
 	clients.Set(conn, user)
 	user.SetWS(conn)
 
@@ -150,6 +163,9 @@ func OnReceive(conn *Connection, packet *Packet) {
 }
 
 func HandleWS(w ResponseWriter, r *Request) {
+    handlers.Add(1)
+    defer handlers.Done()
+
     defer func() {
         if rec := recover(); rec != nil {
             logger.Error().Interface("recover", rec).Msg("Recovered from panic in WebSocket handler")
@@ -164,6 +180,21 @@ func HandleWS(w ResponseWriter, r *Request) {
     }
     defer conn.Close()
 
+    // On shutdown the client is asked to reconnect and the connection is
+    // closed, which ends ReadMessage below and marks the participant offline
+    closed := make(chan struct{})
+    defer close(closed)
+    go func() {
+        select {
+            case <-lifecycle.Stopping(): {
+                message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+                conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+                conn.Close()
+            }
+            case <-closed:
+        }
+    }()
+
 
     for {
 		msgtype, msg, err := conn.ReadMessage()
@@ -182,6 +213,10 @@ func HandleWS(w ResponseWriter, r *Request) {
 				user.State.Server.Online = false
 				user.Save()
 				clients.Delete(conn)
+
+				if err := cluster.Disconnect(context.Background(), user.Token); err != nil {
+					logger.Error().Err(err).Str("token", user.Token).Msg("Failed to release presence")
+				}
 			}
 			break
 		}
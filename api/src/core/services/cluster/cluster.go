@@ -0,0 +1,531 @@
+// Package cluster coordinates API instances that share one database. Every
+// instance has a row with a heartbeat; a participant's connection is
+// recorded as presence of the instance holding it, and messages for that
+// participant are sent to that instance over Postgres LISTEN/NOTIFY.
+// Presence and crawl leases of an instance whose heartbeat stops are
+// removed with it.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"dse/src/core/models"
+	"dse/src/core/services/consent"
+	"dse/src/core/services/db"
+	"dse/src/core/telemetry"
+	"dse/src/utils"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Message is sent from one instance to another, or to every other instance
+// when To is empty.
+type Message struct {
+	From  string          `json:"from"`
+	To    string          `json:"to,omitempty"`
+	Kind  string          `json:"kind"`
+	Token string          `json:"token,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Instance is a running API instance and its latest metrics.
+type Instance struct {
+	ID          string             `json:"id"`
+	StartedAt   time.Time          `json:"started_at"`
+	HeartbeatAt time.Time          `json:"heartbeat_at"`
+	Metrics     map[string]float64 `json:"metrics"`
+}
+
+// Summary aggregates every instance.
+type Summary struct {
+	Instance  string             `json:"instance"` // The instance that answered
+	Instances []*Instance        `json:"instances"`
+	Totals    map[string]float64 `json:"totals"`   // Metrics summed over instances
+	Presence  map[string]int     `json:"presence"` // Connected participants per transport
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	logger = utils.NewLogger()
+
+	id      = identify()
+	started = time.Now().UTC()
+
+	// Overridden with CLUSTER_HEARTBEAT and CLUSTER_TIMEOUT
+	heartbeat = 5 * time.Second
+	timeout   = 30 * time.Second
+
+	channel = "dse_cluster"
+
+	// NOTIFY payloads are limited to 8000 bytes; larger messages are stored
+	// and only their ID is sent
+	inline = 7500
+
+	handlersMu sync.RWMutex
+	handlers   = map[string]func(ctx context.Context, msg *Message){}
+
+	gaugesMu sync.RWMutex
+	gauges   = map[string]func() float64{}
+
+	// Errors
+	ErrNoOwner = errors.New("participant is not connected to any instance")
+)
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// ID returns the ID of this instance, from INSTANCE_ID or generated.
+func ID() string {
+	return id
+}
+
+// OnMessage sets the handler for a kind of message. Handlers run in their
+// own goroutine.
+func OnMessage(kind string, fn func(ctx context.Context, msg *Message)) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[kind] = fn
+}
+
+// Gauge adds a value to the metrics every instance reports with its
+// heartbeat, such as a queue length.
+func Gauge(name string, fn func() float64) {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+	gauges[name] = fn
+}
+
+// Send delivers a message to the instance in msg.To, or to every other
+// instance.
+func Send(ctx context.Context, msg *Message) error {
+	msg.From = id
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	payload := string(b)
+	if len(b) > inline {
+		var ref int64
+		err := db.GetConnection().QueryRow(ctx, `INSERT INTO cluster_messages (payload) VALUES ($1) RETURNING id`, b).Scan(&ref)
+		if err != nil {
+			return err
+		}
+		payload = "@" + strconv.FormatInt(ref, 10)
+	}
+
+	_, err = db.GetConnection().Exec(ctx, `SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// Broadcast sends a message to every other instance.
+func Broadcast(ctx context.Context, kind string, token string, data any) error {
+	msg, err := message(kind, token, data)
+	if err != nil {
+		return err
+	}
+	return Send(ctx, msg)
+}
+
+// SendTo sends a message to one instance.
+func SendTo(ctx context.Context, instance string, kind string, token string, data any) error {
+	msg, err := message(kind, token, data)
+	if err != nil {
+		return err
+	}
+	msg.To = instance
+	return Send(ctx, msg)
+}
+
+// Instances returns every instance with a current heartbeat.
+func Instances(ctx context.Context) ([]*Instance, error) {
+	rows, err := db.GetConnection().Query(ctx, `
+		SELECT id, started_at, heartbeat_at, metrics FROM cluster_instances
+		WHERE heartbeat_at >= now() - $1 * interval '1 second'
+		ORDER BY started_at, id`, timeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*Instance{}
+	for rows.Next() {
+		instance := &Instance{Metrics: map[string]float64{}}
+		var metrics []byte
+		if err := rows.Scan(&instance.ID, &instance.StartedAt, &instance.HeartbeatAt, &metrics); err != nil {
+			return nil, err
+		}
+		if len(metrics) > 0 {
+			json.Unmarshal(metrics, &instance.Metrics)
+		}
+		list = append(list, instance)
+	}
+
+	return list, rows.Err()
+}
+
+// Aggregate sums the metrics of every instance and counts connected
+// participants across them.
+func Aggregate(ctx context.Context) (*Summary, error) {
+	instances, err := Instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	presence, err := Presence(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{
+		Instance : id,
+		Instances: instances,
+		Totals   : map[string]float64{},
+		Presence : presence,
+	}
+	for _, instance := range instances {
+		for name, value := range instance.Metrics {
+			summary.Totals[name] += value
+		}
+	}
+
+	return summary, nil
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func identify() string {
+	if value, ok := os.LookupEnv("INSTANCE_ID"); ok && value != "" {
+		return value
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+func message(kind string, token string, data any) (*Message, error) {
+	msg := &Message{Kind: kind, Token: token}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = b
+	}
+	return msg, nil
+}
+
+// metrics returns the values reported with the heartbeat.
+func metrics() map[string]float64 {
+	m := map[string]float64{
+		"participants.sse": float64(local("sse")),
+		"participants.ws" : float64(local("ws")),
+		"users.dirty"     : float64(db.Dirty()),
+		"goroutines"      : float64(runtime.NumGoroutine()),
+	}
+
+	gaugesMu.RLock()
+	defer gaugesMu.RUnlock()
+	for name, fn := range gauges {
+		m[name] = fn()
+	}
+	return m
+}
+
+// beat records the heartbeat of this instance and removes instances whose
+// heartbeat stopped, with their presence and leases. Presence of this
+// instance is written again, in case it was removed while the heartbeat was
+// late.
+func beat(ctx context.Context) error {
+	b, err := json.Marshal(metrics())
+	if err != nil {
+		return err
+	}
+
+	pool := db.GetConnection()
+
+	_, err = pool.Exec(ctx, `
+		INSERT INTO cluster_instances (id, started_at, heartbeat_at, metrics) VALUES ($1, $2, now(), $3)
+		ON CONFLICT (id) DO UPDATE SET heartbeat_at = now(), metrics = EXCLUDED.metrics`,
+		id, started, b,
+	)
+	if err != nil {
+		return err
+	}
+
+	tokens, transports := snapshot()
+	if len(tokens) > 0 {
+		_, err = pool.Exec(ctx, `
+			INSERT INTO cluster_presence (token, instance, transport, connected_at)
+			SELECT token, $1, transport, now() FROM unnest($2::text[], $3::text[]) AS p(token, transport)
+			ON CONFLICT (token) DO NOTHING`,
+			id, tokens, transports,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = pool.Exec(ctx, `DELETE FROM cluster_instances WHERE heartbeat_at < now() - $1 * interval '1 second'`, timeout.Seconds())
+	if err != nil {
+		return err
+	}
+
+	_, err = pool.Exec(ctx, `DELETE FROM cluster_messages WHERE created_at < now() - interval '5 minutes'`)
+	if err != nil {
+		return err
+	}
+
+	_, err = pool.Exec(ctx, `DELETE FROM cluster_runs WHERE slot < now() - interval '7 days'`)
+	return err
+}
+
+func heartbeats(ctx context.Context) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
+		}
+
+		if err := beat(ctx); err != nil && ctx.Err() == nil {
+			logger.Error().Err(err).Msg("Failed to send heartbeat")
+		}
+	}
+}
+
+// listen receives messages until ctx ends, reconnecting when the connection
+// drops. The connection is taken out of the pool, so it is never handed out
+// while listening.
+func listen(ctx context.Context, listening chan<- error) {
+	for {
+		err := receive(ctx, listening)
+		listening = nil
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Error().Err(err).Msg("Lost cluster channel, reconnecting")
+		select {
+			case <-ctx.Done()              : return
+			case <-time.After(time.Second):
+		}
+	}
+}
+
+func receive(ctx context.Context, listening chan<- error) error {
+	acquired, err := db.GetConnection().Acquire(ctx)
+	if err != nil {
+		if listening != nil { listening <- err }
+		return err
+	}
+	conn := acquired.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		if listening != nil { listening <- err }
+		return err
+	}
+	if listening != nil {
+		listening <- nil
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		msg, err := decode(ctx, notification.Payload)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to decode cluster message")
+			continue
+		}
+		if msg.From == id || (msg.To != "" && msg.To != id) {
+			continue
+		}
+
+		handlersMu.RLock()
+		fn, ok := handlers[msg.Kind]
+		handlersMu.RUnlock()
+		if !ok {
+			logger.Warn().Str("kind", msg.Kind).Str("from", msg.From).Msg("Unhandled cluster message")
+			continue
+		}
+		go fn(ctx, msg)
+	}
+}
+
+func decode(ctx context.Context, payload string) (*Message, error) {
+	b := []byte(payload)
+
+	if ref, ok := strings.CutPrefix(payload, "@"); ok {
+		err := db.GetConnection().QueryRow(ctx, `SELECT payload FROM cluster_messages WHERE id = $1`, ref).Scan(&b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	msg := &Message{}
+	return msg, json.Unmarshal(b, msg)
+}
+
+// ------------------------------------------------------------
+// : Handlers
+// ------------------------------------------------------------
+
+// handle registers the messages every instance answers.
+func handle() {
+	// Packets for a participant connected here
+	OnMessage("send", func(ctx context.Context, msg *Message) {
+		user, err := db.GetUser(msg.Token)
+		if err != nil {
+			return
+		}
+
+		var command struct {
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(msg.Data, &command); err != nil {
+			logger.Error().Err(err).Msg("Failed to decode command")
+			return
+		}
+
+		// Sent only when still connected, so it does not bounce back
+		if user.Connected() {
+			if len(command.Data) == 0 || string(command.Data) == "null" {
+				user.Send(command.Action, nil)
+			} else {
+				user.Send(command.Action, command.Data)
+			}
+		}
+	})
+
+	// A participant was deleted elsewhere
+	OnMessage("evict", func(ctx context.Context, msg *Message) {
+		db.Evict(msg.Token)
+		if err := consent.Refresh(ctx, msg.Token); err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to refresh consent")
+		}
+	})
+
+	// Consent was given or withdrawn elsewhere
+	OnMessage("consent", func(ctx context.Context, msg *Message) {
+		if err := consent.Refresh(ctx, msg.Token); err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to refresh consent")
+		}
+	})
+
+	OnMessage("consent.text", func(ctx context.Context, msg *Message) {
+		if err := consent.Reload(ctx); err != nil {
+			logger.Error().Err(err).Msg("Failed to reload consent")
+		}
+	})
+}
+
+// announce tells other instances about changes to what they cache.
+func announce(ctx context.Context) {
+	models.UserDeleted.Listen(ctx, func(user *models.User) {
+		go Broadcast(ctx, "evict", user.Token, nil)
+	})
+
+	consent.Changed.Listen(ctx, func(record *consent.Record) {
+		go Broadcast(ctx, "consent", record.Token, nil)
+	})
+
+	consent.TextPublished.Listen(ctx, func(text *consent.Text) {
+		go Broadcast(ctx, "consent.text", "", nil)
+	})
+}
+
+// ------------------------------------------------------------
+// : Lifecycle
+// ------------------------------------------------------------
+
+// Start registers this instance and listens for messages. It is started
+// after the database and consent, and before anything that connects
+// participants.
+func Start(ctx context.Context) error {
+	if value, ok := os.LookupEnv("CLUSTER_HEARTBEAT"); ok {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			heartbeat = d
+		}
+	}
+	if value, ok := os.LookupEnv("CLUSTER_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(value); err == nil && d > heartbeat {
+			timeout = d
+		}
+	}
+
+	// A previous run with the same INSTANCE_ID left nothing that is still true
+	_, err := db.GetConnection().Exec(ctx, `DELETE FROM cluster_instances WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("clear instance: %w", err)
+	}
+	if err := beat(ctx); err != nil {
+		return fmt.Errorf("register instance: %w", err)
+	}
+
+	handle()
+
+	listening := make(chan error, 1)
+	go listen(ctx, listening)
+	if err := <-listening; err != nil {
+		return fmt.Errorf("listen on %s: %w", channel, err)
+	}
+
+	if err := models.SendRemote.Handle(ctx, route); err != nil {
+		return err
+	}
+	db.OnFlush(owned)
+
+	announce(ctx)
+	go heartbeats(ctx)
+
+	telemetry.OnScrape(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if instances, err := Instances(ctx); err == nil {
+			telemetry.ClusterInstances.With().Set(float64(len(instances)))
+		}
+		if presence, err := Presence(ctx); err == nil {
+			for _, transport := range []string{"sse", "ws"} {
+				telemetry.ClusterParticipants.With(transport).Set(float64(presence[transport]))
+			}
+		}
+	})
+
+	logger.Info().Str("instance", id).Msg("Joined cluster")
+	return nil
+}
+
+// Stop leaves the cluster, releasing presence and leases so other instances
+// take over the participants right away.
+func Stop(ctx context.Context) error {
+	_, err := db.GetConnection().Exec(ctx, `DELETE FROM cluster_instances WHERE id = $1`, id)
+	return err
+}
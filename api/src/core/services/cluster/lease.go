@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"context"
+	"dse/src/core/services/db"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// A lease expires unless renewed, so a crawl held by an instance that
+	// stopped without releasing it can be taken over
+	leaseTTL = 90 * time.Second
+)
+
+// ------------------------------------------------------------
+// : Leases
+// ------------------------------------------------------------
+
+// Hold takes the crawl lease of a participant, so their crawl runs on one
+// instance only. The lease is renewed until release is called. It returns
+// false when another instance holds it.
+func Hold(ctx context.Context, token string) (release func(), ok bool) {
+	tag, err := db.GetConnection().Exec(ctx, `
+		INSERT INTO cluster_leases (token, instance, expires_at) VALUES ($1, $2, now() + $3 * interval '1 second')
+		ON CONFLICT (token) DO UPDATE SET instance = EXCLUDED.instance, expires_at = EXCLUDED.expires_at
+		WHERE cluster_leases.expires_at < now()`,
+		token, id, leaseTTL.Seconds(),
+	)
+	if err != nil {
+		logger.Error().Err(err).Str("token", token).Msg("Failed to take crawl lease")
+		return func() {}, false
+	}
+	if tag.RowsAffected() == 0 {
+		return func() {}, false
+	}
+
+	renewing, stop := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case <-renewing.Done(): return
+				case <-ticker.C       :
+			}
+
+			_, err := db.GetConnection().Exec(renewing, `
+				UPDATE cluster_leases SET expires_at = now() + $3 * interval '1 second'
+				WHERE token = $1 AND instance = $2`,
+				token, id, leaseTTL.Seconds(),
+			)
+			if err != nil && renewing.Err() == nil {
+				logger.Error().Err(err).Str("token", token).Msg("Failed to renew crawl lease")
+			}
+		}
+	}()
+
+	release = func() {
+		stop()
+		_, err := db.GetConnection().Exec(context.Background(), `DELETE FROM cluster_leases WHERE token = $1 AND instance = $2`, token, id)
+		if err != nil {
+			logger.Error().Err(err).Str("token", token).Msg("Failed to release crawl lease")
+		}
+	}
+	return release, true
+}
+
+// ------------------------------------------------------------
+// : Jobs
+// ------------------------------------------------------------
+
+// Once wraps a scheduled job so it runs on one instance per minute it is
+// scheduled for, whichever claims it first. Jobs that write shared tables
+// (metrics, reports, resets) use it; jobs that fill a local cache do not.
+func Once(name string, fn func()) func() {
+	return func() {
+		slot := time.Now().UTC().Truncate(time.Minute)
+
+		tag, err := db.GetConnection().Exec(context.Background(), `
+			INSERT INTO cluster_runs (name, slot, instance) VALUES ($1, $2, $3)
+			ON CONFLICT (name, slot) DO NOTHING`,
+			name, slot, id,
+		)
+		if err != nil {
+			logger.Error().Err(err).Str("job", name).Msg("Failed to claim job")
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			return
+		}
+
+		fn()
+	}
+}
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"context"
+	"dse/src/core/models"
+	"dse/src/core/services/db"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Participants connected to this instance, by transport
+	presenceMu sync.RWMutex
+	presence   = map[string]string{}
+)
+
+// ------------------------------------------------------------
+// : Presence
+// ------------------------------------------------------------
+
+// Connect records that this instance holds the participant's connection.
+// The latest connection wins: packets for the participant are sent here from
+// now on. The cached state is reloaded first, as another instance may have
+// written a newer one; a user with changes that are not written yet is kept.
+func Connect(ctx context.Context, token string, transport string) error {
+	presenceMu.Lock()
+	_, held := presence[token]
+	presence[token] = transport
+	presenceMu.Unlock()
+
+	if !held && !db.IsDirty(token) {
+		if user, err := db.GetUser(token); err == nil && !user.CrawlingFlag().Load() {
+			if err := db.Reload(ctx, token); err != nil {
+				logger.Error().Err(err).Str("token", token).Msg("Failed to reload user")
+			}
+		}
+	}
+
+	_, err := db.GetConnection().Exec(ctx, `
+		INSERT INTO cluster_presence (token, instance, transport, connected_at) VALUES ($1, $2, $3, now())
+		ON CONFLICT (token) DO UPDATE SET instance = EXCLUDED.instance, transport = EXCLUDED.transport, connected_at = EXCLUDED.connected_at`,
+		token, id, transport,
+	)
+	return err
+}
+
+// Disconnect releases the participant. Their state is written right away,
+// so the instance they connect to next reads it.
+func Disconnect(ctx context.Context, token string) error {
+	presenceMu.Lock()
+	delete(presence, token)
+	presenceMu.Unlock()
+
+	if user, err := db.GetUser(token); err == nil {
+		if err := db.Persist(ctx, user); err != nil {
+			logger.Error().Err(err).Str("token", token).Msg("Failed to persist user")
+		}
+	}
+
+	// Only releases presence held here; the participant may have connected
+	// to another instance in the meantime
+	_, err := db.GetConnection().Exec(ctx, `DELETE FROM cluster_presence WHERE token = $1 AND instance = $2`, token, id)
+	return err
+}
+
+// Owner returns the instance holding the participant's connection, and
+// whether that is another instance. It returns ErrNoOwner when the
+// participant is not connected.
+func Owner(ctx context.Context, token string) (string, bool, error) {
+	presenceMu.RLock()
+	_, held := presence[token]
+	presenceMu.RUnlock()
+	if held {
+		return id, false, nil
+	}
+
+	var instance string
+	err := db.GetConnection().QueryRow(ctx, `
+		SELECT p.instance FROM cluster_presence p
+		JOIN cluster_instances i ON i.id = p.instance
+		WHERE p.token = $1 AND i.heartbeat_at >= now() - $2 * interval '1 second'`,
+		token, timeout.Seconds(),
+	).Scan(&instance)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, ErrNoOwner
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return instance, instance != id, nil
+}
+
+// Owners returns the instance of every connected participant.
+func Owners(ctx context.Context) (map[string]string, error) {
+	rows, err := db.GetConnection().Query(ctx, `SELECT token, instance FROM cluster_presence`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := map[string]string{}
+	for rows.Next() {
+		var token, instance string
+		if err := rows.Scan(&token, &instance); err != nil {
+			return nil, err
+		}
+		owners[token] = instance
+	}
+	return owners, rows.Err()
+}
+
+// Presence returns the number of participants connected to any instance,
+// per transport.
+func Presence(ctx context.Context) (map[string]int, error) {
+	rows, err := db.GetConnection().Query(ctx, `SELECT transport, COUNT(*) FROM cluster_presence GROUP BY transport`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var transport string
+		var count     int
+		if err := rows.Scan(&transport, &count); err != nil {
+			return nil, err
+		}
+		counts[transport] = count
+	}
+	return counts, rows.Err()
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// local returns the number of participants connected here over a transport.
+func local(transport string) int {
+	presenceMu.RLock()
+	defer presenceMu.RUnlock()
+
+	count := 0
+	for _, t := range presence {
+		if t == transport {
+			count += 1
+		}
+	}
+	return count
+}
+
+func snapshot() ([]string, []string) {
+	presenceMu.RLock()
+	defer presenceMu.RUnlock()
+
+	tokens     := make([]string, 0, len(presence))
+	transports := make([]string, 0, len(presence))
+	for token, transport := range presence {
+		tokens     = append(tokens, token)
+		transports = append(transports, transport)
+	}
+	return tokens, transports
+}
+
+// owned drops users connected to another instance from a flush; that
+// instance writes them. When presence cannot be read every user is written,
+// as losing a change is worse than writing a stale one.
+func owned(ctx context.Context, users []*models.User) []*models.User {
+	tokens := make([]string, 0, len(users))
+	for _, user := range users {
+		tokens = append(tokens, user.Token)
+	}
+
+	rows, err := db.GetConnection().Query(ctx, `
+		SELECT token FROM cluster_presence WHERE instance <> $1 AND token = ANY($2)`, id, tokens)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read presence")
+		return users
+	}
+	defer rows.Close()
+
+	elsewhere := map[string]bool{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err == nil {
+			elsewhere[token] = true
+		}
+	}
+	if len(elsewhere) == 0 {
+		return users
+	}
+
+	kept := make([]*models.User, 0, len(users))
+	for _, user := range users {
+		if !elsewhere[user.Token] {
+			kept = append(kept, user)
+		}
+	}
+	return kept
+}
+
+// route sends a packet to the instance holding the participant's
+// connection. Packets for participants that are not connected are dropped,
+// as they are when there is a single instance.
+func route(ctx context.Context, command *models.Command) (struct{}, error) {
+	instance, remote, err := Owner(ctx, command.Token)
+	if err != nil || !remote {
+		return struct{}{}, nil
+	}
+
+	return struct{}{}, SendTo(ctx, instance, "send", command.Token, map[string]any{
+		"action": command.Action,
+		"data"  : command.Data,
+	})
+}
@@ -0,0 +1,491 @@
+package consent
+
+import (
+	"context"
+	"crypto/sha256"
+	"dse/src/core/log"
+	"dse/src/core/services/db"
+	"dse/src/utils/event"
+	"dse/src/utils/gatekeeper"
+	"dse/src/utils/hashmap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Action string
+
+const (
+	ActionGrant    Action = "grant"
+	ActionWithdraw Action = "withdraw"
+)
+
+// Text is a published version of the consent text. Versions are immutable;
+// a change is published as a new version. A version with Reconsent set
+// invalidates every grant of an earlier version.
+type Text struct {
+	Version   string    `json:"version"`
+	Text      string    `json:"text"`
+	Checksum  string    `json:"checksum"` // sha256 of the text
+	Reconsent bool      `json:"reconsent"`
+	Published time.Time `json:"published"`
+}
+
+// Record is one grant or withdrawal by a participant.
+type Record struct {
+	ID        int64     `json:"id"`
+	Token     string    `json:"token"`
+	Version   string    `json:"version"`
+	Action    Action    `json:"action"`
+	Source    string    `json:"source"` // Where the record came from (extension, web, backfill, ...)
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Status summarises the consent of one participant.
+type Status struct {
+	Consented bool    `json:"consented"`
+	Current   string  `json:"current"` // Version participants are asked to accept
+	Minimum   string  `json:"minimum"` // Oldest version that still counts
+	Latest    *Record `json:"latest"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	gk = gatekeeper.NewGateKeeper(true)
+
+	mutex  sync.RWMutex
+	texts  = []*Text{}                              // Ordered by publication
+	latest = hashmap.NewHashMap[string, *Record]() // Latest record per token
+
+	rversion = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+	// Version used for participants that completed the form before consent
+	// was recorded explicitly
+	legacy = "legacy"
+
+	// Published for every recorded decision
+	Changed = event.NewTopic[*Record]("consent.changed", 0)
+
+	// Published for every new version of the text
+	TextPublished = event.NewTopic[*Text]("consent.published", 0)
+
+	// Published on every instance when the text participants are asked to
+	// accept changes, whether it was published here or on another instance
+	CurrentChanged = event.NewTopic[*Text]("consent.current", 0)
+
+	// Errors
+	ErrInvalidVersion  = errors.New("invalid consent version")
+	ErrUnknownVersion  = errors.New("unknown consent version")
+	ErrOutdatedVersion = errors.New("consent version is outdated")
+	ErrVersionExists   = errors.New("consent version already exists")
+	ErrEmptyText       = errors.New("consent text is empty")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrNoText          = errors.New("no consent text has been published")
+	ErrNoConsent       = errors.New("participant has not consented")
+)
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+func Wait() {
+	gk.Wait()
+}
+
+// Has reports whether the participant currently consents: their latest
+// record is a grant of a version that has not been superseded by a version
+// requiring reconsent.
+func Has(token string) bool {
+	Wait()
+
+	record, ok := latest.Get(token)
+	if !ok || record.Action != ActionGrant {
+		return false
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return index(record.Version) >= minimum()
+}
+
+// Get returns the consent status of a participant.
+func Get(token string) *Status {
+	Wait()
+
+	status := &Status{Consented: Has(token)}
+	if record, ok := latest.Get(token); ok {
+		status.Latest = record
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if len(texts) > 0 {
+		status.Current = texts[len(texts)-1].Version
+		status.Minimum = texts[minimum()].Version
+	}
+
+	return status
+}
+
+// Current returns the text participants are asked to accept.
+func Current() (*Text, error) {
+	Wait()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if len(texts) == 0 {
+		return nil, ErrNoText
+	}
+	return texts[len(texts)-1], nil
+}
+
+// Texts returns every published version, oldest first.
+func Texts() []*Text {
+	Wait()
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return append([]*Text{}, texts...)
+}
+
+// Publish adds a new version of the consent text.
+func Publish(ctx context.Context, version string, text string, reconsent bool) (*Text, error) {
+	Wait()
+
+	if !rversion.MatchString(version) { return nil, ErrInvalidVersion }
+	if text == ""                     { return nil, ErrEmptyText }
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if index(version) >= 0 {
+		return nil, ErrVersionExists
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	t   := &Text{
+		Version  : version,
+		Text     : text,
+		Checksum : "sha256:" + hex.EncodeToString(sum[:]),
+		Reconsent: reconsent,
+		Published: time.Now().UTC(),
+	}
+
+	_, err := db.GetConnection().Exec(ctx, `
+		INSERT INTO consent_texts (version, text, checksum, reconsent, published)
+		VALUES ($1, $2, $3, $4, $5)`,
+		t.Version, t.Text, t.Checksum, t.Reconsent, t.Published,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	texts = append(texts, t)
+	log.Info().Str("version", version).Bool("reconsent", reconsent).Msg("Published consent text")
+	TextPublished.Publish(t)
+	CurrentChanged.Publish(t)
+
+	return t, nil
+}
+
+// Grant records that a participant accepted a version of the text.
+func Grant(ctx context.Context, token string, version string, source string) (*Record, error) {
+	Wait()
+
+	mutex.RLock()
+	i, m := index(version), minimum()
+	mutex.RUnlock()
+
+	if i < 0 { return nil, ErrUnknownVersion }
+	if i < m { return nil, ErrOutdatedVersion }
+
+	return insert(ctx, token, version, ActionGrant, source)
+}
+
+// Withdraw records that a participant withdrew consent. It refers to the
+// version they had accepted, or the current one if there is none.
+func Withdraw(ctx context.Context, token string, source string) (*Record, error) {
+	Wait()
+
+	var version string
+	if record, ok := latest.Get(token); ok {
+		version = record.Version
+	} else {
+		text, err := Current()
+		if err != nil {
+			return nil, err
+		}
+		version = text.Version
+	}
+
+	return insert(ctx, token, version, ActionWithdraw, source)
+}
+
+// History returns every record of a participant, oldest first.
+func History(ctx context.Context, token string) ([]*Record, error) {
+	rows, err := db.GetConnection().Query(ctx, `
+		SELECT id, token, version, action, source, timestamp FROM consents
+		WHERE token = $1 ORDER BY id`, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*Record{}
+	for rows.Next() {
+		record := &Record{}
+		if err := rows.Scan(&record.ID, &record.Token, &record.Version, &record.Action, &record.Source, &record.Timestamp); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// Forget drops the cached decision of a participant whose records were
+// deleted, as erasure does in its own transaction.
+func Forget(token string) {
+	latest.Delete(token)
+}
+
+// Refresh reloads the latest record of a participant, for a decision
+// recorded or deleted by another instance.
+func Refresh(ctx context.Context, token string) error {
+	Wait()
+
+	record := &Record{}
+	err := db.GetConnection().QueryRow(ctx, `
+		SELECT id, token, version, action, source, timestamp FROM consents
+		WHERE token = $1 ORDER BY id DESC LIMIT 1`, token,
+	).Scan(&record.ID, &record.Token, &record.Version, &record.Action, &record.Source, &record.Timestamp)
+
+	switch {
+		case errors.Is(err, pgx.ErrNoRows): latest.Delete(token)
+		case err != nil                   : return err
+		default                           : latest.Set(token, record)
+	}
+	return nil
+}
+
+// Reload reloads every text and decision, for a text published by another
+// instance.
+func Reload(ctx context.Context) error {
+	Wait()
+
+	before, _ := Current()
+	if err := load(ctx); err != nil {
+		return err
+	}
+
+	after, err := Current()
+	if err == nil && (before == nil || before.Version != after.Version) {
+		CurrentChanged.Publish(after)
+	}
+	return nil
+}
+
+// Registered records the consent a participant gave on the consent page.
+// Agreeing there leads to the form, and the server first hears of the
+// participant once they submit it, so that is when the current version is
+// granted. Participants that already have a record, including a withdrawal,
+// are left as they are.
+func Registered(ctx context.Context, token string) (*Record, error) {
+	Wait()
+
+	if _, ok := latest.Get(token); ok {
+		return nil, nil
+	}
+
+	text, err := Current()
+	if err != nil {
+		return nil, err
+	}
+
+	return insert(ctx, token, text.Version, ActionGrant, "form")
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// index returns the position of a version, or -1. Callers hold mutex.
+func index(version string) int {
+	for i, text := range texts {
+		if text.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// minimum returns the position of the oldest version that still counts.
+// Callers hold mutex.
+func minimum() int {
+	for i := len(texts) - 1; i > 0; i-- {
+		if texts[i].Reconsent {
+			return i
+		}
+	}
+	return 0
+}
+
+func insert(ctx context.Context, token string, version string, action Action, source string) (*Record, error) {
+	if len(token) != 12 {
+		return nil, ErrInvalidToken
+	}
+
+	record := &Record{
+		Token    : token,
+		Version  : version,
+		Action   : action,
+		Source   : source,
+		Timestamp: time.Now().UTC(),
+	}
+
+	err := db.GetConnection().QueryRow(ctx, `
+		INSERT INTO consents (token, version, action, source, timestamp)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		record.Token, record.Version, record.Action, record.Source, record.Timestamp,
+	).Scan(&record.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	latest.Set(token, record)
+	Changed.Publish(record)
+
+	return record, nil
+}
+
+// ------------------------------------------------------------
+// : Init
+// ------------------------------------------------------------
+func load(ctx context.Context) error {
+	pool := db.GetConnection()
+
+	rows, err := pool.Query(ctx, `SELECT version, text, checksum, reconsent, published FROM consent_texts ORDER BY published, version`)
+	if err != nil {
+		return err
+	}
+
+	loaded := []*Text{}
+	for rows.Next() {
+		text := &Text{}
+		if err := rows.Scan(&text.Version, &text.Text, &text.Checksum, &text.Reconsent, &text.Published); err != nil {
+			rows.Close()
+			return err
+		}
+		loaded = append(loaded, text)
+	}
+	rows.Close()
+
+	mutex.Lock()
+	texts = loaded
+	mutex.Unlock()
+
+	rows, err = pool.Query(ctx, `
+		SELECT DISTINCT ON (token) id, token, version, action, source, timestamp
+		FROM consents ORDER BY token, id DESC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := &Record{}
+		if err := rows.Scan(&record.ID, &record.Token, &record.Version, &record.Action, &record.Source, &record.Timestamp); err != nil {
+			return err
+		}
+		latest.Set(record.Token, record)
+	}
+
+	return rows.Err()
+}
+
+// backfill runs once, when no text has been published yet. Participants
+// that completed the form were asked for consent before it was recorded, so
+// they are granted the legacy version instead of being cut off. Instances
+// that start together may both find no text; only the one that inserts the
+// legacy text grants it.
+func backfill(ctx context.Context) error {
+	mutex.RLock()
+	empty := len(texts) == 0
+	mutex.RUnlock()
+
+	if !empty {
+		return nil
+	}
+
+	text := "Consent was given on the consent page before consent was recorded per participant."
+	sum  := sha256.Sum256([]byte(text))
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO consent_texts (version, text, checksum, reconsent, published)
+		VALUES ($1, $2, $3, FALSE, $4)
+		ON CONFLICT (version) DO NOTHING`,
+		legacy, text, "sha256:"+hex.EncodeToString(sum[:]), now,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	tag, err = tx.Exec(ctx, `
+		INSERT INTO consents (token, version, action, source, timestamp)
+		SELECT token, $1, 'grant', 'backfill', $2 FROM users
+		WHERE COALESCE(state->'client'->'user'->'form'->>'age', '') <> ''`,
+		legacy, now,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Info().Int64("users", tag.RowsAffected()).Msg("Backfilled legacy consent")
+	return nil
+}
+
+// Start loads consent texts and the latest decision of every participant.
+func Start(ctx context.Context) error {
+	if err := load(ctx); err != nil {
+		return fmt.Errorf("load consent: %w", err)
+	}
+
+	if err := backfill(ctx); err != nil {
+		return fmt.Errorf("backfill consent: %w", err)
+	}
+
+	if err := load(ctx); err != nil {
+		return fmt.Errorf("load consent: %w", err)
+	}
+
+	log.Info().Int("texts", len(texts)).Int("participants", latest.Len()).Msg("Consent ready")
+	gk.Unlock()
+	return nil
+}
@@ -1,10 +1,16 @@
 package crawler
 
 import (
+	"context"
 	"dse/src/core/models"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
 	"dse/src/core/services/db"
+	"dse/src/core/telemetry"
 	"dse/src/utils"
-	"dse/src/utils/event"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
@@ -34,6 +40,12 @@ var (
 	websites = []Website{}
 
 	queue = cmap.New[*User]()
+
+	// Errors
+	ErrOffline    = errors.New("participant is not connected")
+	ErrNoConsent  = errors.New("participant has not given consent")
+	ErrNothingDue = errors.New("participant has no tasks due")
+	ErrCrawling   = errors.New("participant is being crawled")
 )
 // ------------------------------------------------------------
 // : Helpers
@@ -41,6 +53,9 @@ var (
 func Populate(user *User) {
 	if user.CrawlingFlag().Load() { return }
 
+	user.Lock()
+	defer user.Unlock()
+
 	counter := 0
 
 	var state = user.State.Server
@@ -69,6 +84,16 @@ func Populate(user *User) {
 	user.Save()
 }
 
+// Keywords returns the configured keywords, in order.
+func Keywords() []Keyword {
+	return append([]Keyword{}, keywords...)
+}
+
+// Websites returns the configured search engines, in order.
+func Websites() []Website {
+	return append([]Website{}, websites...)
+}
+
 // ------------------------------------------------------------
 // : Listeners
 // ------------------------------------------------------------
@@ -83,8 +108,12 @@ func OnUpdate(user *User) {
 		}
 	}()
 
+	if !consent.Has(user.Token) { return }
 	if !user.RequiersScraping() { return }
 
+	// The crawl is driven by the instance holding the connection
+	if !user.Connected() { return }
+
 	if queue.Has(user.Token) {
 		return
 	}
@@ -92,8 +121,18 @@ func OnUpdate(user *User) {
 	queue.Set(user.Token, user)
 	defer queue.Remove(user.Token)
 
+	release, ok := cluster.Hold(context.Background(), user.Token)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Generate tasks if user is new
-	if len(*user.State.Server.Tasks) == 0 {
+	user.Lock()
+	empty := len(*user.State.Server.Tasks) == 0
+	user.Unlock()
+
+	if empty {
 		Populate(user)
 	}
 	
@@ -113,79 +152,242 @@ func OnResetAll() {
 		return
 	}
 
+	// Participants connected elsewhere are reset by their instance, which
+	// holds the state that gets written
+	owners, err := cluster.Owners(context.Background())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get owners")
+		owners = map[string]string{}
+	}
+
 	users.Each(func(index int, user *User) bool {
+		if owner, ok := owners[user.Token]; ok && owner != cluster.ID() {
+			if err := cluster.SendTo(context.Background(), owner, "reset", user.Token, nil); err != nil {
+				logger.Error().Err(err).Str("token", user.Token).Msg("Failed to forward reset")
+			}
+			return true
+		}
 		Populate(user)
 		return true
 	})
 }
 
 // ------------------------------------------------------------
-// : Monnitor
+// : Operations
 // ------------------------------------------------------------
-func Listen() {
-	go func() {
-		ch := event.On("user.connected")
-
-		for e := range ch {
-			user, ok := e.Args[0].(*User)
-			if !ok { continue }
-			go OnConnect(user)
-		}
-	}()
 
-	go func() {
-		ch := event.On("user.updated")
+// Reset marks every task of a participant as due again.
+func Reset(ctx context.Context, token string) error {
+	return dispatch(ctx, token, "tasks.reset", nil, func(user *User) error {
+		user.Reset()
+		return nil
+	})
+}
 
-		for e := range ch {
-			user, ok := e.Args[0].(*User)
-			if !ok { continue }
-			go OnUpdate(user)
+// Repopulate replaces the tasks of a participant with the configured ones.
+// It returns ErrCrawling while the participant is being crawled here, as
+// the tasks are in use.
+func Repopulate(ctx context.Context, token string) error {
+	return dispatch(ctx, token, "reset", nil, func(user *User) error {
+		if crawling(user) {
+			return ErrCrawling
 		}
-	}()
+		Populate(user)
+		return nil
+	})
+}
 
-	go func() {
-		ch := event.On("user.reset")
+// Patch changes server-side fields of a participant. The patch is
+// validated by the caller, see models.ServerPatch.
+func Patch(ctx context.Context, token string, patch *models.ServerPatch) error {
+	return dispatch(ctx, token, "patch", patch, func(user *User) error {
+		apply(user, patch)
+		return nil
+	})
+}
 
-		for e := range ch {
-			user, ok := e.Args[0].(*User)
-			if !ok { continue }
-			go OnReset(user)
-		}
-	}()
+// Crawl starts the crawl of a connected participant, if tasks are due. With
+// force every task is reset first, so all of them are searched again.
+//
+// It returns ErrOffline when the participant is not connected anywhere,
+// ErrNoConsent without consent, and, when they are connected here,
+// ErrCrawling during a crawl and ErrNothingDue when no task is due. Another
+// instance holding the connection checks the last two itself.
+func Crawl(ctx context.Context, token string, force bool) error {
+	// Consent is known to every instance
+	if !consent.Has(token) {
+		return ErrNoConsent
+	}
+
+	instance, remote, err := cluster.Owner(ctx, token)
+	switch {
+		case errors.Is(err, cluster.ErrNoOwner): return ErrOffline
+		case err != nil                        : return err
+		case remote                            : return cluster.SendTo(ctx, instance, "crawl", token, map[string]bool{"force": force})
+	}
+
+	user, err := db.GetUser(token)
+	if err != nil {
+		return err
+	}
+
+	if crawling(user) {
+		return ErrCrawling
+	}
+	if !force && !due(user) {
+		return ErrNothingDue
+	}
+
+	go crawl(user, force)
+	return nil
 }
 
-func Monitor() {
-	time.Sleep(5 * time.Second) // TODO: Change to 10 seconds
+func crawl(user *User, force bool) {
+	if force {
+		user.Reset()
+	}
+	OnUpdate(user)
+}
 
-	go func() {
-		for {
-			users, err := db.GetUsers()
-			if err != nil { continue }
+// crawling reports whether a crawl of a participant runs on this instance.
+func crawling(user *User) bool {
+	return queue.Has(user.Token) || user.CrawlingFlag().Load()
+}
 
-			counter := 0
+// due reports whether a participant has tasks to search.
+func due(user *User) bool {
+	user.Lock()
+	defer user.Unlock()
+	return user.RequiersScraping()
+}
 
-			users.Each(func(index int, user *User) bool {
-				counter += 1
+func apply(user *User, patch *models.ServerPatch) {
+	user.Lock()
+	user.State.Server.Patch(patch)
+	user.Unlock()
 
-				if !user.RequiersScraping() { return true }
-				if !user.IsOnline()         { return true }
+	user.Save()
+}
 
-				return false
-			})
+// dispatch changes a participant on the instance holding their state: the
+// one they are connected to, or this one when they are not connected. Data
+// is forwarded with the change.
+func dispatch(ctx context.Context, token string, kind string, data any, fn func(user *User) error) error {
+	instance, remote, err := cluster.Owner(ctx, token)
+	switch {
+		case errors.Is(err, cluster.ErrNoOwner):
+		case err != nil                        : return err
+		case remote                            : return cluster.SendTo(ctx, instance, kind, token, data)
+	}
 
-			time.Sleep(5 * time.Second)
+	user, err := db.GetUser(token)
+	if err != nil {
+		return err
+	}
+	return fn(user)
+}
+
+// ------------------------------------------------------------
+// : Monnitor
+// ------------------------------------------------------------
+func Listen(ctx context.Context) {
+	models.UserConnected.Listen(ctx, func(user *User) { go OnConnect(user) })
+	models.UserUpdated  .Listen(ctx, func(user *User) { go OnUpdate(user) })
+	models.UserReset    .Listen(ctx, func(user *User) { go OnReset(user) })
+}
+
+func Monitor(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second) // TODO: Change to 10 seconds
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
 		}
-	}()
+
+		users, err := db.GetUsers()
+		if err != nil { continue }
+
+		counter := 0
+
+		users.Each(func(index int, user *User) bool {
+			counter += 1
+
+			if !user.RequiersScraping() { return true }
+			if !user.IsOnline()         { return true }
+
+			return false
+		})
+	}
 }
 
 // ------------------------------------------------------------
 // : Init
 // ------------------------------------------------------------
-func Init() {
-	b, err := os.ReadFile("config/searches.json")
+func Start(ctx context.Context) error {
+	telemetry.OnScrape(func() {
+		telemetry.QueueDepth.With("crawler").Set(float64(queue.Count()))
+	})
+	cluster.Gauge("crawler.queue", func() float64 {
+		return float64(queue.Count())
+	})
+
+	cluster.OnMessage("reset", func(ctx context.Context, msg *cluster.Message) {
+		user, err := db.GetUser(msg.Token)
+		if err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to get user")
+			return
+		}
+		Populate(user)
+	})
+	cluster.OnMessage("tasks.reset", func(ctx context.Context, msg *cluster.Message) {
+		user, err := db.GetUser(msg.Token)
+		if err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to get user")
+			return
+		}
+		user.Reset()
+	})
+	cluster.OnMessage("crawl", func(ctx context.Context, msg *cluster.Message) {
+		user, err := db.GetUser(msg.Token)
+		if err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to get user")
+			return
+		}
+		force := gjson.GetBytes(msg.Data, "force").Bool()
+		if crawling(user) {
+			logger.Warn().Err(ErrCrawling).Str("token", msg.Token).Msg("Forwarded crawl skipped")
+			return
+		}
+		if !force && !due(user) {
+			logger.Warn().Err(ErrNothingDue).Str("token", msg.Token).Msg("Forwarded crawl skipped")
+			return
+		}
+		go crawl(user, force)
+	})
+	cluster.OnMessage("patch", func(ctx context.Context, msg *cluster.Message) {
+		var patch models.ServerPatch
+		if err := json.Unmarshal(msg.Data, &patch); err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to parse patch")
+			return
+		}
+
+		user, err := db.GetUser(msg.Token)
+		if err != nil {
+			logger.Error().Err(err).Str("token", msg.Token).Msg("Failed to get user")
+			return
+		}
+		apply(user, &patch)
+	})
+
+	// Tests point the crawler at fake engines with a config of their own
+	path := "config/searches.json"
+	if value, ok := os.LookupEnv("SEARCHES_FILE"); ok && value != "" { path = value }
+
+	b, err := os.ReadFile(path)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to read searches")
-		return
+		return fmt.Errorf("read searches: %w", err)
 	}
 
 	hash = utils.GenerateHash(string(b))
@@ -206,6 +408,7 @@ func Init() {
 		return true
 	})
 
-	go Listen()
-	go Monitor()
+	Listen(ctx)
+	go Monitor(ctx)
+	return nil
 }
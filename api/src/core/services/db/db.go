@@ -2,17 +2,17 @@ package db
 
 import (
 	"context"
+	"dse/src/core/lifecycle"
 	"dse/src/core/models"
+	"dse/src/core/telemetry"
 	"dse/src/utils"
 	"dse/src/utils/arraylist"
 	"dse/src/utils/cmap"
-	"dse/src/utils/event"
 	"dse/src/utils/gatekeeper"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/dromara/carbon/v2"
@@ -53,14 +53,15 @@ var (
 	users = cmap.New[*User]()
 	ready = make(chan struct{})            // Channel to signal readiness
 
-	mutex = &sync.Mutex{} // Write mutex
+	unlisten  = context.CancelFunc(func() {})
 
-	ch_update = make(chan *User, 1000) // Channel for user updates
+	settle = time.Minute // Longest an insert may take to commit, see SettledSearch
 
 	// Errors
 	ErrMissingToken   = errors.New("missing token")        // Error for missing token
 	ErrTokenInvalid   = errors.New("invalid token")        // Error for invalid token
 	ErrUserNotFound   = errors.New("user not found")       // Error when user is not found
+	ErrUserExists     = errors.New("user already exists")  // Error when a created user exists
 	ErrTokenEmpty     = errors.New("token is empty")       // Error when token is empty
 	ErrTokenIncorrect = errors.New("token length invalid") // Error for incorrect token length
 )
@@ -79,12 +80,12 @@ func HasUser(token string) (bool, error) {
 	if token == ""      { return false, ErrTokenEmpty }
 	if len(token) != 12 { return false, ErrTokenIncorrect }
 
+	// Cached users exist; the rest are looked up
+	if users.Has(token) { return true, nil }
+
     var count int64
     query := `SELECT COUNT(*) FROM users WHERE token = $1`
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
     err := pool.QueryRow(context.Background(), query, token).Scan(&count)
     if err != nil {
 		return false, err
@@ -99,24 +100,20 @@ func CreateUser(token string) (*User, error) {
 	if token == ""       { return nil, ErrTokenEmpty }
 	if len(token) != 12  { return nil, ErrTokenIncorrect }
 
-	exists, err := HasUser(token)
-	if err != nil { return nil, err }
-
-	if exists { return nil, fmt.Errorf("User with token %s already exists", token) }
-	
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	var user = &User{Token: token}
 	user.Init()
 
+	// Two first events of a participant may race; the insert decides which
+	// one created them
 	var query = `INSERT INTO users (token, state) VALUES ($1, $2) ON CONFLICT (token) DO NOTHING`
-	_, err = pool.Exec(context.Background(), query, token, user.State)
+	tag, err := pool.Exec(context.Background(), query, token, user.State)
 	if err != nil { return nil, err }
 
-	event.Emit("user.created", user)
+	if tag.RowsAffected() == 0 { return nil, ErrUserExists }
+
+	users.SetIfAbsent(token, user)
+	models.UserCreated.Publish(user)
 
-	users.Set(token, user)
 	return user, nil
 }
 
@@ -124,9 +121,6 @@ func UpdateUser(user *User) (*User, error) {
 	Wait()
 	defer recover()
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	var query = `UPDATE users SET state = $1 WHERE token = $2`
 	_, err := pool.Exec(context.Background(), query, user.State, user.Token)
 	if err != nil { return nil, err }
@@ -144,9 +138,6 @@ func GetUser(token string) (*User, error) {
 		return user, nil
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	rows, err := pool.Query(context.Background(), `SELECT token, state FROM users WHERE token = $1`, token)
 	if err != nil { return nil, err }
 
@@ -157,13 +148,46 @@ func GetUser(token string) (*User, error) {
 		if err != nil { return nil, err }
 
 		user.Init()
-		users.Set(user.Token, &user)
 
+		// A concurrent load of the same user may have cached it first
+		if !users.SetIfAbsent(user.Token, &user) {
+			cached, _ := users.Get(user.Token)
+			return cached, nil
+		}
 		return &user, nil
 	}
 	return nil, ErrUserNotFound
 }
 
+// Reload replaces the cached state of a user with the one in the database,
+// for a user another instance has been changing. Users that are not cached
+// are loaded on their next GetUser.
+func Reload(ctx context.Context, token string) error {
+	Wait()
+
+	cached, ok := users.Get(token)
+	if !ok {
+		return nil
+	}
+
+	var state models.State
+	err := pool.QueryRow(ctx, `SELECT state FROM users WHERE token = $1`, token).Scan(&state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	cached.Replace(state)
+	return nil
+}
+
+// Evict drops a user from the cache, for a user deleted by another instance.
+func Evict(token string) {
+	users.Remove(token)
+}
+
 func GetUsers() (*arraylist.ArrayList[*User], error) {
 // func GetUsers() ([]*User, error) {
 	Wait()
@@ -181,6 +205,36 @@ func GetUsers() (*arraylist.ArrayList[*User], error) {
 	// return slice, nil
 }
 
+// DeleteUser removes a participant from the users table and the cache.
+func DeleteUser(token string) (int64, error) {
+	Wait()
+	if token == ""      { return 0, ErrTokenEmpty }
+	if len(token) != 12 { return 0, ErrTokenIncorrect }
+
+	tag, err := pool.Exec(context.Background(), `DELETE FROM users WHERE token = $1`, token)
+	if err != nil { return 0, err }
+
+	Forget(token)
+	return tag.RowsAffected(), nil
+}
+
+// Forget drops a deleted user from the cache and from the next flush, and
+// tells other instances to drop it too. Callers that delete the row in their
+// own transaction call it once that commits.
+func Forget(token string) {
+	dirtyMu.Lock()
+	delete(dirty, token)
+	dirtyMu.Unlock()
+
+	user, ok := users.Get(token)
+	if ok {
+		users.Remove(token)
+	} else {
+		user = &User{Token: token}
+	}
+	models.UserDeleted.Publish(user)
+}
+
 func StreamUsers() (<-chan *User, error) {
 	Wait()
 	var channel = make(chan *User, 1000)
@@ -210,7 +264,7 @@ func StreamSearches(ctx context.Context, days int) (<-chan *Search, error) {
 
 		var after = carbon.Now(carbon.UTC).SubDays(days).StdTime()
 		var query = `
-		SELECT searches.*, users.* 
+		SELECT searches.id, searches.token, searches.timestamp, searches.metadata, users.token, users.state
 		FROM   searches LEFT JOIN users ON searches.token = users.token 
 		WHERE  searches.timestamp >= $1 
 		ORDER  BY searches.timestamp DESC 
@@ -219,13 +273,11 @@ func StreamSearches(ctx context.Context, days int) (<-chan *Search, error) {
 		`
 
 		for {
-			mutex.Lock()
 			rows, err := pool.Query(context.Background(), query, after, offset, limit)
 			if err != nil {
 				logger.Error().Err(err).Msg("Failed to stream searches")
 				return
 			}
-			mutex.Unlock()
 
 			count := 0
 			for rows.Next() {
@@ -273,17 +325,14 @@ func CreateSearch(search *Search) (*Search, error) {
 	if len(search.Token) != 12 { return nil, ErrTokenInvalid }
 
     var err error
-    var query = `INSERT INTO searches (token, timestamp, metadata) VALUES ($1, $2, $3)`
+    var query = `INSERT INTO searches (token, timestamp, metadata, attempt, correlation) VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))`
 
     metadata, err := json.Marshal(search.Metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-    _, err = pool.Exec(context.Background(), query, search.Token, search.Timestamp, metadata)
+    _, err = pool.Exec(context.Background(), query, search.Token, search.Timestamp, metadata, search.Attempt, search.Correlation)
     if err != nil { 
 		return nil, err 
 	}
@@ -291,6 +340,20 @@ func CreateSearch(search *Search) (*Search, error) {
 	return search, nil
 }
 
+// SettledSearch returns the highest search ID below which every search has
+// committed. IDs are taken before the insert commits, so a slow insert can
+// become visible after a higher ID; anything that walks searches by ID with a
+// watermark stops here so it does not skip it for good.
+func SettledSearch(ctx context.Context) (int64, error) {
+	var id int64
+	err := pool.QueryRow(ctx, `
+		SELECT COALESCE(MAX(id), 0) FROM searches
+		WHERE  inserted_at IS NULL OR inserted_at < clock_timestamp() - make_interval(secs => $1)`,
+		settle.Seconds(),
+	).Scan(&id)
+	return id, err
+}
+
 // ------------------------------------------------------------
 // : Methods
 // ------------------------------------------------------------
@@ -323,9 +386,7 @@ func StreamQuery(ctx context.Context, query string, args ...interface{}) (<-chan
 			// Add pagination to query
 			query := fmt.Sprintf("%s LIMIT %d OFFSET %d", query, limit, offset)
 			
-			mutex.Lock()
 			rows, err := pool.Query(ctx, query, args...)
-			mutex.Unlock()
 			
 			if err != nil {
 				logger.Error().Err(err).Msg("Query failed")
@@ -391,9 +452,7 @@ func QueryWithLimit(ctx context.Context, query string, limit int, args ...interf
             // Construct the paginated query with ORDER BY before LIMIT and OFFSET
             paginatedQuery := fmt.Sprintf("%s ORDER BY id DESC LIMIT $%d OFFSET $%d", query, len(page)-1, len(page))
 
-            mutex.Lock()
             rows, err := pool.Query(ctx, paginatedQuery, page...)
-            mutex.Unlock()
             if err != nil {
                 logger.Error().Err(err).Msg("Failed to query with limit")
                 return
@@ -456,43 +515,40 @@ func InitUsers() {
 	}
 }
 
-func InitListeners() {
-	go func() {
-		ch := event.On("user.updated")
-
-		for e := range ch {
-			user, ok := e.Args[0].(*User)
-			if !ok { continue }
+// InitListeners handles saving users until ctx ends. Saved users are
+// written by the flusher.
+func InitListeners(ctx context.Context) error {
+	return models.SaveUser.Handle(ctx, func(ctx context.Context, user *User) (struct{}, error) {
+		MarkDirty(user)
+		return struct{}{}, nil
+	})
+}
 
-			ch, ok := e.Args[1].(chan error)
-			if !ok { continue }
+// health shuts the server down when the database stops answering.
+func health(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 
-			_, err := UpdateUser(user)
-			ch <- err
-			close(ch)
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
 		}
-	}()
-}
-
-func health() {
-	var err error
-	go func() {
-		for {
-			_, err = pool.Exec(context.Background(), "SELECT 1")
-			if err != nil {
-				logger.Fatal().Err(err).Msg("Failed to ping database")
-				return
-			}
 
-			time.Sleep(5 * time.Second)
+		_, err := pool.Exec(ctx, "SELECT 1")
+		if err != nil && ctx.Err() == nil {
+			logger.Error().Err(err).Msg("Failed to ping database")
+			lifecycle.Shutdown()
+			return
 		}
-	}()
-	select {}
+	}
 }
 // ------------------------------------------------------------
 // : Start
 // ------------------------------------------------------------
-func Start() {
+// Start connects to the database and creates the tables. It returns once
+// users are loaded.
+func Start(ctx context.Context) error {
 	var err error
 
 	if value, ok := os.LookupEnv("DB_HOST"); ok { host = value }
@@ -506,19 +562,22 @@ func Start() {
 	logger.Debug().Str("dsn", dsn).Msg("Connecting to database")
 
 	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return fmt.Errorf("parse database connection string: %w", err)
+	}
 	config.MaxConns = 20
 	config.MinConns = 1
 	config.MaxConnIdleTime   = 5 * time.Minute
 	config.HealthCheckPeriod = 5 * time.Second
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to parse database connection string")
-		return
-	}
+	config.ConnConfig.Tracer = tracer{}
 
-	pool, err = pgxpool.NewWithConfig(context.Background(), config)
+	telemetry.OnScrape(func() {
+		telemetry.QueueDepth.With("db_updates").Set(float64(Dirty()))
+	})
+
+	pool, err = pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to connect to database")
-		return
+		return fmt.Errorf("connect to database: %w", err)
 	}
 
 	user_table := `
@@ -535,33 +594,229 @@ func Start() {
 		metadata    JSONB
 	);`
 
+	// Keyset pagination for exports walks searches by (timestamp, id)
+	search_index := `
+	CREATE INDEX IF NOT EXISTS searches_timestamp_id_idx ON searches (timestamp DESC, id DESC);`
+
+	// Uploads carry the attempt ID of the task that produced them
+	search_attempt := `
+	ALTER TABLE searches ADD COLUMN IF NOT EXISTS attempt     VARCHAR(32);
+	ALTER TABLE searches ADD COLUMN IF NOT EXISTS correlation VARCHAR(16);
+	CREATE INDEX IF NOT EXISTS searches_attempt_idx ON searches (attempt);`
+
+	// When the row was inserted, close to when its ID was taken. Existing
+	// rows stay NULL rather than rewriting the table
+	search_inserted := `
+	ALTER TABLE searches ADD COLUMN IF NOT EXISTS inserted_at TIMESTAMPTZ;
+	ALTER TABLE searches ALTER COLUMN inserted_at SET DEFAULT clock_timestamp();`
+
 	metric_table := `
 	CREATE TABLE IF NOT EXISTS metrics (
 		id          BIGSERIAL PRIMARY KEY,
 		timestamp   TIMESTAMP,
 		metric      JSONB
+	);
+	CREATE INDEX IF NOT EXISTS metrics_timestamp_idx ON metrics (timestamp);`
+
+	// Minute rollup of the numeric fields in metrics, for long ranges
+	rollup_table := `
+	CREATE TABLE IF NOT EXISTS metrics_rollup (
+		type        VARCHAR(32),
+		field       VARCHAR(32),
+		bucket      TIMESTAMP,
+		count       BIGINT NOT NULL,
+		sum         DOUBLE PRECISION NOT NULL,
+		min         DOUBLE PRECISION NOT NULL,
+		max         DOUBLE PRECISION NOT NULL,
+		last        DOUBLE PRECISION NOT NULL,
+		last_at     TIMESTAMP NOT NULL,
+		PRIMARY KEY (type, field, bucket)
+	);`
+
+	// Consent texts are versioned; consents is an append-only log of grants
+	// and withdrawals referencing the text that was shown
+	consent_table := `
+	CREATE TABLE IF NOT EXISTS consent_texts (
+		version     VARCHAR(32) PRIMARY KEY,
+		text        TEXT NOT NULL,
+		checksum    VARCHAR(71) NOT NULL,
+		reconsent   BOOLEAN NOT NULL DEFAULT FALSE,
+		published   TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS consents (
+		id          BIGSERIAL PRIMARY KEY,
+		token       VARCHAR(12) NOT NULL,
+		version     VARCHAR(32) NOT NULL REFERENCES consent_texts (version),
+		action      VARCHAR(8) NOT NULL,
+		source      VARCHAR(32) NOT NULL,
+		timestamp   TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS consents_token_id_idx ON consents (token, id DESC);`
+
+	// Consecutive captures of a keyword on an engine by one participant are
+	// compared by the analysis service; result_changes holds the results that
+	// were added, removed or moved
+	diff_table := `
+	CREATE INDEX IF NOT EXISTS searches_capture_idx ON searches (token, (metadata->>'keyword'), (metadata->>'website'), timestamp DESC, id DESC);
+	CREATE TABLE IF NOT EXISTS result_diffs (
+		id              BIGINT PRIMARY KEY,
+		previous        BIGINT,
+		token           VARCHAR(12) NOT NULL,
+		keyword         TEXT NOT NULL,
+		engine          VARCHAR(32) NOT NULL,
+		captured_at     TIMESTAMP NOT NULL,
+		previous_at     TIMESTAMP,
+		jaccard         DOUBLE PRECISION NOT NULL,
+		rbo             DOUBLE PRECISION NOT NULL,
+		added           INTEGER NOT NULL,
+		removed         INTEGER NOT NULL,
+		moved           INTEGER NOT NULL,
+		unchanged       INTEGER NOT NULL,
+		shift           DOUBLE PRECISION NOT NULL,
+		domains_added   TEXT[] NOT NULL,
+		domains_removed TEXT[] NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS result_diffs_token_idx ON result_diffs (token, keyword, engine, captured_at);
+	CREATE INDEX IF NOT EXISTS result_diffs_captured_idx ON result_diffs (captured_at);
+	CREATE TABLE IF NOT EXISTS result_changes (
+		id              BIGSERIAL PRIMARY KEY,
+		diff            BIGINT NOT NULL REFERENCES result_diffs (id) ON DELETE CASCADE,
+		link            TEXT NOT NULL,
+		domain          TEXT NOT NULL,
+		change          VARCHAR(8) NOT NULL,
+		previous_rank   INTEGER,
+		current_rank    INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS result_changes_diff_idx ON result_changes (diff);`
+
+	// Computed analysis reports, one per kind and period
+	report_table := `
+	CREATE TABLE IF NOT EXISTS reports (
+		kind        VARCHAR(32),
+		period      VARCHAR(16),
+		computed    TIMESTAMP NOT NULL,
+		report      JSONB NOT NULL,
+		PRIMARY KEY (kind, period)
+	);`
+
+	// Coordination between API instances. Presence and leases belong to an
+	// instance and go with it when its heartbeat stops
+	cluster_table := `
+	CREATE TABLE IF NOT EXISTS cluster_instances (
+		id              VARCHAR(64) PRIMARY KEY,
+		started_at      TIMESTAMP NOT NULL,
+		heartbeat_at    TIMESTAMP NOT NULL,
+		metrics         JSONB
+	);
+	CREATE TABLE IF NOT EXISTS cluster_presence (
+		token           VARCHAR(12) PRIMARY KEY,
+		instance        VARCHAR(64) NOT NULL REFERENCES cluster_instances (id) ON DELETE CASCADE,
+		transport       VARCHAR(8) NOT NULL,
+		connected_at    TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS cluster_presence_instance_idx ON cluster_presence (instance);
+	CREATE TABLE IF NOT EXISTS cluster_leases (
+		token           VARCHAR(12) PRIMARY KEY,
+		instance        VARCHAR(64) NOT NULL REFERENCES cluster_instances (id) ON DELETE CASCADE,
+		expires_at      TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS cluster_runs (
+		name            VARCHAR(64),
+		slot            TIMESTAMP,
+		instance        VARCHAR(64) NOT NULL,
+		PRIMARY KEY (name, slot)
+	);
+	CREATE TABLE IF NOT EXISTS cluster_messages (
+		id              BIGSERIAL PRIMARY KEY,
+		created_at      TIMESTAMP NOT NULL DEFAULT now(),
+		payload         JSONB NOT NULL
 	);`
 
 	_, err = pool.Exec(context.Background(), user_table)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to create users table")
+		return fmt.Errorf("create users table: %w", err)
 	}
 
 	_, err = pool.Exec(context.Background(), search_table)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to create searches table")
+		return fmt.Errorf("create searches table: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), search_index)
+	if err != nil {
+		return fmt.Errorf("create searches index: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), search_attempt)
+	if err != nil {
+		return fmt.Errorf("add attempt columns to searches: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), search_inserted)
+	if err != nil {
+		return fmt.Errorf("add inserted_at to searches: %w", err)
 	}
 
 	_, err = pool.Exec(context.Background(), metric_table)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to create metrics table")
+		return fmt.Errorf("create metrics table: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), rollup_table)
+	if err != nil {
+		return fmt.Errorf("create metrics rollup table: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), consent_table)
+	if err != nil {
+		return fmt.Errorf("create consent tables: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), report_table)
+	if err != nil {
+		return fmt.Errorf("create reports table: %w", err)
 	}
 
-	go health()
-	go InitListeners()
+	_, err = pool.Exec(context.Background(), diff_table)
+	if err != nil {
+		return fmt.Errorf("create result diff tables: %w", err)
+	}
+
+	_, err = pool.Exec(context.Background(), cluster_table)
+	if err != nil {
+		return fmt.Errorf("create cluster tables: %w", err)
+	}
+
+	// Users are saved until the pool closes, not until shutdown begins, so
+	// services that drain can still save them
+	var listening context.Context
+	listening, unlisten = context.WithCancel(context.Background())
+	if err := InitListeners(listening); err != nil {
+		return err
+	}
+
+	go health(ctx)
+	go flusher(ctx)
 	
 	InitUsers()
 	
 	logger.Info().Msg("Ready")
 	gk.Unlock()
+	return nil
+}
+
+// Stop writes the users that are still dirty, so changes made while other
+// services drained are kept, and closes the pool. Users that were not
+// changed are left alone: the cache may hold stale copies of participants
+// another instance has written since.
+func Stop(ctx context.Context) error {
+	unlisten()
+
+	if err := Flush(ctx); err != nil {
+		logger.Error().Err(err).Int("dirty", Dirty()).Msg("Failed to flush users")
+	}
+
+	// Waits for queries in progress
+	pool.Close()
+	return ctx.Err()
 }
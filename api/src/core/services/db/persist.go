@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Write-behind
+// ------------------------------------------------------------
+
+// Saving a user only marks it dirty. A flusher writes every dirty user in
+// batched updates on an interval and once more on shutdown. The state is
+// encoded when it is flushed, so a user saved many times between flushes is
+// written once, with its latest state; a user saved while a flush is running
+// is dirty again and goes out with the next one.
+//
+// Flushes only update rows that CreateUser inserted. A participant erased
+// while a save or a flush was in flight stays deleted.
+
+var (
+	// Time between flushes, overridden with DB_FLUSH_INTERVAL
+	flushInterval = 1 * time.Second
+
+	// Users per update
+	flushBatch = 500
+
+	dirtyMu sync.Mutex
+	dirty   = map[string]*User{}
+
+	// Serialises flushes from the ticker and from Stop
+	flushMu sync.Mutex
+
+	// Drops users another instance is responsible for; see OnFlush
+	filter   func(ctx context.Context, users []*User) []*User
+	filterMu sync.RWMutex
+)
+
+// MarkDirty queues a user to be written with the next flush.
+func MarkDirty(user *User) {
+	dirtyMu.Lock()
+	dirty[user.Token] = user
+	dirtyMu.Unlock()
+}
+
+// Dirty returns the number of users waiting to be written.
+func Dirty() int {
+	dirtyMu.Lock()
+	defer dirtyMu.Unlock()
+	return len(dirty)
+}
+
+// IsDirty reports whether a user has changes that are not written yet.
+func IsDirty(token string) bool {
+	dirtyMu.Lock()
+	defer dirtyMu.Unlock()
+	_, ok := dirty[token]
+	return ok
+}
+
+// Flush writes every dirty user. Users that could not be written are dirty
+// again, unless they were saved in the meantime.
+func Flush(ctx context.Context) error {
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	dirtyMu.Lock()
+	pending := dirty
+	dirty    = map[string]*User{}
+	dirtyMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	list := make([]*User, 0, len(pending))
+	for _, user := range pending {
+		list = append(list, user)
+	}
+
+	filterMu.RLock()
+	fn := filter
+	filterMu.RUnlock()
+	if fn != nil {
+		list = fn(ctx, list)
+	}
+
+	for start := 0; start < len(list); start += flushBatch {
+		end := min(start + flushBatch, len(list))
+		if err := update(ctx, list[start:end]); err != nil {
+			dirtyMu.Lock()
+			for _, user := range list[start:] {
+				if _, ok := dirty[user.Token]; !ok {
+					dirty[user.Token] = user
+				}
+			}
+			dirtyMu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Persist writes one user right away instead of with the next flush, for
+// state another instance is about to read.
+func Persist(ctx context.Context, user *User) error {
+	dirtyMu.Lock()
+	delete(dirty, user.Token)
+	dirtyMu.Unlock()
+
+	if err := update(ctx, []*User{user}); err != nil {
+		MarkDirty(user)
+		return err
+	}
+	return nil
+}
+
+// OnFlush sets a function that picks which dirty users a flush writes. With
+// several instances, a user is only written by the instance it is connected
+// to, so a stale copy elsewhere does not overwrite it.
+func OnFlush(fn func(ctx context.Context, users []*User) []*User) {
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	filter = fn
+}
+
+// update writes the state of users that still have a row. States are
+// encoded under the user's lock, since events keep changing them.
+func update(ctx context.Context, users []*User) error {
+	tokens := make([]string, 0, len(users))
+	states := make([]string, 0, len(users))
+
+	for _, user := range users {
+		user.Lock()
+		b, err := json.Marshal(user.State)
+		user.Unlock()
+		if err != nil {
+			logger.Error().Err(err).Str("token", user.Token).Msg("Failed to encode user state")
+			continue
+		}
+		tokens = append(tokens, user.Token)
+		states = append(states, string(b))
+	}
+
+	_, err := pool.Exec(ctx, `
+	UPDATE users SET state = u.state::jsonb
+	FROM unnest($1::text[], $2::text[]) AS u(token, state)
+	WHERE users.token = u.token`, tokens, states)
+
+	return err
+}
+
+// flusher flushes on an interval until ctx ends.
+func flusher(ctx context.Context) {
+	if value, ok := os.LookupEnv("DB_FLUSH_INTERVAL"); ok {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			flushInterval = d
+		}
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ctx.Done(): return
+			case <-ticker.C  :
+		}
+
+		if err := Flush(ctx); err != nil && ctx.Err() == nil {
+			logger.Error().Err(err).Int("dirty", Dirty()).Msg("Failed to flush users")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"dse/src/core/telemetry"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Tracer
+// ------------------------------------------------------------
+
+// tracer records the latency of every query on the pool, labelled by the
+// statement keyword so the number of series stays small.
+type tracer struct{}
+
+type traceKey struct{}
+
+type trace struct {
+	operation string
+	start     time.Time
+}
+
+func (tracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, &trace{operation: operation(data.SQL), start: time.Now()})
+}
+
+func (tracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t, ok := ctx.Value(traceKey{}).(*trace)
+	if !ok {
+		return
+	}
+
+	telemetry.DBDuration.With(t.operation).Observe(time.Since(t.start).Seconds())
+	if data.Err != nil && data.Err != pgx.ErrNoRows {
+		telemetry.DBErrors.With(t.operation).Inc()
+	}
+}
+
+// operation returns the first keyword of a statement in lower case.
+func operation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+
+	switch keyword := strings.ToLower(fields[0]); keyword {
+		case "select", "insert", "update", "delete", "create", "alter", "drop", "with", "begin", "commit", "rollback", "copy":
+			return keyword
+	}
+	return "other"
+}
@@ -0,0 +1,135 @@
+package enrich
+
+import (
+	"context"
+	"dse/src/core/log"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/db"
+	"dse/src/core/sources"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Searches annotated per statement while backfilling
+	batch = 500
+
+	// How often stored searches are checked against the source list
+	interval = 1 * time.Hour
+)
+
+// ------------------------------------------------------------
+// : Enrich
+// ------------------------------------------------------------
+
+// Results annotates the results of a search with domains and source tags in
+// place (see sources.List.Enrich) and returns the version of the source list
+// used, to be stored as the search's "sources".
+func Results(results map[string]any) string {
+	list, err := sources.Current()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load source list")
+		return ""
+	}
+	return list.Enrich(results)
+}
+
+// ------------------------------------------------------------
+// : Backfill
+// ------------------------------------------------------------
+
+// Backfill annotates stored searches that were enriched with another version
+// of the source list, or not at all. It walks the table by id in batches so
+// it can run next to ingestion. Snapshot partitions are annotated again by
+// each instance (see export.UpdateSnapshot).
+func Backfill(ctx context.Context) (int, error) {
+	list, err := sources.Current()
+	if err != nil {
+		return 0, err
+	}
+
+	pool    := db.GetConnection()
+	updated := 0
+	last    := int64(0)
+
+	for {
+		rows, err := pool.Query(ctx, `
+			SELECT id, metadata->'results' FROM searches
+			WHERE id > $1 AND metadata IS NOT NULL AND metadata->>'sources' IS DISTINCT FROM $2
+			ORDER BY id LIMIT $3`, last, list.Version, batch)
+		if err != nil {
+			return updated, err
+		}
+
+		updates := &pgx.Batch{}
+		for rows.Next() {
+			var id int64
+			var b  []byte
+			if err := rows.Scan(&id, &b); err != nil {
+				rows.Close()
+				return updated, err
+			}
+			last = id
+
+			results := map[string]any{}
+			if len(b) > 0 {
+				json.Unmarshal(b, &results)
+			}
+			list.Enrich(results)
+
+			enriched, err := json.Marshal(results)
+			if err != nil {
+				continue
+			}
+
+			updates.Queue(`
+				UPDATE searches SET metadata = jsonb_set(jsonb_set(metadata, '{results}', $1), '{sources}', to_jsonb($2::text))
+				WHERE id = $3`, enriched, list.Version, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, err
+		}
+
+		if updates.Len() == 0 {
+			return updated, nil
+		}
+
+		if err := pool.SendBatch(ctx, updates).Close(); err != nil {
+			return updated, err
+		}
+		updated += updates.Len()
+	}
+}
+
+// ------------------------------------------------------------
+// : Init
+// ------------------------------------------------------------
+
+// Init backfills on start and then on every whole interval until ctx is
+// done. All instances wake together and only the one that claims the run
+// rewrites the table.
+func Init(ctx context.Context) {
+	run := cluster.Once("enrich.backfill", func() {
+		updated, err := Backfill(ctx)
+		switch {
+			case ctx.Err() != nil: return
+			case err != nil      : log.Error().Err(err).Msg("Failed to enrich stored searches")
+			case updated > 0     : log.Info().Int("searches", updated).Msg("Enriched stored searches")
+		}
+	})
+
+	for {
+		run()
+
+		select {
+			case <-ctx.Done(): return
+			case <-time.After(time.Until(time.Now().Truncate(interval).Add(interval))):
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package export
+
+import (
+	"context"
+	"dse/src/core/models"
+)
+
+// ------------------------------------------------------------
+// : Export
+// ------------------------------------------------------------
+
+// Export writes every search matching the filter to the writer, following
+// the merge rule documented in users.go, and returns the number of searches
+// written. Users may be nil, in which case they are loaded with LoadUsers.
+func Export(ctx context.Context, filter Filter, users map[string]*models.User, writer *Writer) (int64, error) {
+	if users == nil {
+		var err error
+		users, err = LoadUsers(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var count int64
+	channel, errs := Stream(ctx, filter)
+
+	for search := range channel {
+		user := users[search.Token]
+		if user == nil {
+			continue
+		}
+
+		output, err := NewOutputSearch(search, user)
+		if err != nil {
+			continue
+		}
+
+		if err := writer.WriteSearch(output); err != nil {
+			return count, err
+		}
+		count += 1
+	}
+
+	if err := <-errs; err != nil {
+		return count, err
+	}
+
+	return count, ctx.Err()
+}
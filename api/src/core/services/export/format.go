@@ -0,0 +1,454 @@
+package export
+
+import (
+	"dse/src/core/models"
+	"dse/src/utils/json"
+	"dse/src/utils/parquet"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/cast"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Format string
+
+const (
+	FormatNDJSON  Format = "ndjson"
+	FormatCSV     Format = "csv"
+	FormatParquet Format = "parquet"
+)
+
+// Row is one result of one search, with the demographics of the participant
+// that captured it. CSV and Parquet exports contain one Row per result.
+type Row struct {
+	SearchID     int64  `json:"search_id"`
+	Timestamp    string `json:"timestamp"`
+	Website      string `json:"website"`
+	Keyword      string `json:"keyword"`
+	Url          string `json:"url"`
+	Localization string `json:"localization"`
+
+	Section      string `json:"section"`
+	Rank         int64  `json:"rank"`
+	Title        string `json:"title"`
+	Link         string `json:"link"`
+	Publisher    string `json:"publisher"`
+	Description  string `json:"description"`
+
+	OutputUser
+}
+
+// Writer encodes searches or users in one of the export formats. NDJSON
+// keeps the nested documents; CSV and Parquet are written as flat tables.
+type Writer struct {
+	Format Format
+
+	out     io.Writer
+	columns []column
+	table   table
+	rows    atomic.Int64
+
+	pseudonymiser *Pseudonymiser
+}
+
+type column struct {
+	name  string
+	kind  parquet.Kind
+	index []int
+	key   string // Key in the map at index, for columns generated from the form schema
+}
+
+type table interface {
+	write(values []any) error
+	close() error
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	ErrInvalidFormat = errors.New("invalid format, expected ndjson, csv or parquet")
+)
+
+// ------------------------------------------------------------
+// : Format
+// ------------------------------------------------------------
+func ParseFormat(value string) (Format, error) {
+	switch Format(strings.ToLower(value)) {
+		case ""           : return FormatNDJSON, nil
+		case "json"       : return FormatNDJSON, nil
+		case FormatNDJSON : return FormatNDJSON, nil
+		case FormatCSV    : return FormatCSV, nil
+		case FormatParquet: return FormatParquet, nil
+	}
+	return "", ErrInvalidFormat
+}
+
+func (f Format) ContentType() string {
+	switch f {
+		case FormatCSV    : return "text/csv; charset=utf-8"
+		case FormatParquet: return "application/vnd.apache.parquet"
+		default           : return "application/x-ndjson"
+	}
+}
+
+func (f Format) Extension() string {
+	switch f {
+		case FormatCSV    : return "csv"
+		case FormatParquet: return "parquet"
+		default           : return "ndjson"
+	}
+}
+
+// ------------------------------------------------------------
+// : Constructors
+// ------------------------------------------------------------
+func NewSearchWriter(out io.Writer, format Format) *Writer {
+	return newWriter(out, format, reflect.TypeOf(Row{}))
+}
+
+func NewUserWriter(out io.Writer, format Format) *Writer {
+	return newWriter(out, format, reflect.TypeOf(OutputUser{}))
+}
+
+func newWriter(out io.Writer, format Format, row reflect.Type) *Writer {
+	w := &Writer{
+		Format : format,
+		out    : out,
+		columns: columnsOf(row, nil),
+	}
+
+	switch format {
+		case FormatCSV    : w.table = newCSVTable(out, w.columns)
+		case FormatParquet: w.table = newParquetTable(out, w.columns)
+	}
+
+	return w
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Pseudonymise applies the recipient's profile to everything written
+// afterwards and removes the dropped columns from tables. It must be called
+// before the first write.
+func (w *Writer) Pseudonymise(p *Pseudonymiser) *Writer {
+	if p == nil {
+		return w
+	}
+
+	columns := []column{}
+	for _, column := range w.columns {
+		if !p.Dropped(column.name) {
+			columns = append(columns, column)
+		}
+	}
+
+	w.columns       = columns
+	w.pseudonymiser = p
+
+	switch w.Format {
+		case FormatCSV    : w.table = newCSVTable(w.out, w.columns)
+		case FormatParquet: w.table = newParquetTable(w.out, w.columns)
+	}
+
+	return w
+}
+
+// WriteSearch writes a search document, or one row per result for tables.
+func (w *Writer) WriteSearch(search *OutputSearch) error {
+	if w.pseudonymiser != nil {
+		search = w.pseudonymiser.Search(search)
+	}
+
+	if w.table == nil {
+		return w.writeJSON(search)
+	}
+
+	for _, row := range Rows(search) {
+		if err := w.writeRow(reflect.ValueOf(row).Elem()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteUser writes the full user state, or its flattened form for tables.
+// Pseudonymised exports never contain the state, only the flattened form.
+func (w *Writer) WriteUser(user *models.User) error {
+	if w.table == nil && w.pseudonymiser == nil {
+		return w.writeJSON(user)
+	}
+
+	output := NewOutputUser(user.Token, FormOf(user))
+	if w.pseudonymiser != nil {
+		output = w.pseudonymiser.User(output)
+	}
+
+	if w.table == nil {
+		return w.writeJSON(output)
+	}
+
+	return w.writeRow(reflect.ValueOf(output).Elem())
+}
+
+// Rows returns the number of documents or table rows written so far. It is
+// safe to call while another goroutine is writing.
+func (w *Writer) Rows() int64 {
+	return w.rows.Load()
+}
+
+// Close finishes the table (CSV header, Parquet footer). It does not close
+// the underlying writer.
+func (w *Writer) Close() error {
+	if w.table == nil {
+		return nil
+	}
+	return w.table.close()
+}
+
+// ------------------------------------------------------------
+// : Rows
+// ------------------------------------------------------------
+
+// Rows flattens a search into one Row per result. Every list in the results
+// (search_result, videos, people_also_ask, ...) becomes its own section and
+// ranks start at 1 within each section.
+func Rows(search *OutputSearch) []*Row {
+	rows     := []*Row{}
+	user     := NewOutputUser(search.Token, search.Form)
+	sections := make([]string, 0, len(search.Results))
+
+	for section := range search.Results {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		items, ok := search.Results[section].([]any)
+		if !ok {
+			continue
+		}
+
+		for i, item := range items {
+			fields, _ := item.(map[string]any)
+
+			row := &Row{
+				SearchID    : int64(search.ID),
+				Timestamp   : search.Timestamp,
+				Website     : search.Website,
+				Keyword     : search.Keyword,
+				Url         : search.Url,
+				Localization: search.Localization,
+
+				Section    : section,
+				Rank       : int64(i + 1),
+				Title      : first(fields, "title", "question"),
+				Link       : first(fields, "link"),
+				Publisher  : first(fields, "publisher", "channel"),
+				Description: first(fields, "description"),
+
+				OutputUser: *user,
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+func first(fields map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if value := cast.ToString(fields[key]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func (w *Writer) writeJSON(v any) error {
+	b, err := json.ToLine(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.out.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.out.Write([]byte("\n")); err != nil {
+		return err
+	}
+
+	w.rows.Add(1)
+	return nil
+}
+
+func (w *Writer) writeRow(v reflect.Value) error {
+	values := make([]any, len(w.columns))
+	for i, column := range w.columns {
+		field := v.FieldByIndex(column.index)
+		if column.key == "" {
+			values[i] = field.Interface()
+			continue
+		}
+
+		// Answers missing from a form are written as the zero value
+		value := field.MapIndex(reflect.ValueOf(column.key))
+		switch {
+			case value.IsValid()           : values[i] = value.Interface()
+			case column.kind == parquet.Boolean: values[i] = false
+			default                        : values[i] = ""
+		}
+	}
+
+	if err := w.table.write(values); err != nil {
+		return err
+	}
+
+	w.rows.Add(1)
+	return nil
+}
+
+// columnsOf lists the exported fields of a row struct in declaration order,
+// named after their json tags. Embedded structs are inlined and a field
+// tagged export:"answers" expands into the columns of the form schema.
+func columnsOf(t reflect.Type, parent []int) []column {
+	columns := []column{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		index := append(append([]int{}, parent...), i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			columns = append(columns, columnsOf(field.Type, index)...)
+			continue
+		}
+
+		if field.Tag.Get("export") == "answers" {
+			for _, answer := range answerColumns() {
+				columns = append(columns, column{name: answer.Name, kind: answer.Kind, index: index, key: answer.Name})
+			}
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		var kind parquet.Kind
+		switch field.Type.Kind() {
+			case reflect.Bool                  : kind = parquet.Boolean
+			case reflect.Int, reflect.Int64    : kind = parquet.Int64
+			case reflect.Float32, reflect.Float64: kind = parquet.Double
+			default                            : kind = parquet.String
+		}
+
+		columns = append(columns, column{name: name, kind: kind, index: index})
+	}
+
+	return columns
+}
+
+// ------------------------------------------------------------
+// : CSV
+// ------------------------------------------------------------
+type csvTable struct {
+	writer  *csv.Writer
+	columns []column
+	header  bool
+	pending int
+}
+
+func newCSVTable(out io.Writer, columns []column) *csvTable {
+	return &csvTable{writer: csv.NewWriter(out), columns: columns}
+}
+
+func (t *csvTable) writeHeader() error {
+	t.header = true
+
+	names := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		names[i] = column.name
+	}
+	return t.writer.Write(names)
+}
+
+func (t *csvTable) write(values []any) error {
+	if !t.header {
+		if err := t.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+			case bool  : record[i] = strconv.FormatBool(v)
+			case int64 : record[i] = strconv.FormatInt(v, 10)
+			case string: record[i] = v
+			default    : record[i] = fmt.Sprint(v)
+		}
+	}
+
+	if err := t.writer.Write(record); err != nil {
+		return err
+	}
+
+	t.pending += 1
+	if t.pending >= 1_000 {
+		t.pending = 0
+		t.writer.Flush()
+		return t.writer.Error()
+	}
+	return nil
+}
+
+func (t *csvTable) close() error {
+	if !t.header {
+		if err := t.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	t.writer.Flush()
+	return t.writer.Error()
+}
+
+// ------------------------------------------------------------
+// : Parquet
+// ------------------------------------------------------------
+type parquetTable struct {
+	writer *parquet.Writer
+}
+
+func newParquetTable(out io.Writer, columns []column) *parquetTable {
+	schema := make([]parquet.Column, len(columns))
+	for i, column := range columns {
+		schema[i] = parquet.Column{Name: column.name, Kind: column.kind}
+	}
+
+	return &parquetTable{writer: parquet.NewWriter(out, schema, 10_000)}
+}
+
+func (t *parquetTable) write(values []any) error {
+	return t.writer.Write(values)
+}
+
+func (t *parquetTable) close() error {
+	return t.writer.Close()
+}
@@ -0,0 +1,461 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"dse/src/core/global"
+	"dse/src/core/log"
+	"dse/src/core/telemetry"
+	"dse/src/utils/hashmap"
+	"dse/src/utils/json"
+	"dse/src/utils/semaphore"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is an export that runs in the background and writes its artifact and
+// manifest to <dir>/<id>/. Finished jobs survive restarts through their
+// manifest; pending and running jobs do not.
+type Job struct {
+	ID        string    `json:"id"`
+	Status    Status    `json:"status"`
+	Filter    Filter    `json:"filter"`
+	Format    Format    `json:"format"`
+	Recipient string    `json:"recipient,omitempty"`
+	Rows      int64     `json:"rows"`
+	Error     string    `json:"error,omitempty"`
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+
+	Manifest  *Manifest `json:"manifest,omitempty"`
+
+	mutex         sync.Mutex
+	writer        *Writer
+	pseudonymiser *Pseudonymiser
+}
+
+// Manifest describes a finished artifact: what was asked for, what it
+// contains and which build produced it.
+type Manifest struct {
+	ID        string    `json:"id"`
+	File      string    `json:"file"`
+	Filter    Filter    `json:"filter"`
+	Format    Format    `json:"format"`
+	Recipient string    `json:"recipient,omitempty"`
+	Profile   string    `json:"profile"`
+	Searches  int64     `json:"searches"`
+	Rows      int64     `json:"rows"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"` // sha256:<hex>
+	Version   string    `json:"version"`
+	Revision  string    `json:"revision"`
+	Created   time.Time `json:"created"`
+	Finished  time.Time `json:"finished"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	dir  = "exports"
+	jobs = hashmap.NewHashMap[string, *Job]()
+	sem  = semaphore.New(2) // Concurrent jobs
+	rjob = regexp.MustCompile(`^[a-f0-9]{16}$`)
+
+	lifetime = context.Background() // Cancelled at shutdown, see Start
+	running  sync.WaitGroup
+
+	// Errors
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobNotDone  = errors.New("job is not done")
+)
+
+func init() {
+	if value, ok := os.LookupEnv("EXPORT_DIR"); ok { dir = value }
+
+	telemetry.OnScrape(func() {
+		pending := 0
+		jobs.Each(func(_ string, job *Job) {
+			if job.Snapshot().Status == StatusPending {
+				pending += 1
+			}
+		})
+		telemetry.QueueDepth.With("export_jobs").Set(float64(pending))
+	})
+}
+
+// ------------------------------------------------------------
+// : Service
+// ------------------------------------------------------------
+
+// Start ties jobs to the server: shutdown cancels the jobs still running, and
+// they fail rather than leave a partial artifact behind.
+func Start(ctx context.Context) error {
+	lifetime = ctx
+	return nil
+}
+
+// Stop waits for cancelled jobs to remove their partial artifacts.
+func Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+
+	select {
+		case <-done      : return nil
+		case <-ctx.Done(): return ctx.Err()
+	}
+}
+
+// ------------------------------------------------------------
+// : Jobs
+// ------------------------------------------------------------
+
+// Submit queues an export job and returns immediately. A recipient applies
+// their pseudonymisation profile to the artifact.
+func Submit(filter Filter, format Format, recipient string) (*Job, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	var pseudonymiser *Pseudonymiser
+	if recipient != "" {
+		var err error
+		if pseudonymiser, err = NewPseudonymiser(recipient); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID     : id,
+		Status : StatusPending,
+		Filter : filter,
+		Format : format,
+		Created: time.Now().UTC(),
+
+		Recipient    : recipient,
+		pseudonymiser: pseudonymiser,
+	}
+	jobs.Set(id, job)
+
+	running.Add(1)
+	go job.run(lifetime)
+
+	return job, nil
+}
+
+// GetJob returns a job by ID, including finished jobs of earlier runs.
+func GetJob(id string) (*Job, error) {
+	if job, ok := jobs.Get(id); ok {
+		return job, nil
+	}
+
+	manifest, err := ReadManifest(id)
+	if err != nil {
+		return nil, ErrJobNotFound
+	}
+
+	job := &Job{
+		ID      : manifest.ID,
+		Status  : StatusDone,
+		Filter  : manifest.Filter,
+		Format  : manifest.Format,
+		Rows    : manifest.Rows,
+		Created : manifest.Created,
+
+		Recipient: manifest.Recipient,
+		Finished: manifest.Finished,
+		Manifest: manifest,
+	}
+	jobs.Set(id, job)
+
+	return job, nil
+}
+
+// Jobs returns every job known to this process, newest first.
+func Jobs() []*Job {
+	list := []*Job{}
+	jobs.Each(func(_ string, job *Job) {
+		list = append(list, job.Snapshot())
+	})
+
+	sort.Slice(list, func(a, b int) bool { return list[a].Created.After(list[b].Created) })
+	return list
+}
+
+// Prune removes the artifacts of jobs that finished more than maxAge ago,
+// and forgets failed jobs of the same age.
+func Prune(maxAge time.Duration) {
+	failed := []string{}
+	jobs.Each(func(id string, job *Job) {
+		snapshot := job.Snapshot()
+		if snapshot.Status == StatusFailed && time.Since(snapshot.Finished) >= maxAge {
+			failed = append(failed, id)
+		}
+	})
+	for _, id := range failed {
+		jobs.Delete(id)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		manifest, err := ReadManifest(entry.Name())
+		if err != nil || time.Since(manifest.Finished) < maxAge {
+			continue
+		}
+
+		jobs.Delete(manifest.ID)
+		if err := os.RemoveAll(filepath.Join(dir, manifest.ID)); err != nil {
+			log.Error().Err(err).Str("job", manifest.ID).Msg("Failed to remove export")
+		}
+	}
+}
+
+// ReadManifest reads the manifest of a finished job from disk.
+func ReadManifest(id string) (*Manifest, error) {
+	if !rjob.MatchString(id) {
+		return nil, ErrJobNotFound
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, id, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.FromBytes(b, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Snapshot returns a copy of the job that is safe to encode while the job is
+// running.
+func (j *Job) Snapshot() *Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	snapshot := &Job{
+		ID      : j.ID,
+		Status  : j.Status,
+		Filter  : j.Filter,
+		Format  : j.Format,
+		Rows    : j.Rows,
+		Error   : j.Error,
+
+		Recipient: j.Recipient,
+		Created : j.Created,
+		Started : j.Started,
+		Finished: j.Finished,
+		Manifest: j.Manifest,
+	}
+
+	if j.writer != nil {
+		snapshot.Rows = j.writer.Rows()
+	}
+
+	return snapshot
+}
+
+// Open returns the artifact of a finished job.
+func (j *Job) Open() (*os.File, *Manifest, error) {
+	j.mutex.Lock()
+	manifest := j.Manifest
+	j.mutex.Unlock()
+
+	if manifest == nil {
+		return nil, nil, ErrJobNotDone
+	}
+
+	f, err := os.Open(filepath.Join(dir, j.ID, manifest.File))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, manifest, nil
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func (j *Job) run(ctx context.Context) {
+	defer running.Done()
+
+	sem.Acquire()
+	defer sem.Release()
+
+	j.mutex.Lock()
+	j.Status  = StatusRunning
+	j.Started = time.Now().UTC()
+	j.mutex.Unlock()
+
+	manifest, err := j.export(ctx)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.Finished = time.Now().UTC()
+	j.writer   = nil
+
+	if err != nil {
+		log.Error().Err(err).Str("job", j.ID).Msg("Export failed")
+		j.Status = StatusFailed
+		j.Error  = err.Error()
+		os.RemoveAll(filepath.Join(dir, j.ID))
+		return
+	}
+
+	j.Status   = StatusDone
+	j.Rows     = manifest.Rows
+	j.Manifest = manifest
+}
+
+func (j *Job) export(ctx context.Context) (*Manifest, error) {
+	path := filepath.Join(dir, j.ID)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("searches.%s", j.Format.Extension())
+	f, err := os.Create(filepath.Join(path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash    := sha256.New()
+	buffer  := bufio.NewWriter(io.MultiWriter(f, hash))
+	counter := &countingWriter{w: buffer}
+	writer  := NewSearchWriter(counter, j.Format).Pseudonymise(j.pseudonymiser)
+
+	profile := Profiles["internal"].Name
+	if j.pseudonymiser != nil {
+		profile = j.pseudonymiser.Profile.Name
+	}
+
+	j.mutex.Lock()
+	j.writer = writer
+	j.mutex.Unlock()
+
+	searches, err := Export(ctx, j.Filter, nil, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := buffer.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		ID      : j.ID,
+		File    : name,
+		Filter  : j.Filter,
+		Format  : j.Format,
+		Searches: searches,
+
+		Recipient: j.Recipient,
+		Profile  : profile,
+
+		Rows    : writer.Rows(),
+		Size    : counter.n,
+		Checksum: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Version : global.VERSION,
+		Revision: revision(),
+		Created : j.Created,
+		Finished: time.Now().UTC(),
+	}
+
+	b, err := json.ToBytes(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	// The manifest is written last, so its presence marks a complete artifact
+	if err := os.WriteFile(filepath.Join(path, "manifest.json"), b, 0o644); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// revision returns the VCS revision the binary was built from, if known.
+func revision() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,139 @@
+package export
+
+import (
+	"dse/src/core/log"
+	"dse/src/core/models"
+	"dse/src/core/schema"
+	"dse/src/core/sources"
+	"encoding/json"
+	"errors"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+// OutputUser is the flattened form of a participant. Its answer columns are
+// generated from the form schema (see core/schema), so they follow
+// config/form.json instead of being listed here.
+type OutputUser struct {
+	Token       string         `json:"token"`
+	FormVersion string         `json:"form_version"`
+	Answers     map[string]any `json:"-" export:"answers"` // Column name to value
+}
+
+type OutputSearch struct {
+	ID          int    `json:"id"`
+	Token       string `json:"token"`
+	Timestamp   string `json:"timestamp"`
+
+	Url         string `json:"url"`
+	Website     string `json:"website"`
+	Keyword     string `json:"keyword"`
+
+	Browser       map[string]any `json:"browser"`
+	Localization  string          `json:"localization"`
+
+	Form     *models.Form `json:"form"`
+	Results  map[string]any `json:"results"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	ErrEmptyResults = errors.New("search has no results")
+)
+
+// ------------------------------------------------------------
+// : Constructors
+// ------------------------------------------------------------
+
+// NewOutputUser flattens a participant's form into one export row.
+func NewOutputUser(token string, form *models.Form) *OutputUser {
+	output := &OutputUser{Token: token, Answers: map[string]any{}}
+	if form == nil {
+		return output
+	}
+
+	output.FormVersion = form.Version
+	for _, column := range answerColumns() {
+		output.Answers[column.Name] = column.Value(form)
+	}
+
+	return output
+}
+
+// MarshalJSON writes the answers as top level fields, like the columns of a
+// table export.
+func (u OutputUser) MarshalJSON() ([]byte, error) {
+	flat := make(map[string]any, len(u.Answers) + 2)
+	for name, value := range u.Answers {
+		flat[name] = value
+	}
+	flat["token"]        = u.Token
+	flat["form_version"] = u.FormVersion
+
+	return json.Marshal(flat)
+}
+
+// answerColumns returns the answer columns of the current schema. Without a
+// readable schema exports only contain the token.
+func answerColumns() []*schema.Column {
+	current, err := schema.Current()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load form schema")
+		return []*schema.Column{}
+	}
+	return current.Columns()
+}
+
+// NewOutputSearch combines a stored search with the form of the participant
+// that captured it. Searches without a single result in any section are
+// rejected.
+func NewOutputSearch(search *models.Search, user *models.User) (*OutputSearch, error) {
+	b, err := search.Metadata.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	var output = &OutputSearch{}
+	var parsed = gjson.ParseBytes(b)
+
+	output.ID        = int(search.ID)
+	output.Token     = search.Token
+	output.Timestamp = search.Timestamp
+
+	output.Url     = parsed.Get("url").String()
+	output.Website = parsed.Get("website").String()
+	output.Keyword = parsed.Get("keyword").String()
+
+	output.Browser, _ = parsed.Get("browser").Value().(map[string]any)
+
+	output.Localization = parsed.Get("localization").String()
+	output.Results, _   = parsed.Get("results").Value().(map[string]any)
+
+	// Searches stored before the current source list are annotated here, so
+	// every export carries the same domains and tags
+	if list, err := sources.Current(); err == nil && parsed.Get("sources").String() != list.Version {
+		list.Enrich(output.Results)
+	}
+
+	output.Form = FormOf(user)
+
+	if !hasResults(output.Results) {
+		return nil, ErrEmptyResults
+	}
+
+	return output, nil
+}
+
+func hasResults(results map[string]any) bool {
+	for _, section := range results {
+		if items, ok := section.([]any); ok && len(items) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package export
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"dse/src/core/models"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Profile decides how much of a participant an export reveals.
+type Profile struct {
+	Name     string
+	Tokens   bool     // Replace tokens with pseudonyms
+	Postcode int      // Postcode digits kept, 0 drops the postcode
+	Band     bool     // Coarser age and income bands
+	Drop     []string // OutputUser columns (or column prefixes) removed
+}
+
+// Pseudonymiser applies a profile to the exports of one recipient. Tokens
+// become HMAC-SHA256(key, token), where the key is derived from EXPORT_SECRET
+// and the recipient name. Pseudonyms are therefore stable for a recipient,
+// unlinkable across recipients and can only be reversed by someone holding
+// the secret and the list of tokens (see Reverse).
+type Pseudonymiser struct {
+	Recipient string
+	Profile   *Profile
+
+	key []byte
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	Profiles = map[string]*Profile{
+		"internal": {
+			Name    : "internal",
+			Postcode: 4,
+		},
+		"research": {
+			Name    : "research",
+			Tokens  : true,
+			Postcode: 2,
+		},
+		"restricted": {
+			Name    : "restricted",
+			Tokens  : true,
+			Postcode: 0,
+			Band    : true,
+			Drop    : []string{"political", "resident", "language", "browser"},
+		},
+	}
+
+	rrecipient     = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	recipientsFile = "config/recipients.json"
+
+	// Errors
+	ErrInvalidRecipient = errors.New("unknown recipient")
+	ErrMissingSecret    = errors.New("EXPORT_SECRET is not set")
+	ErrUnknownPseudonym = errors.New("pseudonym does not match any participant")
+)
+
+// ------------------------------------------------------------
+// : Constructor
+// ------------------------------------------------------------
+
+// NewPseudonymiser returns the pseudonymiser of a recipient listed in
+// config/recipients.json. A recipient downloads with their own key, listed
+// by its SHA-256 (printf %s "$KEY" | sha256sum):
+//
+//	{"recipients": {"uva": {"profile": "research", "key": "sha256:<hex>"}}}
+func NewPseudonymiser(recipient string) (*Pseudonymiser, error) {
+	if !rrecipient.MatchString(recipient) {
+		return nil, ErrInvalidRecipient
+	}
+
+	b, err := os.ReadFile(recipientsFile)
+	if err != nil {
+		return nil, ErrInvalidRecipient
+	}
+
+	config := gjson.GetBytes(b, "recipients."+recipient)
+	if !config.Exists() {
+		return nil, ErrInvalidRecipient
+	}
+
+	profile, ok := Profiles[config.Get("profile").String()]
+	if !ok {
+		return nil, fmt.Errorf("recipient %s has an unknown profile", recipient)
+	}
+
+	secret := os.Getenv("EXPORT_SECRET")
+	if secret == "" && profile.Tokens {
+		return nil, ErrMissingSecret
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("recipient:" + recipient))
+
+	return &Pseudonymiser{
+		Recipient: recipient,
+		Profile  : profile,
+		key      : mac.Sum(nil),
+	}, nil
+}
+
+// Authenticate returns the pseudonymiser of the recipient whose key is
+// credential. Recipients without a key cannot download themselves.
+func Authenticate(credential string) (*Pseudonymiser, error) {
+	if credential == "" {
+		return nil, ErrInvalidRecipient
+	}
+
+	b, err := os.ReadFile(recipientsFile)
+	if err != nil {
+		return nil, ErrInvalidRecipient
+	}
+
+	sum    := sha256.Sum256([]byte(credential))
+	digest := []byte("sha256:" + hex.EncodeToString(sum[:]))
+
+	recipient := ""
+	gjson.GetBytes(b, "recipients").ForEach(func(name, config gjson.Result) bool {
+		key := config.Get("key").String()
+		if key != "" && subtle.ConstantTimeCompare([]byte(key), digest) == 1 {
+			recipient = name.String()
+			return false
+		}
+		return true
+	})
+
+	if recipient == "" {
+		return nil, ErrInvalidRecipient
+	}
+	return NewPseudonymiser(recipient)
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Token returns the pseudonym of a token for this recipient.
+func (p *Pseudonymiser) Token(token string) string {
+	if !p.Profile.Tokens {
+		return token
+	}
+
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))[:24]
+}
+
+// Dropped reports whether a column is removed by the profile.
+func (p *Pseudonymiser) Dropped(column string) bool {
+	if column == "postcode" && p.Profile.Postcode == 0 {
+		return true
+	}
+
+	for _, drop := range p.Profile.Drop {
+		if column == drop || strings.HasPrefix(column, drop+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// User returns a pseudonymised copy of an output user.
+func (p *Pseudonymiser) User(user *OutputUser) *OutputUser {
+	output := *user
+
+	output.Token   = p.Token(user.Token)
+	output.Answers = make(map[string]any, len(user.Answers))
+	for name, value := range user.Answers {
+		output.Answers[name] = value
+	}
+
+	if postcode, ok := output.Answers["postcode"].(string); ok {
+		output.Answers["postcode"] = p.postcode(postcode)
+	}
+
+	if p.Profile.Band {
+		if age, ok := output.Answers["age"].(string); ok {
+			output.Answers["age"] = bandAge(age)
+		}
+		if income, ok := output.Answers["income"].(string); ok {
+			output.Answers["income"] = bandIncome(income)
+		}
+	}
+
+	// Dropped columns are removed from tables; leave them out of NDJSON
+	for name := range output.Answers {
+		if p.Dropped(name) {
+			delete(output.Answers, name)
+		}
+	}
+
+	return &output
+}
+
+// Search returns a pseudonymised copy of an output search.
+func (p *Pseudonymiser) Search(search *OutputSearch) *OutputSearch {
+	output := *search
+
+	output.Token = p.Token(search.Token)
+	output.Form  = p.form(search.Form)
+
+	return &output
+}
+
+// Reverse returns the token behind a pseudonym by recomputing the pseudonym
+// of every participant. It is only exposed to admins.
+func (p *Pseudonymiser) Reverse(ctx context.Context, pseudonym string) (string, error) {
+	users, err := LoadUsers(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for token := range users {
+		if hmac.Equal([]byte(p.Token(token)), []byte(pseudonym)) {
+			return token, nil
+		}
+	}
+
+	return "", ErrUnknownPseudonym
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func (p *Pseudonymiser) postcode(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > p.Profile.Postcode {
+		value = value[:p.Profile.Postcode]
+	}
+	return value
+}
+
+func (p *Pseudonymiser) form(form *models.Form) *models.Form {
+	if form == nil {
+		return nil
+	}
+
+	output := form.Clone()
+	if _, ok := output.Answers["postcode"]; ok {
+		output.SetPostcode("postcode", p.postcode(form.Text("postcode")))
+	}
+
+	if p.Profile.Band {
+		if _, ok := output.Answers["age"]; ok {
+			output.SetText("age", bandAge(form.Text("age")))
+		}
+		if _, ok := output.Answers["income"]; ok {
+			output.SetText("income", bandIncome(form.Text("income")))
+		}
+	}
+
+	for name := range output.Answers {
+		if p.Dropped(name) {
+			delete(output.Answers, name)
+		}
+	}
+
+	return output
+}
+
+// bandAge merges the form's ten year bands into three.
+func bandAge(age string) string {
+	switch age {
+		case "16-24", "25-34"       : return "16-34"
+		case "35-44", "45-54"       : return "35-54"
+		case "55-64", "65-74", "75+": return "55+"
+	}
+	return age
+}
+
+// bandIncome merges the form's income bands into three.
+func bandIncome(income string) string {
+	switch income {
+		case "<10000", "10000-20000"                    : return "<20000"
+		case "20001-30000", "30001-40000", "40001-50000": return "20001-50000"
+		case "50001-100000", "100000+"                  : return "50000+"
+	}
+	return income
+}
@@ -0,0 +1,276 @@
+package export
+
+import (
+	"context"
+	"dse/src/core/models"
+	"dse/src/core/services/db"
+	"dse/src/utils/datetime"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Filter describes which searches an export should contain. Empty fields
+// are ignored, so the zero value selects every search.
+type Filter struct {
+	Keywords []string  `json:"keywords,omitempty"`
+	Websites []string  `json:"websites,omitempty"`
+	Tokens   []string  `json:"tokens,omitempty"`
+	Versions []string  `json:"versions,omitempty"` // Extension versions
+	Study    string    `json:"study,omitempty"`    // Suffix of config/searches.<study>.json
+	Start    time.Time `json:"start,omitempty"`
+	End      time.Time `json:"end,omitempty"`
+	After    int64     `json:"after,omitempty"` // Search IDs above this watermark
+	Until    int64     `json:"until,omitempty"` // Search IDs up to and including
+}
+
+// Cursor is the keyset position of the last row of a page. Searches are
+// ordered by (timestamp, id) descending, so the next page starts strictly
+// below the cursor.
+type Cursor struct {
+	Timestamp time.Time
+	ID        int64
+}
+
+// Query builds parameterised SQL for a Filter. Every value is passed as a
+// bound argument; only placeholders are formatted into the statement.
+type Query struct {
+	Filter Filter
+	Limit  int
+
+	where []string
+	args  []any
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	rstudy   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	rcomment = regexp.MustCompile(`(?m)^\s*//.*$`)
+
+	// Errors
+	ErrInvalidStudy = errors.New("invalid study")
+	ErrInvalidRange = errors.New("start must be before end")
+)
+
+// ------------------------------------------------------------
+// : Constructor
+// ------------------------------------------------------------
+func NewQuery(filter Filter) *Query {
+	return &Query{
+		Filter: filter,
+		Limit : 5_000,
+	}
+}
+
+// ------------------------------------------------------------
+// : Helpers
+// ------------------------------------------------------------
+func (q *Query) bind(value any) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *Query) reset() {
+	q.where = q.where[:0]
+	q.args  = q.args[:0]
+}
+
+// StudyKeywords returns the keywords of a study, read from the search
+// configuration it was run with (config/searches.<study>.json).
+func StudyKeywords(study string) ([]string, error) {
+	if !rstudy.MatchString(study) {
+		return nil, ErrInvalidStudy
+	}
+
+	b, err := os.ReadFile(fmt.Sprintf("config/searches.%s.json", study))
+	if err != nil {
+		return nil, err
+	}
+
+	keywords := []string{}
+	parsed   := gjson.ParseBytes(rcomment.ReplaceAll(b, nil))
+	parsed.Get("keywords").ForEach(func(_, v gjson.Result) bool {
+		keywords = append(keywords, strings.TrimSpace(v.String()))
+		return true
+	})
+
+	return keywords, nil
+}
+
+// Validate checks the filter for values that can never match.
+func (f *Filter) Validate() error {
+	if !f.Start.IsZero() && !f.End.IsZero() && f.End.Before(f.Start) {
+		return ErrInvalidRange
+	}
+
+	if f.Until > 0 && f.Until <= f.After {
+		return ErrInvalidRange
+	}
+
+	if f.Study != "" && !rstudy.MatchString(f.Study) {
+		return ErrInvalidStudy
+	}
+
+	return nil
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Build returns the statement and its arguments for the page after cursor.
+// A nil cursor selects the first page.
+func (q *Query) Build(cursor *Cursor) (string, []any, error) {
+	q.reset()
+
+	var filter = q.Filter
+	var joined = len(filter.Versions) > 0
+
+	if !filter.Start.IsZero() {
+		q.where = append(q.where, fmt.Sprintf("searches.timestamp >= %s", q.bind(filter.Start.UTC())))
+	}
+
+	if !filter.End.IsZero() {
+		q.where = append(q.where, fmt.Sprintf("searches.timestamp <= %s", q.bind(filter.End.UTC())))
+	}
+
+	if filter.After > 0 {
+		q.where = append(q.where, fmt.Sprintf("searches.id > %s", q.bind(filter.After)))
+	}
+
+	if filter.Until > 0 {
+		q.where = append(q.where, fmt.Sprintf("searches.id <= %s", q.bind(filter.Until)))
+	}
+
+	if len(filter.Tokens) > 0 {
+		q.where = append(q.where, fmt.Sprintf("searches.token = ANY(%s)", q.bind(filter.Tokens)))
+	}
+
+	if len(filter.Keywords) > 0 {
+		q.where = append(q.where, fmt.Sprintf("searches.metadata->>'keyword' = ANY(%s)", q.bind(filter.Keywords)))
+	}
+
+	if len(filter.Websites) > 0 {
+		q.where = append(q.where, fmt.Sprintf("searches.metadata->>'website' = ANY(%s)", q.bind(filter.Websites)))
+	}
+
+	if filter.Study != "" {
+		keywords, err := StudyKeywords(filter.Study)
+		if err != nil {
+			return "", nil, err
+		}
+		q.where = append(q.where, fmt.Sprintf("TRIM(searches.metadata->>'keyword') = ANY(%s)", q.bind(keywords)))
+	}
+
+	// Older searches and uploads from extensions that do not report it carry
+	// no version, so fall back to the version the participant is running.
+	if joined {
+		q.where = append(q.where, fmt.Sprintf(
+			"COALESCE(NULLIF(searches.metadata->>'version', ''), users.state->'client'->'extension'->>'version') = ANY(%s)",
+			q.bind(filter.Versions),
+		))
+	}
+
+	if cursor != nil {
+		q.where = append(q.where, fmt.Sprintf(
+			"(searches.timestamp, searches.id) < (%s, %s)",
+			q.bind(cursor.Timestamp), q.bind(cursor.ID),
+		))
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString("SELECT searches.id, searches.token, searches.timestamp, searches.metadata FROM public.searches AS searches")
+
+	if joined {
+		builder.WriteString(" LEFT JOIN public.users AS users ON users.token = searches.token")
+	}
+
+	if len(q.where) > 0 {
+		builder.WriteString(" WHERE ")
+		builder.WriteString(strings.Join(q.where, " AND "))
+	}
+
+	builder.WriteString(" ORDER BY searches.timestamp DESC, searches.id DESC")
+	builder.WriteString(fmt.Sprintf(" LIMIT %s", q.bind(q.Limit)))
+
+	return builder.String(), q.args, nil
+}
+
+// Stream pages through every search matching the filter using keyset
+// pagination and sends them on the returned channel. The channel is closed
+// when all rows have been read, the context is cancelled or a query fails;
+// in the last case the error is sent on the error channel first.
+func Stream(ctx context.Context, filter Filter) (<-chan *models.Search, <-chan error) {
+	var query    = NewQuery(filter)
+	var channel  = make(chan *models.Search, query.Limit)
+	var errs     = make(chan error, 1)
+
+	go func() {
+		defer close(channel)
+		defer close(errs)
+
+		var cursor *Cursor
+
+		for {
+			statement, args, err := query.Build(cursor)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			rows, err := db.QueryWithContext(ctx, statement, args...)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			count := 0
+			for rows.Next() {
+				var search    models.Search
+				var id        int64
+				var timestamp time.Time
+
+				err = rows.Scan(&id, &search.Token, &timestamp, &search.Metadata)
+				if err != nil {
+					rows.Close()
+					errs <- err
+					return
+				}
+
+				search.ID        = uint64(id)
+				search.Timestamp = datetime.FromTime(timestamp).ToIso8601String()
+
+				cursor = &Cursor{Timestamp: timestamp, ID: id}
+				count += 1
+
+				select {
+					case <-ctx.Done(): rows.Close(); return
+					case channel <- &search:
+				}
+			}
+			rows.Close()
+
+			if err := rows.Err(); err != nil {
+				errs <- err
+				return
+			}
+
+			if count < query.Limit {
+				return
+			}
+		}
+	}()
+
+	return channel, errs
+}
@@ -0,0 +1,190 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ------------------------------------------------------------
+// : Redact
+// ------------------------------------------------------------
+
+// Redact removes a participant from the stored exports. Snapshot partitions
+// are rewritten without their searches, or with the token replaced when a
+// replacement is given, and their checksums are updated. Job artifacts that
+// contain the token are deleted, since they can simply be exported again.
+// It returns the number of snapshot searches and jobs affected.
+func Redact(token string, replacement string) (int64, int64, error) {
+	rows, err := redactSnapshot(token, replacement)
+	if err != nil {
+		return rows, 0, err
+	}
+
+	jobs, err := redactJobs(token)
+	return rows, jobs, err
+}
+
+func redactSnapshot(token string, replacement string) (int64, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	snapshot, err := ReadSnapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, partition := range snapshot.Partitions {
+		path := filepath.Join(snapshotDir(), partition.File)
+
+		count, err := redactPartition(path, partition, token, replacement)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+
+	if total == 0 {
+		return 0, nil
+	}
+
+	return total, snapshot.save()
+}
+
+func redactPartition(path string, partition *Partition, token string, replacement string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var count    int64
+	var searches int64
+
+	hash    := sha256.New()
+	buffer  := bufio.NewWriter(io.MultiWriter(out, hash))
+	counter := &countingWriter{w: buffer}
+
+	err = eachLine(in, func(line []byte) error {
+		if gjson.GetBytes(line, "token").String() == token {
+			count += 1
+			if replacement == "" {
+				return nil
+			}
+
+			redacted, err := sjson.SetBytes(bytes.TrimRight(line, "\n"), "token", replacement)
+			if err != nil {
+				return err
+			}
+			line = append(redacted, '\n')
+		}
+
+		searches += 1
+		_, err := counter.Write(line)
+		return err
+	})
+	if err == nil {
+		err = buffer.Flush()
+	}
+
+	if err != nil || count == 0 {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+
+	if err := os.Rename(path + ".tmp", path); err != nil {
+		return 0, err
+	}
+
+	partition.Searches = searches
+	partition.Size     = counter.n
+	partition.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	return count, nil
+}
+
+func redactJobs(token string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, nil
+	}
+
+	var count int64
+	for _, entry := range entries {
+		manifest, err := ReadManifest(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Pseudonymised artifacts contain the recipient's pseudonym instead.
+		// Artifacts that can no longer be checked are removed as well.
+		needle := token
+		if manifest.Recipient != "" {
+			if p, err := NewPseudonymiser(manifest.Recipient); err == nil {
+				needle = p.Token(token)
+			} else {
+				needle = ""
+			}
+		}
+
+		if needle != "" {
+			found, err := fileContains(filepath.Join(dir, manifest.ID, manifest.File), []byte(needle))
+			if err != nil || !found {
+				continue
+			}
+		}
+
+		jobs.Delete(manifest.ID)
+		if err := os.RemoveAll(filepath.Join(dir, manifest.ID)); err != nil {
+			return count, err
+		}
+		count += 1
+	}
+
+	return count, nil
+}
+
+// fileContains searches a file for needle without reading it into memory.
+func fileContains(path string, needle []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	chunk   := make([]byte, 1 << 20)
+	overlap := []byte{}
+
+	for {
+		n, err := f.Read(chunk)
+		if n > 0 {
+			window := append(overlap, chunk[:n]...)
+			if bytes.Contains(window, needle) {
+				return true, nil
+			}
+
+			keep   := min(len(needle) - 1, len(window))
+			overlap = append([]byte{}, window[len(window) - keep:]...)
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"dse/src/core/global"
+	"dse/src/core/services/db"
+	"dse/src/core/sources"
+	"dse/src/utils/json"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Snapshot is an append-only NDJSON export of every search, split into
+// partitions. Each run exports only the searches with an ID above the
+// watermark of the previous run, so its cost depends on the number of new
+// searches and not on the size of the table.
+//
+// Partitions are only rewritten to redact a participant (see Redact) or to
+// annotate their results with a new source list (see Partition.Sources): a
+// form submitted after a search was exported is only reflected in
+// partitions written afterwards.
+type Snapshot struct {
+	Watermark  int64        `json:"watermark"` // Highest search ID covered
+	Timestamp  time.Time    `json:"timestamp"` // Timestamp of that search
+	Partitions []*Partition `json:"partitions"`
+	Updated    time.Time    `json:"updated"`
+}
+
+// Partition holds the searches with From < id <= To.
+type Partition struct {
+	Seq       int       `json:"seq"`
+	File      string    `json:"file"`
+	From      int64     `json:"from"`
+	To        int64     `json:"to"`
+	Timestamp time.Time `json:"timestamp"` // Timestamp of search To
+	Searches  int64     `json:"searches"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	Version   string    `json:"version"`
+	Sources   string    `json:"sources"` // Version of the source list in the results
+	Created   time.Time `json:"created"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	snapshotMutex sync.Mutex
+
+	// Errors
+	ErrPartitionNotFound = errors.New("partition not found")
+)
+
+// ------------------------------------------------------------
+// : Snapshot
+// ------------------------------------------------------------
+func snapshotDir() string {
+	return filepath.Join(dir, "snapshots")
+}
+
+// ReadSnapshot returns the index of the snapshot. A missing index is an
+// empty snapshot.
+func ReadSnapshot() (*Snapshot, error) {
+	snapshot := &Snapshot{Partitions: []*Partition{}}
+
+	b, err := os.ReadFile(filepath.Join(snapshotDir(), "index.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.FromBytes(b, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// UpdateSnapshot exports the searches above the watermark into a new
+// partition. It returns nil when there were no new searches. Searches that
+// are skipped by the export (see users.go) still advance the watermark.
+//
+// Partitions written with another version of the source list are annotated
+// again first, so the snapshot carries the same domains and tags as the
+// stored searches once they have been backfilled (see enrich.Backfill).
+func UpdateSnapshot(ctx context.Context) (*Partition, error) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	snapshot, err := ReadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := snapshot.annotate(); err != nil {
+		return nil, err
+	}
+
+	// Fix the upper bound first, so searches inserted while exporting are
+	// left for the next run instead of being split across partitions. The
+	// bound trails inserts that may still commit with a lower ID.
+	var until     int64
+	var timestamp time.Time
+
+	settled, err := db.SettledSearch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryWithContext(ctx, `SELECT id, timestamp FROM public.searches WHERE id <= $1 ORDER BY id DESC LIMIT 1`, settled)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Next() {
+		err = rows.Scan(&until, &timestamp)
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if until <= snapshot.Watermark {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(snapshotDir(), 0o755); err != nil {
+		return nil, err
+	}
+
+	partition := &Partition{
+		Seq      : len(snapshot.Partitions) + 1,
+		From     : snapshot.Watermark,
+		To       : until,
+		Timestamp: timestamp.UTC(),
+		Version  : global.VERSION,
+		Created  : time.Now().UTC(),
+	}
+	partition.File = fmt.Sprintf("part-%06d.ndjson", partition.Seq)
+
+	if err := partition.write(ctx); err != nil {
+		return nil, err
+	}
+
+	snapshot.Watermark = partition.To
+	snapshot.Timestamp = partition.Timestamp
+	snapshot.Updated   = partition.Created
+
+	if partition.Searches > 0 {
+		snapshot.Partitions = append(snapshot.Partitions, partition)
+	} else {
+		os.Remove(filepath.Join(snapshotDir(), partition.File))
+	}
+
+	if err := snapshot.save(); err != nil {
+		return nil, err
+	}
+
+	return partition, nil
+}
+
+// Since writes every snapshot search with an ID above the watermark, in
+// partition order. With a pseudonymiser every search is decoded and
+// rewritten, otherwise partitions are copied as they are.
+func (s *Snapshot) Since(w io.Writer, watermark int64, p *Pseudonymiser) error {
+	for _, partition := range s.Partitions {
+		if partition.To <= watermark {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(snapshotDir(), partition.File))
+		if err != nil {
+			return err
+		}
+
+		// Partitions entirely above the watermark are copied as they are
+		if partition.From >= watermark && p == nil {
+			_, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = eachLine(f, func(line []byte) error {
+			if gjson.GetBytes(line, "id").Int() <= watermark {
+				return nil
+			}
+
+			if p != nil {
+				var err error
+				if line, err = p.rewrite(line); err != nil {
+					return err
+				}
+			}
+
+			_, err := w.Write(line)
+			return err
+		})
+		f.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WritePartition writes a partition with every search rewritten for a
+// recipient. Unlike OpenPartition, the output cannot be served in ranges.
+func (s *Snapshot) WritePartition(w io.Writer, seq int, p *Pseudonymiser) error {
+	f, _, err := s.OpenPartition(seq)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return eachLine(f, func(line []byte) error {
+		line, err := p.rewrite(line)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(line)
+		return err
+	})
+}
+
+// OpenPartition returns the file of a partition by sequence number.
+func (s *Snapshot) OpenPartition(seq int) (*os.File, *Partition, error) {
+	for _, partition := range s.Partitions {
+		if partition.Seq != seq {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(snapshotDir(), partition.File))
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, partition, nil
+	}
+
+	return nil, nil, ErrPartitionNotFound
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func (p *Partition) write(ctx context.Context) error {
+	path := filepath.Join(snapshotDir(), p.File)
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Searches are annotated with the current list as they are exported
+	// (see NewOutputSearch)
+	if list, err := sources.Current(); err == nil {
+		p.Sources = list.Version
+	}
+
+	hash    := sha256.New()
+	buffer  := bufio.NewWriter(io.MultiWriter(f, hash))
+	counter := &countingWriter{w: buffer}
+	writer  := NewSearchWriter(counter, FormatNDJSON)
+
+	searches, err := Export(ctx, Filter{After: p.From, Until: p.To}, nil, writer)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	p.Searches = searches
+	p.Size     = counter.n
+	p.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	return os.Rename(path + ".tmp", path)
+}
+
+// annotate rewrites the partitions annotated with another version of the
+// source list and saves the index when any changed.
+func (s *Snapshot) annotate() error {
+	list, err := sources.Current()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, partition := range s.Partitions {
+		if partition.Sources == list.Version {
+			continue
+		}
+
+		if err := partition.annotate(list); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+func (p *Partition) annotate(list *sources.List) error {
+	path := filepath.Join(snapshotDir(), p.File)
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash    := sha256.New()
+	buffer  := bufio.NewWriter(io.MultiWriter(out, hash))
+	counter := &countingWriter{w: buffer}
+
+	err = eachLine(in, func(line []byte) error {
+		results, ok := gjson.GetBytes(line, "results").Value().(map[string]any)
+		if !ok {
+			_, err := counter.Write(line)
+			return err
+		}
+		list.Enrich(results)
+
+		annotated, err := sjson.SetBytes(bytes.TrimRight(line, "\n"), "results", results)
+		if err != nil {
+			return err
+		}
+
+		_, err = counter.Write(append(annotated, '\n'))
+		return err
+	})
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(path + ".tmp", path); err != nil {
+		return err
+	}
+
+	p.Size     = counter.n
+	p.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	p.Sources  = list.Version
+	return nil
+}
+
+func eachLine(r io.Reader, fn func(line []byte) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewrite applies the profile to one snapshot line.
+func (p *Pseudonymiser) rewrite(line []byte) ([]byte, error) {
+	search := &OutputSearch{}
+	if err := json.FromBytes(line, search); err != nil {
+		return nil, err
+	}
+
+	b, err := json.ToLine(p.Search(search))
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (s *Snapshot) save() error {
+	b, err := json.ToBytes(s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(snapshotDir(), "index.json")
+	if err := os.WriteFile(path + ".tmp", b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(path + ".tmp", path)
+}
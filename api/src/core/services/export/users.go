@@ -0,0 +1,171 @@
+package export
+
+import (
+	"context"
+	"dse/src/core/models"
+	"dse/src/core/schema"
+	"dse/src/core/services/db"
+	"dse/src/utils/json"
+	"dse/src/utils/object"
+)
+
+// ------------------------------------------------------------
+// : Merge
+// ------------------------------------------------------------
+//
+// Participants live in two tables: `users` holds the current state of every
+// extension and `users_2` is a backup taken before states were reset, which
+// still holds forms that were lost from `users`. Every export uses the same
+// rule to combine them:
+//
+//   1. `users` is authoritative. Only tokens present in `users` are exported
+//      and backup rows without a matching participant are ignored.
+//   2. A form is complete when its submitted question (age, see
+//      config/form.json) is answered.
+//   3. A complete backup form replaces the current form only when the current
+//      form is not complete. Forms are never merged field by field, so a row
+//      always describes a single submission.
+//
+// Searches are exported when they belong to a participant from step 1 and
+// contain at least one result (see NewOutputSearch).
+
+// Complete reports whether the participant submitted the form, which is
+// when the schema's submitted question (age) is answered.
+func Complete(form *models.Form) bool {
+	if form == nil {
+		return false
+	}
+
+	submitted := "age"
+	if current, err := schema.Current(); err == nil && current.Submitted != "" {
+		submitted = current.Submitted
+	}
+
+	return form.Text(submitted) != ""
+}
+
+// MergeForm applies the merge rule to a participant and its backup form.
+func MergeForm(user *models.User, backup *models.Form) {
+	if !Complete(backup) {
+		return
+	}
+
+	if user.State.Client == nil {
+		user.State.Client = models.NewClientState()
+	}
+	if user.State.Client.User == nil {
+		user.State.Client.User = &models.ClientUser{}
+	}
+
+	if Complete(user.State.Client.User.Form) {
+		return
+	}
+
+	user.State.Client.User.Form = backup
+}
+
+// FormOf returns the form of a participant, or nil when it has none.
+func FormOf(user *models.User) *models.Form {
+	if user == nil || user.State.Client == nil || user.State.Client.User == nil {
+		return nil
+	}
+	return user.State.Client.User.Form
+}
+
+// ------------------------------------------------------------
+// : Users
+// ------------------------------------------------------------
+
+// LoadUsers returns every participant keyed by token, with the forms from the
+// backup table merged in.
+func LoadUsers(ctx context.Context) (map[string]*models.User, error) {
+	users := make(map[string]*models.User)
+
+	rows, err := db.QueryWithContext(ctx, `SELECT users.token, users.state FROM public.users AS users`)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		user := &models.User{}
+		if err := rows.Scan(&user.Token, &user.State); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users[user.Token] = user
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	forms, err := loadBackupForms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for token, form := range forms {
+		if user, has := users[token]; has {
+			MergeForm(user, form)
+		}
+	}
+
+	return users, nil
+}
+
+// loadBackupForms reads the forms of the backup table. Deployments without
+// the table simply have no backup forms.
+func loadBackupForms(ctx context.Context) (map[string]*models.Form, error) {
+	forms := make(map[string]*models.Form)
+
+	var exists bool
+	rows, err := db.QueryWithContext(ctx, `SELECT to_regclass('public.users_2') IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Next() {
+		err = rows.Scan(&exists)
+	}
+	rows.Close()
+
+	if err != nil || !exists {
+		return forms, err
+	}
+
+	rows, err = db.QueryWithContext(ctx, `SELECT users.token, users.state FROM public.users_2 AS users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		var state map[string]any
+
+		if err := rows.Scan(&token, &state); err != nil {
+			return nil, err
+		}
+
+		o, has := object.Get(state, "client.user.form")
+		if !has {
+			continue
+		}
+
+		b, err := json.ToBytes(o)
+		if err != nil {
+			continue
+		}
+
+		form := &models.Form{}
+		if err := json.FromBytes(b, form); err != nil {
+			continue
+		}
+
+		if Complete(form) {
+			forms[token] = form
+		}
+	}
+
+	return forms, rows.Err()
+}
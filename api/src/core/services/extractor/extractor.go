@@ -1,15 +1,22 @@
 package extractor
 
 import (
+	"context"
 	"dse/src/core/models"
+	"dse/src/core/services/cluster"
 	"dse/src/core/services/db"
+	"dse/src/core/services/enrich"
+	"dse/src/core/telemetry"
 	"dse/src/utils"
 	"dse/src/utils/event"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -32,6 +39,13 @@ var (
 	logger = utils.NewLogger()
 	
 	chan_files = make(chan string, 100)
+
+	uploads sync.WaitGroup // Uploads being written to disk
+	pending atomic.Int64   // Files queued or being extracted
+
+	// Events
+	ItemStarted = event.NewTopic[string]("extractor.item.started", 0) // Path of the upload
+	ItemDone    = event.NewTopic[string]("extractor.item.done", 0)    // Engine of the stored search
 )
 // ------------------------------------------------------------
 // : Helpers
@@ -532,14 +546,50 @@ func ParseDuckDuckGo(html string) (string, error) {
 // ------------------------------------------------------------
 // : Handlers
 // ------------------------------------------------------------
+// OnUpload stores an upload for extraction in the background. Uploads that
+// are still being stored are waited for on shutdown.
 func OnUpload(user *User, data []byte) {
+	uploads.Add(1)
+	go func() {
+		defer uploads.Done()
+		receive(user, data)
+	}()
+}
+
+func receive(user *User, data []byte) {
 	parsed := gjson.ParseBytes(data)
 
 	token   := user.Token
 	website := Slugify(parsed.Get("website").String())
 	keyword := Slugify(parsed.Get("keyword").String())
+	attempt := Attempt(parsed)
+
+	// Match the upload to the task that produced it before it is queued, so
+	// a second upload for the same attempt is flagged even if the first one
+	// has not been stored yet. Uploads are received next to the participant's
+	// events, which change the same tasks
+	user.Lock()
+	task, correlation := user.State.Server.Correlate(attempt)
+	user.Unlock()
+	telemetry.Uploads.With(string(correlation)).Inc()
+
+	switch correlation {
+		case models.CorrelationMatched: user.Save()
+		case models.CorrelationMissing: logger.Warn().Str("token", token).Msg("Upload without attempt ID")
+		default: logger.Warn().Str("token", token).Str("attempt", attempt).Str("correlation", string(correlation)).Msg("Upload does not match a pending task")
+	}
+
+	body := parsed.String()
+	body, _ = sjson.Set(body, "attempt"    , attempt)
+	body, _ = sjson.Set(body, "correlation", correlation)
+	if task != nil {
+		body, _ = sjson.Set(body, "task", task.ID)
+	}
 
 	path := fmt.Sprintf("./data/extractor/%s.%s.%s.json", token, website, keyword)
+	if attempt != "" {
+		path = fmt.Sprintf("./data/extractor/%s.%s.%s.%s.json", token, website, keyword, Slugify(attempt))
+	}
 
 	f, err := os.Create(path)
 	if err != nil {
@@ -547,78 +597,139 @@ func OnUpload(user *User, data []byte) {
 		return
 	}
 
-	f.WriteString(parsed.String())
-	chan_files <- path
+	f.WriteString(body)
+	f.Close()
+
+	// Uploads are on disk by now; they are always queued
+	enqueue(context.Background(), path)
+}
+
+// Attempt returns the attempt ID echoed by the extension. Older versions
+// only kept the dse_id query parameter on the result page URL.
+func Attempt(upload gjson.Result) string {
+	if attempt := upload.Get("attempt").String(); attempt != "" {
+		return attempt
+	}
+
+	u, err := url.Parse(upload.Get("url").String())
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("dse_id")
 }
 
 func OnFile() {
-	for {
-		select {
-		case path := <-chan_files:
-			event.Emit(event.ExtractorItemStarted)
+	for path := range chan_files {
+		extract(path)
+		pending.Add(-1)
+	}
+}
 
-			var err    error
-			var result string
+// extract parses one stored upload and saves it as a search.
+func extract(path string) {
+	ItemStarted.Publish(path)
 
-			b, err := os.ReadFile(path)
-			if err != nil {
-				logger.Error().Err(err).Msg("Failed to read file")
-				continue
-			}
+	var err    error
+	var result string
 
-			logger.Info().Str("path", path).Msg("Reading")
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read file")
+		return
+	}
 
-			parsed       := gjson.ParseBytes(b)
-			token        := parsed.Get("token").String()
-			url          := parsed.Get("url").String()
-			browser      := parsed.Get("browser").Value()
-			website      := parsed.Get("website").String()
-			keyword      := parsed.Get("keyword").String()
-			timestamp    := parsed.Get("timestamp").String()
-			localization := parsed.Get("localization").String()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read file")
+		return
+	}
 
-			html := parsed.Get("html").String()
+	start := time.Now()
 
-			switch website {
-				case "Google"    : result, err = ParseGoogle(html)
-				case "Bing"      : result, err = ParseBing(html)
-				case "DuckDuckGo": result, err = ParseDuckDuckGo(html)
+	logger.Info().Str("path", path).Msg("Reading")
 
-				default: logger.Warn().Str("website", website).Msg("Unknown website"); continue
-			}
+	parsed       := gjson.ParseBytes(b)
+	token        := parsed.Get("token").String()
+	url          := parsed.Get("url").String()
+	browser      := parsed.Get("browser").Value()
+	website      := parsed.Get("website").String()
+	keyword      := parsed.Get("keyword").String()
+	timestamp    := parsed.Get("timestamp").String()
+	localization := parsed.Get("localization").String()
+	version      := parsed.Get("version").String()
+	attempt      := parsed.Get("attempt").String()
+	correlation  := parsed.Get("correlation").String()
 
-			if err != nil {
-				logger.Error().Err(err).Msg("Failed to parse")
-				continue
-			}
+	html := parsed.Get("html").String()
 
-			var metadata = map[string]interface{}{
-				"url"         : url,
-				"browser"     : browser,
-				"website"     : website,
-				"keyword"     : keyword,
-				"localization": localization,
-				"results"     : gjson.Parse(result).Value(),
-			}
+	switch website {
+		case "Google"    : result, err = ParseGoogle(html)
+		case "Bing"      : result, err = ParseBing(html)
+		case "DuckDuckGo": result, err = ParseDuckDuckGo(html)
 
-			db.CreateSearch(&models.Search{
-				Token    : token,
-				Timestamp: timestamp,
-				Metadata : metadata,
-			})
+		default: logger.Warn().Str("website", website).Msg("Unknown website"); return
+	}
 
-			os.Remove(path)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to parse")
+		telemetry.Parses.With(website, "error").Inc()
+		return
+	}
 
-			event.Emit(event.ExtractorItemDone)
-			break
-		}
+	// Yield is the number of organic results
+	count := gjson.Get(result, "search_result.#").Int()
+	switch count {
+		case 0 : telemetry.Parses.With(website, "empty").Inc()
+		default: telemetry.Parses.With(website, "ok").Inc()
+	}
+	telemetry.ParseResults.With(website).Observe(float64(count))
+
+	// Annotate links with their domain and source tags
+	results, _ := gjson.Parse(result).Value().(map[string]any)
+	if results == nil {
+		results = map[string]any{}
 	}
+	annotated := enrich.Results(results)
+
+	var metadata = map[string]interface{}{
+		"url"         : url,
+		"browser"     : browser,
+		"website"     : website,
+		"keyword"     : keyword,
+		"localization": localization,
+		"task"        : parsed.Get("task").Value(),
+		"results"     : results,
+		"sources"     : annotated,
+	}
+
+	// The export falls back to the participant's version when it is missing
+	if version != "" {
+		metadata["version"] = version
+	}
+
+	db.CreateSearch(&models.Search{
+		Token    : token,
+		Timestamp: timestamp,
+		Metadata : metadata,
+
+		Attempt    : attempt,
+		Correlation: correlation,
+	})
+
+	os.Remove(path)
+
+	telemetry.ExtractionDuration.With(website).Observe(time.Since(start).Seconds())
+	telemetry.ExtractionLag.With(website).Observe(time.Since(info.ModTime()).Seconds())
+
+	ItemDone.Publish(website)
 }
 
 // ------------------------------------------------------------
 // : Monitor
 // ------------------------------------------------------------
-func Monitor() {
+// Monitor queues uploads left on disk, such as the ones a previous instance
+// did not get to before shutting down.
+func Monitor(ctx context.Context) {
 	for {
 		entries, err := os.ReadDir("./data/extractor/")
 		if err != nil {
@@ -627,19 +738,66 @@ func Monitor() {
 		}
 
 		for _, entry := range entries {
-			if !entry.IsDir() {
-				chan_files <- fmt.Sprintf("./data/extractor/%s", entry.Name())
+			if !entry.IsDir() && !enqueue(ctx, fmt.Sprintf("./data/extractor/%s", entry.Name())) {
+				return
 			}
 		}
 
-		time.Sleep(1 * time.Minute)
+		select {
+			case <-ctx.Done()            : return
+			case <-time.After(time.Minute):
+		}
+	}
+}
+
+// enqueue queues a file for extraction. It returns false when ctx ends
+// first.
+func enqueue(ctx context.Context, path string) bool {
+	pending.Add(1)
+	select {
+		case chan_files <- path: return true
+		case <-ctx.Done()      : pending.Add(-1); return false
 	}
 }
 
 // ------------------------------------------------------------
 // : Init
 // ------------------------------------------------------------
-func Init() {
-	go Monitor()
+func Start(ctx context.Context) error {
+	telemetry.OnScrape(func() {
+		telemetry.QueueDepth.With("extractor").Set(float64(len(chan_files)))
+	})
+	cluster.Gauge("extractor.pending", func() float64 {
+		return float64(pending.Load())
+	})
+
+	go Monitor(ctx)
 	go OnFile()
+	return nil
+}
+
+// Stop waits for uploads in progress and for the queue to be extracted.
+// Whatever is left when ctx ends stays on disk for the next start.
+func Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		uploads.Wait()
+		close(done)
+	}()
+
+	select {
+		case <-done      :
+		case <-ctx.Done(): return ctx.Err()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for pending.Load() > 0 {
+		select {
+			case <-ticker.C  :
+			case <-ctx.Done(): return ctx.Err()
+		}
+	}
+	return nil
 }
@@ -0,0 +1,85 @@
+package gdpr
+
+import (
+	"context"
+	"dse/src/core/services/db"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ------------------------------------------------------------
+// : CLI
+// ------------------------------------------------------------
+const usage = `usage:
+  dse gdpr export <token> [file.zip]     write everything held for a token
+  dse gdpr verify                        check the receipt chain
+
+Erasure goes through the running server, which tells every instance to drop
+the participant: dse users erase [--anonymise] <token>`
+
+// Command runs "dse gdpr ..." and returns the exit code.
+func Command(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	// Erasing from here would leave the participant cached by running
+	// instances, which write them back
+	if args[0] == "erase" {
+		fmt.Fprintln(os.Stderr, "erase through the running server: dse users erase [--anonymise] <token>")
+		return 2
+	}
+
+	if args[0] == "verify" {
+		count, err := Verify()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%d receipts verified\n", count)
+		return 0
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	token := args[1]
+	if err := ValidateToken(token); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+
+	if err := db.Start(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "export":
+		var out io.Writer = os.Stdout
+		if len(args) > 2 {
+			f, err := os.Create(args[2])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if err := Export(ctx, token, out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
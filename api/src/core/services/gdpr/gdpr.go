@@ -0,0 +1,567 @@
+package gdpr
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"dse/src/core/log"
+	"dse/src/core/services/consent"
+	"dse/src/core/services/db"
+	"dse/src/core/services/export"
+	"dse/src/utils/json"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Mode string
+
+const (
+	ModeErase     Mode = "erase"     // Delete every record of the participant
+	ModeAnonymise Mode = "anonymise" // Delete the participant, keep searches under a random ID
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	rtoken = regexp.MustCompile(`^[A-Za-z0-9_-]{12}$`)
+
+	// Places outside the database that may hold a token
+	extractor = "data/extractor"
+	folders   = []string{"logs", "tmp"}
+	files     = []string{"searches.json"}
+
+	// Errors
+	ErrInvalidToken = errors.New("invalid token")
+	ErrInvalidMode  = errors.New("mode must be erase or anonymise")
+)
+
+// ------------------------------------------------------------
+// : Helpers
+// ------------------------------------------------------------
+func ParseMode(value string) (Mode, error) {
+	switch Mode(value) {
+		case ""           : return ModeErase, nil
+		case ModeErase    : return ModeErase, nil
+		case ModeAnonymise: return ModeAnonymise, nil
+	}
+	return "", ErrInvalidMode
+}
+
+func ValidateToken(token string) error {
+	if !rtoken.MatchString(token) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// hasBackup reports whether the users_2 backup table exists.
+func hasBackup(ctx context.Context) (bool, error) {
+	var exists bool
+	err := db.GetConnection().QueryRow(ctx, `SELECT to_regclass('public.users_2') IS NOT NULL`).Scan(&exists)
+	return exists, err
+}
+
+// anonymousToken returns a random ID with the length of a token, so it fits
+// the searches table and can replace a token in place.
+func anonymousToken() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "anon" + hex.EncodeToString(b), nil
+}
+
+// ------------------------------------------------------------
+// : Export
+// ------------------------------------------------------------
+
+// Export writes a zip archive with everything held for a participant: the
+// user state, the backup form, consent records, searches, metrics, log
+// lines and pending extractor uploads.
+func Export(ctx context.Context, token string, w io.Writer) error {
+	if err := ValidateToken(token); err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	pool    := db.GetConnection()
+
+	{ // User
+		var state []byte
+		err := pool.QueryRow(ctx, `SELECT state FROM public.users WHERE token = $1`, token).Scan(&state)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if err := writeEntry(archive, "user.json", state); err != nil {
+			return err
+		}
+	}
+
+	{ // Backup
+		backup, err := hasBackup(ctx)
+		if err != nil {
+			return err
+		}
+
+		var state []byte
+		if backup {
+			err = pool.QueryRow(ctx, `SELECT state FROM public.users_2 WHERE token = $1`, token).Scan(&state)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+		}
+		if err := writeEntry(archive, "backup.json", state); err != nil {
+			return err
+		}
+	}
+
+	{ // Consent
+		records, err := consent.History(ctx, token)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.ToBytes(records)
+		if err != nil {
+			return err
+		}
+		if err := writeEntry(archive, "consent.json", b); err != nil {
+			return err
+		}
+	}
+
+	{ // Searches
+		entry, err := archive.Create("searches.ndjson")
+		if err != nil {
+			return err
+		}
+
+		channel, errs := export.Stream(ctx, export.Filter{Tokens: []string{token}})
+		for search := range channel {
+			b, err := json.ToLine(search)
+			if err != nil {
+				return err
+			}
+			entry.Write(append(b, '\n'))
+		}
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	{ // Metrics
+		entry, err := archive.Create("metrics.ndjson")
+		if err != nil {
+			return err
+		}
+
+		rows, err := pool.Query(ctx, `SELECT id, timestamp, metric FROM public.metrics WHERE strpos(metric::text, $1) > 0`, token)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id        int64
+			var timestamp time.Time
+			var metric    map[string]any
+
+			if err := rows.Scan(&id, &timestamp, &metric); err != nil {
+				rows.Close()
+				return err
+			}
+
+			b, _ := json.ToLine(json.JSON{"id": id, "timestamp": timestamp, "metric": metric})
+			entry.Write(append(b, '\n'))
+		}
+		rows.Close()
+	}
+
+	{ // Logs
+		entry, err := archive.Create("logs.txt")
+		if err != nil {
+			return err
+		}
+
+		for _, path := range scanFiles() {
+			if err := grep(path, token, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	{ // Extractor
+		for _, path := range extractorFiles(token) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			if err := writeEntry(archive, "extractor/"+filepath.Base(path), b); err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// ------------------------------------------------------------
+// : Erase
+// ------------------------------------------------------------
+
+// Erase removes a participant from every store and appends a receipt that
+// records what was removed. In anonymise mode searches are kept under a new
+// random ID that cannot be traced back to the token.
+func Erase(ctx context.Context, token string, mode Mode, operator string) (*Receipt, error) {
+	if err := ValidateToken(token); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	pool   := db.GetConnection()
+
+	// Same length as a token, so files can be redacted in place
+	replacement := strings.Repeat("x", len(token))
+	if mode == ModeAnonymise {
+		var err error
+		if replacement, err = anonymousToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	backup, err := hasBackup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The database is erased in one transaction, so a failure leaves the
+	// participant as they were and can simply be retried
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	{ // Searches
+		var query = `DELETE FROM public.searches WHERE token = $1`
+		var args  = []any{token}
+		if mode == ModeAnonymise {
+			query = `UPDATE public.searches SET token = $2 WHERE token = $1`
+			args  = append(args, replacement)
+		}
+
+		tag, err := tx.Exec(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		counts["searches"] = tag.RowsAffected()
+	}
+
+	{ // Result diffs (their result changes cascade)
+		var query = `DELETE FROM public.result_diffs WHERE token = $1`
+		var args  = []any{token}
+		if mode == ModeAnonymise {
+			query = `UPDATE public.result_diffs SET token = $2 WHERE token = $1`
+			args  = append(args, replacement)
+		}
+
+		tag, err := tx.Exec(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		counts["result_diffs"] = tag.RowsAffected()
+	}
+
+	{ // Users
+		tag, err := tx.Exec(ctx, `DELETE FROM public.users WHERE token = $1`, token)
+		if err != nil {
+			return nil, err
+		}
+		counts["users"] = tag.RowsAffected()
+	}
+
+	if backup { // Backup
+		tag, err := tx.Exec(ctx, `DELETE FROM public.users_2 WHERE token = $1`, token)
+		if err != nil {
+			return nil, err
+		}
+		counts["users_2"] = tag.RowsAffected()
+	}
+
+	{ // Consent
+		tag, err := tx.Exec(ctx, `DELETE FROM public.consents WHERE token = $1`, token)
+		if err != nil {
+			return nil, err
+		}
+		counts["consents"] = tag.RowsAffected()
+	}
+
+	{ // Metrics aggregate many participants, so only the token is replaced
+		tag, err := tx.Exec(ctx, `
+			UPDATE public.metrics SET metric = replace(metric::text, $1, $2)::jsonb
+			WHERE  strpos(metric::text, $1) > 0`, token, replacement,
+		)
+		if err != nil {
+			return nil, err
+		}
+		counts["metrics"] = tag.RowsAffected()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	db.Forget(token)
+	consent.Forget(token)
+
+	// The participant is gone from the database from here on, so the steps
+	// below do not stop the receipt; failures are counted in it and a second
+	// erasure finishes the job
+
+	{ // Extractor
+		for _, path := range extractorFiles(token) {
+			if err := os.Remove(path); err == nil {
+				counts["extractor_files"] += 1
+			}
+		}
+	}
+
+	{ // Logs and temporary files, including rotated logs
+		for _, path := range scanFiles() {
+			count, err := redact(path, token, replacement)
+			if err != nil {
+				log.Error().Err(err).Str("path", path).Msg("Failed to redact file")
+				counts["failures"] += 1
+				continue
+			}
+			counts["file_occurrences"] += count
+
+			if count > 0 && compressed(path) {
+				counts["archives"] += 1
+			}
+		}
+	}
+
+	{ // Exports
+		snapshot := ""
+		if mode == ModeAnonymise {
+			snapshot = replacement
+		}
+
+		rows, jobs, err := export.Redact(token, snapshot)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to redact exports")
+			counts["failures"] += 1
+		}
+		counts["snapshot_searches"] = rows
+		counts["export_jobs"]       = jobs
+	}
+
+	return AppendReceipt(mode, token, counts, operator)
+}
+
+// ------------------------------------------------------------
+// : Files
+// ------------------------------------------------------------
+func extractorFiles(token string) []string {
+	matches, _ := filepath.Glob(filepath.Join(extractor, token+".*"))
+	return matches
+}
+
+// scanFiles lists the files outside the database that may mention a token.
+func scanFiles() []string {
+	paths := []string{}
+	for _, folder := range folders {
+		filepath.WalkDir(folder, func(path string, entry os.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+	}
+
+	for _, path := range files {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// compressed reports whether a file is a gzip archive, such as a log the
+// rotation has compressed.
+func compressed(path string) bool {
+	return strings.HasSuffix(path, ".gz")
+}
+
+// grep copies the lines of a file that contain the token. Archives are read
+// decompressed.
+func grep(path string, token string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed(path) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if bytes.Contains(line, []byte(token)) {
+			fmt.Fprintf(w, "%s: %s", path, bytes.TrimRight(line, "\n"))
+			w.Write([]byte("\n"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// redact overwrites every occurrence of the token in place. The replacement
+// has the same length, so files that are still open for appending (such as
+// the log files) stay consistent. Archives are rewritten instead.
+func redact(path string, token string, replacement string) (int64, error) {
+	if len(replacement) != len(token) {
+		return 0, fmt.Errorf("replacement must be %d bytes", len(token))
+	}
+
+	if compressed(path) {
+		return redactArchive(path, token, replacement)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count  int64
+	var offset int64
+	var needle = []byte(token)
+	var chunk  = make([]byte, 1 << 20)
+
+	for {
+		n, err := f.ReadAt(chunk, offset)
+		if n > 0 {
+			window := chunk[:n]
+			for i := bytes.Index(window, needle); i >= 0; {
+				if _, err := f.WriteAt([]byte(replacement), offset + int64(i)); err != nil {
+					return count, err
+				}
+				count += 1
+
+				next := bytes.Index(window[i+len(needle):], needle)
+				if next < 0 { break }
+				i += len(needle) + next
+			}
+		}
+
+		if err == io.EOF || n < len(chunk) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		// Overlap chunks, so tokens on a boundary are found too
+		offset += int64(n - len(needle) + 1)
+	}
+}
+
+func writeEntry(archive *zip.Writer, name string, b []byte) error {
+	entry, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if len(b) == 0 {
+		b = []byte("null")
+	}
+
+	_, err = entry.Write(b)
+	return err
+}
+
+// redactArchive decompresses a gzip archive, replaces the token and
+// compresses it again. Archives without the token are left untouched.
+func redactArchive(path string, token string, replacement string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	out, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	var count  int64
+	var needle = []byte(token)
+	var writer = gzip.NewWriter(out)
+	var reader = bufio.NewReader(gz)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if n := bytes.Count(line, needle); n > 0 {
+			count += int64(n)
+			line   = bytes.ReplaceAll(line, needle, []byte(replacement))
+		}
+		if _, err := writer.Write(line); err != nil {
+			os.Remove(path + ".tmp")
+			return 0, err
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			os.Remove(path + ".tmp")
+			return 0, err
+		}
+	}
+
+	if err := writer.Close(); err != nil || count == 0 {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+
+	return count, os.Rename(path + ".tmp", path)
+}
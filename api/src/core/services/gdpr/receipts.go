@@ -0,0 +1,176 @@
+package gdpr
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// Receipt records one erasure. Receipts are appended to a log in which each
+// receipt includes the hash of the previous one, so removing or editing a
+// receipt breaks every hash after it (see Verify). The token itself is not
+// stored, only its SHA-256, which lets an operator prove that a given token
+// was erased without keeping it.
+type Receipt struct {
+	Seq       int64            `json:"seq"`
+	Action    Mode             `json:"action"`
+	Subject   string           `json:"subject"` // sha256 of the token
+	Counts    map[string]int64 `json:"counts"`
+	Operator  string           `json:"operator"`
+	Timestamp time.Time        `json:"timestamp"`
+	Previous  string           `json:"previous"`
+	Hash      string           `json:"hash"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	receiptsPath  = "data/gdpr/receipts.ndjson"
+	receiptsMutex sync.Mutex
+
+	// Errors
+	ErrBrokenChain = errors.New("receipt chain is broken")
+)
+
+// ------------------------------------------------------------
+// : Receipts
+// ------------------------------------------------------------
+
+// Subject returns the value stored in receipts for a token.
+func Subject(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendReceipt adds a receipt to the end of the chain.
+func AppendReceipt(mode Mode, token string, counts map[string]int64, operator string) (*Receipt, error) {
+	receiptsMutex.Lock()
+	defer receiptsMutex.Unlock()
+
+	receipts, err := Receipts()
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &Receipt{
+		Seq      : 1,
+		Action   : mode,
+		Subject  : Subject(token),
+		Counts   : counts,
+		Operator : operator,
+		Timestamp: time.Now().UTC(),
+	}
+	if n := len(receipts); n > 0 {
+		receipt.Seq      = receipts[n-1].Seq + 1
+		receipt.Previous = receipts[n-1].Hash
+	}
+	receipt.Hash = receipt.digest()
+
+	b, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(receiptsPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(receiptsPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+
+	return receipt, f.Sync()
+}
+
+// Receipts returns every receipt in order.
+func Receipts() ([]*Receipt, error) {
+	receipts := []*Receipt{}
+
+	f, err := os.Open(receiptsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return receipts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		receipt := &Receipt{}
+		if err := json.Unmarshal(scanner.Bytes(), receipt); err != nil {
+			return nil, fmt.Errorf("%w: receipt %d: %v", ErrBrokenChain, len(receipts) + 1, err)
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	return receipts, scanner.Err()
+}
+
+// Verify walks the chain and returns the first receipt that does not match
+// its hash or the hash of its predecessor.
+func Verify() (int, error) {
+	receipts, err := Receipts()
+	if err != nil {
+		return 0, err
+	}
+
+	previous := ""
+	for i, receipt := range receipts {
+		if receipt.Seq != int64(i + 1) || receipt.Previous != previous {
+			return i, fmt.Errorf("%w: receipt %d does not follow receipt %d", ErrBrokenChain, receipt.Seq, i)
+		}
+		if !hmac.Equal([]byte(receipt.digest()), []byte(receipt.Hash)) {
+			return i, fmt.Errorf("%w: receipt %d was modified", ErrBrokenChain, receipt.Seq)
+		}
+		previous = receipt.Hash
+	}
+
+	return len(receipts), nil
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+
+// digest hashes the receipt without its own hash. With GDPR_SECRET set the
+// hash is an HMAC, so the chain cannot be rebuilt by someone without it.
+func (r *Receipt) digest() string {
+	unsigned     := *r
+	unsigned.Hash = ""
+
+	// encoding/json sorts map keys, so the encoding is stable
+	b, _ := json.Marshal(unsigned)
+
+	if secret := os.Getenv("GDPR_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(b)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
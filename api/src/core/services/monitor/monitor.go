@@ -3,10 +3,12 @@ package monitor
 import (
 	"context"
 	"dse/src/core/models"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
 	"dse/src/core/services/db"
 	"dse/src/utils"
 	"dse/src/utils/datetime"
-	"dse/src/utils/event"
+	"dse/src/core/services/extractor"
 	"dse/src/utils/hashmap"
 	"time"
 
@@ -52,18 +54,26 @@ func MonitorUsers() {
 	m.Set("disconnected", int64(0))
 
 	users.Each(func(index int, user *models.User) bool {
-		if user.State.Client.User.Form.Age != "" {
+		if consent.Has(user.Token) {
 			m.Set("consented", m.MustGet("consented").(int64)+1)
 		}
-
-		if user.State.Server.Online {
-			m.Set("connected", m.MustGet("connected").(int64)+1)
-		} else {
-			m.Set("disconnected", m.MustGet("disconnected").(int64)+1)
-		}
 		return true
 	})
 
+	// Connections are counted across every instance
+	presence, err := cluster.Presence(context.Background())
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get presence")
+		return
+	}
+
+	connected := int64(0)
+	for _, count := range presence {
+		connected += int64(count)
+	}
+	m.Set("connected",    connected)
+	m.Set("disconnected", int64(users.Len()) - connected)
+
 	save(datetime.ToISO(datetime.Now()), m)
 }
 
@@ -146,48 +156,32 @@ func MonitorSearchesTotal() {
 // ------------------------------------------------------------
 // : Monitor
 // ------------------------------------------------------------
-func Init() {
-	go func() {
-		limiter := rate.NewLimiter(rate.Every(5 * time.Second), 1)
-		ch      := event.On(event.UserConnected)
-		for range ch { 
-			if limiter.Allow() {
-				go MonitorUsers()
-			}
-		}	
-	}()
-
-	go func() {
-		limiter := rate.NewLimiter(rate.Every(5 * time.Second), 1)
-		ch      := event.On(event.UserDisconnected)
-		for range ch { 
-			if limiter.Allow() {
-				go MonitorUsers() 
-			}
-		}	
-	}()
-
-	go func() {
-		go MonitorSearches()
-
-		limiter := rate.NewLimiter(rate.Every(5 * time.Second), 1)
-		ch      := event.On(event.ExtractorItemDone)
-		for range ch { 
-			if limiter.Allow() {
-				go MonitorSearches() 
-			}
+func Start(ctx context.Context) error {
+	// Connections come in bursts; the limiters keep them to one refresh every
+	// 5 seconds
+	users    := rate.NewLimiter(rate.Every(5 * time.Second), 1)
+	searches := rate.NewLimiter(rate.Every(5 * time.Second), 1)
+	size     := rate.NewLimiter(rate.Every(5 * time.Second), 1)
+
+	onUser := func(*models.User) {
+		if users.Allow() {
+			go MonitorUsers()
 		}
-	}()
+	}
+	models.UserConnected   .Listen(ctx, onUser)
+	models.UserDisconnected.Listen(ctx, onUser)
 
-	go func() {
-		go MonitorSearchesSize()
+	go MonitorSearches()
+	go MonitorSearchesSize()
 
-		limiter := rate.NewLimiter(rate.Every(5 * time.Second), 1)
-		ch      := event.On(event.ExtractorItemDone)
-		for range ch { 
-			if limiter.Allow() {
-				go MonitorSearchesSize()
-			}
+	extractor.ItemDone.Listen(ctx, func(string) {
+		if searches.Allow() {
+			go MonitorSearches()
 		}
-	}()
+		if size.Allow() {
+			go MonitorSearchesSize()
+		}
+	})
+
+	return nil
 }
@@ -0,0 +1,367 @@
+package progress
+
+import (
+	"context"
+	"dse/src/core/models"
+	"dse/src/core/services/consent"
+	"dse/src/core/services/crawler"
+	"dse/src/core/services/db"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dromara/carbon/v2"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Status string
+
+const (
+	StatusComplete Status = "complete" // Every keyword was uploaded for every engine
+	StatusPartial  Status = "partial"  // Some cells were uploaded
+	StatusNone     Status = "none"     // Nothing was uploaded in the period
+)
+
+// Period is a half-open time range, usually one study week.
+type Period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Cell is one keyword on one engine for one participant.
+type Cell struct {
+	Keyword     string     `json:"keyword"`
+	Engine      string     `json:"engine"`
+	Uploads     int64      `json:"uploads"`                // Stored result pages in the period
+	LastUpload  *time.Time `json:"last_upload,omitempty"`
+	CompletedAt string     `json:"completed_at,omitempty"` // Task completion reported by the crawler, if in the period
+}
+
+// Participant is the completion of one participant in a period.
+type Participant struct {
+	Token     string  `json:"token"`
+	Status    Status  `json:"status"`
+	Uploaded  int     `json:"uploaded"` // Cells with at least one upload
+	Expected  int     `json:"expected"`
+	Online    bool    `json:"online"`
+	LastSeen  string  `json:"last_seen"`
+	Version   string  `json:"version"` // Extension version
+	Cells     []*Cell `json:"cells,omitempty"`
+}
+
+// Rate is the share of the cohort that uploaded one cell.
+type Rate struct {
+	Keyword  string  `json:"keyword"`
+	Engine   string  `json:"engine"`
+	Uploaded int     `json:"uploaded"`
+	Rate     float64 `json:"rate"`
+}
+
+// Report is the completion of the whole cohort in a period.
+type Report struct {
+	Period       Period         `json:"period"`
+	Keywords     []string       `json:"keywords"`
+	Engines      []string       `json:"engines"`
+	Participants int            `json:"participants"` // Consenting participants
+	Complete     int            `json:"complete"`
+	Partial      int            `json:"partial"`
+	None         int            `json:"none"`
+	Completion   float64        `json:"completion"` // Share of participants that completed everything
+	Coverage     float64        `json:"coverage"`   // Share of all expected cells that were uploaded
+	Rates        []*Rate        `json:"rates"`
+	Stuck        []*Participant `json:"stuck"`                  // Partial and none, longest unseen first
+	Matrix       []*Participant `json:"matrix,omitempty"`       // Every participant with cells
+}
+
+type key struct {
+	token   string
+	keyword string
+	engine  string
+}
+
+type upload struct {
+	count int64
+	last  time.Time
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Errors
+	ErrInvalidWeek  = errors.New("week must look like 2025-W10")
+	ErrInvalidRange = errors.New("start must be before end")
+)
+
+// ------------------------------------------------------------
+// : Period
+// ------------------------------------------------------------
+
+// Week returns the study week (Monday to Monday, UTC) containing t.
+func Week(t time.Time) Period {
+	start := carbon.CreateFromStdTime(t.UTC()).SetWeekStartsAt(carbon.Monday).StartOfWeek().StdTime().UTC()
+	return Period{Start: start, End: start.AddDate(0, 0, 7)}
+}
+
+// ParseWeek reads an ISO week such as 2025-W10.
+func ParseWeek(value string) (Period, error) {
+	var year, week int
+	if _, err := fmt.Sscanf(value, "%d-W%d", &year, &week); err != nil || week < 1 || week > 53 {
+		return Period{}, ErrInvalidWeek
+	}
+
+	// The 4th of January is always in week 1
+	period := Week(time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC))
+	period.Start = period.Start.AddDate(0, 0, 7*(week-1))
+	period.End   = period.Start.AddDate(0, 0, 7)
+
+	if y, w := period.Start.ISOWeek(); y != year || w != week {
+		return Period{}, ErrInvalidWeek
+	}
+	return period, nil
+}
+
+// ISOWeek names the week the period starts in, such as 2025-W10.
+func (p Period) ISOWeek() string {
+	year, week := p.Start.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+func (p Period) Contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// ------------------------------------------------------------
+// : Report
+// ------------------------------------------------------------
+
+// Build computes the completion of every consenting participant in the
+// period. Uploads come from the searches table; the crawler's task
+// completion is included per cell so uploads that never arrived can be told
+// apart from searches that never ran.
+func Build(ctx context.Context, period Period, matrix bool) (*Report, error) {
+	if !period.Start.Before(period.End) {
+		return nil, ErrInvalidRange
+	}
+
+	keywords := crawler.Keywords()
+	engines  := []string{}
+	for _, website := range crawler.Websites() {
+		engines = append(engines, website.Name)
+	}
+
+	uploads, err := uploads(ctx, period)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Period  : period,
+		Keywords: keywords,
+		Engines : engines,
+		Rates   : []*Rate{},
+		Stuck   : []*Participant{},
+	}
+
+	rates := map[[2]string]*Rate{}
+	for _, keyword := range keywords {
+		for _, engine := range engines {
+			rate := &Rate{Keyword: keyword, Engine: engine}
+			rates[[2]string{keyword, engine}] = rate
+			report.Rates = append(report.Rates, rate)
+		}
+	}
+
+	users.Each(func(_ int, user *models.User) bool {
+		if !consent.Has(user.Token) {
+			return true
+		}
+
+		participant := participant(user, period, keywords, engines, uploads)
+		for _, cell := range participant.Cells {
+			if cell.Uploads > 0 {
+				rates[[2]string{cell.Keyword, cell.Engine}].Uploaded += 1
+			}
+		}
+
+		report.Participants += 1
+		switch participant.Status {
+			case StatusComplete: report.Complete += 1
+			case StatusPartial : report.Partial  += 1
+			case StatusNone    : report.None     += 1
+		}
+
+		if participant.Status != StatusComplete {
+			report.Stuck = append(report.Stuck, participant.summary())
+		}
+		if matrix {
+			report.Matrix = append(report.Matrix, participant)
+		}
+		return true
+	})
+
+	if report.Participants > 0 {
+		uploaded := 0
+		for _, rate := range report.Rates {
+			rate.Rate = float64(rate.Uploaded) / float64(report.Participants)
+			uploaded += rate.Uploaded
+		}
+
+		report.Completion = float64(report.Complete) / float64(report.Participants)
+		if cells := report.Participants * len(report.Rates); cells > 0 {
+			report.Coverage = float64(uploaded) / float64(cells)
+		}
+	}
+
+	sort.SliceStable(report.Stuck, func(i, j int) bool { return report.Stuck[i].LastSeen < report.Stuck[j].LastSeen })
+	sort.Slice(report.Matrix, func(i, j int) bool { return report.Matrix[i].Token < report.Matrix[j].Token })
+
+	return report, nil
+}
+
+// Get computes the completion of one participant, consenting or not.
+func Get(ctx context.Context, token string, period Period) (*Participant, error) {
+	user, err := db.GetUser(token)
+	if err != nil {
+		return nil, err
+	}
+
+	uploads, err := uploadsOf(ctx, period, token)
+	if err != nil {
+		return nil, err
+	}
+
+	engines := []string{}
+	for _, website := range crawler.Websites() {
+		engines = append(engines, website.Name)
+	}
+
+	return participant(user, period, crawler.Keywords(), engines, uploads), nil
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func participant(user *models.User, period Period, keywords []string, engines []string, uploads map[key]*upload) *Participant {
+	// A crawl on this instance changes the state meanwhile
+	user.Lock()
+	defer user.Unlock()
+
+	server := user.State.Server
+
+	p := &Participant{
+		Token   : user.Token,
+		Expected: len(keywords) * len(engines),
+		Online  : server.Online,
+		LastSeen: server.LastPing,
+		Cells   : []*Cell{},
+	}
+	if user.State.Client != nil && user.State.Client.Extension != nil {
+		p.Version = user.State.Client.Extension.Version
+	}
+
+	completed := map[[2]string]string{}
+	if server.Tasks != nil {
+		for _, task := range *server.Tasks {
+			if task.CompletedAt != "" && period.Contains(task.GetCompletedAt()) {
+				completed[[2]string{task.Keyword, engine(task.Website)}] = task.CompletedAt
+			}
+		}
+	}
+
+	for _, keyword := range keywords {
+		for _, name := range engines {
+			cell := &Cell{
+				Keyword    : keyword,
+				Engine     : name,
+				CompletedAt: completed[[2]string{keyword, name}],
+			}
+
+			if u, ok := uploads[key{user.Token, keyword, name}]; ok {
+				last           := u.last
+				cell.Uploads    = u.count
+				cell.LastUpload = &last
+				p.Uploaded     += 1
+			}
+			p.Cells = append(p.Cells, cell)
+		}
+	}
+
+	switch {
+		case p.Uploaded == 0         : p.Status = StatusNone
+		case p.Uploaded < p.Expected : p.Status = StatusPartial
+		default                      : p.Status = StatusComplete
+	}
+
+	return p
+}
+
+// summary is the participant without cells, for lists.
+func (p *Participant) summary() *Participant {
+	s      := *p
+	s.Cells = nil
+	return &s
+}
+
+// engine returns the name of a task's website, which is a Website when the
+// task was just created and a map once it has been loaded from the database.
+func engine(website any) string {
+	switch w := website.(type) {
+		case models.Website : return w.Name
+		case *models.Website: return w.Name
+		case map[string]any : name, _ := w["name"].(string); return name
+	}
+	return ""
+}
+
+func uploads(ctx context.Context, period Period) (map[key]*upload, error) {
+	return query(ctx, `
+	SELECT token, metadata->>'keyword', metadata->>'website', COUNT(*), MAX(timestamp)
+	FROM searches
+	WHERE timestamp >= $1 AND timestamp < $2
+	GROUP BY 1, 2, 3`, period.Start, period.End)
+}
+
+func uploadsOf(ctx context.Context, period Period, token string) (map[key]*upload, error) {
+	return query(ctx, `
+	SELECT token, metadata->>'keyword', metadata->>'website', COUNT(*), MAX(timestamp)
+	FROM searches
+	WHERE timestamp >= $1 AND timestamp < $2 AND token = $3
+	GROUP BY 1, 2, 3`, period.Start, period.End, token)
+}
+
+func query(ctx context.Context, sql string, args ...any) (map[key]*upload, error) {
+	rows, err := db.GetConnection().Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[key]*upload{}
+	for rows.Next() {
+		var k       key
+		var keyword *string
+		var website *string
+		var u       upload
+
+		if err := rows.Scan(&k.token, &keyword, &website, &u.count, &u.last); err != nil {
+			return nil, err
+		}
+		if keyword == nil || website == nil {
+			continue
+		}
+
+		k.keyword, k.engine = *keyword, *website
+		result[k] = &u
+	}
+
+	return result, rows.Err()
+}
@@ -1,13 +1,16 @@
 package scheduler
 
 import (
+	"context"
+	"dse/src/core/services/analysis"
 	"dse/src/core/services/api/download"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
 	"dse/src/core/services/crawler"
 	"dse/src/core/services/db"
+	"dse/src/core/services/export"
 	"dse/src/core/services/monitor"
 	"dse/src/utils"
-	"encoding/json"
-	"os"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -18,6 +21,8 @@ import (
 // ------------------------------------------------------------
 var (
 	logger = utils.NewLogger()
+
+	c = cron.New()
 )
 
 // ------------------------------------------------------------
@@ -28,46 +33,25 @@ func reset() {
 	crawler.OnResetAll()
 }
 
-func Consent() {
+// ask asks participants connected here without a current consent to
+// accept a new text; every instance asks its own.
+func ask(text *consent.Text) {
 	users, err := db.GetUsers()
 	if err != nil {
-		panic(err)
+		logger.Error().Err(err).Msg("Failed to get users")
+		return
 	}
 
-	// Prepare data to write to file
-	user_data := []map[string]interface{}{}
+	asked := 0
 	users.Each(func(i int, v *db.User) bool {
-		user_data = append(user_data, map[string]interface{}{
-			"token":  v.Token, // Changed "id" to "token"
-			"online": v.IsOnline(),
-		})
-
-		if v.IsOnline() { // Check if user is online
-			if v.State.Client.User.Form.Postcode.Value == "" {
-				v.Send("consent", nil) // Send "consent" to the user with correct arguments
-			}
+		if v.Connected() && !consent.Has(v.Token) {
+			v.Send("consent", map[string]string{"version": text.Version})
+			asked += 1
 		}
 		return true
 	})
 
-	// Write users to /tmp/YYYYMMDD_HHMMSS_users.json
-	timestamp := time.Now().Format("20060102_150405")
-	file_path := "tmp/" + timestamp + "_users.json"
-
-	file, err := os.Create(file_path) // Use os.Create to create the file
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to create file")
-		return
-	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file) // Use json.NewEncoder to write JSON
-	err = encoder.Encode(user_data)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to write users to file")
-	} else {
-		logger.Info().Msgf("Users written to %s", file_path)
-	}
+	logger.Info().Str("version", text.Version).Int("participants", asked).Msg("Asked for consent")
 }
 
 func debug() {
@@ -78,21 +62,35 @@ func debug() {
 // ------------------------------------------------------------
 // : Scheduler
 // -----------------------------------------------------------
-func Init() {
+func Start(ctx context.Context) error {
 	// Triggers that should happen on start
 	go download.LoadData()
 
-	// Triggers that should happen on a schedule
-	c := cron.New()
-	c.AddFunc("0 0 * * 1", func() { reset() })
-	c.AddFunc("*/10 * * * *", func() { monitor.MonitorUsers() })
-	c.AddFunc("*/10 * * * *", func() { monitor.MonitorSearches() })
-	c.AddFunc("*/10 * * * *", func() { monitor.MonitorSearchesSize() })
-	c.AddFunc("*/10 * * * *", func() { monitor.MonitorSearchesTotal() })
+	// Triggers that should happen on a schedule. Jobs that write shared
+	// tables run on one instance; the others fill local caches and files
+	c.AddFunc("0 0 * * 1"   , cluster.Once("reset", reset))
+	c.AddFunc("*/10 * * * *", cluster.Once("monitor.users", monitor.MonitorUsers))
+	c.AddFunc("*/10 * * * *", cluster.Once("monitor.searches", monitor.MonitorSearches))
+	c.AddFunc("*/10 * * * *", cluster.Once("monitor.searches_size", monitor.MonitorSearchesSize))
+	c.AddFunc("*/10 * * * *", cluster.Once("monitor.searches_total", monitor.MonitorSearchesTotal))
 	c.AddFunc("*/10 * * * *", func() { download.LoadData() })
-	c.AddFunc("0 12 20 3 *" , func() { Consent() }) // On March 20th at 12:00 PM
-	c.AddFunc("0 12 21 3 *" , func() { Consent() }) // On March 21st at 12:00 PM
+	c.AddFunc("0 3 * * *"   , func() { export.Prune(7 * 24 * time.Hour) })
+	c.AddFunc("0 4 * * 1"   , cluster.Once("analysis.weekly", analysis.Weekly)) // Mondays, for the week before
+	c.AddFunc("*/10 * * * *", cluster.Once("analysis.diffs", analysis.RunDiffs))
 	c.Start()
 
+	// Participants are asked again when a new text needs their consent
+	consent.CurrentChanged.Listen(ctx, ask)
+
 	go debug()
+	return nil
+}
+
+// Stop stops scheduling and waits for jobs that are running.
+func Stop(ctx context.Context) error {
+	select {
+		case <-c.Stop().Done():
+		case <-ctx.Done()     : return ctx.Err()
+	}
+	return nil
 }
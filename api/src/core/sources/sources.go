@@ -0,0 +1,272 @@
+package sources
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+
+// List is the source list in config/sources.json: domains tagged with what
+// kind of source they are. Results whose domain is not on the list keep
+// their domain but get no tags.
+type List struct {
+	Version string    `json:"version"`
+	Sources []*Source `json:"sources"`
+
+	domains map[string]*Source
+}
+
+type Source struct {
+	Domain      string `json:"domain"`      // Registrable domain (nos.nl) or subdomain (joop.bnnvara.nl)
+	Name        string `json:"name"`
+	Type        string `json:"type"`        // Outlet type (public-broadcaster, newspaper, ...)
+	Lean        string `json:"lean"`        // Political lean, empty when not assigned
+	Scope       string `json:"scope"`       // national, regional or international
+	FactChecker bool   `json:"factchecker"`
+}
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	path = "config/sources.json"
+
+	mutex    sync.Mutex
+	current  *List
+	modified time.Time
+
+	// Tags that results can be aggregated by
+	Tags = []string{"type", "lean", "scope", "factchecker"}
+
+	// Hosts of search engine redirect wrappers
+	rgoogle = regexp.MustCompile(`^(www\.)?google\.[a-z.]+$`)
+
+	// Errors
+	ErrInvalidList = errors.New("invalid source list")
+)
+
+// ------------------------------------------------------------
+// : Load
+// ------------------------------------------------------------
+
+// Current returns the list in config/sources.json. The file is read again
+// when it changes. A missing file is an empty list, so results still get
+// their domains.
+func Current() (*List, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Parse([]byte(`{"version": "none", "sources": []}`))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if current != nil && info.ModTime().Equal(modified) {
+		return current, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	current  = list
+	modified = info.ModTime()
+	return current, nil
+}
+
+// Parse decodes and checks a source list.
+func Parse(b []byte) (*List, error) {
+	list := &List{}
+	if err := json.Unmarshal(b, list); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidList, err)
+	}
+
+	if list.Version == "" {
+		return nil, fmt.Errorf("%w: missing version", ErrInvalidList)
+	}
+
+	list.domains = map[string]*Source{}
+	for _, source := range list.Sources {
+		domain := strings.ToLower(strings.TrimSpace(source.Domain))
+		if domain == "" {
+			return nil, fmt.Errorf("%w: source without domain", ErrInvalidList)
+		}
+		if _, ok := list.domains[domain]; ok {
+			return nil, fmt.Errorf("%w: duplicate domain %q", ErrInvalidList, domain)
+		}
+		source.Domain        = domain
+		list.domains[domain] = source
+	}
+
+	return list, nil
+}
+
+// Lookup returns the source of a domain, or nil.
+func (l *List) Lookup(domain string) *Source {
+	return l.domains[domain]
+}
+
+// Match returns the source of a link. Sources can be listed by registrable
+// domain or by a subdomain (joop.bnnvara.nl); the most specific one wins.
+func (l *List) Match(link string) *Source {
+	host, domain := Host(link), Domain(link)
+	for host != "" {
+		if source, ok := l.domains[host]; ok {
+			return source
+		}
+		if host == domain {
+			break
+		}
+
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			break
+		}
+		host = parent
+	}
+	return nil
+}
+
+// Tag returns the value of one of Tags, or "" for unknown sources.
+func (s *Source) Tag(name string) string {
+	if s == nil {
+		return ""
+	}
+
+	switch name {
+		case "type"       : return s.Type
+		case "lean"       : return s.Lean
+		case "scope"      : return s.Scope
+		case "factchecker": return fmt.Sprint(s.FactChecker)
+	}
+	return ""
+}
+
+// ------------------------------------------------------------
+// : Links
+// ------------------------------------------------------------
+
+// Unwrap returns the destination of search engine redirect links
+// (google.*/url?q=..., duckduckgo.com/l/?uddg=...). Other links are returned
+// unchanged.
+func Unwrap(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+		// Relative redirects are scraped from Google result pages as is
+		case (host == "" || rgoogle.MatchString(host)) && u.Path == "/url": {
+			for _, name := range []string{"q", "url"} {
+				if target := u.Query().Get(name); strings.HasPrefix(target, "http") {
+					return target
+				}
+			}
+		}
+		case strings.HasSuffix(host, "duckduckgo.com") && u.Path == "/l/": {
+			if target := u.Query().Get("uddg"); strings.HasPrefix(target, "http") {
+				return target
+			}
+		}
+	}
+
+	return link
+}
+
+// Host returns the lower case host of a link, after unwrapping redirects.
+func Host(link string) string {
+	u, err := url.Parse(Unwrap(link))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// Domain returns the registrable domain of a link (news.example.co.uk ->
+// example.co.uk), after unwrapping redirects. Links without a host return "".
+func Domain(link string) string {
+	host := Host(link)
+	if host == "" {
+		return ""
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host // IP addresses and bare suffixes
+	}
+	return domain
+}
+
+// ------------------------------------------------------------
+// : Enrich
+// ------------------------------------------------------------
+
+// Enrich annotates every result with a link in a parsed result page (the
+// "results" of a search) in place:
+//
+//	url    the link with redirect wrappers removed
+//	domain its registrable domain
+//	source the matching entry of the list, or null
+//
+// It returns the list version, which is stored with the search so results
+// can be annotated again when the list changes.
+func (l *List) Enrich(results map[string]any) string {
+	for _, value := range results {
+		items, ok := value.([]any)
+		if !ok {
+			continue
+		}
+
+		for _, item := range items {
+			result, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			link, ok := result["link"].(string)
+			if !ok || link == "" {
+				continue
+			}
+
+			result["url"]    = Unwrap(link)
+			result["domain"] = Domain(link)
+
+			if source := l.Match(link); source != nil {
+				result["source"] = map[string]any{
+					"name"       : source.Name,
+					"type"       : source.Type,
+					"lean"       : source.Lean,
+					"scope"      : source.Scope,
+					"factchecker": source.FactChecker,
+				}
+			} else {
+				result["source"] = nil
+			}
+		}
+	}
+
+	return l.Version
+}
@@ -0,0 +1,256 @@
+// Package telemetry defines the service and pipeline metrics exposed on
+// /metrics in the Prometheus text format. The JSON endpoints under
+// /api/metrics are unaffected.
+package telemetry
+
+import (
+	"bufio"
+	"dse/src/utils/event"
+	"dse/src/utils/prometheus"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ------------------------------------------------------------
+// : Metrics
+// ------------------------------------------------------------
+var (
+	HTTPRequests = prometheus.NewCounter(
+		"dse_http_requests_total",
+		"HTTP requests by method, route pattern and status code.",
+		"method", "route", "code",
+	)
+
+	HTTPDuration = prometheus.NewHistogram(
+		"dse_http_request_duration_seconds",
+		"Time to serve HTTP requests, excluding long-lived streams.",
+		prometheus.DefBuckets,
+		"method", "route",
+	)
+
+	Participants = prometheus.NewGauge(
+		"dse_participants_connected",
+		"Participants currently connected, by transport (sse, ws, http).",
+		"transport",
+	)
+
+	Tasks = prometheus.NewCounter(
+		"dse_tasks_total",
+		"Crawler tasks by status (dispatched, completed, timed_out).",
+		"status",
+	)
+
+	EventsDropped = prometheus.NewCounter(
+		"dse_events_dropped_total",
+		"Events a subscriber missed because its buffer was full, by topic.",
+		"topic",
+	)
+
+	Uploads = prometheus.NewCounter(
+		"dse_uploads_total",
+		"Uploads by how they matched a task (matched, completed, stale, unknown, missing).",
+		"correlation",
+	)
+
+	ExtractionDuration = prometheus.NewHistogram(
+		"dse_extraction_duration_seconds",
+		"Time to parse and store one result page, by engine.",
+		prometheus.DefBuckets,
+		"engine",
+	)
+
+	ExtractionLag = prometheus.NewHistogram(
+		"dse_extraction_lag_seconds",
+		"Time from a result page being received to it being stored, by engine.",
+		[]float64{.1, .5, 1, 5, 15, 60, 300, 900, 3600},
+		"engine",
+	)
+
+	ParseResults = prometheus.NewHistogram(
+		"dse_parse_results",
+		"Results parsed from one result page, by engine.",
+		[]float64{0, 1, 2, 5, 10, 15, 20, 30, 50},
+		"engine",
+	)
+
+	Parses = prometheus.NewCounter(
+		"dse_parse_total",
+		"Result pages parsed, by engine and outcome (ok, empty, error).",
+		"engine", "outcome",
+	)
+
+	DBDuration = prometheus.NewHistogram(
+		"dse_db_query_duration_seconds",
+		"Database query latency, by statement (select, insert, ...).",
+		prometheus.DefBuckets,
+		"operation",
+	)
+
+	DBErrors = prometheus.NewCounter(
+		"dse_db_query_errors_total",
+		"Failed database queries, by statement.",
+		"operation",
+	)
+
+	QueueDepth = prometheus.NewGauge(
+		"dse_queue_depth",
+		"Items waiting in each queue.",
+		"queue",
+	)
+
+	ClusterInstances = prometheus.NewGauge(
+		"dse_cluster_instances",
+		"API instances with a current heartbeat.",
+	)
+
+	ClusterParticipants = prometheus.NewGauge(
+		"dse_cluster_participants_connected",
+		"Participants connected to any instance, by transport (sse, ws).",
+		"transport",
+	)
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	mutex    sync.Mutex
+	scrapers = []func(){}
+	seen     = map[string]time.Time{}
+
+	// Window after which a participant polling over HTTP counts as gone
+	window = 1 * time.Minute
+)
+
+func init() {
+	event.OnDrop(func(topic string) {
+		EventsDropped.With(topic).Inc()
+	})
+
+	prometheus.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	OnScrape(func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		cutoff := time.Now().Add(-window)
+		for token, at := range seen {
+			if at.Before(cutoff) {
+				delete(seen, token)
+			}
+		}
+		Participants.With("http").Set(float64(len(seen)))
+	})
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// OnScrape registers a function that refreshes gauges right before they are
+// written, for values that are cheaper to read than to track (queue lengths,
+// connection counts).
+func OnScrape(fn func()) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	scrapers = append(scrapers, fn)
+}
+
+// Seen marks a participant as connected over HTTP for the next minute.
+func Seen(token string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	seen[token] = time.Now()
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	fns := append([]func(){}, scrapers...)
+	mutex.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+
+	prometheus.Handler().ServeHTTP(w, r)
+}
+
+// ------------------------------------------------------------
+// : Middleware
+// ------------------------------------------------------------
+
+// Middleware counts requests by route pattern, so /api/users/{token} is one
+// series rather than one per participant. Requests that do not match a route
+// are counted under "unmatched".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start    := time.Now()
+		recorder := &recorder{ResponseWriter: w, code: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		route := "unmatched"
+		if ctx := chi.RouteContext(r.Context()); ctx != nil && ctx.RoutePattern() != "" {
+			route = ctx.RoutePattern()
+		}
+
+		HTTPRequests.With(r.Method, route, strconv.Itoa(recorder.code)).Inc()
+
+		// Streams stay open for as long as the participant is connected
+		if !recorder.streamed {
+			HTTPDuration.With(r.Method, route).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// recorder captures the status code. It passes Flush and Hijack through,
+// which the SSE and websocket endpoints rely on.
+type recorder struct {
+	http.ResponseWriter
+	code     int
+	written  bool
+	streamed bool
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if !r.written {
+		r.code    = code
+		r.written = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.written = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Flush() {
+	r.streamed = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking unsupported")
+	}
+
+	r.streamed = true
+	r.code     = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
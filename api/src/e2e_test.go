@@ -0,0 +1,134 @@
+//go:build e2e
+
+package main
+
+import (
+	"context"
+	"dse/src/core/lifecycle"
+	"dse/src/core/loadtest"
+	"dse/src/core/log"
+	"dse/src/utils/env"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The end-to-end test runs the whole server in process against the fake
+// engines, so it needs the Postgres of .env:
+//
+//	go test -tags e2e -run TestE2E -timeout 10m ./src
+
+// ------------------------------------------------------------
+// : Tests
+// ------------------------------------------------------------
+func TestE2E(t *testing.T) {
+	// The server runs from api/, where config/ and .env are
+	t.Chdir("..")
+	directories()
+	log.Init()
+
+	engine := httptest.NewServer(loadtest.NewEngine(""))
+	defer engine.Close()
+
+	keywords := []string{"Migrantenstroom", "Asielcrisis"}
+	websites := []string{"Google", "Bing", "DuckDuckGo"}
+	t.Setenv("SEARCHES_FILE", searches(t, engine.URL, keywords, websites))
+
+	port := free(t)
+	t.Setenv("API_HOST", "127.0.0.1")
+	t.Setenv("API_PORT", port)
+	env.Load()
+
+	lifecycle.Register(services()...)
+
+	code := 0
+	done := make(chan struct{})
+	go func() {
+		code = lifecycle.Run()
+		close(done)
+	}()
+	defer func() {
+		lifecycle.Shutdown()
+		<-done
+		if code != 0 {
+			t.Errorf("server stopped with code %d", code)
+		}
+	}()
+
+	// Wait for every service to start
+	deadline := time.Now().Add(time.Minute)
+	for !lifecycle.Ready() {
+		select {
+			case <-done: t.Fatal("server did not start")
+			default    :
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not become ready")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	checks, err := loadtest.E2E(context.Background(), "http://127.0.0.1:"+port, engine.URL, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(checks) != len(keywords) * len(websites) {
+		t.Errorf("%d searches checked, want %d", len(checks), len(keywords) * len(websites))
+	}
+	for _, check := range checks {
+		switch {
+			case !check.Found      : t.Errorf("%s %q: missing from the download", check.Website, check.Keyword)
+			case check.Results == 0: t.Errorf("%s %q: no results extracted", check.Website, check.Keyword)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// : Helpers
+// ------------------------------------------------------------
+
+// searches writes a searches file that sends the crawler to the engine at
+// base and returns its path.
+func searches(t *testing.T, base string, keywords []string, websites []string) string {
+	type website struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+		Url   string `json:"url"`
+	}
+
+	config := struct {
+		Keywords []string  `json:"keywords"`
+		Websites []website `json:"websites"`
+	}{Keywords: keywords}
+	for _, name := range websites {
+		config.Websites = append(config.Websites, website{Name: name, Query: "q", Url: loadtest.Url(base, name)})
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "searches.json")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// free returns a port nothing listens on.
+func free(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
+	"dse/src/core/lifecycle"
+	"dse/src/core/loadtest"
 	"dse/src/core/log"
+	"dse/src/core/operator"
 	"dse/src/core/services/api"
 	"dse/src/core/services/api/metrics"
+	"dse/src/core/services/cluster"
+	"dse/src/core/services/consent"
 	"dse/src/core/services/crawler"
 	"dse/src/core/services/db"
+	"dse/src/core/services/enrich"
+	"dse/src/core/services/export"
 	"dse/src/core/services/extractor"
+	"dse/src/core/services/gdpr"
 	"dse/src/core/services/monitor"
 	"dse/src/core/services/scheduler"
 	"dse/src/utils"
 	"dse/src/utils/env"
-	"dse/src/utils/event"
 	"os"
 	"time"
-
-	"github.com/olebedev/emitter"
 )
 
 // TODO: Move the searches from searches_2 into the current table
@@ -35,7 +41,9 @@ var (
 // ------------------------------------------------------------
 // : Init
 // ------------------------------------------------------------
-func init() {
+
+// directories creates what the server writes to, relative to where it runs.
+func directories() {
 	os.MkdirAll("tmp" , os.ModePerm)
 	os.MkdirAll("logs", os.ModePerm)
 
@@ -46,83 +54,80 @@ func init() {
 }
 
 // ------------------------------------------------------------
-// : Debug
+// : Main
 // ------------------------------------------------------------
-func Debug() {
-
-
-	// if env.IsLocal() == false { return }
-
-	// api.Wait()
-
-	// fsearches, _ := file.Open("searches.json")
-	// defer fsearches.Close()
 
-	// foutput, _ := file.Create("output.csv")
-	// defer foutput.Close()
-
-	// count_token  := 0 
-	// count_age    := 0
-	// count_sex    := 0
-
-	// scanner := bufio.NewScanner(fsearches)
-	// for scanner.Scan() {
-	// 	line := scanner.Text()
-
-	// 	timestamp := json.Get(line, "timestamp").String()
-	// 	token  := json.Get(line, "token").String()
-	// 	age    := json.Get(line, "form.age").String()
-	// 	sex    := json.Get(line, "form.sex").String()
-
-	// 	if token  != "" { count_token++  }
-	// 	if age    != "" { count_age++ }
-	// 	if sex    != "" { count_sex++ }
+// The API docs in src/docs are generated from these and the handler
+// annotations with "swag init -g src/main.go -o src/docs".
+//
+//	@title						DSE API
+//	@description				Server of the Digital Society Extension: participants, their crawls and the searches they upload.
+//	@securityDefinitions.apikey	AdminToken
+//	@in							header
+//	@name						Authorization
+//	@description				"Bearer " followed by ADMIN_TOKEN
+func main() {
+	directories()
+	log.Init() // TODO: Move this to init?
 
-	// 	foutput.WriteString(fmt.Sprintf("%s, %d, %d, %d\n", timestamp, count_token, count_age, count_sex))
-	// }
-	// if err := scanner.Err(); err != nil {
-	// 	logger.Error().Err(err).Msg("Error reading file")
-	// }
+	// The load test talks to a running server and needs no configuration
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(loadtest.Command(os.Args[2:]))
+	}
 
-	// log.Println(count_token, count_age, count_sex)
-}
+	// Operator commands go through the admin API of a running server
+	if len(os.Args) > 1 && operator.Has(os.Args[1]) {
+		os.Exit(operator.Command(os.Args[1:]))
+	}
 
-// ------------------------------------------------------------
-// : Main
-// ------------------------------------------------------------
-func main() {
-	log.Init() // TODO: Move this to init?
 	env.Load() // TODO: Move this to init?
 
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "gdpr" {
+		os.Exit(gdpr.Command(os.Args[2:]))
+	}
+
 	log.Info().Msg("🚀 Starting...")
 	
-	event.Use("*", emitter.Sync, emitter.Skip)
-
-	// Start services
-	go db       .Start()
-	go api      .Init()
-	go crawler  .Init()
-	go extractor.Init()
-	go scheduler.Init()
-	go monitor  .Init()
-	go metrics  .Init()
+	lifecycle.Register(services()...)
 
-	go func() {
-		time.Sleep(1 * time.Hour)
-
-		process, err := os.FindProcess(os.Getpid())
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to find process")
-			return
-		}
-		
-		err = process.Signal(os.Kill)
+	// Optional periodic restart, through a graceful shutdown; the process
+	// supervisor starts the server again
+	if value, ok := os.LookupEnv("MAX_UPTIME"); ok {
+		uptime, err := time.ParseDuration(value)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to send SIGKILL")
+			log.Fatal().Err(err).Str("MAX_UPTIME", value).Msg("Invalid duration")
 		}
-	}()
+		time.AfterFunc(uptime, lifecycle.Shutdown)
+	}
 
-	go Debug()
+	os.Exit(lifecycle.Run())
+}
+
+// services are the parts of the server. They start in this order and stop
+// in reverse; the API is last so requests are only accepted once everything
+// else is ready.
+func services() []*lifecycle.Service {
+	return []*lifecycle.Service{
+		&lifecycle.Service{Name: "db"       , Start: db.Start       , Stop: db.Stop},
+		&lifecycle.Service{Name: "consent"  , Start: consent.Start},
+		&lifecycle.Service{Name: "cluster"  , Start: cluster.Start  , Stop: cluster.Stop},
+		&lifecycle.Service{Name: "crawler"  , Start: crawler.Start},
+		&lifecycle.Service{Name: "extractor", Start: extractor.Start, Stop: extractor.Stop},
+		&lifecycle.Service{Name: "export"   , Start: export.Start   , Stop: export.Stop},
+		&lifecycle.Service{Name: "enrich"   , Start: background(enrich.Init)},
+		&lifecycle.Service{Name: "scheduler", Start: scheduler.Start, Stop: scheduler.Stop},
+		&lifecycle.Service{Name: "monitor"  , Start: monitor.Start},
+		&lifecycle.Service{Name: "metrics"  , Start: background(metrics.Init)},
+		&lifecycle.Service{Name: "api"      , Start: api.Start      , Stop: api.Stop},
+	}
+}
 
-	select { }
+// background starts services whose work runs in the background until ctx
+// is done and needs nothing to be ready.
+func background(run func(ctx context.Context)) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		go run(ctx)
+		return nil
+	}
 }
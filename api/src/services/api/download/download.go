@@ -1,3 +1,8 @@
+// Package download is the download API of the previous bms.dse server.
+//
+// Deprecated: it is no longer built or routed. Downloads are served by
+// dse/src/core/services/api/download through dse/src/core/services/export,
+// which applies one merge rule for users and forms on every route.
 package download
 
 import (
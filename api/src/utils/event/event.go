@@ -1,45 +1,192 @@
 package event
 
-import "github.com/olebedev/emitter"
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
 
 // ------------------------------------------------------------
-// : Enums
+// : Types
 // ------------------------------------------------------------
-const (
-	UserConnected    = "user.connected"
-	UserDisconnected = "user.disconnected"
 
-	ExtractorItemStarted = "extractor.item.started"
-	ExtractorItemFailed  = "extractor.item.failed"
-	ExtractorItemDone    = "extractor.item.done"
-)
+// Topic is a typed stream of events. Every subscriber gets its own buffered
+// channel; a subscriber whose buffer is full misses the event instead of
+// holding up the publisher, and the drop is counted.
+type Topic[T any] struct {
+	name    string
+	buffer  int
+	dropped atomic.Uint64
+
+	mutex       sync.RWMutex
+	subscribers map[chan T]struct{}
+}
+
+// Call is a typed request/reply operation with a single handler, such as
+// saving a user.
+type Call[Q any, R any] struct {
+	name string
+
+	mutex   sync.RWMutex
+	handler func(ctx context.Context, request Q) (R, error)
+}
 
 // ------------------------------------------------------------
 // : Locals
 // ------------------------------------------------------------
 var (
-	e = emitter.Emitter{Cap: 1}
+	// Buffer is the subscriber buffer of topics created with a size of 0
+	Buffer = 64
+
+	hook   func(topic string)
+	hookMu sync.RWMutex
+
+	// Errors
+	ErrNoHandler     = errors.New("no handler")
+	ErrHandlerExists = errors.New("handler already registered")
 )
 
 // ------------------------------------------------------------
-// : Methods
+// : Topic
 // ------------------------------------------------------------
-func Use(topic string, middlewares ...func(*emitter.Event)) {
-	e.Use(topic, middlewares...)
+
+// NewTopic creates a topic whose subscribers buffer up to buffer events.
+func NewTopic[T any](name string, buffer int) *Topic[T] {
+	if buffer <= 0 {
+		buffer = Buffer
+	}
+	return &Topic[T]{name: name, buffer: buffer, subscribers: map[chan T]struct{}{}}
 }
 
-func Emit(topic string, args ...interface{}) chan struct{} {
-	return e.Emit(topic, args...)
+func (t *Topic[T]) Name() string {
+	return t.name
 }
 
-func On(topic string, middlewares ...func(*emitter.Event)) <-chan emitter.Event {
-	return e.On(topic, middlewares...)
+// Subscribe returns a channel with every event published from now on. The
+// subscription ends and the channel is closed when ctx ends.
+func (t *Topic[T]) Subscribe(ctx context.Context) <-chan T {
+	ch := make(chan T, t.buffer)
+
+	t.mutex.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		t.mutex.Lock()
+		delete(t.subscribers, ch)
+		close(ch)
+		t.mutex.Unlock()
+	}()
+
+	return ch
+}
+
+// Listen calls fn for every event until ctx ends. Events are handled one at
+// a time; fn should hand slow work to a goroutine.
+func (t *Topic[T]) Listen(ctx context.Context, fn func(value T)) {
+	ch := t.Subscribe(ctx)
+	go func() {
+		for value := range ch {
+			fn(value)
+		}
+	}()
 }
 
-func Once(topic string, middlewares ...func(*emitter.Event)) <- chan emitter.Event {
-	return e.Once(topic, middlewares...)
+// Publish delivers an event to every subscriber without blocking. It
+// returns the number of subscribers that received it.
+func (t *Topic[T]) Publish(value T) int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	delivered := 0
+	for ch := range t.subscribers {
+		select {
+			case ch <- value: delivered += 1
+			default         : t.drop()
+		}
+	}
+	return delivered
 }
 
-func Off(topic string, channels ...<-chan emitter.Event) {
-	e.Off(topic, channels...)
+// Subscribers returns the number of current subscriptions.
+func (t *Topic[T]) Subscribers() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.subscribers)
+}
+
+// Dropped returns the number of events subscribers have missed.
+func (t *Topic[T]) Dropped() uint64 {
+	return t.dropped.Load()
+}
+
+func (t *Topic[T]) drop() {
+	t.dropped.Add(1)
+
+	hookMu.RLock()
+	defer hookMu.RUnlock()
+	if hook != nil {
+		hook(t.name)
+	}
+}
+
+// OnDrop sets a function that is called with the topic name for every
+// dropped event, for metrics.
+func OnDrop(fn func(topic string)) {
+	hookMu.Lock()
+	defer hookMu.Unlock()
+	hook = fn
+}
+
+// ------------------------------------------------------------
+// : Call
+// ------------------------------------------------------------
+func NewCall[Q any, R any](name string) *Call[Q, R] {
+	return &Call[Q, R]{name: name}
+}
+
+func (c *Call[Q, R]) Name() string {
+	return c.name
+}
+
+// Handle registers the handler of the call until ctx ends.
+func (c *Call[Q, R]) Handle(ctx context.Context, handler func(ctx context.Context, request Q) (R, error)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.handler != nil {
+		return ErrHandlerExists
+	}
+	c.handler = handler
+
+	go func() {
+		<-ctx.Done()
+
+		c.mutex.Lock()
+		c.handler = nil
+		c.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+// Request calls the handler and returns its reply. It fails with
+// ErrNoHandler when nothing handles the call.
+func (c *Call[Q, R]) Request(ctx context.Context, request Q) (R, error) {
+	c.mutex.RLock()
+	handler := c.handler
+	c.mutex.RUnlock()
+
+	if handler == nil {
+		var zero R
+		return zero, ErrNoHandler
+	}
+	if err := ctx.Err(); err != nil {
+		var zero R
+		return zero, err
+	}
+	return handler(ctx, request)
 }
@@ -31,6 +31,25 @@ func ToBytes(v interface{}) ([]byte, error) {
 	return data, nil
 }
 
+// ToLine converts an interface{} value to compact JSON on a single line.
+// It uses jsoniter library configured to be compatible with the standard library,
+// which makes it suitable for newline delimited JSON.
+//
+// Parameters:
+//   - v: interface{} - The value to be converted to JSON bytes
+//
+// Returns:
+//   - []byte - The compact JSON byte array, without a trailing newline
+//   - error - An error if JSON marshaling fails, nil otherwise
+func ToLine(v interface{}) ([]byte, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var data, err = json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 // ToString converts an interface{} value to its JSON string representation.
 // It first marshals the value into bytes using ToByte and then converts the bytes to a string.
 //
@@ -0,0 +1,335 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal streaming Parquet writer for flat tables.
+//
+// Every column is REQUIRED, PLAIN encoded and uncompressed, which keeps the
+// format simple enough to write without a thrift runtime while remaining
+// readable by pandas, R (arrow) and DuckDB. Rows are buffered per row group,
+// so memory is bounded by the row group size and not by the export size.
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Kind int
+
+const (
+	Boolean Kind = iota
+	Int64
+	Double
+	String
+)
+
+type Column struct {
+	Name string
+	Kind Kind
+}
+
+type Writer struct {
+	w       io.Writer
+	columns []Column
+	size    int // Rows per row group
+
+	offset  int64
+	rows    int64
+	buffers []*bytes.Buffer
+	bits    [][]bool
+	pending int
+	groups  []rowGroup
+	closed  bool
+}
+
+type rowGroup struct {
+	rows    int64
+	size    int64
+	chunks  []chunk
+}
+
+type chunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+// ------------------------------------------------------------
+// : Constants
+// ------------------------------------------------------------
+const (
+	magic = "PAR1"
+
+	// parquet.thrift enums
+	typeBoolean   = 0
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	repetitionRequired = 0
+	convertedUTF8      = 0
+	encodingPlain      = 0
+	encodingRLE        = 3
+	codecUncompressed  = 0
+	pageData           = 0
+)
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	ErrClosed       = errors.New("parquet: writer is closed")
+	ErrColumnCount  = errors.New("parquet: column count mismatch")
+)
+
+// ------------------------------------------------------------
+// : Constructor
+// ------------------------------------------------------------
+func NewWriter(w io.Writer, columns []Column, size int) *Writer {
+	if size <= 0 {
+		size = 10_000
+	}
+
+	pw := &Writer{
+		w      : w,
+		columns: columns,
+		size   : size,
+	}
+	pw.buffers = make([]*bytes.Buffer, len(columns))
+	pw.bits    = make([][]bool, len(columns))
+	for i := range columns {
+		pw.buffers[i] = &bytes.Buffer{}
+	}
+
+	return pw
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// Write appends one row. Values must be in column order; bool, int, int64,
+// float64 and string are accepted and converted to the column kind.
+func (pw *Writer) Write(values []any) error {
+	if pw.closed { return ErrClosed }
+	if len(values) != len(pw.columns) { return ErrColumnCount }
+
+	if pw.offset == 0 {
+		if err := pw.write([]byte(magic)); err != nil {
+			return err
+		}
+	}
+
+	for i, column := range pw.columns {
+		buffer := pw.buffers[i]
+
+		switch column.Kind {
+			case Boolean:
+				v, _ := values[i].(bool)
+				pw.bits[i] = append(pw.bits[i], v)
+
+			case Int64:
+				var v int64
+				switch n := values[i].(type) {
+					case int  : v = int64(n)
+					case int64: v = n
+					case uint64: v = int64(n)
+				}
+				binary.Write(buffer, binary.LittleEndian, v)
+
+			case Double:
+				v, _ := values[i].(float64)
+				binary.Write(buffer, binary.LittleEndian, math.Float64bits(v))
+
+			case String:
+				v := fmt.Sprint(values[i])
+				if values[i] == nil { v = "" }
+				binary.Write(buffer, binary.LittleEndian, uint32(len(v)))
+				buffer.WriteString(v)
+		}
+	}
+
+	pw.pending += 1
+	if pw.pending >= pw.size {
+		return pw.flush()
+	}
+
+	return nil
+}
+
+// Close flushes the last row group and writes the footer. It does not close
+// the underlying writer.
+func (pw *Writer) Close() error {
+	if pw.closed { return nil }
+
+	if pw.offset == 0 {
+		if err := pw.write([]byte(magic)); err != nil {
+			return err
+		}
+	}
+
+	if err := pw.flush(); err != nil {
+		return err
+	}
+	pw.closed = true
+
+	footer := pw.footer()
+	if err := pw.write(footer); err != nil {
+		return err
+	}
+
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(footer)))
+	if err := pw.write(length); err != nil {
+		return err
+	}
+
+	return pw.write([]byte(magic))
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func (pw *Writer) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+func (pw *Writer) flush() error {
+	if pw.pending == 0 { return nil }
+
+	group := rowGroup{rows: int64(pw.pending)}
+
+	for i, column := range pw.columns {
+		if column.Kind == Boolean {
+			pw.buffers[i].Write(packBits(pw.bits[i]))
+			pw.bits[i] = pw.bits[i][:0]
+		}
+
+		data   := pw.buffers[i].Bytes()
+		header := pageHeader(int32(len(data)), int32(pw.pending))
+		start  := pw.offset
+
+		if err := pw.write(header); err != nil { return err }
+		if err := pw.write(data);   err != nil { return err }
+
+		size := pw.offset - start
+		group.size  += size
+		group.chunks = append(group.chunks, chunk{
+			offset: start,
+			size  : size,
+			values: int64(pw.pending),
+		})
+
+		pw.buffers[i].Reset()
+	}
+
+	pw.rows   += int64(pw.pending)
+	pw.groups  = append(pw.groups, group)
+	pw.pending = 0
+
+	return nil
+}
+
+func packBits(values []bool) []byte {
+	out := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			out[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+	return out
+}
+
+func physicalType(kind Kind) int32 {
+	switch kind {
+		case Boolean: return typeBoolean
+		case Int64  : return typeInt64
+		case Double : return typeDouble
+		default     : return typeByteArray
+	}
+}
+
+func pageHeader(size int32, values int32) []byte {
+	e := &encoder{}
+
+	e.i32(1, pageData)
+	e.i32(2, size)
+	e.i32(3, size)
+	e.begin(5)
+		e.i32(1, values)
+		e.i32(2, encodingPlain)
+		e.i32(3, encodingRLE)
+		e.i32(4, encodingRLE)
+	e.end()
+	e.stop()
+
+	return e.Bytes()
+}
+
+func (pw *Writer) footer() []byte {
+	e := &encoder{}
+
+	// FileMetaData
+	e.i32(1, 1)
+
+	e.list(2, typeStruct, len(pw.columns)+1)
+	{ // Root
+		e.enter()
+		e.binary(4, "schema")
+		e.i32(5, int32(len(pw.columns)))
+		e.end()
+	}
+	for _, column := range pw.columns {
+		e.enter()
+		e.i32(1, physicalType(column.Kind))
+		e.i32(3, repetitionRequired)
+		e.binary(4, column.Name)
+		if column.Kind == String {
+			e.i32(6, convertedUTF8)
+		}
+		e.end()
+	}
+
+	e.i64(3, pw.rows)
+
+	e.list(4, typeStruct, len(pw.groups))
+	for _, group := range pw.groups {
+		e.enter() // RowGroup
+		e.list(1, typeStruct, len(group.chunks))
+		for i, c := range group.chunks {
+			column := pw.columns[i]
+
+			e.enter() // ColumnChunk
+			e.i64(2, c.offset)
+			e.begin(3) // ColumnMetaData
+				e.i32(1, physicalType(column.Kind))
+				e.list(2, typeI32, 2)
+				e.element(encodingPlain)
+				e.element(encodingRLE)
+				e.list(3, typeBinary, 1)
+				e.raw(column.Name)
+				e.i32(4, codecUncompressed)
+				e.i64(5, c.values)
+				e.i64(6, c.size)
+				e.i64(7, c.size)
+				e.i64(9, c.offset)
+			e.end()
+			e.end()
+		}
+		e.i64(2, group.size)
+		e.i64(3, group.rows)
+		e.end()
+	}
+
+	e.binary(6, "dse")
+	e.stop()
+
+	return e.Bytes()
+}
@@ -0,0 +1,304 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// The writer is read back with an independent decoder for the thrift compact
+// protocol and PLAIN pages, following parquet.thrift field by field rather
+// than the writer's own helpers.
+
+// ------------------------------------------------------------
+// : Tests
+// ------------------------------------------------------------
+func TestRoundTrip(t *testing.T) {
+	columns := []Column{
+		{Name: "token"  , Kind: String},
+		{Name: "rank"   , Kind: Int64},
+		{Name: "score"  , Kind: Double},
+		{Name: "organic", Kind: Boolean},
+	}
+
+	rows := [][]any{}
+	for i := 0; i < 23; i++ {
+		rows = append(rows, []any{
+			[]string{"a1b2c3", "", "zoë ünïcode", "line\nbreak"}[i%4],
+			int64(i*1000 - 7000),
+			float64(i) / 3,
+			i%3 == 0,
+		})
+	}
+
+	// Ten rows per group gives three row groups and boolean pages that
+	// cross byte boundaries
+	var out bytes.Buffer
+	pw := NewWriter(&out, columns, 10)
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := read(t, out.Bytes())
+
+	if file.rows != int64(len(rows)) {
+		t.Fatalf("num_rows = %d, want %d", file.rows, len(rows))
+	}
+	if !reflect.DeepEqual(file.names, []string{"token", "rank", "score", "organic"}) {
+		t.Fatalf("schema = %v", file.names)
+	}
+	if file.groups != 3 {
+		t.Fatalf("row groups = %d, want 3", file.groups)
+	}
+	if !reflect.DeepEqual(file.values, rows) {
+		t.Fatalf("values differ\n got: %v\nwant: %v", file.values, rows)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var out bytes.Buffer
+	pw := NewWriter(&out, []Column{{Name: "token", Kind: String}}, 0)
+	if err := pw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := read(t, out.Bytes())
+	if file.rows != 0 || file.groups != 0 || len(file.values) != 0 {
+		t.Fatalf("empty file has %d rows in %d groups", file.rows, file.groups)
+	}
+}
+
+// ------------------------------------------------------------
+// : Reader
+// ------------------------------------------------------------
+type file struct {
+	rows   int64
+	names  []string
+	groups int
+	values [][]any
+}
+
+func read(t *testing.T, b []byte) *file {
+	t.Helper()
+
+	if len(b) < 12 || string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		t.Fatal("missing PAR1 magic")
+	}
+
+	length := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	footer := b[len(b)-8-length : len(b)-8]
+
+	d    := &decoder{t: t, b: footer}
+	meta := d.structure()
+	if d.pos != len(footer) {
+		t.Fatalf("footer has %d trailing bytes", len(footer)-d.pos)
+	}
+
+	f := &file{rows: meta[3].(int64)}
+
+	// FileMetaData.schema: the root, then one leaf per column
+	schema := meta[2].([]any)
+	root   := schema[0].(map[int16]any)
+	if int(root[5].(int64)) != len(schema)-1 {
+		t.Fatalf("root has %d children, schema has %d leaves", root[5], len(schema)-1)
+	}
+
+	types := []int64{}
+	for _, element := range schema[1:] {
+		leaf := element.(map[int16]any)
+		if leaf[3].(int64) != repetitionRequired {
+			t.Fatalf("column %s is not required", leaf[4])
+		}
+		f.names = append(f.names, string(leaf[4].([]byte)))
+		types   = append(types, leaf[1].(int64))
+	}
+
+	groups, _ := meta[4].([]any)
+	f.groups = len(groups)
+
+	for _, g := range groups {
+		group  := g.(map[int16]any)
+		count  := int(group[3].(int64))
+		chunks := group[1].([]any)
+
+		columns := make([][]any, len(chunks))
+		for i, c := range chunks {
+			column := c.(map[int16]any)[3].(map[int16]any)
+
+			if column[1].(int64) != types[i] {
+				t.Fatalf("column %d chunk type %d, schema type %d", i, column[1], types[i])
+			}
+			if column[4].(int64) != codecUncompressed {
+				t.Fatalf("column %d is compressed", i)
+			}
+			if int(column[5].(int64)) != count {
+				t.Fatalf("column %d has %d values in a group of %d rows", i, column[5], count)
+			}
+
+			offset := int(column[9].(int64))
+			page   := &decoder{t: t, b: b[offset:]}
+			header := page.structure()
+
+			if header[1].(int64) != pageData {
+				t.Fatalf("column %d page type %d", i, header[1])
+			}
+			size := int(header[3].(int64))
+			if int64(page.pos+size) != column[7].(int64) {
+				t.Fatalf("column %d chunk size %d, page is %d", i, column[7], page.pos+size)
+			}
+
+			data := header[5].(map[int16]any)
+			if int(data[1].(int64)) != count || data[2].(int64) != encodingPlain {
+				t.Fatalf("column %d data page header %v", i, data)
+			}
+
+			columns[i] = plain(t, types[i], page.b[page.pos:page.pos+size], count)
+		}
+
+		for row := 0; row < count; row++ {
+			values := []any{}
+			for i := range columns {
+				values = append(values, columns[i][row])
+			}
+			f.values = append(f.values, values)
+		}
+	}
+
+	return f
+}
+
+func plain(t *testing.T, kind int64, b []byte, count int) []any {
+	values := []any{}
+
+	switch kind {
+		case typeBoolean:
+			for i := 0; i < count; i++ {
+				values = append(values, b[i/8]&(1<<(uint(i)%8)) != 0)
+			}
+
+		case typeInt64:
+			for i := 0; i < count; i++ {
+				values = append(values, int64(binary.LittleEndian.Uint64(b[i*8:])))
+			}
+
+		case typeDouble:
+			for i := 0; i < count; i++ {
+				values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:])))
+			}
+
+		case typeByteArray:
+			pos := 0
+			for i := 0; i < count; i++ {
+				n := int(binary.LittleEndian.Uint32(b[pos:]))
+				values = append(values, string(b[pos+4:pos+4+n]))
+				pos += 4 + n
+			}
+			if pos != len(b) {
+				t.Fatalf("byte array page has %d trailing bytes", len(b)-pos)
+			}
+
+		default:
+			t.Fatalf("unexpected physical type %d", kind)
+	}
+
+	return values
+}
+
+// decoder reads thrift compact protocol values into maps keyed by field id.
+type decoder struct {
+	t   *testing.T
+	b   []byte
+	pos int
+}
+
+func (d *decoder) byte() byte {
+	if d.pos >= len(d.b) {
+		d.t.Fatal("unexpected end of thrift data")
+	}
+	d.pos += 1
+	return d.b[d.pos-1]
+}
+
+func (d *decoder) varint() uint64 {
+	var v uint64
+	for shift := 0; ; shift += 7 {
+		b := d.byte()
+		v |= uint64(b&0x7F) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+}
+
+func (d *decoder) zigzag() int64 {
+	v := d.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (d *decoder) structure() map[int16]any {
+	fields := map[int16]any{}
+
+	var last int16
+	for {
+		header := d.byte()
+		if header == 0 {
+			return fields
+		}
+
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(d.zigzag())
+		}
+		last = id
+
+		// Booleans carry their value in the field type
+		switch kind := header & 0x0F; kind {
+			case 1, 2: fields[id] = kind == 1
+			default  : fields[id] = d.value(kind)
+		}
+	}
+}
+
+func (d *decoder) value(kind byte) any {
+	switch kind {
+		case 3:
+			return int64(int8(d.byte()))
+
+		case 4, 5, 6:
+			return d.zigzag()
+
+		case 7:
+			d.pos += 8
+			return math.Float64frombits(binary.LittleEndian.Uint64(d.b[d.pos-8:]))
+
+		case typeBinary:
+			n := int(d.varint())
+			d.pos += n
+			return d.b[d.pos-n : d.pos]
+
+		case typeList:
+			header := d.byte()
+			size   := int(header >> 4)
+			if size == 15 {
+				size = int(d.varint())
+			}
+			values := []any{}
+			for i := 0; i < size; i++ {
+				values = append(values, d.value(header&0x0F))
+			}
+			return values
+
+		case typeStruct:
+			return d.structure()
+	}
+
+	d.t.Fatalf("unexpected thrift type %d", kind)
+	return nil
+}
@@ -0,0 +1,109 @@
+package parquet
+
+import "bytes"
+
+// ------------------------------------------------------------
+// : Thrift
+// ------------------------------------------------------------
+
+// encoder writes the subset of the thrift compact protocol needed for the
+// Parquet page headers and file footer.
+type encoder struct {
+	bytes.Buffer
+	last []int16 // Last field id per open struct
+}
+
+const (
+	typeI32    = 5
+	typeI64    = 6
+	typeBinary = 8
+	typeList   = 9
+	typeStruct = 12
+)
+
+func (e *encoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) zigzag(v int64) {
+	e.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (e *encoder) field(id int16, kind byte) {
+	if len(e.last) == 0 {
+		e.last = append(e.last, 0)
+	}
+
+	top   := len(e.last) - 1
+	delta := id - e.last[top]
+
+	if delta > 0 && delta <= 15 {
+		e.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		e.WriteByte(kind)
+		e.zigzag(int64(id))
+	}
+	e.last[top] = id
+}
+
+func (e *encoder) i32(id int16, v int32) {
+	e.field(id, typeI32)
+	e.zigzag(int64(v))
+}
+
+func (e *encoder) i64(id int16, v int64) {
+	e.field(id, typeI64)
+	e.zigzag(v)
+}
+
+func (e *encoder) binary(id int16, s string) {
+	e.field(id, typeBinary)
+	e.raw(s)
+}
+
+// raw writes a binary value without a field header, as used in lists.
+func (e *encoder) raw(s string) {
+	e.varint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+// element writes an i32 list element.
+func (e *encoder) element(v int32) {
+	e.zigzag(int64(v))
+}
+
+func (e *encoder) list(id int16, kind byte, size int) {
+	e.field(id, typeList)
+	if size < 15 {
+		e.WriteByte(byte(size)<<4 | kind)
+	} else {
+		e.WriteByte(0xF0 | kind)
+		e.varint(uint64(size))
+	}
+}
+
+// begin opens a struct field; enter opens a struct list element.
+func (e *encoder) begin(id int16) {
+	e.field(id, typeStruct)
+	e.enter()
+}
+
+func (e *encoder) enter() {
+	if len(e.last) == 0 {
+		e.last = append(e.last, 0)
+	}
+	e.last = append(e.last, 0)
+}
+
+func (e *encoder) end() {
+	e.WriteByte(0)
+	e.last = e.last[:len(e.last)-1]
+}
+
+func (e *encoder) stop() {
+	e.WriteByte(0)
+}
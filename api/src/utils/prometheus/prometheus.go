@@ -0,0 +1,361 @@
+// Package prometheus is a minimal implementation of Prometheus metrics:
+// counters, gauges and histograms with labels, exposed in the text format
+// (version 0.0.4) that Prometheus and OpenMetrics scrapers accept.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ------------------------------------------------------------
+// : Types
+// ------------------------------------------------------------
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// Registry holds the metrics exposed by one handler.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	describe() (name string, help string, kind Type)
+	write(w *bufio.Writer)
+}
+
+// vec holds the series of a metric, one per combination of label values.
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.RWMutex
+	series map[string]*T
+	values map[string][]string
+	create func() *T
+}
+
+// Counter only goes up.
+type Counter struct{ value atomicFloat }
+
+// Gauge goes up and down.
+type Gauge struct{ value atomicFloat }
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type CounterVec   struct{ *vec[Counter] }
+type GaugeVec     struct{ *vec[Gauge] }
+type HistogramVec struct{ *vec[Histogram] }
+
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+type atomicFloat struct{ bits atomic.Uint64 }
+
+// ------------------------------------------------------------
+// : Locals
+// ------------------------------------------------------------
+var (
+	// Default is the registry used by the New* functions and Handler.
+	Default = NewRegistry()
+
+	// DefBuckets suit latencies in seconds.
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// ------------------------------------------------------------
+// : Constructors
+// ------------------------------------------------------------
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// register adds a metric. Names must be unique within a registry.
+func (r *Registry) register(m metric) {
+	name, _, _ := m.describe()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[name] {
+		panic("prometheus: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics     = append(r.metrics, m)
+}
+
+func NewCounter(name string, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, labels, func() *Counter { return &Counter{} })}
+	Default.register(v)
+	return v
+}
+
+func NewGauge(name string, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, labels, func() *Gauge { return &Gauge{} })}
+	Default.register(v)
+	return v
+}
+
+// NewGaugeFunc registers a gauge whose value is read on every scrape.
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	Default.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+// NewHistogram registers a histogram with the given upper bounds, which must
+// be sorted. The +Inf bucket is implicit.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64{}, buckets...)
+	v := &HistogramVec{newVec(name, help, labels, func() *Histogram {
+		return &Histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+	})}
+	Default.register(v)
+	return v
+}
+
+func newVec[T any](name string, help string, labels []string, create func() *T) *vec[T] {
+	return &vec[T]{
+		name  : name,
+		help  : help,
+		labels: labels,
+		series: map[string]*T{},
+		values: map[string][]string{},
+		create: create,
+	}
+}
+
+// ------------------------------------------------------------
+// : Methods
+// ------------------------------------------------------------
+
+// With returns the series for the label values, in the order the labels
+// were declared.
+func (v *vec[T]) With(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("prometheus: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mutex.RLock()
+	series, ok := v.series[key]
+	v.mutex.RUnlock()
+	if ok {
+		return series
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if series, ok := v.series[key]; ok {
+		return series
+	}
+
+	series        = v.create()
+	v.series[key] = series
+	v.values[key] = append([]string{}, values...)
+	return series
+}
+
+func (c *Counter) Inc()              { c.value.add(1) }
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("prometheus: counters cannot decrease")
+	}
+	c.value.add(delta)
+}
+
+func (g *Gauge) Set(value float64) { g.value.set(value) }
+func (g *Gauge) Add(delta float64) { g.value.add(delta) }
+func (g *Gauge) Inc()              { g.value.add(1) }
+func (g *Gauge) Dec()              { g.value.add(-1) }
+
+func (h *Histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.count += 1
+	h.sum   += value
+
+	i := sort.SearchFloat64s(h.bounds, value)
+	if i < len(h.buckets) {
+		h.buckets[i] += 1
+	}
+}
+
+// ------------------------------------------------------------
+// : Exposition
+// ------------------------------------------------------------
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Write writes every metric in the text format, sorted by name.
+func (r *Registry) Write(out io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		a, _, _ := metrics[i].describe()
+		b, _, _ := metrics[j].describe()
+		return a < b
+	})
+
+	w := bufio.NewWriter(out)
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+func (v *CounterVec) describe() (string, string, Type)   { return v.name, v.help, TypeCounter }
+func (v *GaugeVec) describe() (string, string, Type)     { return v.name, v.help, TypeGauge }
+func (v *HistogramVec) describe() (string, string, Type) { return v.name, v.help, TypeHistogram }
+func (g *gaugeFunc) describe() (string, string, Type)    { return g.name, g.help, TypeGauge }
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.each(func(labels string, c *Counter) {
+		writeSample(w, v.name, labels, c.value.get())
+	})
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.each(func(labels string, g *Gauge) {
+		writeSample(w, v.name, labels, g.value.get())
+	})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	writeSample(w, g.name, "", g.fn())
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.each(func(labels string, h *Histogram) {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.buckets[i]
+			writeSample(w, v.name+"_bucket", join(labels, `le="`+formatFloat(bound)+`"`), float64(cumulative))
+		}
+		writeSample(w, v.name+"_bucket", join(labels, `le="+Inf"`), float64(h.count))
+		writeSample(w, v.name+"_sum", labels, h.sum)
+		writeSample(w, v.name+"_count", labels, float64(h.count))
+	})
+}
+
+// each visits the series in a stable order with their formatted labels.
+func (v *vec[T]) each(fn func(labels string, series *T)) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	v.mutex.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.mutex.RLock()
+		series, values := v.series[key], v.values[key]
+		v.mutex.RUnlock()
+
+		pairs := make([]string, len(values))
+		for i, value := range values {
+			pairs[i] = v.labels[i] + `="` + escapeLabel(value) + `"`
+		}
+		fn(strings.Join(pairs, ","), series)
+	}
+}
+
+// ------------------------------------------------------------
+// : Internals
+// ------------------------------------------------------------
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func join(labels string, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(value float64) string {
+	switch {
+		case math.IsInf(value, +1): return "+Inf"
+		case math.IsInf(value, -1): return "-Inf"
+		case math.IsNaN(value)     : return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func escapeHelp(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func (f *atomicFloat) get() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) set(value float64) {
+	f.bits.Store(math.Float64bits(value))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := f.bits.Load()
+		new := math.Float64bits(math.Float64frombits(old) + delta)
+		if f.bits.CompareAndSwap(old, new) {
+			return
+		}
+	}
+}
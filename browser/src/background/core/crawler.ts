@@ -26,6 +26,7 @@
         keyword: string
         website: string
         url    : string
+        attempt: string // Echoed with the upload so the server can match it to the task
     }
 
     // ------------------------------------------------------------
@@ -173,12 +174,14 @@
                     const tab_promises = tasks.map(async (task) => {
                         const website = task.website
                         const keyword = task.keyword
+                        const attempt = task.attempt
             
                         const url = new URL(website.url)
                         url.searchParams.append(website.query, keyword)
                         url.searchParams.append('dse', '1')
                         url.searchParams.append('dse_keyword', keyword)
                         url.searchParams.append('dse_website', website.name)
+                        if (attempt) url.searchParams.append('dse_id', attempt)
             
                         const tab = await browser.tabs.create({ 
                             windowId: await store.get('crawler.window'),
@@ -191,6 +194,7 @@
                             ipc.on('upload', async (ctx, data) => {
                                 if (keyword != data.keyword) return
                                 if (website.name != data.website) return
+                                if (attempt && attempt != data.attempt) return
                                 resolve()
                             })
                         })
@@ -45,6 +45,7 @@ class IPC extends EventEmitter {
                 browser: await store.get('browser'),
                 keyword: data.keyword,
                 website: data.website,
+                attempt: data.attempt,
                 localization: data.localization,
 
                 html: data.html,
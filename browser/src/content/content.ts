@@ -115,6 +115,7 @@ class Uploader {
     public async upload() {
         const keyword = new URLSearchParams(window.location.search).get('dse_keyword')
         const website = new URLSearchParams(window.location.search).get('dse_website')
+        const attempt = new URLSearchParams(window.location.search).get('dse_id')
         log(`DSE: ${website}:${keyword}`)
 
         const html = document.body.outerHTML
@@ -138,6 +139,7 @@ class Uploader {
     
                 keyword: keyword,
                 website: website,
+                attempt: attempt,
     
                 html: html,
             }